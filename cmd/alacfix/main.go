@@ -1,45 +1,186 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io/fs"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
 
 	"github.com/utopian-society/apple-music-downloader/utils/alacfix"
 )
 
+// result is one input file in the JSON output.
+type result struct {
+	Path  string `json:"path"`
+	Error string `json:"error,omitempty"`
+	*alacfix.Report
+}
+
 func main() {
-	var inPlace, force bool
-	flag.BoolVar(&inPlace, "i", false, "modify file in place")
-	flag.BoolVar(&inPlace, "in-place", false, "modify file in place")
+	var inPlace, force, dryRun, backup, jsonOut bool
+	var jobs int
+	flag.BoolVar(&inPlace, "i", false, "modify files in place")
+	flag.BoolVar(&inPlace, "in-place", false, "modify files in place")
 	flag.BoolVar(&force, "f", false, "always write output even if no patches applied")
 	flag.BoolVar(&force, "force", false, "always write output even if no patches applied")
+	flag.BoolVar(&dryRun, "n", false, "only report what would be patched")
+	flag.BoolVar(&dryRun, "dry-run", false, "only report what would be patched")
+	flag.BoolVar(&backup, "b", false, "keep the original of each patched file as <file>.bak")
+	flag.BoolVar(&backup, "backup", false, "keep the original of each patched file as <file>.bak")
+	flag.IntVar(&jobs, "j", runtime.NumCPU(), "number of files processed at once")
+	flag.IntVar(&jobs, "jobs", runtime.NumCPU(), "number of files processed at once")
+	flag.BoolVar(&jsonOut, "json", false, "print the reports as JSON")
 	flag.Usage = func() {
 		fmt.Fprintln(os.Stderr, "Usage:")
 		fmt.Fprintln(os.Stderr, "  alacfix [-f] <input.m4a> <output.m4a>")
-		fmt.Fprintln(os.Stderr, "  alacfix [-f] -i <input.m4a>")
+		fmt.Fprintln(os.Stderr, "  alacfix [-f] [-b] [-j N] -i <file|dir|glob>...")
+		fmt.Fprintln(os.Stderr, "  alacfix -n <file|dir|glob>...")
+		fmt.Fprintln(os.Stderr, "")
+		fmt.Fprintln(os.Stderr, "Directories are searched recursively for .m4a and .mp4 files.")
 		fmt.Fprintln(os.Stderr, "")
 		fmt.Fprintln(os.Stderr, "Flags:")
-		fmt.Fprintln(os.Stderr, "  -i, --in-place   modify file in place")
+		fmt.Fprintln(os.Stderr, "  -i, --in-place   modify files in place")
 		fmt.Fprintln(os.Stderr, "  -f, --force      always write output even if no patches applied")
+		fmt.Fprintln(os.Stderr, "  -n, --dry-run    only report what would be patched")
+		fmt.Fprintln(os.Stderr, "  -b, --backup     keep the original of each patched file as <file>.bak")
+		fmt.Fprintln(os.Stderr, "  -j, --jobs N     number of files processed at once (default: CPU count)")
+		fmt.Fprintln(os.Stderr, "      --json       print the reports as JSON")
 	}
 	flag.Parse()
 
 	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
 
-	var input, output string
+	opts := alacfix.Options{DryRun: dryRun, Force: force, Backup: backup}
+	var inputs []string
 	switch {
-	case inPlace && len(args) == 1:
-		input = args[0]
-	case !inPlace && len(args) == 2:
-		input, output = args[0], args[1]
+	case inPlace || dryRun:
+		var err error
+		if inputs, err = expand(args); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+	case len(args) == 2:
+		inputs = args[:1]
+		opts.OutPath = args[1]
 	default:
 		flag.Usage()
 		os.Exit(1)
 	}
 
-	if err := alacfix.Run(input, force, output); err != nil {
-		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+	results := run(inputs, opts, jobs, jsonOut)
+	failed := false
+	for _, r := range results {
+		failed = failed || r.Error != ""
+	}
+	if jsonOut {
+		out, _ := json.MarshalIndent(results, "", "  ")
+		fmt.Println(string(out))
+	}
+	if failed {
 		os.Exit(1)
 	}
 }
+
+// expand turns files, directories and glob patterns into a list of files.
+func expand(args []string) ([]string, error) {
+	var files []string
+	seen := map[string]bool{}
+	add := func(path string) {
+		if !seen[path] {
+			seen[path] = true
+			files = append(files, path)
+		}
+	}
+	for _, arg := range args {
+		matches := []string{arg}
+		if strings.ContainsAny(arg, "*?[") {
+			var err error
+			if matches, err = filepath.Glob(arg); err != nil {
+				return nil, fmt.Errorf("%s: %w", arg, err)
+			}
+			if len(matches) == 0 {
+				return nil, fmt.Errorf("%s: no matches", arg)
+			}
+		}
+		for _, m := range matches {
+			info, err := os.Stat(m)
+			if err != nil {
+				return nil, err
+			}
+			if !info.IsDir() {
+				add(m)
+				continue
+			}
+			err = filepath.WalkDir(m, func(path string, d fs.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+				ext := strings.ToLower(filepath.Ext(path))
+				if !d.IsDir() && (ext == ".m4a" || ext == ".mp4") {
+					add(path)
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return files, nil
+}
+
+// run repairs the inputs with a fixed number of workers. Each worker holds
+// one moov box, one packet and the locations of the damaged packets, so
+// memory does not grow with the size of the audio. Text reports are printed
+// as files finish; the results keep the input order.
+func run(inputs []string, opts alacfix.Options, jobs int, quiet bool) []result {
+	if jobs < 1 {
+		jobs = 1
+	}
+	results := make([]result, len(inputs))
+	next := make(chan int)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for w := 0; w < jobs && w < len(inputs); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				report, err := alacfix.Repair(inputs[i], opts)
+				res := result{Path: inputs[i], Report: report}
+				if err != nil {
+					res.Error = err.Error()
+				}
+				results[i] = res
+				if quiet {
+					continue
+				}
+				mu.Lock()
+				if len(inputs) > 1 {
+					fmt.Printf("== %s\n", inputs[i])
+				}
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "error: %s: %v\n", inputs[i], err)
+				} else {
+					report.WriteText(os.Stdout)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for i := range inputs {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	return results
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/utopian-society/apple-music-downloader/utils/manifest"
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage:")
+	fmt.Fprintln(os.Stderr, "  manifest write <album dir>...")
+	fmt.Fprintln(os.Stderr, "  manifest verify [-json] [-all] <dir>...")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintf(os.Stderr, "write hashes every file of an album folder into %s and %s.\n", manifest.SHA256File, manifest.FFPFile)
+	fmt.Fprintln(os.Stderr, "verify checks every manifest found under the given folders and reports")
+	fmt.Fprintln(os.Stderr, "missing, extra and changed files; changed files are split into tag-only")
+	fmt.Fprintln(os.Stderr, "and audio changes where the decoded audio MD5 is known.")
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() < 1 {
+		usage()
+		os.Exit(1)
+	}
+
+	var err error
+	switch flag.Arg(0) {
+	case "write":
+		err = write(flag.Args()[1:])
+	case "verify":
+		err = verify(flag.Args()[1:])
+	default:
+		usage()
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func write(args []string) error {
+	if len(args) == 0 {
+		usage()
+		os.Exit(1)
+	}
+	for _, dir := range args {
+		if err := manifest.Write(dir); err != nil {
+			return fmt.Errorf("%s: %w", dir, err)
+		}
+		fmt.Printf("Wrote %s\n", filepath.Join(dir, manifest.SHA256File))
+	}
+	return nil
+}
+
+func verify(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	jsonOut := fs.Bool("json", false, "print every result as JSON")
+	all := fs.Bool("all", false, "also list files that are unchanged")
+	fs.Usage = usage
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		usage()
+		os.Exit(1)
+	}
+
+	var results []manifest.Result
+	for _, root := range fs.Args() {
+		res, err := manifest.VerifyTree(root)
+		if err != nil {
+			return err
+		}
+		if len(res) == 0 {
+			fmt.Fprintf(os.Stderr, "warning: no %s under %s\n", manifest.SHA256File, root)
+		}
+		results = append(results, res...)
+	}
+
+	counts := map[string]int{}
+	for _, r := range results {
+		counts[r.Status]++
+	}
+	if *jsonOut {
+		out, err := json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(out))
+	} else {
+		for _, r := range results {
+			if r.Status == manifest.StatusOK && !*all {
+				continue
+			}
+			line := fmt.Sprintf("%-13s %s", strings.ToUpper(r.Status), filepath.Join(r.Dir, filepath.FromSlash(r.Path)))
+			if r.Error != "" {
+				line += ": " + r.Error
+			}
+			fmt.Println(line)
+		}
+		fmt.Printf("%d ok, %d tags changed, %d audio changed, %d changed, %d missing, %d extra\n",
+			counts[manifest.StatusOK], counts[manifest.StatusTagsChanged], counts[manifest.StatusAudioChanged],
+			counts[manifest.StatusChanged], counts[manifest.StatusMissing], counts[manifest.StatusExtra])
+	}
+	// Tag edits and new files are not damage
+	if counts[manifest.StatusAudioChanged]+counts[manifest.StatusChanged]+counts[manifest.StatusMissing] > 0 {
+		os.Exit(1)
+	}
+	return nil
+}
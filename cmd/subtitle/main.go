@@ -0,0 +1,90 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/utopian-society/apple-music-downloader/utils/subtitle"
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage:")
+	fmt.Fprintln(os.Stderr, "  subtitle convert [-from fmt] [-to fmt] [-lang code] <input> <output|->")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "Input formats:  srt, vtt, ttml, scc, or an .mp4/.m4v/.mov with CEA-608 captions")
+	fmt.Fprintln(os.Stderr, "Output formats: srt, vtt, ass, ttml")
+	fmt.Fprintln(os.Stderr, "Formats are inferred from the file content and extension when not given.")
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() < 1 {
+		usage()
+		os.Exit(1)
+	}
+
+	switch flag.Arg(0) {
+	case "convert":
+		if err := convert(flag.Args()[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+	default:
+		usage()
+		os.Exit(1)
+	}
+}
+
+func convert(args []string) error {
+	fs := flag.NewFlagSet("convert", flag.ExitOnError)
+	from := fs.String("from", "", "input format (srt, vtt, ttml, scc)")
+	to := fs.String("to", "", "output format (srt, vtt, ass, ttml)")
+	lang := fs.String("lang", "", "language tag written to the output, if the format has one")
+	fs.Usage = usage
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		usage()
+		os.Exit(1)
+	}
+	input, output := fs.Arg(0), fs.Arg(1)
+
+	var doc *subtitle.Document
+	var err error
+	if *from != "" {
+		data, err := os.ReadFile(input)
+		if err != nil {
+			return err
+		}
+		doc, err = subtitle.Parse(string(data), subtitle.Format(*from))
+		if err != nil {
+			return err
+		}
+	} else if doc, err = subtitle.ParseFile(input); err != nil {
+		return err
+	}
+	if *lang != "" {
+		doc.Language = *lang
+	}
+
+	format := subtitle.Format(*to)
+	if format == "" {
+		if output == "-" {
+			return fmt.Errorf("-to is required when writing to stdout")
+		}
+		if format, err = subtitle.FormatFromPath(output); err != nil {
+			return err
+		}
+	}
+	out, err := doc.Encode(format)
+	if err != nil {
+		return err
+	}
+
+	if output == "-" {
+		_, err = fmt.Println(out)
+		return err
+	}
+	return subtitle.SaveToFile(out, output)
+}
@@ -8,7 +8,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"io/fs"
 	"math"
 	"net"
 	"net/http"
@@ -17,6 +17,7 @@ import (
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
@@ -24,14 +25,22 @@ import (
 	"time"
 
 	"github.com/utopian-society/apple-music-downloader/utils/alacfix"
+	"github.com/utopian-society/apple-music-downloader/utils/albumimage"
 	"github.com/utopian-society/apple-music-downloader/utils/ampapi"
+	"github.com/utopian-society/apple-music-downloader/utils/editions"
+	"github.com/utopian-society/apple-music-downloader/utils/loudness"
 	"github.com/utopian-society/apple-music-downloader/utils/lyrics"
+	"github.com/utopian-society/apple-music-downloader/utils/manifest"
 	"github.com/utopian-society/apple-music-downloader/utils/metadata"
+	"github.com/utopian-society/apple-music-downloader/utils/mirror"
+	"github.com/utopian-society/apple-music-downloader/utils/mkv"
+	"github.com/utopian-society/apple-music-downloader/utils/rendition"
 	"github.com/utopian-society/apple-music-downloader/utils/runv2"
 	"github.com/utopian-society/apple-music-downloader/utils/runv3"
 	"github.com/utopian-society/apple-music-downloader/utils/structs"
 	"github.com/utopian-society/apple-music-downloader/utils/subtitle"
 	"github.com/utopian-society/apple-music-downloader/utils/task"
+	"github.com/utopian-society/apple-music-downloader/utils/urlref"
 
 	"github.com/AlecAivazis/survey/v2"
 	"github.com/fatih/color"
@@ -52,9 +61,27 @@ var (
 	dl_mv              *bool
 	dl_lyrics          bool
 	artist_select      bool
+	artist_views       string
+	artist_types       string
+	artist_since       string
+	artist_no_comps    bool
+	artist_name_regex  string
+	artistFilters      artistFilter
+	dedupe_editions    *bool
 	debug_mode         bool
 	print_json         bool
 	save_m3u8_playlist bool
+	list_renditions    bool
+	mv_chapters        string
+	verify_mode        bool
+	verify_report      string
+	verify_requeue     bool
+	mirror_profile     string
+	library_source     string
+	chart_type         string
+	chart_genre        string
+	chart_storefront   string
+	chart_top          int
 	alac_max           *int
 	atmos_max          *int
 	mv_max             *int
@@ -110,6 +137,14 @@ func loadConfig() error {
 	if Config.MVAudioType == "" {
 		Config.MVAudioType = "atmos"
 	}
+
+	if Config.MVSubtitleMode == "" {
+		Config.MVSubtitleMode = "embed"
+	}
+
+	if Config.MVContainer == "" {
+		Config.MVContainer = "mp4"
+	}
 	return nil
 }
 
@@ -159,10 +194,10 @@ func readUrlsFromFile(filePath string) ([]string, error) {
 		}
 
 		// Validate URL format
-		if strings.Contains(line, "music.apple.com") || strings.Contains(line, "classical.music.apple.com") {
+		if _, err := urlref.Parse(line); err == nil {
 			urls = append(urls, line)
 		} else {
-			fmt.Printf("Warning: Line %d does not appear to be a valid Apple Music URL: %s\n", lineNum, line)
+			fmt.Printf("Warning: Line %d: %v\n", lineNum, err)
 		}
 	}
 
@@ -177,70 +212,12 @@ func readUrlsFromFile(filePath string) ([]string, error) {
 	return urls, nil
 }
 
-func checkUrl(url string) (string, string) {
-	pat := regexp.MustCompile(`^(?:https://(?:beta\.music|music|classical\.music)\.apple\.com/(\w{2})(?:/album|/album/.+))/(?:id)?(\d[^\D]+)(?:$|\?)`)
-	matches := pat.FindAllStringSubmatch(url, -1)
-
-	if matches == nil {
-		return "", ""
-	} else {
-		return matches[0][1], matches[0][2]
-	}
-}
-func checkUrlMv(url string) (string, string) {
-	pat := regexp.MustCompile(`^(?:https://(?:beta\.music|music)\.apple\.com/(\w{2})(?:/music-video|/music-video/.+))/(?:id)?(\d[^\D]+)(?:$|\?)`)
-	matches := pat.FindAllStringSubmatch(url, -1)
-
-	if matches == nil {
-		return "", ""
-	} else {
-		return matches[0][1], matches[0][2]
-	}
-}
-func checkUrlSong(url string) (string, string) {
-	pat := regexp.MustCompile(`^(?:https://(?:beta\.music|music|classical\.music)\.apple\.com/(\w{2})(?:/song|/song/.+))/(?:id)?(\d[^\D]+)(?:$|\?)`)
-	matches := pat.FindAllStringSubmatch(url, -1)
-
-	if matches == nil {
-		return "", ""
-	} else {
-		return matches[0][1], matches[0][2]
-	}
-}
-func checkUrlPlaylist(url string) (string, string) {
-	pat := regexp.MustCompile(`^(?:https://(?:beta\.music|music|classical\.music)\.apple\.com/(\w{2})(?:/playlist|/playlist/.+))/(?:id)?(pl\.[\w-]+)(?:$|\?)`)
-	matches := pat.FindAllStringSubmatch(url, -1)
-
-	if matches == nil {
-		return "", ""
-	} else {
-		return matches[0][1], matches[0][2]
-	}
-}
-
-func checkUrlStation(url string) (string, string) {
-	pat := regexp.MustCompile(`^(?:https://(?:beta\.music|music)\.apple\.com/(\w{2})(?:/station|/station/.+))/(?:id)?(ra\.[\w-]+)(?:$|\?)`)
-	matches := pat.FindAllStringSubmatch(url, -1)
-
-	if matches == nil {
-		return "", ""
-	} else {
-		return matches[0][1], matches[0][2]
-	}
-}
-
-func checkUrlArtist(url string) (string, string) {
-	pat := regexp.MustCompile(`^(?:https://(?:beta\.music|music|classical\.music)\.apple\.com/(\w{2})(?:/artist|/artist/.+))/(?:id)?(\d[^\D]+)(?:$|\?)`)
-	matches := pat.FindAllStringSubmatch(url, -1)
-
-	if matches == nil {
-		return "", ""
-	} else {
-		return matches[0][1], matches[0][2]
-	}
-}
 func getUrlSong(songUrl string, token string) (string, error) {
-	storefront, songId := checkUrlSong(songUrl)
+	ref, err := urlref.Parse(songUrl)
+	if err != nil {
+		return "", err
+	}
+	storefront, songId := refStorefront(ref), ref.ID
 	manifest, err := ampapi.GetSongResp(storefront, songId, Config.Language, token)
 	if err != nil {
 		fmt.Println("[WARNING] Failed to get manifest:", err)
@@ -251,8 +228,18 @@ func getUrlSong(songUrl string, token string) (string, error) {
 	songAlbumUrl := fmt.Sprintf("https://music.apple.com/%s/album/1/%s?i=%s", storefront, albumId, songId)
 	return songAlbumUrl, nil
 }
-func getUrlArtistName(artistUrl string, token string) (string, string, error) {
-	storefront, artistId := checkUrlArtist(artistUrl)
+
+// refStorefront returns the storefront of a link, or the configured one for
+// links without.
+func refStorefront(ref urlref.Ref) string {
+	if ref.Storefront == "" {
+		return Config.Storefront
+	}
+	return ref.Storefront
+}
+
+func getUrlArtistName(artist urlref.Ref, token string) (string, string, error) {
+	storefront, artistId := refStorefront(artist), artist.ID
 	req, err := http.NewRequest("GET", fmt.Sprintf("https://amp-api.music.apple.com/v1/catalog/%s/artists/%s", storefront, artistId), nil)
 	if err != nil {
 		return "", "", err
@@ -279,15 +266,149 @@ func getUrlArtistName(artistUrl string, token string) (string, string, error) {
 	return obj.Data[0].Attributes.Name, obj.Data[0].ID, nil
 }
 
-func checkArtist(artistUrl string, token string, relationship string) ([]string, error) {
-	storefront, artistId := checkUrlArtist(artistUrl)
+// artistRelationships are the artist views that are relationships of the
+// artist resource; all others are fetched as views.
+var artistRelationships = map[string]bool{
+	"albums":       true,
+	"music-videos": true,
+	"playlists":    true,
+	"songs":        true,
+}
+
+// artistViews are the views --artist-views accepts besides the
+// relationships.
+var artistViews = map[string]bool{
+	"full-albums":        true,
+	"singles":            true,
+	"live-albums":        true,
+	"compilation-albums": true,
+	"appears-on-albums":  true,
+	"featured-albums":    true,
+	"latest-release":     true,
+	"top-songs":          true,
+	"top-music-videos":   true,
+}
+
+// artistFilter narrows the items of artist views before selection.
+type artistFilter struct {
+	types               map[string]bool // album, ep, single, compilation; nil = all
+	since               time.Time
+	excludeCompilations bool
+	name                *regexp.Regexp
+}
+
+// newArtistFilter parses the artist filter flags.
+func newArtistFilter(types, since string, excludeCompilations bool, nameRegex string) (artistFilter, error) {
+	f := artistFilter{excludeCompilations: excludeCompilations}
+	if types != "" {
+		f.types = map[string]bool{}
+		for _, t := range strings.Split(types, ",") {
+			t = strings.ToLower(strings.TrimSpace(t))
+			switch t {
+			case "album", "ep", "single", "compilation":
+				f.types[t] = true
+			default:
+				return f, fmt.Errorf("unknown release type %q, use album, ep, single or compilation", t)
+			}
+		}
+	}
+	if since != "" {
+		var err error
+		for _, layout := range []string{"2006-01-02", "2006-01", "2006"} {
+			if f.since, err = time.Parse(layout, since); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return f, fmt.Errorf("--since %q is no year, month or date", since)
+		}
+	}
+	if nameRegex != "" {
+		re, err := regexp.Compile(nameRegex)
+		if err != nil {
+			return f, fmt.Errorf("--name-regex: %v", err)
+		}
+		f.name = re
+	}
+	return f, nil
+}
+
+// releaseType classifies an album as album, ep, single or compilation.
+// EPs are only recognizable by their name.
+func releaseType(name string, isSingle, isCompilation bool) string {
+	switch {
+	case isCompilation:
+		return "compilation"
+	case isSingle || strings.HasSuffix(name, " - Single"):
+		return "single"
+	case strings.HasSuffix(name, " - EP"):
+		return "ep"
+	}
+	return "album"
+}
+
+// keep reports whether an item passes the filter, and if not, why.
+func (f artistFilter) keep(itemType, name, releaseDate, kind string) (bool, string) {
+	if itemType == "albums" {
+		if f.excludeCompilations && kind == "compilation" {
+			return false, "compilation"
+		}
+		if f.types != nil && !f.types[kind] {
+			return false, kind
+		}
+	}
+	if !f.since.IsZero() {
+		date, err := time.Parse("2006-01-02", releaseDate)
+		if err == nil && date.Before(f.since) {
+			return false, "released " + releaseDate
+		}
+	}
+	if f.name != nil && !f.name.MatchString(name) {
+		return false, "name"
+	}
+	return true, ""
+}
+
+// checkArtistViews lists every view of --artist-views of an artist for
+// selection and returns the picked links, each only once.
+func checkArtistViews(artist urlref.Ref, token string) ([]string, error) {
+	var urls []string
+	seen := map[string]bool{}
+	for _, view := range strings.Split(artist_views, ",") {
+		view = strings.TrimSpace(view)
+		if view == "" {
+			continue
+		}
+		picked, err := checkArtist(artist, token, view)
+		if err != nil {
+			fmt.Printf("[WARNING] Failed to get artist %s: %v\n", view, err)
+			continue
+		}
+		for _, u := range picked {
+			if !seen[u] {
+				seen[u] = true
+				urls = append(urls, u)
+			}
+		}
+	}
+	return urls, nil
+}
+
+func checkArtist(artist urlref.Ref, token string, view string) ([]string, error) {
+	storefront, artistId := refStorefront(artist), artist.ID
+	path := fmt.Sprintf("%s/view/%s", artistId, view)
+	if artistRelationships[view] {
+		path = fmt.Sprintf("%s/%s", artistId, view)
+	} else if !artistViews[view] {
+		return nil, fmt.Errorf("unknown artist view %q", view)
+	}
 	Num := 0
 	//id := 1
-	var args []string
 	var urls []string
 	var options [][]string
+	skipped := 0
 	for {
-		req, err := http.NewRequest("GET", fmt.Sprintf("https://amp-api.music.apple.com/v1/catalog/%s/artists/%s/%s?limit=100&offset=%d&l=%s", storefront, artistId, relationship, Num, Config.Language), nil)
+		req, err := http.NewRequest("GET", fmt.Sprintf("https://amp-api.music.apple.com/v1/catalog/%s/artists/%s?limit=100&offset=%d&l=%s", storefront, path, Num, Config.Language), nil)
 		if err != nil {
 			return nil, err
 		}
@@ -309,38 +430,381 @@ func checkArtist(artistUrl string, token string, relationship string) ([]string,
 			return nil, err
 		}
 		for _, album := range obj.Data {
-			options = append(options, []string{album.Attributes.Name, album.Attributes.ReleaseDate, album.ID, album.Attributes.URL})
+			kind := strings.TrimSuffix(album.Type, "s")
+			if album.Type == "albums" {
+				kind = releaseType(album.Attributes.Name, album.Attributes.IsSingle, album.Attributes.IsCompilation)
+			}
+			if ok, why := artistFilters.keep(album.Type, album.Attributes.Name, album.Attributes.ReleaseDate, kind); !ok {
+				if debug_mode {
+					fmt.Printf("Debug: Skipping %s (%s)\n", album.Attributes.Name, why)
+				}
+				skipped++
+				continue
+			}
+			options = append(options, []string{album.Attributes.Name, kind, album.Attributes.ReleaseDate, album.ID, album.Attributes.URL})
 		}
 		Num = Num + 100
 		if len(obj.Next) == 0 {
 			break
 		}
 	}
-	sort.Slice(options, func(i, j int) bool {
-		// 将日期字符串解析为 time.Time 类型进行比较
-		dateI, _ := time.Parse("2006-01-02", options[i][1])
-		dateJ, _ := time.Parse("2006-01-02", options[j][1])
-		return dateI.Before(dateJ) // 返回 true 表示 i 在 j 前面
-	})
-
-	table := tablewriter.NewWriter(os.Stdout)
-	if relationship == "albums" {
-		table.Header("", "Album Name", "Date", "Album ID")
-	} else if relationship == "music-videos" {
-		table.Header("", "MV Name", "Date", "MV ID")
+	if skipped > 0 {
+		fmt.Printf("[INFO] %d item(s) of %s filtered out\n", skipped, view)
 	}
+	if len(options) == 0 {
+		return nil, nil
+	}
+	if Config.DedupeEditions {
+		kept, err := dedupeEditions(options, storefront, token)
+		if err != nil {
+			fmt.Printf("[WARNING] Edition de-duplication of %s failed: %v\n", view, err)
+		} else {
+			options = kept
+		}
+	}
+	// Top lists keep their ranking
+	if !strings.HasPrefix(view, "top-") {
+		sort.SliceStable(options, func(i, j int) bool {
+			// 将日期字符串解析为 time.Time 类型进行比较
+			dateI, _ := time.Parse("2006-01-02", options[i][2])
+			dateJ, _ := time.Parse("2006-01-02", options[j][2])
+			return dateI.Before(dateJ) // 返回 true 表示 i 在 j 前面
+		})
+	}
+
+	rows := make([][]string, len(options))
 	for i, v := range options {
-		urls = append(urls, v[3])
-		options[i] = append([]string{fmt.Sprint(i + 1)}, v[:3]...)
+		rows[i] = v[:4]
+		urls = append(urls, v[4])
+	}
+	return selectFromTable([]string{"", "Name", "Type", "Date", "ID"}, rows, urls, view), nil
+}
+
+// dedupeEditions drops the album rows of an artist view that are other
+// editions of a record listed in the same view, keeping one per
+// edition-preference. Rows are [name, kind, date, id, url]; rows other
+// than albums are kept as they are.
+func dedupeEditions(options [][]string, storefront string, token string) ([][]string, error) {
+	var ids []string
+	for _, v := range options {
+		if v[1] != "music-video" && v[1] != "playlist" && v[1] != "song" {
+			ids = append(ids, v[3])
+		}
+	}
+	if len(ids) < 2 {
+		return options, nil
+	}
+	albums, err := ampapi.GetAlbumsResp(storefront, ids, Config.Language, token)
+	if err != nil {
+		return nil, err
+	}
+	var eds []editions.Edition
+	for _, album := range albums {
+		ed := editions.Edition{
+			ID:            album.ID,
+			Name:          album.Attributes.Name,
+			ReleaseDate:   album.Attributes.ReleaseDate,
+			ContentRating: album.Attributes.ContentRating,
+			TrackCount:    album.Attributes.TrackCount,
+			DigitalMaster: album.Attributes.IsAppleDigitalMaster,
+			HiRes:         slices.Contains(album.Attributes.AudioTraits, "hi-res-lossless"),
+			UPC:           album.Attributes.Upc,
+		}
+		for _, track := range album.Relationships.Tracks.Data {
+			if track.Attributes.Isrc != "" {
+				ed.ISRCs = append(ed.ISRCs, track.Attributes.Isrc)
+			}
+		}
+		eds = append(eds, ed)
+	}
+	_, skipped, err := editions.Dedupe(eds, Config.EditionPreference)
+	if err != nil {
+		return nil, err
+	}
+	drop := map[string]bool{}
+	for _, s := range skipped {
+		fmt.Printf("[INFO] Skipping %s (%s), keeping %s\n", s.Edition.Name, s.Reason, s.Kept.Name)
+		drop[s.Edition.ID] = true
+	}
+	var kept [][]string
+	for _, v := range options {
+		if !drop[v[3]] {
+			kept = append(kept, v)
+		}
+	}
+	return kept, nil
+}
+
+// checkPage lists the albums and playlists of a curator, record label,
+// room or multi-room page for selection, like checkArtist.
+func checkPage(ref urlref.Ref, token string) ([]string, error) {
+	storefront := refStorefront(ref)
+	var page *ampapi.Page
+	var err error
+	switch ref.Kind {
+	case urlref.Curator:
+		page, err = ampapi.GetCuratorPage(storefront, ref.ID, Config.Language, token)
+	case urlref.RecordLabel:
+		page, err = ampapi.GetRecordLabelPage(storefront, ref.ID, Config.Language, token)
+	case urlref.Room:
+		page, err = ampapi.GetRoomPage(storefront, ref.ID, Config.Language, token)
+	case urlref.MultiRoom:
+		page, err = ampapi.GetMultiRoomPage(storefront, ref.ID, Config.Language, token)
+	default:
+		return nil, fmt.Errorf("%s links have no item list", ref.Kind)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(page.Items) == 0 {
+		return nil, fmt.Errorf("no albums or playlists on %s %s", ref.Kind, ref.ID)
+	}
+	fmt.Printf("%s: %s\n", ref.Kind, page.Name)
+	var rows [][]string
+	var urls []string
+	for _, item := range page.Items {
+		kind := urlref.Album
+		if item.Type == "playlists" {
+			kind = urlref.Playlist
+		}
+		link := item.URL
+		if link == "" {
+			link = urlref.Ref{Kind: kind, Storefront: storefront, ID: item.ID}.String()
+		}
+		rows = append(rows, []string{string(kind), item.Name, item.ArtistName, item.ReleaseDate, item.ID})
+		urls = append(urls, link)
+	}
+	return selectFromTable([]string{"", "Type", "Name", "Artist", "Date", "ID"}, rows, urls, string(ref.Kind)), nil
+}
+
+// expandQueue replaces the artist, curator, record label and room links of
+// a queue by the items picked from them, and library links by their catalog
+// counterparts.
+func expandQueue(urlQueue []string, token string) []string {
+	var expanded []string
+	for _, urlRaw := range urlQueue {
+		ref, err := urlref.Parse(urlRaw)
+		var urls []string
+		switch {
+		case err == nil && ref.Library:
+			urls, err = resolveLibrary(ref, token)
+		case err == nil && ref.Kind == urlref.Artist:
+			urls, err = checkArtistViews(ref, token)
+		case err == nil && (ref.Kind == urlref.Curator || ref.Kind == urlref.RecordLabel || ref.Kind == urlref.Room || ref.Kind == urlref.MultiRoom):
+			urls, err = checkPage(ref, token)
+		default:
+			expanded = append(expanded, urlRaw)
+			continue
+		}
+		if err != nil {
+			fmt.Printf("[WARNING] Failed to get %s %s: %v\n", ref.Kind, ref.ID, err)
+			continue
+		}
+		expanded = append(expanded, urls...)
+	}
+	return expanded
+}
+
+// resolveLibrary returns the catalog links of a library album or playlist.
+// Personal playlists that are not shared have no catalog version; their
+// library link is kept for ripLibraryPlaylist.
+func resolveLibrary(ref urlref.Ref, token string) ([]string, error) {
+	storefront := refStorefront(ref)
+	catalogLink := func(kind urlref.Kind, id string) string {
+		return urlref.Ref{Kind: kind, Storefront: storefront, ID: id}.String()
+	}
+	if ref.Kind == urlref.Playlist && strings.HasPrefix(ref.ID, "pl.") {
+		return []string{catalogLink(urlref.Playlist, ref.ID)}, nil
+	}
+	if ref.Kind == urlref.Album {
+		album, err := ampapi.GetLibraryAlbum(ref.ID, Config.MediaUserToken, Config.Language, token)
+		if err != nil {
+			return nil, err
+		}
+		if album.CatalogID == "" {
+			return nil, fmt.Errorf("%s is not in the catalog", album.Name)
+		}
+		return []string{catalogLink(urlref.Album, album.CatalogID)}, nil
+	}
+	playlist, err := ampapi.GetLibraryPlaylist(ref.ID, Config.MediaUserToken, Config.Language, token)
+	if err != nil {
+		return nil, err
+	}
+	if playlist.CatalogID != "" {
+		return []string{catalogLink(urlref.Playlist, playlist.CatalogID)}, nil
+	}
+	return []string{urlref.Ref{Kind: urlref.Playlist, Storefront: ref.Storefront, ID: ref.ID, Library: true}.String()}, nil
+}
+
+// libraryQueue lists a source of the user's library for selection and
+// returns the links of the picked items. Library links are resolved later
+// by expandQueue.
+func libraryQueue(source string, token string) ([]string, error) {
+	if len(Config.MediaUserToken) <= 50 {
+		return nil, errors.New("media-user-token is not set")
+	}
+	var items []ampapi.LibraryItem
+	var err error
+	switch source {
+	case "albums":
+		items, err = ampapi.GetLibraryAlbums(Config.MediaUserToken, Config.Language, token)
+	case "playlists":
+		items, err = ampapi.GetLibraryPlaylists(Config.MediaUserToken, Config.Language, token)
+	case "favorites":
+		playlists, err := ampapi.GetLibraryPlaylists(Config.MediaUserToken, Config.Language, token)
+		if err != nil {
+			return nil, err
+		}
+		if p, ok := ampapi.FindFavoriteSongs(playlists); ok {
+			return []string{libraryLink(p)}, nil
+		}
+		return nil, errors.New("no Favorite Songs playlist in the library")
+	case "recent":
+		items, err = ampapi.GetRecentlyAdded(Config.MediaUserToken, Config.Language, token)
+	default:
+		return nil, fmt.Errorf("unknown library source %q, use albums, playlists, favorites, recent or list", source)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var rows [][]string
+	var urls []string
+	for _, item := range items {
+		link := libraryLink(item)
+		if link == "" {
+			continue
+		}
+		rows = append(rows, []string{strings.TrimPrefix(item.Type, "library-"), item.Name, item.ArtistName, item.DateAdded, item.ID})
+		urls = append(urls, link)
+	}
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("no %s in the library", source)
+	}
+	return selectFromTable([]string{"", "Type", "Name", "Artist", "Date Added", "ID"}, rows, urls, "library "+source), nil
+}
+
+// libraryLink returns the link of a library album or playlist, or of a
+// catalog one that shows up among the recently added items.
+func libraryLink(item ampapi.LibraryItem) string {
+	switch item.Type {
+	case "library-albums":
+		return urlref.Ref{Kind: urlref.Album, ID: item.ID, Library: true}.String()
+	case "library-playlists":
+		return urlref.Ref{Kind: urlref.Playlist, ID: item.ID, Library: true}.String()
+	case "albums":
+		return urlref.Ref{Kind: urlref.Album, Storefront: Config.Storefront, ID: item.ID}.String()
+	case "playlists":
+		return urlref.Ref{Kind: urlref.Playlist, Storefront: Config.Storefront, ID: item.ID}.String()
+	}
+	return ""
+}
+
+// chartQueue lists a chart of a storefront for selection and returns the
+// links of the picked items. With top set, the first top entries are
+// returned without asking.
+func chartQueue(chartType, storefront, genre string, top int, token string) ([]string, error) {
+	kinds := map[string]urlref.Kind{
+		"songs":        urlref.Song,
+		"albums":       urlref.Album,
+		"music-videos": urlref.MusicVideo,
+		"playlists":    urlref.Playlist,
+	}
+	if _, ok := kinds[chartType]; !ok {
+		return nil, fmt.Errorf("unknown chart type %q, use songs, albums, music-videos or playlists", chartType)
+	}
+	if storefront == "" {
+		storefront = Config.Storefront
+	}
+	var genreID string
+	if genre != "" {
+		genres, err := ampapi.GetGenres(storefront, Config.Language, token)
+		if err != nil {
+			return nil, err
+		}
+		id, ok := ampapi.FindGenre(genres, genre)
+		if !ok {
+			return nil, fmt.Errorf("no genre %q in storefront %s", genre, storefront)
+		}
+		genreID = id
+	}
+	limit := top
+	if limit <= 0 {
+		limit = 50
+	}
+	chart, err := ampapi.GetChart(storefront, chartType, genreID, limit, Config.Language, token)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("%s (%s)\n", chart.Name, storefront)
+	var rows [][]string
+	var urls []string
+	for _, item := range chart.Items {
+		link := item.URL
+		if link == "" {
+			link = urlref.Ref{Kind: kinds[item.Type], Storefront: storefront, ID: item.ID}.String()
+		}
+		rows = append(rows, []string{item.Name, item.ArtistName, item.ReleaseDate, item.ID})
+		urls = append(urls, link)
+	}
+	if top > 0 {
+		for i, row := range rows {
+			fmt.Printf("%d. %s - %s\n", i+1, row[0], row[1])
+		}
+		return urls, nil
+	}
+	return selectFromTable([]string{"", "Name", "Artist", "Date", "ID"}, rows, urls, "chart"), nil
+}
+
+// listLibrary prints the albums and playlists of the user's library.
+func listLibrary(token string) error {
+	if len(Config.MediaUserToken) <= 50 {
+		return errors.New("media-user-token is not set")
+	}
+	albums, err := ampapi.GetLibraryAlbums(Config.MediaUserToken, Config.Language, token)
+	if err != nil {
+		return err
+	}
+	playlists, err := ampapi.GetLibraryPlaylists(Config.MediaUserToken, Config.Language, token)
+	if err != nil {
+		return err
+	}
+	for _, section := range []struct {
+		name  string
+		items []ampapi.LibraryItem
+	}{{"Albums", albums}, {"Playlists", playlists}} {
+		fmt.Printf("%s (%d)\n", section.name, len(section.items))
+		table := tablewriter.NewWriter(os.Stdout)
+		table.Header("Name", "Artist", "Tracks", "Date Added", "ID", "In Catalog")
+		for _, item := range section.items {
+			inCatalog := "no"
+			if item.CatalogID != "" {
+				inCatalog = "yes"
+			}
+			table.Append([]string{item.Name, item.ArtistName, fmt.Sprint(item.TrackCount), item.DateAdded, item.ID, inCatalog})
+		}
+		table.Render()
+	}
+	return nil
+}
+
+// selectFromTable lists rows in a numbered table and returns the URLs of
+// the rows the user picks, or of all rows with --all-album.
+func selectFromTable(header []string, rows [][]string, urls []string, what string) []string {
+	var args []string
+	options := make([][]string, len(rows))
+	table := tablewriter.NewWriter(os.Stdout)
+	table.Header(header)
+	for i, v := range rows {
+		options[i] = append([]string{fmt.Sprint(i + 1)}, v...)
 		table.Append(options[i])
 	}
 	table.Render()
 	if artist_select {
 		fmt.Println("You have selected all options:")
-		return urls, nil
+		return urls
 	}
 	reader := bufio.NewReader(os.Stdin)
-	fmt.Println("Please select from the " + relationship + " options above (multiple options separated by commas, ranges supported, or type 'all' to select all)")
+	fmt.Println("Please select from the " + what + " options above (multiple options separated by commas, ranges supported, or type 'all' to select all)")
 	cyanColor := color.New(color.FgCyan)
 	cyanColor.Print("Enter your choice: ")
 	input, _ := reader.ReadString('\n')
@@ -348,7 +812,7 @@ func checkArtist(artistUrl string, token string, relationship string) ([]string,
 	input = strings.TrimSpace(input)
 	if input == "all" {
 		fmt.Println("You have selected all options:")
-		return urls, nil
+		return urls
 	}
 
 	selectedOptions := [][]string{}
@@ -395,7 +859,7 @@ func checkArtist(artistUrl string, token string, relationship string) ([]string,
 			fmt.Println("Invalid option:", opt)
 		}
 	}
-	return args, nil
+	return args
 }
 
 func writeCover(sanAlbumFolder, name string, url string) (string, error) {
@@ -708,9 +1172,39 @@ func getAudioBitDepth(ffmpegPath string, filePath string) (int, error) {
 	return 16, nil
 }
 
+// getAudioSampleRate returns the sample rate of an audio file using ffprobe.
+func getAudioSampleRate(ffmpegPath string, filePath string) (int, error) {
+	ffprobePath := strings.Replace(ffmpegPath, "ffmpeg", "ffprobe", 1)
+	if _, err := exec.LookPath(ffprobePath); err != nil {
+		return 0, fmt.Errorf("ffprobe not found: %w", err)
+	}
+	cmd := exec.Command(ffprobePath, "-v", "error", "-select_streams", "a:0", "-show_entries", "stream=sample_rate", "-of", "default=noprint_wrappers=1:nokey=1", filePath)
+	out, err := cmd.Output()
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(out)))
+}
+
+// lowerLimit returns the lower of two limits, where 0 means no limit.
+func lowerLimit(a, b int) int {
+	if a == 0 || (b > 0 && b < a) {
+		return b
+	}
+	return a
+}
+
 // CONVERSION FEATURE: Build ffmpeg arguments for desired target.
-func buildFFmpegArgs(ffmpegPath, inPath, outPath, targetFmt, extraArgs, coverPath string, srcBitDepth int) ([]string, error) {
-	args := []string{"-y", "-i", inPath}
+func buildFFmpegArgs(ffmpegPath, inPath, outPath string, p structs.ConvertProfile, coverPath string, srcBitDepth, srcSampleRate int, trim *metadata.Gapless) ([]string, error) {
+	targetFmt := strings.ToLower(p.Format)
+	if targetFmt == "copy" {
+		trim = nil
+	}
+	args := []string{"-y"}
+	if trim != nil {
+		args = append(args, "-ignore_editlist", "1")
+	}
+	args = append(args, "-i", inPath)
 
 	// Check if cover art should be embedded (supported for flac, mp3, opus — not wav)
 	embedCover := false
@@ -732,12 +1226,74 @@ func buildFFmpegArgs(ffmpegPath, inPath, outPath, targetFmt, extraArgs, coverPat
 		args = append(args, "-map", "0:a", "-map", "1:v", "-c:v", "copy", "-disposition:v:0", "attached_pic")
 	}
 
+	// Profile and policy limits only ever lower the rate and depth of the
+	// source; the lower of the two applies
+	policy := Config.AudioPolicy
+	maxDepth := lowerLimit(p.BitDepth, policy.MaxBitDepth)
+	maxRate := lowerLimit(p.SampleRate, policy.MaxRate)
+	dither := p.Dither
+	if dither == "" {
+		dither = policy.Dither
+	}
+	bitDepth := srcBitDepth
+	reduceDepth := maxDepth > 0 && srcBitDepth > maxDepth
+	if reduceDepth {
+		bitDepth = maxDepth
+	}
+	resample := maxRate > 0 && srcSampleRate > maxRate
+	var filters []string
+	if trim != nil {
+		filters = append(filters, fmt.Sprintf("atrim=start_sample=%d:end_sample=%d,asetpts=N/SR/TB", trim.Delay, trim.Delay+trim.Frames))
+	}
+	ditherDepth := reduceDepth && bitDepth <= 16 && dither != ""
+	if resample || ditherDepth {
+		var opts []string
+		if resample {
+			opts = append(opts, "osr="+strconv.Itoa(maxRate))
+			if policy.DownsampleMethod != "" {
+				opts = append(opts, "resampler="+policy.DownsampleMethod)
+			}
+		}
+		if ditherDepth {
+			opts = append(opts, "osf=s16", "dither_method="+dither)
+		}
+		filters = append(filters, "aresample="+strings.Join(opts, ":"))
+	}
+	if resample {
+		args = append(args, "-ar", strconv.Itoa(maxRate))
+	}
+	if p.Channels > 0 {
+		args = append(args, "-ac", strconv.Itoa(p.Channels))
+	}
+
 	switch targetFmt {
 	case "flac":
 		args = append(args, "-c:a", "flac")
+		if reduceDepth {
+			if bitDepth <= 16 {
+				args = append(args, "-sample_fmt", "s16")
+			} else {
+				args = append(args, "-sample_fmt", "s32", "-bits_per_raw_sample", strconv.Itoa(bitDepth))
+			}
+		}
 	case "mp3":
-		// VBR quality 2 ~ high quality
-		args = append(args, "-c:a", "libmp3lame", "-qscale:a", "2")
+		args = append(args, "-c:a", "libmp3lame")
+		if p.Bitrate != "" {
+			args = append(args, "-b:a", p.Bitrate)
+			if !p.CBR {
+				args = append(args, "-abr", "1")
+			}
+		} else {
+			// VBR quality 2 ~ high quality
+			quality := p.Quality
+			if quality == "" {
+				quality = "2"
+			}
+			args = append(args, "-qscale:a", quality)
+		}
+		if reduceDepth && bitDepth <= 16 {
+			args = append(args, "-sample_fmt", "s16p")
+		}
 		if embedCover {
 			args = append(args, "-id3v2_version", "3",
 				"-metadata:s:v", "title=Album cover",
@@ -745,16 +1301,27 @@ func buildFFmpegArgs(ffmpegPath, inPath, outPath, targetFmt, extraArgs, coverPat
 		}
 	case "opus":
 		// Medium/high quality
-		args = append(args, "-c:a", "libopus", "-b:a", "192k", "-vbr", "on")
+		bitrate := p.Bitrate
+		if bitrate == "" {
+			bitrate = "192k"
+		}
+		vbr := "on"
+		if p.CBR {
+			vbr = "off"
+		}
+		args = append(args, "-c:a", "libopus", "-b:a", bitrate, "-vbr", vbr)
+		if reduceDepth && bitDepth <= 16 {
+			args = append(args, "-sample_fmt", "s16")
+		}
 	case "wav":
 		codec := "pcm_s16le" // default 16-bit
-		if srcBitDepth == 24 || srcBitDepth == 32 {
+		if bitDepth == 24 || bitDepth == 32 {
 			codec = "pcm_s24le"
 		}
 		args = append(args, "-c:a", codec)
 	case "aiff":
 		codec := "pcm_s16be" // default 16-bit
-		if srcBitDepth == 24 || srcBitDepth == 32 {
+		if bitDepth == 24 || bitDepth == 32 {
 			codec = "pcm_s24be"
 		}
 		args = append(args, "-c:a", codec, "-write_id3v2", "1")
@@ -764,34 +1331,302 @@ func buildFFmpegArgs(ffmpegPath, inPath, outPath, targetFmt, extraArgs, coverPat
 	default:
 		return nil, fmt.Errorf("unsupported convert-format: %s", targetFmt)
 	}
-	if extraArgs != "" {
+	if len(filters) > 0 {
+		args = append(args, "-af", strings.Join(filters, ","))
+	}
+	if targetFmt == "mp3" {
+		// Xing/LAME header with the encoder delay and padding
+		args = append(args, "-write_xing", "1")
+	}
+	if p.ExtraArgs != "" {
 		// naive split; for complex quoting you could enhance
-		args = append(args, strings.Fields(extraArgs)...)
+		args = append(args, strings.Fields(p.ExtraArgs)...)
 	}
 	args = append(args, outPath)
 	return args, nil
 }
 
-// CONVERSION FEATURE: Perform conversion if enabled.
-func convertIfNeeded(track *task.Track) {
-	if !Config.ConvertAfterDownload {
-		return
+// writeGapless gives the remuxed file an edit list and iTunSMPB tag for the
+// priming of its codec. The edit list runv2 writes into the fragmented file
+// does not survive MP4Box, and has no duration to carry the padding, so the
+// length of the audio is taken from the catalog duration (durationMs) and
+// what the track holds beyond it is padding.
+func writeGapless(path, codecName string, durationMs int) error {
+	g, err := metadata.ReadGapless(path)
+	if err != nil {
+		return err
 	}
-	if Config.ConvertFormat == "" {
-		return
+	if g.Delay == 0 {
+		g = guessGapless(g, runv2.EncoderDelay(codecName), durationMs)
 	}
-	srcPath := track.SavePath
-	if srcPath == "" {
-		return
+	if g.Delay == 0 && g.Padding == 0 {
+		return nil
 	}
-	ext := strings.ToLower(filepath.Ext(srcPath))
-	targetFmt := strings.ToLower(Config.ConvertFormat)
+	return metadata.WriteGapless(path, g)
+}
 
-	// Map extension for output
-	if targetFmt == "copy" {
-		fmt.Println("Convert (copy) requested; skipping because it produces no new format.")
-		return
-	}
+// guessGapless splits the samples of a track without gapless info into the
+// encoder delay, the audio of the catalog duration and the padding. The
+// catalog duration is in whole milliseconds, so the padding is only known
+// to half a millisecond (22 samples at 44.1 kHz); the priming, which is
+// what would be heard as a gap, is exact.
+func guessGapless(g metadata.Gapless, delay int64, durationMs int) metadata.Gapless {
+	if delay <= 0 || g.Frames <= delay {
+		return g
+	}
+	g.Delay = delay
+	g.Frames -= delay
+	// Padding never reaches a tenth of a second; a catalog duration
+	// further off is for another version of the audio
+	frames := (int64(durationMs)*g.Timescale + 500) / 1000
+	if frames > 0 && frames <= g.Frames && g.Frames-frames < g.Timescale/10 {
+		g.Padding = g.Frames - frames
+		g.Frames = frames
+	}
+	return g
+}
+
+// gaplessTrim returns the priming and padding to cut from an MP4 source.
+// They are trimmed by the conversion instead of by ffmpeg's edit list
+// handling, which differs between versions; the encoders then record their
+// own delay (LAME header, Opus pre-skip).
+func gaplessTrim(srcPath string) *metadata.Gapless {
+	ext := strings.ToLower(filepath.Ext(srcPath))
+	if ext != ".m4a" && ext != ".mp4" {
+		return nil
+	}
+	g, err := metadata.ReadGapless(srcPath)
+	if err != nil || (g.Delay == 0 && g.Padding == 0) {
+		return nil
+	}
+	return &g
+}
+
+// convertProfiles writes a copy of the track for every conversion profile,
+// at the same path relative to the profile's output folder as the track
+// has to its download folder. Existing copies are kept.
+func convertProfiles(track *task.Track) {
+	if len(Config.ConvertProfiles) == 0 || track.SavePath == "" {
+		return
+	}
+	if _, err := exec.LookPath(Config.FFmpegPath); err != nil {
+		fmt.Printf("ffmpeg not found at '%s'; skipping conversion profiles.\n", Config.FFmpegPath)
+		return
+	}
+	srcPath := track.SavePath
+	ext := strings.ToLower(filepath.Ext(srcPath))
+	root := Config.AlacSaveFolder
+	if dl_atmos {
+		root = Config.AtmosSaveFolder
+	} else if dl_aac {
+		root = Config.AacSaveFolder
+	}
+	rel, err := filepath.Rel(root, srcPath)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		rel = filepath.Join(filepath.Base(filepath.Dir(srcPath)), filepath.Base(srcPath))
+	}
+	rel = strings.TrimSuffix(rel, filepath.Ext(rel))
+
+	srcBitDepth, err := getAudioBitDepth(Config.FFmpegPath, srcPath)
+	if err != nil {
+		fmt.Printf("Warning: failed to detect source bit depth for %s, defaulting to 16-bit. Error: %v\n", filepath.Base(srcPath), err)
+	}
+	srcSampleRate, err := getAudioSampleRate(Config.FFmpegPath, srcPath)
+	if err != nil {
+		fmt.Printf("Warning: failed to detect source sample rate for %s: %v\n", filepath.Base(srcPath), err)
+	}
+	trim := gaplessTrim(srcPath)
+
+	names := make([]string, 0, len(Config.ConvertProfiles))
+	for name := range Config.ConvertProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		p := Config.ConvertProfiles[name]
+		targetFmt := strings.ToLower(p.Format)
+		if p.Output == "" || targetFmt == "" || targetFmt == "copy" {
+			fmt.Printf("[WARNING] Conversion profile %q needs an output folder and a format other than copy\n", name)
+			continue
+		}
+		if (targetFmt == "flac" || targetFmt == "wav" || targetFmt == "aiff") && isLossySource(ext, track.Codec) && Config.ConvertSkipLossyToLossless {
+			fmt.Printf("[INFO] Skipping profile %s: source appears lossy and target is lossless\n", name)
+			continue
+		}
+		outPath := filepath.Join(p.Output, rel+"."+targetFmt)
+		if exists, _ := fileExists(outPath); exists {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(outPath), os.ModePerm); err != nil {
+			fmt.Printf("[WARNING] Profile %s: %v\n", name, err)
+			continue
+		}
+		// The folder of the copy gets the album cover as well
+		cover := profileCover(track.CoverPath, filepath.Dir(outPath), p.CoverSize)
+		args, err := buildFFmpegArgs(Config.FFmpegPath, srcPath, outPath, p, cover, srcBitDepth, srcSampleRate, trim)
+		if err != nil {
+			fmt.Printf("[WARNING] Conversion profile %q: %v\n", name, err)
+			continue
+		}
+		fmt.Printf("Converting [%s] -> %s ...\n", name, targetFmt)
+		if out, err := exec.Command(Config.FFmpegPath, args...).CombinedOutput(); err != nil {
+			os.Remove(outPath)
+			fmt.Printf("[WARNING] Profile %s conversion failed: %v %s\n", name, err, strings.TrimSpace(string(out)))
+			continue
+		}
+		fmt.Printf("✓ Converted [%s]: %s\n", name, outPath)
+	}
+}
+
+// profileCover puts a copy of an album cover into the folder of a profile
+// copy, scaled down to size pixels when set, and returns its path. A cover
+// that is already there and newer than the original is kept.
+func profileCover(srcCover, dstDir string, size int) string {
+	if srcCover == "" {
+		return ""
+	}
+	srcInfo, err := os.Stat(srcCover)
+	if err != nil {
+		return ""
+	}
+	dst := filepath.Join(dstDir, "cover"+strings.ToLower(filepath.Ext(srcCover)))
+	if info, err := os.Stat(dst); err == nil && !info.ModTime().Before(srcInfo.ModTime()) {
+		return dst
+	}
+	if size <= 0 {
+		data, err := os.ReadFile(srcCover)
+		if err != nil || os.WriteFile(dst, data, 0644) != nil {
+			return srcCover
+		}
+		return dst
+	}
+	scale := fmt.Sprintf("scale='min(%d,iw)':'min(%d,ih)':force_original_aspect_ratio=decrease", size, size)
+	cmd := exec.Command(Config.FFmpegPath, "-y", "-loglevel", "error", "-i", srcCover, "-vf", scale, "-frames:v", "1", "-update", "1", dst)
+	if err := cmd.Run(); err != nil {
+		fmt.Printf("[WARNING] Failed to scale cover for %s: %v\n", dstDir, err)
+		os.Remove(dst)
+		return srcCover
+	}
+	return dst
+}
+
+// mirrorLibrary brings the output tree of a conversion profile up to date
+// with the given folders, by default the ALAC and Atmos download folders.
+// Only new and changed tracks are converted, and copies of tracks that were
+// deleted are removed.
+func mirrorLibrary(name string, roots []string) error {
+	p, ok := Config.ConvertProfiles[name]
+	if !ok {
+		return fmt.Errorf("no conversion profile %q in convert-profiles", name)
+	}
+	format := strings.ToLower(p.Format)
+	if p.Output == "" || format == "" || format == "copy" {
+		return fmt.Errorf("profile %q needs an output folder and a format other than copy", name)
+	}
+	if _, err := exec.LookPath(Config.FFmpegPath); err != nil {
+		return fmt.Errorf("ffmpeg not found at '%s'", Config.FFmpegPath)
+	}
+	if len(roots) == 0 {
+		roots = []string{Config.AlacSaveFolder, Config.AtmosSaveFolder}
+	}
+	// Any change to the profile converts the whole mirror again
+	fingerprint, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	m := mirror.Mirror{
+		Output:  p.Output,
+		Ext:     "." + format,
+		Sources: []string{".m4a"},
+		Profile: string(fingerprint),
+		Convert: func(src, dst string) ([]string, error) {
+			return mirrorTrack(p, src, dst)
+		},
+		Progress: func(rel, action string, err error) {
+			switch action {
+			case mirror.ActionConverted:
+				fmt.Printf("\r\033[K✓ Converted: %s\n", rel)
+			case mirror.ActionRemoved:
+				fmt.Printf("\r\033[K✓ Removed: %s\n", rel)
+			case mirror.ActionSkipped:
+				fmt.Printf("[INFO] %s is already mirrored from another folder, skipping\n", rel)
+			case mirror.ActionFailed:
+				fmt.Printf("[WARNING] Failed to convert %s: %v\n", rel, err)
+			}
+		},
+	}
+	fmt.Printf("Mirroring %s into %s (%s)\n", strings.Join(roots, ", "), p.Output, name)
+	sum, err := m.Sync(roots)
+	fmt.Printf("Converted: %d, Unchanged: %d, Removed: %d, Failed: %d\n", sum.Converted, sum.Unchanged, sum.Removed, sum.Failed)
+	return err
+}
+
+// mirrorTrack converts one library track for the mirror, together with its
+// cover and lyrics files, and returns the lyrics files it copied.
+func mirrorTrack(p structs.ConvertProfile, src, dst string) ([]string, error) {
+	dir := filepath.Dir(src)
+	var cover string
+	for _, c := range []string{"cover.jpg", "cover.png"} {
+		if exists, _ := fileExists(filepath.Join(dir, c)); exists {
+			cover = profileCover(filepath.Join(dir, c), filepath.Dir(dst), p.CoverSize)
+			break
+		}
+	}
+	bitDepth, _ := getAudioBitDepth(Config.FFmpegPath, src)
+	sampleRate, _ := getAudioSampleRate(Config.FFmpegPath, src)
+
+	// Converted next to the copy first, so an interrupted run leaves no
+	// truncated file behind that looks current
+	ext := filepath.Ext(dst)
+	tmp := strings.TrimSuffix(dst, ext) + ".part" + ext
+	args, err := buildFFmpegArgs(Config.FFmpegPath, src, tmp, p, cover, bitDepth, sampleRate, gaplessTrim(src))
+	if err != nil {
+		return nil, err
+	}
+	if out, err := exec.Command(Config.FFmpegPath, args...).CombinedOutput(); err != nil {
+		os.Remove(tmp)
+		return nil, fmt.Errorf("%v %s", err, strings.TrimSpace(string(out)))
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+
+	var extra []string
+	stem := strings.TrimSuffix(src, filepath.Ext(src))
+	for _, lrcExt := range []string{".lrc", ".ttml"} {
+		data, err := os.ReadFile(stem + lrcExt)
+		if err != nil {
+			continue
+		}
+		lrcPath := strings.TrimSuffix(dst, ext) + lrcExt
+		if err := os.WriteFile(lrcPath, data, 0644); err == nil {
+			extra = append(extra, lrcPath)
+		}
+	}
+	return extra, nil
+}
+
+// CONVERSION FEATURE: Perform conversion if enabled.
+func convertIfNeeded(track *task.Track) {
+	if !Config.ConvertAfterDownload {
+		return
+	}
+	if Config.ConvertFormat == "" {
+		return
+	}
+	srcPath := track.SavePath
+	if srcPath == "" {
+		return
+	}
+	ext := strings.ToLower(filepath.Ext(srcPath))
+	targetFmt := strings.ToLower(Config.ConvertFormat)
+
+	// Map extension for output
+	if targetFmt == "copy" {
+		fmt.Println("Convert (copy) requested; skipping because it produces no new format.")
+		return
+	}
 
 	if Config.ConvertSkipIfSourceMatch {
 		if ext == "."+targetFmt {
@@ -820,7 +1655,7 @@ func convertIfNeeded(track *task.Track) {
 	}
 
 	srcBitDepth := 16
-	if targetFmt == "aiff" || targetFmt == "wav" || targetFmt == "flac" {
+	if targetFmt == "aiff" || targetFmt == "wav" || targetFmt == "flac" || Config.AudioPolicy.MaxBitDepth > 0 {
 		depth, err := getAudioBitDepth(Config.FFmpegPath, srcPath)
 		if err != nil {
 			fmt.Printf("Warning: failed to detect source bit depth for %s, defaulting to 16-bit. Error: %v\n", filepath.Base(srcPath), err)
@@ -828,8 +1663,17 @@ func convertIfNeeded(track *task.Track) {
 			srcBitDepth = depth
 		}
 	}
+	srcSampleRate := 0
+	if Config.AudioPolicy.MaxRate > 0 {
+		rate, err := getAudioSampleRate(Config.FFmpegPath, srcPath)
+		if err != nil {
+			fmt.Printf("Warning: failed to detect source sample rate for %s: %v\n", filepath.Base(srcPath), err)
+		}
+		srcSampleRate = rate
+	}
 
-	args, err := buildFFmpegArgs(Config.FFmpegPath, srcPath, outPath, targetFmt, Config.ConvertExtraArgs, track.CoverPath, srcBitDepth)
+	profile := structs.ConvertProfile{Format: targetFmt, ExtraArgs: Config.ConvertExtraArgs}
+	args, err := buildFFmpegArgs(Config.FFmpegPath, srcPath, outPath, profile, track.CoverPath, srcBitDepth, srcSampleRate, gaplessTrim(srcPath))
 	if err != nil {
 		fmt.Println("Conversion config error:", err)
 		return
@@ -933,6 +1777,15 @@ func ripTrack(track *task.Track, token string, mediaUserToken string) {
 			counter.Unavailable++
 			return
 		}
+		if list_renditions {
+			if err := listMvRenditions(track.ID, token, mediaUserToken); err != nil {
+				fmt.Println("[WARNING] Failed to list MV renditions:", err)
+				counter.Error++
+				return
+			}
+			counter.Success++
+			return
+		}
 		err := mvDownloader(track.ID, track.SaveDir, token, track.Storefront, mediaUserToken, track)
 		if err != nil {
 			fmt.Println("[WARNING] Failed to dl MV:", err)
@@ -942,6 +1795,10 @@ func ripTrack(track *task.Track, token string, mediaUserToken string) {
 		counter.Success++
 		return
 	}
+	if list_renditions {
+		// Only music videos have renditions to list
+		return
+	}
 
 	needDlAacLc := false
 	if dl_aac && Config.AacType == "aac-lc" {
@@ -1057,6 +1914,9 @@ func ripTrack(track *task.Track, token string, mediaUserToken string) {
 			fmt.Println("Track already exists locally.")
 			counter.Success++
 			okDict[track.PreID] = append(okDict[track.PreID], track.TaskNum)
+			// Profiles added since the download still get their copies
+			track.SavePath = trackPath
+			convertProfiles(track)
 
 			tArtistId := ""
 			if len(track.Resp.Relationships.Artists.Data) > 0 {
@@ -1138,6 +1998,16 @@ func ripTrack(track *task.Track, token string, mediaUserToken string) {
 		track.GetAlbumData(token)
 	}
 
+	codecName := "aac-lc"
+	if !needDlAacLc {
+		if dl_atmos {
+			codecName = "ec3"
+		} else if dl_aac {
+			codecName = Config.AacType
+		} else {
+			codecName = "alac"
+		}
+	}
 	if needDlAacLc {
 		if len(mediaUserToken) <= 50 {
 			fmt.Println("Invalid media-user-token")
@@ -1161,14 +2031,6 @@ func ripTrack(track *task.Track, token string, mediaUserToken string) {
 			counter.Unavailable++
 			return
 		}
-		var codecName string
-		if dl_atmos {
-			codecName = "ec3"
-		} else if dl_aac {
-			codecName = Config.AacType
-		} else {
-			codecName = "alac"
-		}
 		//边下载边解密
 		err = runv2.Run(track.ID, trackM3u8Url, trackPath, Config, codecName)
 		if err != nil {
@@ -1207,12 +2069,18 @@ func ripTrack(track *task.Track, token string, mediaUserToken string) {
 	}
 	track.SavePath = trackPath
 	if Config.ALACFix {
-		err = alacfix.Run(track.SavePath, false)
+		report, err := alacfix.Repair(track.SavePath, alacfix.Options{})
 		if err != nil {
 			fmt.Println("⚠ Failed to fix ALAC:", err)
 			counter.Unavailable++
 			return
 		}
+		if report.Patched > 0 {
+			fmt.Printf("✓ ALAC fix: patched %d packet(s)\n", report.Patched)
+		}
+		if debug_mode {
+			report.WriteText(os.Stdout)
+		}
 	}
 	err = writeMP4Tags(track, lrc)
 	if err != nil {
@@ -1220,6 +2088,12 @@ func ripTrack(track *task.Track, token string, mediaUserToken string) {
 		counter.Unavailable++
 		return
 	}
+	if err := writeGapless(track.SavePath, codecName, track.Resp.Attributes.DurationInMillis); err != nil {
+		fmt.Println("[WARNING] Failed to write gapless info:", err)
+	}
+
+	// Profiles convert from the master, which convertIfNeeded may remove
+	convertProfiles(track)
 
 	// CONVERSION FEATURE hook
 	convertIfNeeded(track)
@@ -1414,25 +2288,26 @@ func ripStation(albumId string, token string, storefront string, mediaUserToken
 				return err
 			}
 		}
-		// tags embedding continues...
-		tags := []string{
-			"tool=",
-			"disk=1/1",
-			"track=1",
-			"tracknum=1/1",
-			fmt.Sprintf("artist=%s", "Apple Music Station"),
-			fmt.Sprintf("performer=%s", "Apple Music Station"),
-			fmt.Sprintf("album_artist=%s", "Apple Music Station"),
-			fmt.Sprintf("album=%s", station.Name),
-			fmt.Sprintf("title=%s", station.Name),
-		}
+		t := &mp4tag.MP4Tags{
+			Title:       station.Name,
+			Artist:      "Apple Music Station",
+			Album:       station.Name,
+			AlbumArtist: "Apple Music Station",
+			TrackNumber: 1,
+			TrackTotal:  1,
+			DiscNumber:  1,
+			DiscTotal:   1,
+			Custom: map[string]string{
+				"PERFORMER": "Apple Music Station",
+				"STATIONID": station.ID,
+			},
+		}
+		coverPath := ""
 		if Config.EmbedCover {
-			tags = append(tags, fmt.Sprintf("cover=%s", station.CoverPath))
+			coverPath = station.CoverPath
 		}
-		tagsString := strings.Join(tags, ":")
-		cmd := exec.Command("MP4Box", "-itags", tagsString, trackPath)
-		if err := cmd.Run(); err != nil {
-			fmt.Printf("Embed failed: %v\n", err)
+		if err := metadata.WriteTags(trackPath, t, metadata.ItunesAtoms{MediaKind: metadata.MediaKindMusic}, coverPath, Config); err != nil {
+			fmt.Println("[WARNING] Failed to write tags in media:", err)
 		}
 		AddedTracks = append(AddedTracks, AddedTrack{
 			Path:     trackPath,
@@ -1667,9 +2542,10 @@ func ripAlbum(albumId string, token string, storefront string, mediaUserToken st
 	os.MkdirAll(albumFolderPath, os.ModePerm)
 	album.SaveName = albumFolderName
 	fmt.Println(albumFolderName)
+	var artistCovPath string
 	if Config.SaveArtistCover && len(meta.Data[0].Relationships.Artists.Data) > 0 {
 		if meta.Data[0].Relationships.Artists.Data[0].Attributes.Artwork.Url != "" {
-			_, err = writeCover(singerFolder, "folder", meta.Data[0].Relationships.Artists.Data[0].Attributes.Artwork.Url)
+			artistCovPath, err = writeCover(singerFolder, "folder", meta.Data[0].Relationships.Artists.Data[0].Attributes.Artwork.Url)
 			if err != nil {
 				fmt.Println("Failed to write artist cover.")
 			}
@@ -1679,6 +2555,19 @@ func ripAlbum(albumId string, token string, storefront string, mediaUserToken st
 	if err != nil {
 		fmt.Println("Failed to write cover.")
 	}
+	if Config.SaveNFO {
+		if err := metadata.WriteAlbumNFO(albumFolderPath, meta.Data[0], covPath, Config); err != nil {
+			fmt.Println("Failed to write album.nfo:", err)
+		}
+		// Only write artist.nfo into a real artist folder
+		if singerFoldername != "" && len(meta.Data[0].Relationships.Artists.Data) > 0 {
+			artist := meta.Data[0].Relationships.Artists.Data[0]
+			err := metadata.WriteArtistNFO(singerFolder, artist.Attributes.Name, artist.ID, artist.Attributes.Artwork.Url, artistCovPath, Config)
+			if err != nil {
+				fmt.Println("Failed to write artist.nfo:", err)
+			}
+		}
+	}
 	if Config.SaveAnimatedArtwork && meta.Data[0].Attributes.EditorialVideo.MotionDetailSquare.Video != "" {
 		fmt.Println("Found Animation Artwork.")
 
@@ -1813,6 +2702,18 @@ func ripAlbum(albumId string, token string, storefront string, mediaUserToken st
 		if err := writeM3UPlaylist(albumFolderPath, albumFolderName, AddedTracks[startIdx:]); err != nil {
 			fmt.Printf("Failed to write M3U8 playlist: %v\n", err)
 		}
+		if Config.ReplayGain {
+			writeAlbumLoudness(album, albumFolderPath, AddedTracks[startIdx:])
+		}
+		if Config.AlbumImage != "" {
+			writeAlbumImages(album, covPath, AddedTracks[startIdx:])
+		}
+		// Last, so the hashes cover the final tags
+		if Config.SaveManifest {
+			if err := manifest.Write(albumFolderPath); err != nil {
+				fmt.Printf("Failed to write checksum manifest: %v\n", err)
+			}
+		}
 	}
 
 	// Final cleanup of empty disc folders (especially useful if tracks were not downloaded or setting was toggled)
@@ -1835,6 +2736,56 @@ func ripPlaylist(playlistId string, token string, storefront string, mediaUserTo
 		fmt.Println("Failed to get playlist response.")
 		return err
 	}
+	return ripPlaylistTracks(playlist, token, storefront, mediaUserToken)
+}
+
+// ripLibraryPlaylist downloads a personal playlist of the user's library
+// that has no catalog version: its songs are looked up in the catalog and
+// ripped in the playlist's order into a folder of its own, like a catalog
+// playlist. Songs that are not in the catalog, such as uploads, are
+// skipped.
+func ripLibraryPlaylist(id string, token string, storefront string, mediaUserToken string) error {
+	item, err := ampapi.GetLibraryPlaylist(id, mediaUserToken, Config.Language, token)
+	if err != nil {
+		return err
+	}
+	tracks, err := ampapi.GetLibraryPlaylistTracks(id, mediaUserToken, Config.Language, token)
+	if err != nil {
+		return err
+	}
+	var ids []string
+	for _, track := range tracks {
+		if track.CatalogID != "" {
+			ids = append(ids, track.CatalogID)
+		}
+	}
+	songs, err := ampapi.GetSongsResp(storefront, ids, Config.Language, token)
+	if err != nil {
+		return err
+	}
+	if missing := len(tracks) - len(songs); missing > 0 {
+		fmt.Printf("[INFO] %d song(s) of %s are not in the catalog, skipping\n", missing, item.Name)
+	}
+	if len(songs) == 0 {
+		return fmt.Errorf("no song of %s is in the catalog", item.Name)
+	}
+
+	var data ampapi.PlaylistRespData
+	data.ID, data.Type = id, "library-playlists"
+	data.Attributes.Name = item.Name
+	data.Attributes.TrackCount = len(songs)
+	data.Attributes.Artwork.URL = item.ArtworkURL
+	if data.Attributes.Artwork.URL == "" {
+		data.Attributes.Artwork.URL = songs[0].Attributes.Artwork.URL
+	}
+	data.Relationships.Tracks.Data = songs
+	return ripPlaylistTracks(task.NewLibraryPlaylist(storefront, id, Config.Language, data), token, storefront, mediaUserToken)
+}
+
+// ripPlaylistTracks downloads the tracks of a fetched playlist into its
+// folder and writes its M3U playlist.
+func ripPlaylistTracks(playlist *task.Playlist, token string, storefront string, mediaUserToken string) error {
+	playlistId := playlist.ID
 	meta := playlist.Resp
 	if debug_mode {
 		fmt.Println(meta.Data[0].Attributes.ArtistName)
@@ -2115,76 +3066,355 @@ func writeM3UPlaylist(folderPath string, name string, tracks []AddedTrack) (err
 	return nil
 }
 
-func writeMP4Tags(track *task.Track, lrc string) error {
-	// Build custom tags map
-	customTags := map[string]string{
-		"PERFORMER":   track.Resp.Attributes.ArtistName,
-		"RELEASETIME": track.Resp.Attributes.ReleaseDate,
-		"ISRC":        track.Resp.Attributes.Isrc,
-		"LABEL":       "",
-		"UPC":         "",
-	}
+// verifyResult is one file of the --verify report.
+type verifyResult struct {
+	Path              string `json:"path"`
+	OK                bool   `json:"ok"`
+	Error             string `json:"error,omitempty"`
+	CatalogID         string `json:"catalog_id,omitempty"`
+	CatalogDurationMs int    `json:"catalog_duration_ms,omitempty"`
+	*alacfix.VerifyReport
+}
 
-	// Add Apple Music metadata
-	if track.Resp.ID != "" {
-		customTags["CATALOG"] = track.Resp.ID
+// verifyDurationSlack is how far the decoded duration may be from the
+// catalog duration, which Apple rounds and measures before encoding.
+const verifyDurationSlack = 1000 // ms
+
+// verifyFiles decodes every ALAC file under paths, compares it with its
+// sample table and catalog duration and writes the JSON report. It returns
+// the song URLs of damaged files for --verify-requeue, after moving those
+// files aside so the download does not skip them.
+func verifyFiles(paths []string, token string) []string {
+	var files []string
+	for _, root := range paths {
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			ext := strings.ToLower(filepath.Ext(path))
+			if !d.IsDir() && (ext == ".m4a" || ext == ".mp4") {
+				files = append(files, path)
+			}
+			return nil
+		})
+		if err != nil {
+			fmt.Printf("[WARNING] Failed to read %s: %v\n", root, err)
+		}
 	}
 
-	if track.PreType == "albums" && track.PreID != "" {
-		customTags["ALBUMID"] = track.PreID
-	} else if track.AlbumData.ID != "" {
-		customTags["ALBUMID"] = track.AlbumData.ID
+	var results []verifyResult
+	var requeue []string
+	failed := 0
+	for _, path := range files {
+		fmt.Printf("\r\033[KVerifying: %s", filepath.Base(path))
+		report, err := alacfix.Verify(path)
+		if errors.Is(err, alacfix.ErrNoALAC) {
+			continue
+		}
+		res := verifyResult{Path: path, VerifyReport: report}
+		if err != nil {
+			res.Error = err.Error()
+		} else {
+			res.OK = report.OK()
+		}
+		if tags, err := metadata.ReadFreeformTags(path); err == nil {
+			res.CatalogID = tags["CATALOG"]
+		}
+		if res.CatalogID != "" && report != nil {
+			song, err := ampapi.GetSongResp(Config.Storefront, res.CatalogID, Config.Language, token)
+			if err == nil && len(song.Data) > 0 {
+				res.CatalogDurationMs = song.Data[0].Attributes.DurationInMillis
+				diff := report.DurationMs - int64(res.CatalogDurationMs)
+				if res.CatalogDurationMs > 0 && (diff > verifyDurationSlack || diff < -verifyDurationSlack) {
+					res.OK = false
+					res.Error = fmt.Sprintf("decoded %d ms, catalog says %d ms", report.DurationMs, res.CatalogDurationMs)
+				}
+			}
+		}
+		results = append(results, res)
+		if res.OK {
+			continue
+		}
+		failed++
+		reason := res.Error
+		if reason == "" {
+			reason = fmt.Sprintf("%d damaged packet(s), %d of %d frames", len(report.Issues), report.Frames, report.TableFrames)
+		}
+		fmt.Printf("\r\033[K✗ %s: %s\n", path, reason)
+		if verify_requeue && res.CatalogID != "" {
+			if err := os.Rename(path, path+".bad"); err != nil {
+				fmt.Printf("[WARNING] Failed to move %s aside: %v\n", filepath.Base(path), err)
+				continue
+			}
+			requeue = append(requeue, fmt.Sprintf("https://music.apple.com/%s/song/%s", Config.Storefront, res.CatalogID))
+		}
 	}
+	fmt.Printf("\r\033[K✓ Verified %d ALAC file(s), %d damaged\n", len(results), failed)
 
-	if len(track.Resp.Relationships.Artists.Data) > 0 {
-		customTags["ARTISTID"] = track.Resp.Relationships.Artists.Data[0].ID
+	out, err := json.MarshalIndent(results, "", "  ")
+	if err != nil {
+		fmt.Println("Error generating verify report:", err)
+		return requeue
 	}
-
-	if track.PreType == "playlists" && track.PreID != "" {
-		customTags["PLAYLISTID"] = track.PreID
+	if verify_report == "" {
+		fmt.Println(string(out))
+	} else if err := os.WriteFile(verify_report, out, 0644); err != nil {
+		fmt.Println("Failed to write verify report:", err)
 	}
+	return requeue
+}
 
-	if len(track.Resp.Attributes.GenreNames) > 0 {
-		customTags["GENREID"] = track.Resp.Attributes.GenreNames[0]
+// writeAlbumLoudness measures the tracks of an album and tags each MP4 with
+// its track gain and the gain of the album as a whole. The album gain is
+// measured over every song of the album found in its folder (by CATALOG
+// tag), including tracks left out of this run; when some song is missing
+// from the folder only the track gains of this run are written. Tracks
+// converted to other formats are left out.
+func writeAlbumLoudness(album *task.Album, folder string, tracks []AddedTrack) {
+	type measured struct {
+		path   string
+		result loudness.Result
+	}
+	songs := map[string]bool{}
+	for _, track := range album.Tracks {
+		if track.Type == "songs" {
+			songs[track.ID] = true
+		}
 	}
+	found := map[string]string{}
+	filepath.WalkDir(folder, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if ext := strings.ToLower(filepath.Ext(path)); ext != ".m4a" && ext != ".mp4" {
+			return nil
+		}
+		if tags, err := metadata.ReadFreeformTags(path); err == nil && songs[tags["CATALOG"]] {
+			found[tags["CATALOG"]] = path
+		}
+		return nil
+	})
 
-	if Config.Storefront != "" {
-		customTags["AppleStoreCountry"] = getCountryName(Config.Storefront)
+	inRun := map[string]bool{}
+	var paths []string
+	for _, track := range tracks {
+		ext := strings.ToLower(filepath.Ext(track.Path))
+		if ext != ".m4a" && ext != ".mp4" {
+			fmt.Printf("[INFO] Skipping loudness of %s: not an MP4 file\n", filepath.Base(track.Path))
+			continue
+		}
+		inRun[track.Path] = true
+		paths = append(paths, track.Path)
 	}
-
-	customTags["PURCHASEDATE"] = time.Now().Format("2006-01-02 15:04:05")
-
-	if track.Resp.Attributes.Isrc != "" {
-		customTags["VENDOR"] = ":isrc:" + track.Resp.Attributes.Isrc
+	complete := len(found) == len(songs)
+	if complete {
+		paths = paths[:0]
+		for _, track := range album.Tracks {
+			if path, ok := found[track.ID]; ok {
+				paths = append(paths, path)
+			}
+		}
+	} else {
+		fmt.Printf("[INFO] Skipping album gain: %d of %d songs of the album are in its folder\n", len(found), len(songs))
 	}
 
-	customGenre := ""
-	if len(track.Resp.Attributes.GenreNames) > 0 {
-		customGenre = track.Resp.Attributes.GenreNames[0]
+	var done []measured
+	for _, path := range paths {
+		fmt.Printf("\r\033[KMeasuring loudness: %s", filepath.Base(path))
+		res, err := loudness.MeasureFile(path, Config.FFmpegPath)
+		if err != nil {
+			fmt.Printf("\r\033[K[WARNING] Failed to measure loudness of %s: %v\n", filepath.Base(path), err)
+			complete = false
+			continue
+		}
+		done = append(done, measured{path, res})
 	}
-
-	t := &mp4tag.MP4Tags{
-		Title:       track.Resp.Attributes.Name,
-		Artist:      track.Resp.Attributes.ArtistName,
-		Custom:      customTags,
-		Composer:    track.Resp.Attributes.ComposerName,
-		CustomGenre: customGenre,
-		Lyrics:      lrc,
-		TrackNumber: int16(track.Resp.Attributes.TrackNumber),
-		DiscNumber:  int16(track.Resp.Attributes.DiscNumber),
-		Album:       track.Resp.Attributes.AlbumName,
+	if len(done) == 0 {
+		return
 	}
-	if Config.TagSortOrder {
-		t.TitleSort = track.Resp.Attributes.Name
-		t.ArtistSort = track.Resp.Attributes.ArtistName
-		t.ComposerSort = track.Resp.Attributes.ComposerName
-		t.AlbumSort = track.Resp.Attributes.AlbumName
+	// An album gain of part of the album would be wrong for all of it
+	whole := loudness.Result{Loudness: math.Inf(-1)}
+	if complete {
+		results := make([]loudness.Result, len(done))
+		for i, m := range done {
+			results[i] = m.result
+		}
+		whole = loudness.Album(results)
 	}
-
-	// Add EditorialNotes as comment if available (try Standard, then Short, then Name)
-	// For playlists/stations with PreferPlaylistEditorial=true: use playlist editorial first
-	// Otherwise: use album editorial first
-	var editorialNote string
+	tagged := 0
+	for _, m := range done {
+		if !complete && !inRun[m.path] {
+			continue
+		}
+		if err := metadata.WriteFreeformTags(m.path, loudness.Tags(m.result, whole)); err != nil {
+			fmt.Printf("\r\033[K[WARNING] Failed to write loudness tags to %s: %v\n", filepath.Base(m.path), err)
+			continue
+		}
+		tagged++
+	}
+	if complete {
+		fmt.Printf("\r\033[K✓ Loudness tagged %d track(s), album %.1f LUFS (gain %+.2f dB)\n", tagged, whole.Loudness, whole.Gain())
+	} else {
+		fmt.Printf("\r\033[K✓ Loudness tagged %d track(s), without album gain\n", tagged)
+	}
+}
+
+// writeAlbumImages joins each fully downloaded disc of an album into one
+// FLAC or ALAC file with a CUE sheet, next to the tracks of the disc.
+func writeAlbumImages(album *task.Album, covPath string, tracks []AddedTrack) {
+	var ext string
+	switch strings.ToLower(Config.AlbumImage) {
+	case "flac":
+		ext = ".flac"
+	case "alac":
+		ext = ".m4a"
+	default:
+		fmt.Printf("[WARNING] Unknown album-image format %q, use flac or alac\n", Config.AlbumImage)
+		return
+	}
+	if album.Codec != "ALAC" {
+		fmt.Println("[INFO] Skipping album image: only lossless downloads can be joined")
+		return
+	}
+	// Tracks are found by file name, which conversion only changes the
+	// extension of
+	downloaded := make(map[string]string, len(tracks))
+	for _, t := range tracks {
+		downloaded[strings.TrimSuffix(t.Path, filepath.Ext(t.Path))] = t.Path
+	}
+
+	attrs := album.Resp.Data[0].Attributes
+	discs := map[int]*albumimage.Disc{}
+	var numbers []int
+	missing := map[int]int{}
+	for _, track := range album.Tracks {
+		if track.Type != "songs" {
+			continue
+		}
+		n := track.Resp.Attributes.DiscNumber
+		if n == 0 {
+			n = 1
+		}
+		disc, ok := discs[n]
+		if !ok {
+			disc = &albumimage.Disc{
+				Title:     attrs.Name,
+				Performer: attrs.ArtistName,
+				Date:      attrs.ReleaseDate,
+				Catalog:   attrs.Upc,
+				Number:    n,
+				CoverPath: covPath,
+			}
+			if len(attrs.GenreNames) > 0 {
+				disc.Genre = attrs.GenreNames[0]
+			}
+			discs[n] = disc
+			numbers = append(numbers, n)
+		}
+		path := downloaded[filepath.Join(track.SaveDir, strings.TrimSuffix(track.SaveName, filepath.Ext(track.SaveName)))]
+		if track.SaveName == "" || path == "" {
+			missing[n]++
+			continue
+		}
+		disc.Tracks = append(disc.Tracks, albumimage.Track{
+			Path:       path,
+			Title:      track.Resp.Attributes.Name,
+			Performer:  track.Resp.Attributes.ArtistName,
+			Songwriter: track.Resp.Attributes.ComposerName,
+			ISRC:       track.Resp.Attributes.Isrc,
+		})
+	}
+	sort.Ints(numbers)
+
+	for _, n := range numbers {
+		disc := discs[n]
+		disc.Total = numbers[len(numbers)-1]
+		if missing[n] > 0 {
+			fmt.Printf("[INFO] Skipping album image of disc %d: %d of %d tracks downloaded\n", n, len(disc.Tracks), len(disc.Tracks)+missing[n])
+			continue
+		}
+		name := forbiddenNames.ReplaceAllString(album.SaveName, "_")
+		if disc.Total > 1 {
+			name += fmt.Sprintf(" (Disc %d)", n)
+		}
+		outPath := filepath.Join(filepath.Dir(disc.Tracks[0].Path), name+ext)
+		if exists, _ := fileExists(outPath); exists {
+			fmt.Println("Album image already exists locally.")
+			continue
+		}
+		fmt.Printf("\r\033[KWriting album image: %s", filepath.Base(outPath))
+		if err := albumimage.Write(outPath, *disc, Config.FFmpegPath); err != nil {
+			fmt.Printf("\r\033[K[WARNING] Failed to write album image of disc %d: %v\n", n, err)
+			continue
+		}
+		fmt.Printf("\r\033[K✓ Album image: %s (%d tracks)\n", filepath.Base(outPath), len(disc.Tracks))
+	}
+}
+
+func writeMP4Tags(track *task.Track, lrc string) error {
+	// Build custom tags map
+	customTags := map[string]string{
+		"PERFORMER":   track.Resp.Attributes.ArtistName,
+		"RELEASETIME": track.Resp.Attributes.ReleaseDate,
+		"ISRC":        track.Resp.Attributes.Isrc,
+		"LABEL":       "",
+		"UPC":         "",
+	}
+
+	// Add Apple Music metadata
+	if track.Resp.ID != "" {
+		customTags["CATALOG"] = track.Resp.ID
+	}
+
+	if track.PreType == "albums" && track.PreID != "" {
+		customTags["ALBUMID"] = track.PreID
+	} else if track.AlbumData.ID != "" {
+		customTags["ALBUMID"] = track.AlbumData.ID
+	}
+
+	if len(track.Resp.Relationships.Artists.Data) > 0 {
+		customTags["ARTISTID"] = track.Resp.Relationships.Artists.Data[0].ID
+	}
+
+	if track.PreType == "playlists" && track.PreID != "" {
+		customTags["PLAYLISTID"] = track.PreID
+	}
+
+	if len(track.Resp.Attributes.GenreNames) > 0 {
+		customTags["GENREID"] = track.Resp.Attributes.GenreNames[0]
+	}
+
+	if Config.Storefront != "" {
+		customTags["AppleStoreCountry"] = getCountryName(Config.Storefront)
+	}
+
+	customTags["PURCHASEDATE"] = time.Now().Format("2006-01-02 15:04:05")
+
+	if track.Resp.Attributes.Isrc != "" {
+		customTags["VENDOR"] = ":isrc:" + track.Resp.Attributes.Isrc
+	}
+
+	customGenre := ""
+	if len(track.Resp.Attributes.GenreNames) > 0 {
+		customGenre = track.Resp.Attributes.GenreNames[0]
+	}
+
+	t := &mp4tag.MP4Tags{
+		Title:       track.Resp.Attributes.Name,
+		Artist:      track.Resp.Attributes.ArtistName,
+		Custom:      customTags,
+		Composer:    track.Resp.Attributes.ComposerName,
+		CustomGenre: customGenre,
+		Lyrics:      lrc,
+		TrackNumber: int16(track.Resp.Attributes.TrackNumber),
+		DiscNumber:  int16(track.Resp.Attributes.DiscNumber),
+		Album:       track.Resp.Attributes.AlbumName,
+	}
+
+	// Add EditorialNotes as comment if available (try Standard, then Short, then Name)
+	// For playlists/stations with PreferPlaylistEditorial=true: use playlist editorial first
+	// Otherwise: use album editorial first
+	var editorialNote string
 	isPlaylist := track.PreType == "playlists" || track.PreType == "stations"
 	shouldUsePlaylistEditorial := isPlaylist && Config.PreferPlaylistEditorial
 
@@ -2253,31 +3483,14 @@ func writeMP4Tags(track *task.Track, lrc string) error {
 	}
 
 	if Config.TagItunesID {
+		albumID, artistID := "", ""
 		if track.PreType == "albums" {
-			albumID, err := strconv.ParseUint(track.PreID, 10, 64)
-			if err == nil {
-				if albumID <= math.MaxInt32 {
-					t.ItunesAlbumID = int32(albumID)
-				} else if debug_mode {
-					fmt.Printf("[DEBUG] iTunes album ID out of range: %s\n", track.PreID)
-				}
-			} else if debug_mode {
-				fmt.Printf("[DEBUG] iTunes album ID parse failed: %s\n", track.PreID)
-			}
+			albumID = track.PreID
 		}
-
 		if len(track.Resp.Relationships.Artists.Data) > 0 {
-			artistID, err := strconv.ParseUint(track.Resp.Relationships.Artists.Data[0].ID, 10, 64)
-			if err == nil {
-				if artistID <= math.MaxInt32 {
-					t.ItunesArtistID = int32(artistID)
-				} else if debug_mode {
-					fmt.Printf("[DEBUG] iTunes artist ID out of range: %s\n", track.Resp.Relationships.Artists.Data[0].ID)
-				}
-			} else if debug_mode {
-				fmt.Printf("[DEBUG] iTunes artist ID parse failed: %s\n", track.Resp.Relationships.Artists.Data[0].ID)
-			}
+			artistID = track.Resp.Relationships.Artists.Data[0].ID
 		}
+		setItunesIDs(t, albumID, artistID)
 	}
 
 	if (track.PreType == "playlists" || track.PreType == "stations") && !Config.UseSongInfoForPlaylist {
@@ -2287,10 +3500,6 @@ func writeMP4Tags(track *task.Track, lrc string) error {
 		t.TrackTotal = int16(track.TaskTotal)
 		t.Album = track.PlaylistData.Attributes.Name
 		t.AlbumArtist = track.PlaylistData.Attributes.ArtistName
-		if Config.TagSortOrder {
-			t.AlbumSort = track.PlaylistData.Attributes.Name
-			t.AlbumArtistSort = track.PlaylistData.Attributes.ArtistName
-		}
 	} else if (track.PreType == "playlists" || track.PreType == "stations") && Config.UseSongInfoForPlaylist {
 		t.DiscTotal = int16(track.DiscTotal)
 		t.TrackTotal = int16(track.AlbumData.Attributes.TrackCount)
@@ -2304,9 +3513,6 @@ func writeMP4Tags(track *task.Track, lrc string) error {
 		t.Date = track.AlbumData.Attributes.ReleaseDate
 		t.Copyright = track.AlbumData.Attributes.Copyright
 		t.Publisher = track.AlbumData.Attributes.RecordLabel
-		if Config.TagSortOrder {
-			t.AlbumArtistSort = track.AlbumData.Attributes.ArtistName
-		}
 	} else {
 		t.DiscTotal = int16(track.DiscTotal)
 		t.TrackTotal = int16(track.AlbumData.Attributes.TrackCount)
@@ -2320,9 +3526,6 @@ func writeMP4Tags(track *task.Track, lrc string) error {
 		t.Date = track.AlbumData.Attributes.ReleaseDate
 		t.Copyright = track.AlbumData.Attributes.Copyright
 		t.Publisher = track.AlbumData.Attributes.RecordLabel
-		if Config.TagSortOrder {
-			t.AlbumArtistSort = track.AlbumData.Attributes.ArtistName
-		}
 	}
 
 	if track.Resp.Attributes.ContentRating == "explicit" {
@@ -2333,16 +3536,141 @@ func writeMP4Tags(track *task.Track, lrc string) error {
 		t.ItunesAdvisory = mp4tag.ItunesAdvisoryNone
 	}
 
-	mp4, err := mp4tag.Open(track.SavePath)
+	return metadata.WriteTags(track.SavePath, t, metadata.ItunesAtoms{MediaKind: metadata.MediaKindMusic}, "", Config)
+}
+
+// setItunesIDs stores the iTunes album and artist IDs. IDs that are empty,
+// not numeric or too large for the atoms are skipped.
+func setItunesIDs(t *mp4tag.MP4Tags, albumID, artistID string) {
+	parse := func(kind, id string) int32 {
+		if id == "" {
+			return 0
+		}
+		v, err := strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			if debug_mode {
+				fmt.Printf("[DEBUG] iTunes %s ID parse failed: %s\n", kind, id)
+			}
+			return 0
+		}
+		if v > math.MaxInt32 {
+			if debug_mode {
+				fmt.Printf("[DEBUG] iTunes %s ID out of range: %s\n", kind, id)
+			}
+			return 0
+		}
+		return int32(v)
+	}
+	t.ItunesAlbumID = parse("album", albumID)
+	t.ItunesArtistID = parse("artist", artistID)
+}
+
+// preferContentVersion swaps an album or song link for the edition of the
+// same release with the content rating asked for by the link's
+// content-version, or else by content-version-preference. The returned
+// note tells what was substituted, or why the link is kept; it is empty
+// when nothing was to be done.
+func preferContentVersion(ref urlref.Ref, token string) (urlref.Ref, string) {
+	want := Config.ContentVersionPreference
+	if ref.ContentVersion != "" {
+		want = ref.ContentVersion
+	}
+	if want != "explicit" && want != "clean" {
+		return ref, ""
+	}
+	storefront := refStorefront(ref)
+	albumId, songId := ref.ID, ref.SongID
+	if ref.Kind == urlref.Song {
+		song, err := ampapi.GetSongResp(storefront, ref.ID, Config.Language, token)
+		if err != nil {
+			return ref, fmt.Sprintf("[WARNING] Failed to look up the %s version: %v", want, err)
+		}
+		if len(song.Data) == 0 || len(song.Data[0].Relationships.Albums.Data) == 0 {
+			return ref, ""
+		}
+		albumId, songId = song.Data[0].Relationships.Albums.Data[0].ID, ref.ID
+	}
+	albums, err := ampapi.GetAlbumsResp(storefront, []string{albumId}, Config.Language, token)
 	if err != nil {
-		return err
+		return ref, fmt.Sprintf("[WARNING] Failed to look up the %s version: %v", want, err)
+	}
+	if len(albums) == 0 {
+		return ref, ""
+	}
+	album := albums[0]
+	name, rating := album.Attributes.Name, album.Attributes.ContentRating
+	var track *ampapi.TrackRespData
+	if songId != "" {
+		for i := range album.Relationships.Tracks.Data {
+			if album.Relationships.Tracks.Data[i].ID == songId {
+				track = &album.Relationships.Tracks.Data[i]
+			}
+		}
+		if track == nil {
+			return ref, ""
+		}
+		name, rating = track.Attributes.Name, track.Attributes.ContentRating
 	}
-	defer mp4.Close()
-	err = mp4.Write(t, []string{})
+	// Unrated releases have no counterpart
+	if rating == "" || rating == want {
+		return ref, ""
+	}
+
+	others, err := ampapi.GetOtherVersions(storefront, album.ID, Config.Language, token)
 	if err != nil {
-		return err
+		return ref, fmt.Sprintf("[WARNING] Failed to look up the %s version of %s: %v", want, name, err)
+	}
+	// Only a version with the same title is a counterpart; among those
+	// prefer the same track count
+	var alt *ampapi.AlbumRespData
+	bestScore := -1
+	for i, other := range others {
+		if other.Attributes.ContentRating != want {
+			continue
+		}
+		score := 0
+		if editions.NormalizeTitle(other.Attributes.Name) == editions.NormalizeTitle(album.Attributes.Name) {
+			score += 2
+		}
+		if other.Attributes.TrackCount == album.Attributes.TrackCount {
+			score++
+		}
+		if score > bestScore {
+			alt, bestScore = &others[i], score
+		}
 	}
-	return nil
+	if alt == nil || bestScore < 2 {
+		return ref, fmt.Sprintf("[INFO] No %s version of %s, keeping the %s one", want, name, rating)
+	}
+
+	swapped := ref
+	swapped.Kind, swapped.ID, swapped.SongID = urlref.Album, alt.ID, ""
+	if songId != "" {
+		altAlbums, err := ampapi.GetAlbumsResp(storefront, []string{alt.ID}, Config.Language, token)
+		if err != nil {
+			return ref, fmt.Sprintf("[WARNING] Failed to look up the %s version of %s: %v", want, name, err)
+		}
+		if len(altAlbums) == 0 {
+			return ref, fmt.Sprintf("[INFO] No %s version of %s, keeping the %s one", want, name, rating)
+		}
+		altSongId := ""
+		for _, t := range altAlbums[0].Relationships.Tracks.Data {
+			if t.Attributes.DiscNumber == track.Attributes.DiscNumber && t.Attributes.TrackNumber == track.Attributes.TrackNumber {
+				altSongId = t.ID
+				break
+			}
+		}
+		if altSongId == "" {
+			return ref, fmt.Sprintf("[INFO] No %s version of %s, keeping the %s one", want, name, rating)
+		}
+		if ref.Kind == urlref.Song {
+			swapped.Kind, swapped.ID = urlref.Song, altSongId
+		} else {
+			swapped.SongID = altSongId
+		}
+		return swapped, fmt.Sprintf("[INFO] Using the %s version of %s (song %s instead of %s)", want, name, altSongId, songId)
+	}
+	return swapped, fmt.Sprintf("[INFO] Using the %s version of %s (album %s instead of %s)", want, name, alt.ID, album.ID)
 }
 
 // processURL processes a single URL (album, playlist, station, song, or music video)
@@ -2351,9 +3679,29 @@ func processURL(urlRaw string, albumNum int, albumTotal int, token string, mutex
 	fmt.Printf("Queue %d of %d: ", albumNum+1, albumTotal)
 	mutex.Unlock()
 
-	var storefront, albumId string
+	ref, err := urlref.Parse(urlRaw)
+	if err != nil {
+		mutex.Lock()
+		fmt.Println(err)
+		mutex.Unlock()
+		return
+	}
+	// Personal library playlists are ripped from their catalog songs;
+	// other library links were resolved by expandQueue
+	if ref.Library && ref.Kind != urlref.Playlist {
+		mutex.Lock()
+		fmt.Println("Library links are not supported")
+		mutex.Unlock()
+		return
+	}
+	var versionNote string
+	if ref.Kind == urlref.Album || ref.Kind == urlref.Song {
+		ref, versionNote = preferContentVersion(ref, token)
+	}
+	storefront, albumId := refStorefront(ref), ref.ID
 
-	if strings.Contains(urlRaw, "/music-video/") {
+	switch ref.Kind {
+	case urlref.MusicVideo:
 		mutex.Lock()
 		fmt.Println("Music Video")
 		mutex.Unlock()
@@ -2384,18 +3732,21 @@ func processURL(urlRaw string, albumNum int, albumTotal int, token string, mutex
 			mutex.Unlock()
 			return
 		}
-		mvSaveDir := strings.NewReplacer(
-			"{ArtistName}", "",
-			"{UrlArtistName}", "",
-			"{ArtistId}", "",
-		).Replace(Config.ArtistFolderFormat)
-		if mvSaveDir != "" {
-			mvSaveDir = filepath.Join(Config.MVSaveFolder, forbiddenNames.ReplaceAllString(mvSaveDir, "_"))
-		} else {
-			mvSaveDir = Config.MVSaveFolder
+		if list_renditions {
+			if err := listMvRenditions(albumId, token, Config.MediaUserToken); err != nil {
+				mutex.Lock()
+				fmt.Println("[WARNING] Failed to list MV renditions:", err)
+				counter.Error++
+				mutex.Unlock()
+				return
+			}
+			mutex.Lock()
+			counter.Success++
+			mutex.Unlock()
+			return
 		}
-		storefront, albumId = checkUrlMv(urlRaw)
-		err := mvDownloader(albumId, mvSaveDir, token, storefront, Config.MediaUserToken, nil)
+		// The artist and mv-folder-format folders are resolved from the MV metadata
+		err := mvDownloader(albumId, Config.MVSaveFolder, token, storefront, Config.MediaUserToken, nil)
 		if err != nil {
 			mutex.Lock()
 			fmt.Println("[WARNING] Failed to dl MV:", err)
@@ -2406,66 +3757,53 @@ func processURL(urlRaw string, albumNum int, albumTotal int, token string, mutex
 		mutex.Lock()
 		counter.Success++
 		mutex.Unlock()
-		return
-	}
-	if strings.Contains(urlRaw, "/song/") {
+	case urlref.Song:
 		mutex.Lock()
+		if versionNote != "" {
+			fmt.Println(versionNote)
+		}
 		fmt.Printf("Song->")
 		// counter.Total++
 		mutex.Unlock()
-		storefront, songId := checkUrlSong(urlRaw)
-		if storefront == "" || songId == "" {
-			mutex.Lock()
-			fmt.Println("Invalid song URL format.")
-			counter.Error++
-			mutex.Unlock()
-			return
-		}
-		err := ripSong(songId, token, storefront, Config.MediaUserToken)
+		err := ripSong(albumId, token, storefront, Config.MediaUserToken)
 		if err != nil {
 			mutex.Lock()
 			fmt.Println("Failed to rip song:", err)
 			counter.Error++
 			mutex.Unlock()
 		}
-		return
-	}
-	parse, err := url.Parse(urlRaw)
-	if err != nil {
-		mutex.Lock()
-		log.Printf("Invalid URL: %v", err)
-		mutex.Unlock()
-		return
-	}
-	var urlArg_i = parse.Query().Get("i")
-
-	if strings.Contains(urlRaw, "/album/") {
+	case urlref.Album:
 		mutex.Lock()
 		fmt.Println("Album")
+		if versionNote != "" {
+			fmt.Println(versionNote)
+		}
 		mutex.Unlock()
-		storefront, albumId = checkUrl(urlRaw)
-		err := ripAlbum(albumId, token, storefront, Config.MediaUserToken, urlArg_i)
+		err := ripAlbum(albumId, token, storefront, Config.MediaUserToken, ref.SongID)
 		if err != nil {
 			mutex.Lock()
 			fmt.Println("Failed to rip album:", err)
 			mutex.Unlock()
 		}
-	} else if strings.Contains(urlRaw, "/playlist/") {
+	case urlref.Playlist:
 		mutex.Lock()
 		fmt.Println("Playlist")
 		mutex.Unlock()
-		storefront, albumId = checkUrlPlaylist(urlRaw)
-		err := ripPlaylist(albumId, token, storefront, Config.MediaUserToken)
+		var err error
+		if ref.Library {
+			err = ripLibraryPlaylist(albumId, token, storefront, Config.MediaUserToken)
+		} else {
+			err = ripPlaylist(albumId, token, storefront, Config.MediaUserToken)
+		}
 		if err != nil {
 			mutex.Lock()
 			fmt.Println("Failed to rip playlist:", err)
 			mutex.Unlock()
 		}
-	} else if strings.Contains(urlRaw, "/station/") {
+	case urlref.Station:
 		mutex.Lock()
 		fmt.Printf("Station")
 		mutex.Unlock()
-		storefront, albumId = checkUrlStation(urlRaw)
 		if len(Config.MediaUserToken) <= 50 {
 			mutex.Lock()
 			fmt.Println(": media-user-token is not set, skip station dl")
@@ -2491,7 +3829,7 @@ func processURL(urlRaw string, albumNum int, albumTotal int, token string, mutex
 			fmt.Println("Failed to rip station:", err)
 			mutex.Unlock()
 		}
-	} else {
+	default:
 		mutex.Lock()
 		fmt.Println("Invalid type")
 		mutex.Unlock()
@@ -2535,8 +3873,25 @@ func main() {
 	pflag.BoolVar(&dl_select, "select", false, "Enable selective download")
 	pflag.BoolVar(&dl_song, "song", false, "Enable single song download mode")
 	dl_mv = pflag.Bool("dl-mv", Config.DownloadMusicVideo, "Enable music video download mode")
-	pflag.BoolVar(&artist_select, "all-album", false, "Download all artist albums")
+	pflag.BoolVar(&artist_select, "all-album", false, "Download all artist albums, and all items of curator, record label and room links")
+	pflag.StringVar(&artist_views, "artist-views", "albums,music-videos", "Artist views to pick from: albums, music-videos, playlists, songs, full-albums, singles, live-albums, compilation-albums, appears-on-albums, featured-albums, latest-release, top-songs, top-music-videos")
+	pflag.StringVar(&artist_types, "type", "", "Only artist albums of these types: album, ep, single, compilation (comma separated)")
+	pflag.StringVar(&artist_since, "since", "", "Only artist items released on or after this year, month or date (e.g. 2019 or 2019-06-01)")
+	pflag.BoolVar(&artist_no_comps, "exclude-compilations", false, "Leave out compilation albums of artists")
+	pflag.StringVar(&artist_name_regex, "name-regex", "", "Only artist items whose name matches this regular expression")
+	dedupe_editions = pflag.Bool("dedupe-editions", Config.DedupeEditions, "Keep one edition of each artist album (deluxe, explicit, clean, remastered, ...) by edition-preference")
 	pflag.BoolVar(&debug_mode, "debug", false, "Enable debug mode to show audio quality information")
+	pflag.BoolVar(&list_renditions, "list-renditions", false, "List music video renditions and the ones that would be picked, without downloading")
+	pflag.StringVar(&mv_chapters, "mv-chapters", "", "Chapter list to write into MKV music videos; {MVId} in the path is replaced by the video's ID")
+	pflag.BoolVar(&verify_mode, "verify", false, "Fully decode the ALAC files and folders given as arguments and report damaged tracks")
+	pflag.StringVar(&verify_report, "verify-report", "", "Write the --verify JSON report to this file instead of stdout")
+	pflag.BoolVar(&verify_requeue, "verify-requeue", false, "With --verify, move damaged tracks aside and download them again")
+	pflag.StringVar(&library_source, "library", "", "Pick from the library: albums, playlists, favorites or recent; 'list' only prints albums and playlists")
+	pflag.StringVar(&chart_type, "charts", "", "Pick from a chart: songs, albums, music-videos or playlists")
+	pflag.StringVar(&chart_genre, "chart-genre", "", "Genre name or ID of the --charts chart, e.g. J-Pop")
+	pflag.StringVar(&chart_storefront, "chart-storefront", "", "Storefront of the --charts chart (default: storefront from config)")
+	pflag.IntVar(&chart_top, "top", 0, "Queue the first N entries of the --charts chart without asking")
+	pflag.StringVar(&mirror_profile, "mirror", "", "Bring the output tree of this conversion profile up to date with the library, then exit")
 	pflag.BoolVar(&print_json, "json", false, "Output JSON summary at the end")
 	pflag.BoolVar(&save_m3u8_playlist, "save-m3u8-playlist", false, "Save M3U8 playlist file")
 	pflag.BoolVar(&dl_lyrics, "lyrics", false, "Download only lyrics files (LRC or TTML based on config)")
@@ -2554,6 +3909,10 @@ func main() {
 		fmt.Fprintf(os.Stderr, "Batch Usage: %s --batch file1.txt --batch file2.txt\n", "[main | main.exe | go run main.go]")
 		fmt.Fprintf(os.Stderr, "Lyrics Usage: %s --lyrics [url]\n", "[main | main.exe | go run main.go]")
 		fmt.Fprintf(os.Stderr, "Batch Usage (multiple files): %s --batch file1.txt file2.txt file3.txt\n", "[main | main.exe | go run main.go]")
+		fmt.Fprintf(os.Stderr, "Verify Usage: %s --verify [--verify-report report.json] [--verify-requeue] path1 [path2 ...]\n", "[main | main.exe | go run main.go]")
+		fmt.Fprintf(os.Stderr, "Mirror Usage: %s --mirror profile [folder1 folder2 ...]\n", "[main | main.exe | go run main.go]")
+		fmt.Fprintf(os.Stderr, "Library Usage: %s --library [albums|playlists|favorites|recent|list]\n", "[main | main.exe | go run main.go]")
+		fmt.Fprintf(os.Stderr, "Charts Usage: %s --charts [songs|albums|music-videos|playlists] [--chart-storefront jp] [--chart-genre J-Pop] [--top 50]\n", "[main | main.exe | go run main.go]")
 		fmt.Println("\nOptions:")
 		pflag.PrintDefaults()
 	}
@@ -2566,9 +3925,84 @@ func main() {
 	Config.MVAudioType = *mv_audio_type
 	Config.MVMax = *mv_max
 	Config.DownloadMusicVideo = *dl_mv
+	Config.DedupeEditions = *dedupe_editions
 
 	args := pflag.Args()
 
+	artistFilters, err = newArtistFilter(artist_types, artist_since, artist_no_comps, artist_name_regex)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	if err := editions.CheckPolicy(Config.EditionPreference); err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	if _, err := mvVideoPrefs(); err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	if _, err := mvAudioTracks(); err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	if mv_chapters != "" && !strings.Contains(mv_chapters, "{MVId}") {
+		if _, err := mvChapters(""); err != nil {
+			fmt.Println("Error: mv-chapters:", err)
+			return
+		}
+	}
+	switch Config.ContentVersionPreference {
+	case "", "explicit", "clean", "as-linked":
+	default:
+		fmt.Printf("Error: unknown content-version-preference %q\n", Config.ContentVersionPreference)
+		return
+	}
+
+	if mirror_profile != "" {
+		if err := mirrorLibrary(mirror_profile, args); err != nil {
+			fmt.Println("Mirror failed:", err)
+		}
+		return
+	}
+
+	if library_source == "list" {
+		if err := listLibrary(token); err != nil {
+			fmt.Println("Failed to list library:", err)
+		}
+		return
+	}
+	if library_source != "" {
+		urls, err := libraryQueue(library_source, token)
+		if err != nil {
+			fmt.Println("Failed to get library:", err)
+			return
+		}
+		args = append(args, urls...)
+	}
+	if chart_type != "" {
+		urls, err := chartQueue(chart_type, chart_storefront, chart_genre, chart_top, token)
+		if err != nil {
+			fmt.Println("Failed to get chart:", err)
+			return
+		}
+		args = append(args, urls...)
+	}
+
+	if verify_mode {
+		if len(args) == 0 {
+			fmt.Println("Error: --verify needs at least one file or folder.")
+			pflag.Usage()
+			return
+		}
+		requeue := verifyFiles(args, token)
+		if !verify_requeue || len(requeue) == 0 {
+			return
+		}
+		fmt.Printf("Downloading %d damaged track(s) again\n", len(requeue))
+		args = requeue
+	}
+
 	// If --batch flag is used, check if there are additional .txt files in args
 	if len(batch_files) > 0 && len(args) > 0 {
 		// Add any .txt files from args to batch_files
@@ -2645,8 +4079,8 @@ func main() {
 		return
 	}
 
-	if strings.Contains(urlQueue[0], "/artist/") {
-		urlArtistName, urlArtistID, err := getUrlArtistName(urlQueue[0], token)
+	if artist, err := urlref.Parse(urlQueue[0]); err == nil && artist.Kind == urlref.Artist {
+		urlArtistName, urlArtistID, err := getUrlArtistName(artist, token)
 		if err != nil {
 			fmt.Println("Failed to get artistname.")
 			return
@@ -2655,17 +4089,8 @@ func main() {
 			"{UrlArtistName}", LimitString(urlArtistName),
 			"{ArtistId}", urlArtistID,
 		).Replace(Config.ArtistFolderFormat)
-		albumArgs, err := checkArtist(urlQueue[0], token, "albums")
-		if err != nil {
-			fmt.Println("Failed to get artist albums.")
-			return
-		}
-		mvArgs, err := checkArtist(urlQueue[0], token, "music-videos")
-		if err != nil {
-			fmt.Println("Failed to get artist music-videos.")
-		}
-		urlQueue = append(albumArgs, mvArgs...)
 	}
+	urlQueue = expandQueue(urlQueue, token)
 	albumTotal := len(urlQueue)
 
 	var mutex sync.Mutex
@@ -2706,25 +4131,87 @@ func mvDownloader(adamID string, saveDir string, token string, storefront string
 		return nil
 	}
 
-	if strings.HasSuffix(saveDir, ".") {
-		saveDir = strings.ReplaceAll(saveDir, ".", "")
+	// Rendition fields in the naming templates need the master playlist
+	// before the output path is known.
+	var mvm3u8url string
+	var video rendition.Video
+	var audios []rendition.Audio
+	selectStreams := func() error {
+		mvm3u8url, _, _, _ = runv3.GetWebplayback(adamID, token, mediaUserToken, true)
+		if mvm3u8url == "" {
+			return errors.New("media-user-token may wrong or expired")
+		}
+		playlist, master, MediaUrl, err := fetchMvMaster(mvm3u8url)
+		if err != nil {
+			fmt.Println("[WARNING] Failed to fetch MV m3u8:", err)
+			return err
+		}
+		prefs, err := mvVideoPrefs()
+		if err != nil {
+			return err
+		}
+		video, err = extractVideoVariant(master, MediaUrl, prefs)
+		if err != nil {
+			fmt.Println("[WARNING] Failed to extract video m3u8:", err)
+			return err
+		}
+		audios, err = extractMvAudio(playlist, master, MediaUrl)
+		if err != nil {
+			fmt.Println("[WARNING] Failed to extract audio m3u8:", err)
+			return err
+		}
+		return nil
 	}
-	saveDir = strings.TrimSpace(saveDir)
-
-	vidPath := filepath.Join(saveDir, fmt.Sprintf("%s_vid.mp4", adamID))
-	audPath := filepath.Join(saveDir, fmt.Sprintf("%s_aud.mp4", adamID))
-	mvSaveName := fmt.Sprintf("%s (%s)", MVInfo.Data[0].Attributes.Name, adamID)
-	if track != nil {
-		mvSaveName = fmt.Sprintf("%02d. %s", track.TaskNum, MVInfo.Data[0].Attributes.Name)
+	fileFormat := Config.MVFileFormat
+	if fileFormat == "" {
+		fileFormat = "{MVName} ({MVId})"
+		if track != nil {
+			fileFormat = "{SongNumer}. {MVName}"
+		}
+	}
+	folderFormat := ""
+	if track == nil {
+		folderFormat = Config.ArtistFolderFormat + Config.MVFolderFormat
+	}
+	if mvFormatNeedsStreams(fileFormat + folderFormat) {
+		if err := selectStreams(); err != nil {
+			return err
+		}
+	}
+	fields := mvNameReplacer(MVInfo.Data[0], track, video, audios)
+
+	if track == nil {
+		// Standalone music videos get the same artist folder as albums
+		for _, format := range []string{Config.ArtistFolderFormat, Config.MVFolderFormat} {
+			folder := fields.Replace(format)
+			if strings.HasSuffix(folder, ".") {
+				folder = strings.ReplaceAll(folder, ".", "")
+			}
+			folder = strings.TrimSpace(folder)
+			if folder != "" {
+				saveDir = filepath.Join(saveDir, forbiddenNames.ReplaceAllString(folder, "_"))
+			}
+		}
 	}
 
-	mvOutPath := filepath.Join(saveDir, fmt.Sprintf("%s.mp4", forbiddenNames.ReplaceAllString(mvSaveName, "_")))
+	if strings.HasSuffix(saveDir, ".") {
+		saveDir = strings.ReplaceAll(saveDir, ".", "")
+	}
+	saveDir = strings.TrimSpace(saveDir)
+
+	vidPath := filepath.Join(saveDir, fmt.Sprintf("%s_vid.mp4", adamID))
+	mvSaveName := strings.TrimSpace(fields.Replace(fileFormat))
+
+	mvOutPath := filepath.Join(saveDir, fmt.Sprintf("%s.%s", forbiddenNames.ReplaceAllString(mvSaveName, "_"), mvContainer()))
 
 	fmt.Println(MVInfo.Data[0].Attributes.Name)
 
 	exists, _ := fileExists(mvOutPath)
 	if exists {
 		fmt.Println("MV already exists locally.")
+		if nfoExists, _ := fileExists(metadata.MusicVideoNFOPath(mvOutPath)); Config.SaveNFO && !nfoExists {
+			writeMvNFO(mvOutPath, MVInfo.Data[0], track)
+		}
 
 		mvArtistName := MVInfo.Data[0].Attributes.ArtistName
 		mvAlbumName := MVInfo.Data[0].Attributes.AlbumName
@@ -2744,18 +4231,14 @@ func mvDownloader(adamID string, saveDir string, token string, storefront string
 		return nil
 	}
 
-	mvm3u8url, _, _, _ := runv3.GetWebplayback(adamID, token, mediaUserToken, true)
 	if mvm3u8url == "" {
-		return errors.New("media-user-token may wrong or expired")
+		if err := selectStreams(); err != nil {
+			return err
+		}
 	}
 
 	os.MkdirAll(saveDir, os.ModePerm)
-	videom3u8url, err := extractVideo(mvm3u8url)
-	if err != nil {
-		fmt.Println("[WARNING] Failed to extract video m3u8:", err)
-		return err
-	}
-	videokeyAndUrls, err := runv3.Run(adamID, videom3u8url, token, mediaUserToken, true, "")
+	videokeyAndUrls, err := runv3.Run(adamID, video.URL, token, mediaUserToken, true, "")
 	if err != nil {
 		fmt.Println("[WARNING] Failed to run video download:", err)
 		return err
@@ -2766,78 +4249,24 @@ func mvDownloader(adamID string, saveDir string, token string, storefront string
 		return err
 	}
 	defer os.Remove(vidPath)
-	audiom3u8url, err := extractMvAudio(mvm3u8url)
-	if err != nil {
-		fmt.Println("[WARNING] Failed to extract audio m3u8:", err)
-		return err
-	}
-	audiokeyAndUrls, err := runv3.Run(adamID, audiom3u8url, token, mediaUserToken, true, "")
-	if err != nil {
-		fmt.Println("[WARNING] Failed to run audio download:", err)
-		return err
-	}
-	err = runv3.ExtMvData(audiokeyAndUrls, audPath)
-	if err != nil {
-		fmt.Println("[WARNING] Failed to extract audio data:", err)
-		return err
-	}
-	defer os.Remove(audPath)
-
-	mvGenre := ""
-	if len(MVInfo.Data[0].Attributes.GenreNames) > 0 {
-		mvGenre = MVInfo.Data[0].Attributes.GenreNames[0]
-	}
-
-	tags := []string{
-		"tool=",
-		fmt.Sprintf("artist=%s", MVInfo.Data[0].Attributes.ArtistName),
-		fmt.Sprintf("title=%s", MVInfo.Data[0].Attributes.Name),
-		fmt.Sprintf("genre=%s", mvGenre),
-		fmt.Sprintf("created=%s", MVInfo.Data[0].Attributes.ReleaseDate),
-		fmt.Sprintf("ISRC=%s", MVInfo.Data[0].Attributes.Isrc),
-	}
-
-	if MVInfo.Data[0].Attributes.ContentRating == "explicit" {
-		tags = append(tags, "rating=1")
-	} else if MVInfo.Data[0].Attributes.ContentRating == "clean" {
-		tags = append(tags, "rating=2")
-	} else {
-		tags = append(tags, "rating=0")
-	}
-
-	if track != nil {
-		if track.PreType == "playlists" && !Config.UseSongInfoForPlaylist {
-			tags = append(tags, "disk=1/1")
-			tags = append(tags, fmt.Sprintf("album=%s", track.PlaylistData.Attributes.Name))
-			tags = append(tags, fmt.Sprintf("track=%d", track.TaskNum))
-			tags = append(tags, fmt.Sprintf("tracknum=%d/%d", track.TaskNum, track.TaskTotal))
-			tags = append(tags, fmt.Sprintf("album_artist=%s", track.PlaylistData.Attributes.ArtistName))
-			tags = append(tags, fmt.Sprintf("performer=%s", track.Resp.Attributes.ArtistName))
-		} else if track.PreType == "playlists" && Config.UseSongInfoForPlaylist {
-			tags = append(tags, fmt.Sprintf("album=%s", track.AlbumData.Attributes.Name))
-			tags = append(tags, fmt.Sprintf("disk=%d/%d", track.Resp.Attributes.DiscNumber, track.DiscTotal))
-			tags = append(tags, fmt.Sprintf("track=%d", track.Resp.Attributes.TrackNumber))
-			tags = append(tags, fmt.Sprintf("tracknum=%d/%d", track.Resp.Attributes.TrackNumber, track.AlbumData.Attributes.TrackCount))
-			tags = append(tags, fmt.Sprintf("album_artist=%s", track.AlbumData.Attributes.ArtistName))
-			tags = append(tags, fmt.Sprintf("performer=%s", track.Resp.Attributes.ArtistName))
-			tags = append(tags, fmt.Sprintf("copyright=%s", track.AlbumData.Attributes.Copyright))
-			tags = append(tags, fmt.Sprintf("UPC=%s", track.AlbumData.Attributes.Upc))
-		} else {
-			tags = append(tags, fmt.Sprintf("album=%s", track.AlbumData.Attributes.Name))
-			tags = append(tags, fmt.Sprintf("disk=%d/%d", track.Resp.Attributes.DiscNumber, track.DiscTotal))
-			tags = append(tags, fmt.Sprintf("track=%d", track.Resp.Attributes.TrackNumber))
-			tags = append(tags, fmt.Sprintf("tracknum=%d/%d", track.Resp.Attributes.TrackNumber, track.AlbumData.Attributes.TrackCount))
-			tags = append(tags, fmt.Sprintf("album_artist=%s", track.AlbumData.Attributes.ArtistName))
-			tags = append(tags, fmt.Sprintf("performer=%s", track.Resp.Attributes.ArtistName))
-			tags = append(tags, fmt.Sprintf("copyright=%s", track.AlbumData.Attributes.Copyright))
-			tags = append(tags, fmt.Sprintf("UPC=%s", track.AlbumData.Attributes.Upc))
+	var audPaths []string
+	for i, audio := range audios {
+		audPath := filepath.Join(saveDir, fmt.Sprintf("%s_aud.mp4", adamID))
+		if i > 0 {
+			audPath = filepath.Join(saveDir, fmt.Sprintf("%s_aud%d.mp4", adamID, i))
 		}
-	} else {
-		tags = append(tags, fmt.Sprintf("album=%s", MVInfo.Data[0].Attributes.AlbumName))
-		tags = append(tags, fmt.Sprintf("disk=%d", MVInfo.Data[0].Attributes.DiscNumber))
-		tags = append(tags, fmt.Sprintf("track=%d", MVInfo.Data[0].Attributes.TrackNumber))
-		tags = append(tags, fmt.Sprintf("tracknum=%d", MVInfo.Data[0].Attributes.TrackNumber))
-		tags = append(tags, fmt.Sprintf("performer=%s", MVInfo.Data[0].Attributes.ArtistName))
+		audiokeyAndUrls, err := runv3.Run(adamID, audio.URL, token, mediaUserToken, true, "")
+		if err != nil {
+			fmt.Println("[WARNING] Failed to run audio download:", err)
+			return err
+		}
+		err = runv3.ExtMvData(audiokeyAndUrls, audPath)
+		if err != nil {
+			fmt.Println("[WARNING] Failed to extract audio data:", err)
+			return err
+		}
+		defer os.Remove(audPath)
+		audPaths = append(audPaths, audPath)
 	}
 
 	var covPath string
@@ -2847,56 +4276,23 @@ func mvDownloader(adamID string, saveDir string, token string, storefront string
 		covPath, err = writeCover(saveDir, baseThumbName, thumbURL)
 		if err != nil {
 			fmt.Println("Failed to save MV thumbnail:", err)
-		} else {
-			tags = append(tags, fmt.Sprintf("cover=%s", covPath))
+			covPath = ""
 		}
 	}
 	defer os.Remove(covPath)
 
-	tagsString := strings.Join(tags, ":")
-
-	// Check for and extract closed captions/subtitles BEFORE muxing
+	// Collect subtitles BEFORE muxing
 	// (because MP4Box muxing may not preserve EIA-608 closed captions)
-	tempSubtitlePath := filepath.Join(saveDir, fmt.Sprintf("%s_temp.srt", adamID))
-	subtitleExtracted := false
-
-	fmt.Printf("Checking for subtitles...")
-
-	// Check if video has embedded closed captions (check vidPath, not tempMvPath)
-	hasCC, err := subtitle.HasClosedCaptions(vidPath, Config.FFmpegPath)
-	if err == nil && hasCC {
-		fmt.Printf("\r\033[KExtracting closed captions...")
-		err = subtitle.ExtractClosedCaptionsFromMP4(vidPath, tempSubtitlePath, Config.FFmpegPath)
-		if err != nil {
-			// If extraction failed, don't treat this as having closed captions
-			hasCC = false
-			// Don't show error for common cases - it's expected for some videos
-			if strings.Contains(err.Error(), "no data") ||
-				strings.Contains(err.Error(), "not found") ||
-				strings.Contains(err.Error(), "does not contain extractable") ||
-				strings.Contains(err.Error(), "all closed caption extraction methods failed") ||
-				strings.Contains(err.Error(), "all alternative extraction methods failed") {
-				fmt.Printf("\r\033[K") // Clear the line
-			} else {
-				fmt.Printf("\r\033[K[INFO] Could not extract closed captions: %v\n", err)
-			}
-		} else {
-			// Clean up the extracted subtitles (remove formatting tags, duplicates)
-			err = subtitle.CleanSRTFile(tempSubtitlePath)
-			if err != nil {
-				fmt.Printf("\r\033[K[WARNING] Subtitle cleaning failed: %v\n", err)
-			}
-			subtitleExtracted = true
-			fmt.Printf("\r\033[K✓ Closed captions extracted successfully\n")
-		}
-	} else {
-		fmt.Printf("\r\033[K") // Clear the line - no need to show info if no subs
+	var subStreams []subtitle.Stream
+	hasCC := false
+	if Config.MVSubtitleMode != "off" {
+		subStreams, hasCC = collectMvSubtitles(adamID, storefront, token, mediaUserToken, mvm3u8url, vidPath)
 	}
 
 	// Remove EIA-608 closed captions from video file if they exist
-	// Only do this if we successfully extracted subtitles (meaning they really exist)
+	// Only do this if we successfully extracted them (meaning they really exist)
 	vidPathClean := vidPath
-	if subtitleExtracted {
+	if hasCC && mvContainer() != "mkv" {
 		fmt.Printf("Removing EIA-608 closed captions from video...")
 		vidPathClean = filepath.Join(saveDir, fmt.Sprintf("%s_vid_nocc.mp4", adamID))
 		stripCmd := exec.Command(Config.FFmpegPath,
@@ -2917,18 +4313,31 @@ func mvDownloader(adamID string, saveDir string, token string, storefront string
 		}
 	}
 
+	embedSubs := len(subStreams) > 0 && (Config.MVSubtitleMode == "embed" || Config.MVSubtitleMode == "both")
+
 	// Now create the muxed video with or without subtitles
-	if subtitleExtracted {
+	if mvContainer() == "mkv" {
+		// The Matroska muxer strips the captions itself and keeps subtitle
+		// styling, so neither ffmpeg nor MP4Box is needed
+		fmt.Printf("MV Muxing to MKV...")
+		var mkvSubs []subtitle.Stream
+		if embedSubs {
+			mkvSubs = subStreams
+		}
+		if err := muxMvMKV(mvOutPath, vidPath, hasCC, audPaths, audios, mkvSubs, covPath, MVInfo.Data[0], track); err != nil {
+			fmt.Printf("\r\033[K[WARNING] MV mux failed: %v\n", err)
+			return err
+		}
+		fmt.Printf("\r\033[KMV Muxed.\n")
+	} else if embedSubs {
 		// Mux video (without captions), audio, and SRT subtitles together
 		// Use FFmpeg for subtitle muxing as it properly positions subtitles at the bottom
-		fmt.Printf("MV Remuxing with subtitles...")
+		fmt.Printf("MV Remuxing with %d subtitle track(s)...", len(subStreams))
 
 		// First mux video and audio with MP4Box
 		tempMuxPath := filepath.Join(saveDir, fmt.Sprintf("%s_temp_mux.mp4", adamID))
-		muxCmd := exec.Command("MP4Box", "-itags", tagsString, "-quiet",
-			"-add", vidPathClean,
-			"-add", audPath,
-			"-keep-utc", "-new", tempMuxPath)
+		muxArgs := append([]string{"-quiet", "-add", vidPathClean}, mvAudioAddArgs(audPaths, audios)...)
+		muxCmd := exec.Command("MP4Box", append(muxArgs, "-keep-utc", "-new", tempMuxPath)...)
 
 		if err := muxCmd.Run(); err != nil {
 			fmt.Printf("\r\033[K[WARNING] MV mux failed: %v\n", err)
@@ -2936,39 +4345,52 @@ func mvDownloader(adamID string, saveDir string, token string, storefront string
 		}
 
 		// Then use FFmpeg to add subtitles with proper positioning (mov_text codec positions at bottom)
-		subMuxCmd := exec.Command(Config.FFmpegPath,
-			"-i", tempMuxPath,
-			"-i", tempSubtitlePath,
-			"-c:v", "copy",
-			"-c:a", "copy",
-			"-c:s", "mov_text",
-			"-metadata:s:s:0", "language=eng",
-			"-y",
-			mvOutPath)
-
-		if err := subMuxCmd.Run(); err != nil {
+		subPaths, err := subtitle.WriteTempFiles(saveDir, adamID, subStreams)
+		if err == nil {
+			subMuxCmd := exec.Command(Config.FFmpegPath,
+				subtitle.FFmpegMuxArgs(tempMuxPath, subPaths, subStreams, "mov_text", mvOutPath)...)
+			err = subMuxCmd.Run()
+			for _, p := range subPaths {
+				os.Remove(p)
+			}
+		}
+		if err != nil {
 			fmt.Printf("\r\033[K[WARNING] Subtitle mux failed: %v, using video without subtitles\n", err)
 			// Fallback: just rename the temp file
 			os.Rename(tempMuxPath, mvOutPath)
 		} else {
 			os.Remove(tempMuxPath)
+			fmt.Printf("\r\033[K✓ MV Remuxed with subtitles\n")
 		}
-
-		fmt.Printf("\r\033[K✓ MV Remuxed with subtitles\n")
-		// Clean up temp subtitle file
-		os.Remove(tempSubtitlePath)
 	} else {
 		// Mux video and audio only
 		fmt.Printf("MV Remuxing...")
-		muxCmd := exec.Command("MP4Box", "-itags", tagsString, "-quiet",
-			"-add", vidPathClean,
-			"-add", audPath, "-keep-utc", "-new", mvOutPath)
+		muxArgs := append([]string{"-quiet", "-add", vidPathClean}, mvAudioAddArgs(audPaths, audios)...)
+		muxCmd := exec.Command("MP4Box", append(muxArgs, "-keep-utc", "-new", mvOutPath)...)
 		if err := muxCmd.Run(); err != nil {
 			fmt.Printf("MV mux failed: %v\n", err)
 			return err
 		}
 		fmt.Printf("\r\033[KMV Remuxed.\n")
 	}
+	if mvContainer() == "mp4" {
+		if err := writeMvTags(mvOutPath, MVInfo.Data[0], track, video, covPath); err != nil {
+			fmt.Println("[WARNING] Failed to write MV tags:", err)
+		}
+	}
+
+	if len(subStreams) > 0 && (Config.MVSubtitleMode == "sidecar" || Config.MVSubtitleMode == "both") {
+		paths, err := subtitle.WriteSidecars(mvOutPath, subStreams)
+		if err != nil {
+			fmt.Printf("[WARNING] Failed to save subtitle sidecar: %v\n", err)
+		} else {
+			fmt.Printf("✓ Saved %d subtitle sidecar(s)\n", len(paths))
+		}
+	}
+
+	if Config.SaveNFO {
+		writeMvNFO(mvOutPath, MVInfo.Data[0], track)
+	}
 
 	// Append to AddedTracks
 	mvArtistName := MVInfo.Data[0].Attributes.ArtistName
@@ -2990,84 +4412,539 @@ func mvDownloader(adamID string, saveDir string, token string, storefront string
 	return nil
 }
 
-func extractMvAudio(c string) (string, error) {
+// writeMvNFO writes the Kodi/Jellyfin NFO of a music video. Inside an album
+// the album being ripped is used as the NFO album.
+func writeMvNFO(mvOutPath string, mv ampapi.MusicVideoRespData, track *task.Track) {
+	album := ""
+	if track != nil && track.PreType != "playlists" {
+		album = track.AlbumData.Attributes.Name
+	}
+	if err := metadata.WriteMusicVideoNFO(mvOutPath, mv, album, Config); err != nil {
+		fmt.Println("[WARNING] Failed to write MV NFO:", err)
+	}
+}
+
+// writeMvTags tags a muxed MP4 music video through the same path as songs,
+// embedding the thumbnail at covPath when it is not empty.
+func writeMvTags(mvOutPath string, mv ampapi.MusicVideoRespData, track *task.Track, video rendition.Video, covPath string) error {
+	attrs := mv.Attributes
+	customTags := map[string]string{
+		"PERFORMER":    attrs.ArtistName,
+		"RELEASETIME":  attrs.ReleaseDate,
+		"ISRC":         attrs.Isrc,
+		"CATALOG":      mv.ID,
+		"PURCHASEDATE": time.Now().Format("2006-01-02 15:04:05"),
+	}
+	artistID := ""
+	if len(mv.Relationships.Artists.Data) > 0 {
+		artistID = mv.Relationships.Artists.Data[0].ID
+		customTags["ARTISTID"] = artistID
+	}
+	if Config.Storefront != "" {
+		customTags["AppleStoreCountry"] = getCountryName(Config.Storefront)
+	}
+	customGenre := ""
+	if len(attrs.GenreNames) > 0 {
+		customGenre = attrs.GenreNames[0]
+		customTags["GENREID"] = customGenre
+	}
+
+	t := &mp4tag.MP4Tags{
+		Title:       attrs.Name,
+		Artist:      attrs.ArtistName,
+		Album:       attrs.AlbumName,
+		CustomGenre: customGenre,
+		Date:        attrs.ReleaseDate,
+		TrackNumber: int16(attrs.TrackNumber),
+		DiscNumber:  int16(attrs.DiscNumber),
+		Custom:      customTags,
+	}
+	albumID := ""
+	if track != nil {
+		if track.PreType == "playlists" && !Config.UseSongInfoForPlaylist {
+			t.DiscNumber = 1
+			t.DiscTotal = 1
+			t.TrackNumber = int16(track.TaskNum)
+			t.TrackTotal = int16(track.TaskTotal)
+			t.Album = track.PlaylistData.Attributes.Name
+			t.AlbumArtist = track.PlaylistData.Attributes.ArtistName
+		} else {
+			t.DiscNumber = int16(track.Resp.Attributes.DiscNumber)
+			t.DiscTotal = int16(track.DiscTotal)
+			t.TrackNumber = int16(track.Resp.Attributes.TrackNumber)
+			t.TrackTotal = int16(track.AlbumData.Attributes.TrackCount)
+			t.Album = track.AlbumData.Attributes.Name
+			t.AlbumArtist = track.AlbumData.Attributes.ArtistName
+			t.Copyright = track.AlbumData.Attributes.Copyright
+			t.Publisher = track.AlbumData.Attributes.RecordLabel
+			customTags["UPC"] = track.AlbumData.Attributes.Upc
+			customTags["LABEL"] = track.AlbumData.Attributes.RecordLabel
+			if track.AlbumData.ID != "" {
+				albumID = track.AlbumData.ID
+				customTags["ALBUMID"] = albumID
+			}
+		}
+		if track.PreType == "playlists" && track.PreID != "" {
+			customTags["PLAYLISTID"] = track.PreID
+		}
+	}
+	if Config.TagItunesID {
+		setItunesIDs(t, albumID, artistID)
+	}
+
+	switch attrs.ContentRating {
+	case "explicit":
+		t.ItunesAdvisory = mp4tag.ItunesAdvisoryExplicit
+	case "clean":
+		t.ItunesAdvisory = mp4tag.ItunesAdvisoryClean
+	default:
+		t.ItunesAdvisory = mp4tag.ItunesAdvisoryNone
+	}
+
+	atoms := metadata.ItunesAtoms{MediaKind: metadata.MediaKindMusicVideo, HDVideo: metadata.HDVideo(video.Height)}
+	return metadata.WriteTags(mvOutPath, t, atoms, covPath, Config)
+}
+
+// mvContainer returns the file extension of music videos: "mkv" or "mp4".
+func mvContainer() string {
+	if strings.EqualFold(Config.MVContainer, "mkv") {
+		return "mkv"
+	}
+	return "mp4"
+}
+
+// muxMvMKV writes a music video as Matroska with every audio and subtitle
+// track, the thumbnail as cover attachment and the metadata as tags.
+func muxMvMKV(outPath, vidPath string, stripCC bool, audPaths []string, audios []rendition.Audio, subStreams []subtitle.Stream, covPath string, mv ampapi.MusicVideoRespData, track *task.Track) error {
+	attrs := mv.Attributes
+	chapters, err := mvChapters(mv.ID)
+	if err != nil {
+		return fmt.Errorf("mv-chapters: %v", err)
+	}
+	file := mkv.File{
+		Title:    attrs.Name,
+		Tracks:   []mkv.Input{{Path: vidPath, Default: true, StripCaptions: stripCC}},
+		Chapters: chapters,
+	}
+	for i, p := range audPaths {
+		file.Tracks = append(file.Tracks, mkv.Input{
+			Path:     p,
+			Language: audios[i].Language,
+			Name:     audios[i].Title(),
+			Default:  i == 0,
+		})
+	}
+	for _, s := range subStreams {
+		doc, err := subtitle.Parse(s.SRT, subtitle.FormatSRT)
+		if err != nil || len(doc.Cues) == 0 {
+			continue
+		}
+		file.Subtitles = append(file.Subtitles, mkv.Subtitle{
+			Language: s.Language,
+			Name:     s.Title(),
+			Default:  s.Default,
+			Forced:   s.Forced,
+			Doc:      doc,
+		})
+	}
+	if covPath != "" {
+		if data, err := os.ReadFile(covPath); err == nil {
+			ext := strings.ToLower(filepath.Ext(covPath))
+			mimeType := "image/jpeg"
+			if ext == ".png" {
+				mimeType = "image/png"
+			}
+			file.Attachments = append(file.Attachments, mkv.Attachment{
+				Name:     "cover" + ext,
+				MIMEType: mimeType,
+				Data:     data,
+			})
+		}
+	}
+
+	album := attrs.AlbumName
+	copyright := ""
+	if track != nil {
+		if track.PreType == "playlists" && !Config.UseSongInfoForPlaylist {
+			album = track.PlaylistData.Attributes.Name
+		} else {
+			album = track.AlbumData.Attributes.Name
+			copyright = track.AlbumData.Attributes.Copyright
+		}
+	}
+	file.Tags = []mkv.Tag{
+		{Name: "TITLE", Value: attrs.Name},
+		{Name: "ARTIST", Value: attrs.ArtistName},
+		{Name: "ALBUM", Value: album},
+		{Name: "DATE_RELEASED", Value: attrs.ReleaseDate},
+		{Name: "ISRC", Value: attrs.Isrc},
+		{Name: "COPYRIGHT", Value: copyright},
+	}
+	for _, genre := range attrs.GenreNames {
+		file.Tags = append(file.Tags, mkv.Tag{Name: "GENRE", Value: genre})
+	}
+	return mkv.Write(outPath, file)
+}
+
+// mvChapters reads the --mv-chapters list of a music video. With {MVId} in
+// the path one pattern serves a batch, and a video without a file has no
+// chapters.
+func mvChapters(id string) ([]mkv.Chapter, error) {
+	if mv_chapters == "" {
+		return nil, nil
+	}
+	path := strings.ReplaceAll(mv_chapters, "{MVId}", id)
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) && path != mv_chapters {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return mkv.ReadChapters(f)
+}
+
+// mvStreamFields are the naming template fields that depend on the selected
+// video and audio renditions.
+var mvStreamFields = []string{"{Resolution}", "{Codec}", "{VideoRange}", "{AudioType}"}
+
+func mvFormatNeedsStreams(format string) bool {
+	for _, f := range mvStreamFields {
+		if strings.Contains(format, f) {
+			return true
+		}
+	}
+	return false
+}
+
+// mvNameReplacer fills the mv-folder-format and mv-file-format fields.
+// video and audios are empty when the templates do not use them.
+func mvNameReplacer(mv ampapi.MusicVideoRespData, track *task.Track, video rendition.Video, audios []rendition.Audio) *strings.Replacer {
+	artistID := ""
+	if len(mv.Relationships.Artists.Data) > 0 {
+		artistID = mv.Relationships.Artists.Data[0].ID
+	}
+	releaseYear := ""
+	if len(mv.Attributes.ReleaseDate) >= 4 {
+		releaseYear = mv.Attributes.ReleaseDate[:4]
+	}
+	tag := ""
+	if mv.Attributes.ContentRating == "explicit" {
+		tag = Config.ExplicitChoice
+	} else if mv.Attributes.ContentRating == "clean" {
+		tag = Config.CleanChoice
+	}
+
+	trackNum := mv.Attributes.TrackNumber
+	songNumer := trackNum
+	if track != nil {
+		songNumer = track.TaskNum
+		if track.Resp.Attributes.TrackNumber > 0 {
+			trackNum = track.Resp.Attributes.TrackNumber
+		}
+	}
+
+	var audioTypes []string
+	for _, a := range audios {
+		audioTypes = append(audioTypes, a.Label())
+	}
+
+	return strings.NewReplacer(
+		"{ArtistName}", LimitString(mv.Attributes.ArtistName),
+		"{UrlArtistName}", LimitString(mv.Attributes.ArtistName),
+		"{ArtistId}", artistID,
+		"{AlbumName}", LimitString(mv.Attributes.AlbumName),
+		"{MVName}", LimitString(mv.Attributes.Name),
+		"{MVId}", mv.ID,
+		"{ReleaseDate}", mv.Attributes.ReleaseDate,
+		"{ReleaseYear}", releaseYear,
+		"{ISRC}", mv.Attributes.Isrc,
+		"{SongNumer}", fmt.Sprintf("%02d", songNumer),
+		"{TrackNumber}", fmt.Sprintf("%0d", trackNum),
+		"{Tag}", tag,
+		"{Resolution}", video.Resolution(),
+		"{Codec}", video.Codec,
+		"{VideoRange}", video.Range,
+		"{AudioType}", strings.Join(audioTypes, "+"),
+	)
+}
+
+// mvSubtitleLanguages returns the subtitle languages requested for music videos.
+// An empty entry asks the API for the storefront's default language.
+func mvSubtitleLanguages() []string {
+	var langs []string
+	for _, l := range strings.Split(Config.MVSubtitleLanguages, ",") {
+		if l = strings.TrimSpace(l); l != "" {
+			langs = append(langs, l)
+		}
+	}
+	if len(langs) == 0 {
+		langs = append(langs, Config.Language)
+	}
+	return langs
+}
+
+// collectMvSubtitles gathers every subtitle source available for a music video:
+// HLS subtitle renditions from the master playlist, API TTML in each requested
+// language and EIA/CEA-608 captions embedded in the video. Duplicates are
+// dropped and the default track is flagged. hasCC reports whether embedded
+// captions were found in vidPath.
+func collectMvSubtitles(adamID, storefront, token, mediaUserToken, mvm3u8url, vidPath string) (streams []subtitle.Stream, hasCC bool) {
+	fmt.Printf("Checking for subtitles...")
+
+	// HLS subtitle renditions
+	if tracks, err := subtitle.ExtractSubtitlesFromM3U8(mvm3u8url); err == nil {
+		for _, t := range tracks {
+			srt, err := subtitle.DownloadHLSSubtitle(t)
+			if err != nil {
+				fmt.Printf("\r\033[K[INFO] Could not download %s subtitles: %v\n", t.Language, err)
+				continue
+			}
+			streams = append(streams, subtitle.Stream{
+				Language: t.LanguageCode,
+				Name:     t.Language,
+				Source:   subtitle.SourceHLS,
+				Forced:   t.Forced,
+				Default:  t.Default,
+				SRT:      srt,
+			})
+		}
+	}
+
+	// API TTML subtitles, one request per language
+	langs := mvSubtitleLanguages()
+	for _, lang := range langs {
+		ttml, err := subtitle.Get(storefront, adamID, lang, "ttml", token, mediaUserToken)
+		if err != nil {
+			continue
+		}
+		srt, err := subtitle.TTMLToSRT(ttml)
+		if err != nil {
+			continue
+		}
+		streamLang := subtitle.TTMLLanguage(ttml)
+		if streamLang == "" {
+			streamLang = lang
+		}
+		streams = append(streams, subtitle.Stream{
+			Language: streamLang,
+			Source:   subtitle.SourceAPI,
+			SRT:      srt,
+		})
+	}
+
+	// Embedded closed captions (check vidPath, not the muxed file)
+	ccDoc, err := subtitle.ReadClosedCaptions(vidPath)
+	if err != nil {
+		fmt.Printf("\r\033[K[INFO] Could not read closed captions: %v\n", err)
+	} else if len(ccDoc.Cues) > 0 {
+		ccLang, _ := subtitle.ExtractClosedCaptionLanguage(mvm3u8url)
+		if ccLang == "" {
+			ccLang = "en"
+		}
+		ccDoc.Language = ccLang
+		srt, _ := ccDoc.Encode(subtitle.FormatSRT)
+		streams = append(streams, subtitle.Stream{
+			Language: ccLang,
+			Name:     "CC",
+			Source:   subtitle.SourceCEA608,
+			SRT:      srt,
+		})
+		hasCC = true
+	}
+
+	streams = subtitle.DedupeStreams(streams)
+	defaultLang := Config.MVSubtitleDefaultLanguage
+	if defaultLang == "" {
+		defaultLang = langs[0]
+	}
+	subtitle.SelectDefault(streams, defaultLang)
+
+	if len(streams) == 0 {
+		fmt.Printf("\r\033[K") // Clear the line - no need to show info if no subs
+		return streams, hasCC
+	}
+	var names []string
+	for _, s := range streams {
+		names = append(names, s.Language)
+	}
+	fmt.Printf("\r\033[K✓ Found subtitles: %s\n", strings.Join(names, ", "))
+	return streams, hasCC
+}
+
+// fetchMvMaster downloads and parses a music video master playlist.
+func fetchMvMaster(c string) (string, *m3u8.MasterPlaylist, *url.URL, error) {
 	MediaUrl, err := url.Parse(c)
 	if err != nil {
-		return "", err
+		return "", nil, nil, err
 	}
 
 	resp, err := httpClient.Get(c)
 	if err != nil {
-		return "", err
+		return "", nil, nil, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return "", errors.New(resp.Status)
+		return "", nil, nil, errors.New(resp.Status)
 	}
 
 	// Limit m3u8 file size to 5MB
 	limitedReader := io.LimitReader(resp.Body, 5*1024*1024)
 	body, err := io.ReadAll(limitedReader)
 	if err != nil {
-		return "", err
+		return "", nil, nil, err
 	}
 
-	audioString := string(body)
-	from, listType, err := m3u8.DecodeFrom(strings.NewReader(audioString), true)
+	playlist := string(body)
+	from, listType, err := m3u8.DecodeFrom(strings.NewReader(playlist), true)
 	if err != nil || listType != m3u8.MASTER {
-		return "", errors.New("m3u8 not of media type")
-	}
-
-	audio := from.(*m3u8.MasterPlaylist)
-
-	var audioPriority = []string{"audio-atmos", "audio-ac3", "audio-stereo-256"}
-	if Config.MVAudioType == "ac3" {
-		audioPriority = []string{"audio-ac3", "audio-stereo-256"}
-	} else if Config.MVAudioType == "aac" {
-		audioPriority = []string{"audio-stereo-256"}
-	}
-
-	re := regexp.MustCompile(`_gr(\d+)_`)
-
-	type AudioStream struct {
-		URL     string
-		Rank    int
-		GroupID string
-	}
-	var audioStreams []AudioStream
-
-	for _, variant := range audio.Variants {
-		for _, audiov := range variant.Alternatives {
-			if audiov.URI != "" {
-				for _, priority := range audioPriority {
-					if audiov.GroupId == priority {
-						matches := re.FindStringSubmatch(audiov.URI)
-						if len(matches) == 2 {
-							var rank int
-							fmt.Sscanf(matches[1], "%d", &rank)
-							streamUrl, _ := MediaUrl.Parse(audiov.URI)
-							audioStreams = append(audioStreams, AudioStream{
-								URL:     streamUrl.String(),
-								Rank:    rank,
-								GroupID: audiov.GroupId,
-							})
-						}
-					}
-				}
-			}
+		return "", nil, nil, errors.New("m3u8 not of media type")
+	}
+	return playlist, from.(*m3u8.MasterPlaylist), MediaUrl, nil
+}
+
+// mvVideoPrefs returns the video rendition preferences from the config.
+func mvVideoPrefs() (rendition.VideoPrefs, error) {
+	codecs, err := rendition.ParseCodecs(Config.MVVideoCodecs)
+	if err != nil {
+		return rendition.VideoPrefs{}, fmt.Errorf("mv-video-codecs: %w", err)
+	}
+	ranges, err := rendition.ParseRanges(Config.MVVideoRanges)
+	if err != nil {
+		return rendition.VideoPrefs{}, fmt.Errorf("mv-video-ranges: %w", err)
+	}
+	return rendition.VideoPrefs{
+		Codecs:       codecs,
+		Ranges:       ranges,
+		MaxHeight:    Config.MVMax,
+		MaxBitrate:   Config.MVMaxBitrate,
+		MaxFrameRate: Config.MVMaxFrameRate,
+	}, nil
+}
+
+// mvAudioTracks returns the audio types of mv-audio-tracks.
+func mvAudioTracks() ([]string, error) {
+	types, err := rendition.ParseAudioTypes(Config.MVAudioTracks)
+	if err != nil {
+		return nil, fmt.Errorf("mv-audio-tracks: %w", err)
+	}
+	return types, nil
+}
+
+// mvAudioPrefs returns the audio rendition preferences from the config.
+func mvAudioPrefs() rendition.AudioPrefs {
+	return rendition.AudioPrefs{
+		Types:       rendition.AudioTypes(Config.MVAudioType),
+		MaxChannels: Config.MVAudioMaxChannels,
+		Language:    Config.MVAudioLanguage,
+	}
+}
+
+// extractMvAudio picks the audio renditions to download. With
+// mv-audio-tracks set, the best rendition of each listed type is returned
+// (stereo first); otherwise a single rendition chosen by mv-audio-type and
+// its fallbacks, then channel layout and bitrate.
+func extractMvAudio(playlist string, master *m3u8.MasterPlaylist, MediaUrl *url.URL) ([]rendition.Audio, error) {
+	types, err := mvAudioTracks()
+	if err != nil {
+		return nil, err
+	}
+	all := rendition.Audios(playlist, master, MediaUrl)
+	var audios []rendition.Audio
+	if len(types) > 0 {
+		audios = rendition.SelectAudios(all, types, mvAudioPrefs())
+	} else if audio, ok := rendition.SelectAudio(all, mvAudioPrefs()); ok {
+		audios = append(audios, audio)
+	}
+	if len(audios) == 0 {
+		return nil, errors.New("no suitable audio stream found")
+	}
+	for _, audio := range audios {
+		fmt.Printf("Audio: %s %s (%s)\n", audio.Label(), audio.Layout(), audio.GroupID)
+	}
+	return audios, nil
+}
+
+// mvAudioAddArgs returns the MP4Box -add arguments for the audio tracks.
+// Several tracks are put in one alternate group with language and title.
+// All of them stay enabled so players can switch between them; players
+// start with the first track of the group.
+func mvAudioAddArgs(audPaths []string, audios []rendition.Audio) []string {
+	var args []string
+	for i, p := range audPaths {
+		if len(audPaths) > 1 {
+			p += fmt.Sprintf(":lang=%s:name=%s:group=1", subtitle.ISO639_2(audios[i].Language), audios[i].Title())
 		}
+		args = append(args, "-add", p)
 	}
+	return args
+}
 
-	if len(audioStreams) == 0 {
-		return "", errors.New("no suitable audio stream found")
+// listMvRenditions prints every video and audio rendition of a music video,
+// marking the ones the current preferences would download.
+func listMvRenditions(adamID, token, mediaUserToken string) error {
+	mvm3u8url, _, _, _ := runv3.GetWebplayback(adamID, token, mediaUserToken, true)
+	if mvm3u8url == "" {
+		return errors.New("media-user-token may wrong or expired")
+	}
+	playlist, master, MediaUrl, err := fetchMvMaster(mvm3u8url)
+	if err != nil {
+		return err
 	}
 
-	sort.Slice(audioStreams, func(i, j int) bool {
-		return audioStreams[i].Rank > audioStreams[j].Rank
-	})
-	fmt.Println("Audio: " + audioStreams[0].GroupID)
-	return audioStreams[0].URL, nil
+	prefs, err := mvVideoPrefs()
+	if err != nil {
+		return err
+	}
+	types, err := mvAudioTracks()
+	if err != nil {
+		return err
+	}
+	videos := rendition.Videos(master, MediaUrl)
+	sort.SliceStable(videos, func(i, j int) bool { return videos[i].AverageBandwidth > videos[j].AverageBandwidth })
+	selected, _ := rendition.SelectVideo(videos, prefs)
+	var data [][]string
+	for _, v := range videos {
+		mark := ""
+		if v.URL == selected.URL {
+			mark = "*"
+		}
+		data = append(data, []string{mark, v.Resolution(), v.Codec, v.Range, fmt.Sprintf("%.3g", v.FrameRate),
+			fmt.Sprint(v.AverageBandwidth / 1000), fmt.Sprint(v.Bandwidth / 1000), v.Codecs})
+	}
+	fmt.Println("\nVideo Renditions:")
+	table := tablewriter.NewWriter(os.Stdout)
+	table.Header("", "Resolution", "Codec", "Range", "FPS", "Avg Kbps", "Peak Kbps", "Codecs")
+	table.Options(tablewriter.WithRendition(tw.Rendition{Settings: tw.Settings{Separators: tw.Separators{BetweenRows: tw.On}}}))
+	table.Bulk(data)
+	table.Render()
+
+	audios := rendition.Audios(playlist, master, MediaUrl)
+	picked := map[string]bool{}
+	if len(types) > 0 {
+		for _, a := range rendition.SelectAudios(audios, types, mvAudioPrefs()) {
+			picked[a.URL] = true
+		}
+	} else if a, ok := rendition.SelectAudio(audios, mvAudioPrefs()); ok {
+		picked[a.URL] = true
+	}
+	data = nil
+	for _, a := range audios {
+		mark := ""
+		if picked[a.URL] {
+			mark = "*"
+		}
+		data = append(data, []string{mark, a.Label(), a.Layout(), a.Codecs, fmt.Sprint(a.Bitrate), a.Language, a.Name, a.GroupID})
+	}
+	fmt.Println("\nAudio Renditions:")
+	table = tablewriter.NewWriter(os.Stdout)
+	table.Header("", "Type", "Channels", "Codec", "Kbps", "Language", "Name", "Group")
+	table.Options(tablewriter.WithRendition(tw.Rendition{Settings: tw.Settings{Separators: tw.Separators{BetweenRows: tw.On}}}))
+	table.Bulk(data)
+	table.Render()
+	return nil
 }
 
 func checkM3u8(b string, f string) (string, error) {
@@ -3279,6 +5156,23 @@ func extractMedia(b string, more_mode bool) (string, string, error) {
 	}
 	var Quality string
 	// UI selector and config dump removed
+	if !dl_atmos && !dl_aac {
+		if variant := pickAlacVariant(master.Variants); variant != nil {
+			split := strings.Split(variant.Audio, "-")
+			length := len(split)
+			if !debug_mode && !more_mode {
+				fmt.Printf("%s-bit / %s Hz\n", split[length-1], split[length-2])
+			}
+			streamUrlTemp, err := masterUrl.Parse(variant.URI)
+			if err != nil {
+				return "", "", err
+			}
+			streamUrl = streamUrlTemp
+			length_int, _ := strconv.Atoi(split[length-2])
+			KHZ := float64(length_int) / 1000.0
+			Quality = fmt.Sprintf("%sB-%.1fkHz", split[length-1], KHZ)
+		}
+	}
 	for _, variant := range master.Variants {
 		if dl_atmos {
 			if variant.Codecs == "ec-3" && strings.Contains(variant.Audio, "atmos") {
@@ -3355,34 +5249,6 @@ func extractMedia(b string, more_mode bool) (string, string, error) {
 					}
 				}
 			}
-		} else {
-			if variant.Codecs == "alac" {
-				split := strings.Split(variant.Audio, "-")
-
-				length := len(split)
-
-				length_int, err := strconv.Atoi(split[length-2])
-				if err != nil {
-					return "", "", err
-				}
-				max := Config.AlacMax
-				if max == 0 {
-					max = 192000
-				}
-				if length_int <= Config.AlacMax {
-					if !debug_mode && !more_mode {
-						fmt.Printf("%s-bit / %s Hz\n", split[length-1], split[length-2])
-					}
-					streamUrlTemp, err := masterUrl.Parse(variant.URI)
-					if err != nil {
-						return "", "", err
-					}
-					streamUrl = streamUrlTemp
-					KHZ := float64(length_int) / 1000.0
-					Quality = fmt.Sprintf("%sB-%.1fkHz", split[length-1], KHZ)
-					break
-				}
-			}
 		}
 	}
 	if streamUrl == nil {
@@ -3390,72 +5256,81 @@ func extractMedia(b string, more_mode bool) (string, string, error) {
 	}
 	return streamUrl.String(), Quality, nil
 }
-func extractVideo(c string) (string, error) {
-	MediaUrl, err := url.Parse(c)
-	if err != nil {
-		return "", err
-	}
 
-	resp, err := httpClient.Get(c)
-	if err != nil {
-		return "", err
+// pickAlacVariant returns the ALAC variant to download: the first one of
+// the preferred rates of the audio policy that is available, or else the
+// best one within alac-max and the policy limits. When the limits rule out
+// every variant, the lowest one is downloaded for conversions to bring down.
+// Variants are expected in order of descending bandwidth.
+func pickAlacVariant(variants []*m3u8.Variant) *m3u8.Variant {
+	policy := Config.AudioPolicy
+	maxRate := lowerLimit(Config.AlacMax, policy.MaxRate)
+	var allowed []*m3u8.Variant
+	var lowest *m3u8.Variant
+	var lowestRate, lowestDepth int
+	rates := map[*m3u8.Variant]int{}
+	for _, variant := range variants {
+		if variant.Codecs != "alac" {
+			continue
+		}
+		// audio-alac-stereo-<rate>-<depth>
+		split := strings.Split(variant.Audio, "-")
+		if len(split) < 3 {
+			continue
+		}
+		rate, err := strconv.Atoi(split[len(split)-2])
+		if err != nil {
+			continue
+		}
+		depth, err := strconv.Atoi(split[len(split)-1])
+		if err != nil {
+			continue
+		}
+		if lowest == nil || rate < lowestRate || (rate == lowestRate && depth < lowestDepth) {
+			lowest, lowestRate, lowestDepth = variant, rate, depth
+		}
+		if (maxRate > 0 && rate > maxRate) || (policy.MaxBitDepth > 0 && depth > policy.MaxBitDepth) {
+			continue
+		}
+		rates[variant] = rate
+		allowed = append(allowed, variant)
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return "", errors.New(resp.Status)
+	for _, preferred := range policy.PreferredRates {
+		for _, variant := range allowed {
+			if rates[variant] == preferred {
+				return variant
+			}
+		}
+	}
+	if len(allowed) == 0 {
+		if lowest != nil {
+			fmt.Printf("[WARNING] No ALAC variant within alac-max and audio-policy, downloading the lowest one (%d-bit / %d Hz)\n", lowestDepth, lowestRate)
+		}
+		return lowest
 	}
+	return allowed[0]
+}
 
-	// Limit m3u8 file size to 5MB
-	limitedReader := io.LimitReader(resp.Body, 5*1024*1024)
-	body, err := io.ReadAll(limitedReader)
+func extractVideo(c string) (string, error) {
+	_, master, MediaUrl, err := fetchMvMaster(c)
 	if err != nil {
 		return "", err
 	}
-	videoString := string(body)
-
-	from, listType, err := m3u8.DecodeFrom(strings.NewReader(videoString), true)
-	if err != nil || listType != m3u8.MASTER {
-		return "", errors.New("m3u8 not of media type")
-	}
-
-	video := from.(*m3u8.MasterPlaylist)
-
-	re := regexp.MustCompile(`_(\d+)x(\d+)`)
-
-	var streamUrl *url.URL
-	sort.Slice(video.Variants, func(i, j int) bool {
-		return video.Variants[i].AverageBandwidth > video.Variants[j].AverageBandwidth
-	})
-
-	maxHeight := Config.MVMax
-
-	for _, variant := range video.Variants {
-		matches := re.FindStringSubmatch(variant.URI)
-		if len(matches) == 3 {
-			height := matches[2]
-			var h int
-			_, err := fmt.Sscanf(height, "%d", &h)
-			if err != nil {
-				continue
-			}
-			if h <= maxHeight {
-				streamUrl, err = MediaUrl.Parse(variant.URI)
-				if err != nil {
-					return "", err
-				}
-				fmt.Println("Video: " + variant.Resolution + "-" + variant.VideoRange)
-				break
-			}
-		}
-	}
+	video, err := extractVideoVariant(master, MediaUrl, rendition.VideoPrefs{MaxHeight: Config.MVMax})
+	return video.URL, err
+}
 
-	if streamUrl == nil {
-		return "", errors.New("no suitable video stream found")
+// extractVideoVariant picks the video rendition of a master playlist that
+// best matches prefs.
+func extractVideoVariant(master *m3u8.MasterPlaylist, MediaUrl *url.URL, prefs rendition.VideoPrefs) (rendition.Video, error) {
+	video, ok := rendition.SelectVideo(rendition.Videos(master, MediaUrl), prefs)
+	if !ok {
+		return rendition.Video{}, errors.New("no suitable video stream found")
 	}
-
-	return streamUrl.String(), nil
+	fmt.Printf("Video: %dx%d-%s %s\n", video.Width, video.Height, video.Codec, video.Range)
+	return video, nil
 }
+
 func ripSong(songId string, token string, storefront string, mediaUserToken string) error {
 	// Get song info to find album ID
 	manifest, err := ampapi.GetSongResp(storefront, songId, Config.Language, token)
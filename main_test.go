@@ -0,0 +1,123 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/utopian-society/apple-music-downloader/utils/metadata"
+	"github.com/utopian-society/apple-music-downloader/utils/structs"
+)
+
+// TestBuildFFmpegArgsTrim checks that conversions ignore the source's edit
+// list and cut exactly the priming and padding, and that the lossy encoders
+// are left to record their own delay.
+func TestBuildFFmpegArgsTrim(t *testing.T) {
+	trim := &metadata.Gapless{Delay: 2112, Padding: 1000, Frames: 441000, Timescale: 44100}
+	const atrim = "atrim=start_sample=2112:end_sample=443112,asetpts=N/SR/TB"
+
+	for _, tc := range []struct {
+		format string
+		want   []string // in order, not necessarily adjacent
+	}{
+		{"flac", []string{"-c:a", "flac"}},
+		{"wav", []string{"-c:a", "pcm_s16le"}},
+		{"mp3", []string{"-c:a", "libmp3lame", "-write_xing", "1"}},
+		{"opus", []string{"-c:a", "libopus"}},
+	} {
+		args, err := buildFFmpegArgs("ffmpeg", "in.m4a", "out", structs.ConvertProfile{Format: tc.format}, "", 16, 44100, trim)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.format, err)
+		}
+		input := slices.Index(args, "-i")
+		if input < 2 || args[input-2] != "-ignore_editlist" || args[input-1] != "1" {
+			t.Errorf("%s: the edit list is not ignored before the input: %q", tc.format, args)
+		}
+		af := slices.Index(args, "-af")
+		if af < 0 || !strings.HasPrefix(args[af+1], atrim) {
+			t.Errorf("%s: no %s filter: %q", tc.format, atrim, args)
+		}
+		if !inOrder(args, tc.want) {
+			t.Errorf("%s: args %q lack %q", tc.format, args, tc.want)
+		}
+	}
+
+	// The trim comes first, so resampling works on the trimmed audio
+	p := structs.ConvertProfile{Format: "flac", SampleRate: 48000}
+	args, err := buildFFmpegArgs("ffmpeg", "in.m4a", "out.flac", p, "", 24, 96000, trim)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if af := slices.Index(args, "-af"); af < 0 || !strings.HasPrefix(args[af+1], atrim+",aresample=") {
+		t.Errorf("resampled conversion does not trim first: %q", args)
+	}
+
+	// A container copy has nothing to cut
+	args, err = buildFFmpegArgs("ffmpeg", "in.m4a", "out.m4a", structs.ConvertProfile{Format: "copy"}, "", 16, 44100, trim)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slices.Contains(args, "-ignore_editlist") || slices.Contains(args, "-af") {
+		t.Errorf("copy trims: %q", args)
+	}
+}
+
+func TestGaplessTrimOnlyReadsMP4(t *testing.T) {
+	if g := gaplessTrim("track.flac"); g != nil {
+		t.Errorf("gaplessTrim(track.flac) = %+v, want nil", g)
+	}
+}
+
+// TestGuessGapless checks the split of an AAC track without gapless info
+// into priming, audio and padding from the millisecond catalog duration.
+func TestGuessGapless(t *testing.T) {
+	const rate, delay = 44100, 2112
+	// The catalog rounds to whole milliseconds, so the padding is known to
+	// half a millisecond of samples
+	const slack = rate/2000 + 1
+	for _, tc := range []struct {
+		audio, padding int64
+	}{
+		{441000, 1024}, // exactly 10 s
+		{441001, 1023},
+		{123457, 0},
+		{9999999, 1979},
+	} {
+		in := metadata.Gapless{Frames: delay + tc.audio + tc.padding, Timescale: rate}
+		durationMs := int((tc.audio*1000 + rate/2) / rate)
+		g := guessGapless(in, delay, durationMs)
+		if g.Delay != delay {
+			t.Errorf("%+v: delay %d, want %d", tc, g.Delay, delay)
+		}
+		if g.Frames+g.Padding != tc.audio+tc.padding {
+			t.Errorf("%+v: %d frames + %d padding, want %d samples", tc, g.Frames, g.Padding, tc.audio+tc.padding)
+		}
+		if d := g.Padding - tc.padding; d < -slack || d > slack {
+			t.Errorf("%+v: padding %d, want %d ± %d", tc, g.Padding, tc.padding, slack)
+		}
+		if tc.audio*1000%rate == 0 && g.Padding != tc.padding {
+			t.Errorf("%+v: padding %d, want exactly %d", tc, g.Padding, tc.padding)
+		}
+	}
+
+	// A catalog duration of another version of the audio is not trusted
+	in := metadata.Gapless{Frames: delay + 441000 + 1024, Timescale: rate}
+	if g := guessGapless(in, delay, 9000); g.Padding != 0 || g.Frames != 441000+1024 {
+		t.Errorf("catalog duration 1 s short: %+v, want no padding", g)
+	}
+	// Codecs without a known delay are left alone
+	if g := guessGapless(in, 0, 10000); g != in {
+		t.Errorf("no delay: %+v, want %+v", g, in)
+	}
+}
+
+// inOrder reports whether want appears in args in order.
+func inOrder(args, want []string) bool {
+	i := 0
+	for _, a := range args {
+		if i < len(want) && a == want[i] {
+			i++
+		}
+	}
+	return i == len(want)
+}
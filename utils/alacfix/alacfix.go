@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 )
 
@@ -120,6 +121,7 @@ type alacParams struct {
 	riceInitialHistory uint8
 	riceLimit          uint8
 	channels           uint8
+	sampleRate         uint32
 }
 
 func decodeScalar(br *bitReader, k int, bps int) (uint32, error) {
@@ -150,7 +152,9 @@ func decodeScalar(br *bitReader, k int, bps int) (uint32, error) {
 	return x, nil
 }
 
-func riceDecompress(br *bitReader, nbSamples int, bps int, rhmEff uint32, p *alacParams) error {
+// riceDecompress reads nbSamples residuals into out, or only skips them
+// when out is nil.
+func riceDecompress(br *bitReader, out []int32, nbSamples int, bps int, rhmEff uint32, p *alacParams) error {
 	history := uint32(p.riceInitialHistory)
 	signMod := uint32(0)
 	limit := int(p.riceLimit)
@@ -174,6 +178,9 @@ func riceDecompress(br *bitReader, nbSamples int, bps int, rhmEff uint32, p *ala
 		}
 		x = x + signMod
 		signMod = 0
+		if out != nil {
+			out[i] = int32(x>>1) ^ -int32(x&1)
+		}
 		if x > 0xFFFF {
 			history = 0xFFFF
 		} else {
@@ -192,6 +199,9 @@ func riceDecompress(br *bitReader, nbSamples int, bps int, rhmEff uint32, p *ala
 				if int(blockSize) >= nbSamples-i {
 					blockSize = uint32(nbSamples - i - 1)
 				}
+				if out != nil {
+					clear(out[i+1 : i+1+int(blockSize)])
+				}
 				i += int(blockSize)
 			}
 			if blockSize <= 0xFFFF {
@@ -303,7 +313,7 @@ func scanOneElement(br *bitReader, p *alacParams) (int, bool, error) {
 		}
 		for c := 0; c < channels; c++ {
 			rhmEff := (rhms[c] * uint32(p.riceHistoryMult)) / 4
-			if err := riceDecompress(br, int(outputSamples), bps, rhmEff, p); err != nil {
+			if err := riceDecompress(br, nil, int(outputSamples), bps, rhmEff, p); err != nil {
 				return 0, false, err
 			}
 		}
@@ -414,15 +424,18 @@ type packetLoc struct {
 }
 
 type trackData struct {
-	trackID uint32
-	params  alacParams
-	locs    []packetLoc
+	trackID   uint32
+	timescale uint32
+	params    alacParams
+	locs      []packetLoc
+	durations []uint32 // per packet, in timescale units, from stts
 }
 
 // parseAlacMagicCookie parses the ALAC specific box payload (without atom header).
 // Layout: version_flags(4) | maxFrames(4) | compat(1) | sampleSize(1)
 //
-// | histMult(1) | initHist(1) | riceLim(1) | channels(1) | ...
+// | histMult(1) | initHist(1) | riceLim(1) | channels(1) | maxRun(2)
+// | maxFrameBytes(4) | avgBitRate(4) | sampleRate(4)
 func parseAlacMagicCookie(c []byte) (alacParams, error) {
 	var p alacParams
 	if len(c) < 24 {
@@ -434,6 +447,9 @@ func parseAlacMagicCookie(c []byte) (alacParams, error) {
 	p.riceInitialHistory = c[11]
 	p.riceLimit = c[12]
 	p.channels = c[13]
+	if len(c) >= 28 {
+		p.sampleRate = binary.BigEndian.Uint32(c[24:28])
+	}
 	return p, nil
 }
 
@@ -559,6 +575,35 @@ func readPacketLocations(data []byte, stbl atom) ([]packetLoc, error) {
 	return locs, nil
 }
 
+// readSampleDurations expands the stts run table to one duration per sample.
+func readSampleDurations(data []byte, stbl atom) ([]uint32, error) {
+	stts, ok := findChild(data, stbl.bodyOff, stbl.endOff, "stts")
+	if !ok {
+		return nil, errors.New("stts missing")
+	}
+	b := stts.bodyOff
+	if stts.endOff-b < 8 {
+		return nil, errors.New("stts too small")
+	}
+	ent := int(binary.BigEndian.Uint32(data[b+4 : b+8]))
+	if b+8+ent*8 > stts.endOff {
+		return nil, errors.New("stts truncated")
+	}
+	var durations []uint32
+	for i := 0; i < ent; i++ {
+		p := b + 8 + i*8
+		count := binary.BigEndian.Uint32(data[p : p+4])
+		delta := binary.BigEndian.Uint32(data[p+4 : p+8])
+		if len(durations)+int(count) > 1<<24 {
+			return nil, errors.New("stts sample count too large")
+		}
+		for j := uint32(0); j < count; j++ {
+			durations = append(durations, delta)
+		}
+	}
+	return durations, nil
+}
+
 // findAlacTracks returns one entry per audio track whose first sample entry
 // in stsd has format == 'alac'. All other tracks (video, AAC audio, etc.)
 // are silently skipped.
@@ -597,6 +642,15 @@ func findAlacTracks(data []byte) ([]trackData, error) {
 		if hdlr.endOff-hb < 12 || string(data[hb+8:hb+12]) != "soun" {
 			continue
 		}
+		var timescale uint32
+		if mdhd, ok := findChild(data, mdia.bodyOff, mdia.endOff, "mdhd"); ok {
+			b := mdhd.bodyOff
+			if data[b] == 0 && mdhd.endOff-b >= 16 {
+				timescale = binary.BigEndian.Uint32(data[b+12 : b+16])
+			} else if data[b] == 1 && mdhd.endOff-b >= 24 {
+				timescale = binary.BigEndian.Uint32(data[b+20 : b+24])
+			}
+		}
 		minf, ok := findChild(data, mdia.bodyOff, mdia.endOff, "minf")
 		if !ok {
 			continue
@@ -644,78 +698,199 @@ func findAlacTracks(data []byte) ([]trackData, error) {
 		if err != nil {
 			return nil, fmt.Errorf("track %d: %w", trackID, err)
 		}
-		tracks = append(tracks, trackData{trackID: trackID, params: params, locs: locs})
+		// Only verification needs the durations, so a bad stts is not fatal.
+		durations, _ := readSampleDurations(data, stbl)
+		tracks = append(tracks, trackData{trackID: trackID, timescale: timescale, params: params, locs: locs, durations: durations})
 	}
 	return tracks, nil
 }
 
+// readMoov returns the moov box of a file, found by walking the top level
+// box headers, so the media data is never read.
+func readMoov(f *os.File, size int64) ([]byte, error) {
+	hdr := make([]byte, 16)
+	for pos := int64(0); pos+8 <= size; {
+		if _, err := f.ReadAt(hdr, pos); err != nil && err != io.EOF {
+			return nil, err
+		}
+		boxSize := int64(binary.BigEndian.Uint32(hdr[0:4]))
+		if boxSize == 1 {
+			boxSize = int64(binary.BigEndian.Uint64(hdr[8:16]))
+		} else if boxSize == 0 {
+			boxSize = size - pos
+		}
+		if boxSize < 8 || pos+boxSize > size {
+			break
+		}
+		if string(hdr[4:8]) == "moov" {
+			moov := make([]byte, boxSize)
+			if _, err := f.ReadAt(moov, pos); err != nil {
+				return nil, err
+			}
+			return moov, nil
+		}
+		pos += boxSize
+	}
+	return nil, errors.New("no moov atom (not an MP4/M4A?)")
+}
+
+// openTracks opens a file and finds its ALAC tracks. Packet offsets in the
+// result are file offsets; the packets are read on demand.
+func openTracks(path string) (*os.File, int64, []trackData, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	info, err := f.Stat()
+	if err == nil {
+		var moov []byte
+		if moov, err = readMoov(f, info.Size()); err == nil {
+			var tracks []trackData
+			if tracks, err = findAlacTracks(moov); err == nil {
+				return f, info.Size(), tracks, nil
+			}
+		}
+	}
+	f.Close()
+	return nil, 0, nil, err
+}
+
+// readPacket reads a packet into buf, growing it as needed.
+func readPacket(f *os.File, size int64, loc packetLoc, buf []byte) ([]byte, error) {
+	if loc.offset < 0 || loc.offset+int64(loc.size) > size {
+		return buf, ErrTruncated
+	}
+	if cap(buf) < loc.size {
+		buf = make([]byte, loc.size)
+	}
+	buf = buf[:loc.size]
+	if _, err := f.ReadAt(buf, loc.offset); err != nil {
+		return buf, err
+	}
+	return buf, nil
+}
+
 // ---------- Patcher ---------------------------------------------------------
 
-func patchInPlace(data []byte, off int64, size int, bodyEndBit int) bool {
-	totalBits := size * 8
+// patchPacket writes TYPE_END at bodyEndBit and zeroes the rest of the
+// packet.
+func patchPacket(pkt []byte, bodyEndBit int) bool {
+	totalBits := len(pkt) * 8
 	if bodyEndBit < 0 || bodyEndBit+3 > totalBits {
 		return false
 	}
 	for i := 0; i < 3; i++ {
 		bp := bodyEndBit + i
-		bi := off + int64(bp>>3)
-		mask := byte(1 << uint(7-(bp&7)))
-		data[bi] |= mask
+		pkt[bp>>3] |= byte(1 << uint(7-(bp&7)))
 	}
 	padStart := bodyEndBit + 3
-	bi := off + int64(padStart>>3)
-	bitInByte := padStart & 7
-	if bitInByte != 0 {
-		keep := byte(0xFF<<uint(8-bitInByte)) & 0xFF
-		data[bi] &= keep
+	bi := padStart >> 3
+	if bitInByte := padStart & 7; bitInByte != 0 {
+		pkt[bi] &= byte(0xFF << uint(8-bitInByte))
 		bi++
 	}
-	endByte := off + int64(size)
-	for j := bi; j < endByte; j++ {
-		data[j] = 0
+	for ; bi < len(pkt); bi++ {
+		pkt[bi] = 0
 	}
 	return true
 }
 
-// ---------- main ------------------------------------------------------------
+// Options control how Repair writes its result.
+type Options struct {
+	DryRun  bool   // only report
+	Force   bool   // write even when nothing was patched
+	Backup  bool   // keep the original as <path>.bak when replacing it
+	OutPath string // write here instead of replacing the input
+}
 
-func Run(path string, force bool, outPath ...string) error {
-	data, err := os.ReadFile(path)
-	if err != nil {
-		return err
+// PatchedPacket is a packet whose tail was replaced with TYPE_END.
+type PatchedPacket struct {
+	Packet     int   `json:"packet"`
+	Offset     int64 `json:"offset"`
+	Size       int   `json:"size"`
+	BodyEndBit int   `json:"body_end_bit"`
+}
+
+// TrackReport describes one ALAC track of a repaired file.
+type TrackReport struct {
+	TrackID            uint32          `json:"track_id"`
+	Packets            int             `json:"packets"`
+	MaxSamplesPerFrame uint32          `json:"max_samples_per_frame"`
+	SampleSize         uint8           `json:"sample_size"`
+	Channels           uint8           `json:"channels"`
+	Unparsable         int             `json:"unparsable"` // packets left alone because they do not parse
+	Patched            []PatchedPacket `json:"patched,omitempty"`
+}
+
+// Report is the result of Repair.
+type Report struct {
+	Path    string        `json:"path"`
+	Output  string        `json:"output,omitempty"` // written file, empty when nothing was written
+	Backup  string        `json:"backup,omitempty"`
+	DryRun  bool          `json:"dry_run,omitempty"`
+	Patched int           `json:"patched"`
+	Tracks  []TrackReport `json:"tracks"`
+}
+
+// WriteText prints the report in the tool's plain text format.
+func (r *Report) WriteText(w io.Writer) {
+	for _, t := range r.Tracks {
+		fmt.Fprintf(w, "Track #%d: %d packets, max_samples_per_frame=%d sample_size=%d channels=%d\n",
+			t.TrackID, t.Packets, t.MaxSamplesPerFrame, t.SampleSize, t.Channels)
 	}
-	dst := path
-	if len(outPath) > 0 && outPath[0] != "" {
-		dst = outPath[0]
+	if r.Patched == 0 && r.Output == "" {
+		return
 	}
-	tracks, err := findAlacTracks(data)
-	if err != nil {
-		return err
+	verb := "Patched"
+	if r.DryRun {
+		verb = "Would patch"
 	}
-	if len(tracks) == 0 {
-		return nil
+	fmt.Fprintf(w, "%s %d packet(s).\n", verb, r.Patched)
+	for _, t := range r.Tracks {
+		for _, p := range t.Patched {
+			fmt.Fprintf(w, "  track #%d packet #%d  file_offset=0x%x  size=%d  body_ends_at_bit=%d  tail_overwritten=[%d..%d)\n",
+				t.TrackID, p.Packet, p.Offset, p.Size, p.BodyEndBit, p.BodyEndBit, p.Size*8)
+		}
 	}
+}
 
-	type bad struct {
-		trackID    uint32
-		idx        int
-		off        int64
-		size       int
-		bodyEndBit int
+// Repair finds ALAC packets without a TYPE_END terminator and patches them.
+// Only the moov box and one packet at a time are held in memory: the scan
+// keeps the location of each damaged packet, and the write reads each one
+// again to patch it into the copy. The output is written to a temporary
+// file next to it and renamed into place, so an interrupted run never
+// leaves a half written file behind.
+func Repair(path string, opts Options) (*Report, error) {
+	f, size, tracks, err := openTracks(path)
+	if err != nil {
+		return nil, err
 	}
+	defer f.Close()
 
-	patched := 0
-	var report []bad
-
+	r := &Report{Path: path, DryRun: opts.DryRun}
+	type patch struct {
+		loc     packetLoc
+		bodyEnd int
+	}
+	var patches []patch
+	var pkt []byte
 	for _, td := range tracks {
 		params := td.params
-		fmt.Printf("Track #%d: %d packets, max_samples_per_frame=%d sample_size=%d channels=%d\n",
-			td.trackID, len(td.locs), params.maxSamplesPerFrame, params.sampleSize, params.channels)
-
+		tr := TrackReport{
+			TrackID:            td.trackID,
+			Packets:            len(td.locs),
+			MaxSamplesPerFrame: params.maxSamplesPerFrame,
+			SampleSize:         params.sampleSize,
+			Channels:           params.channels,
+		}
 		for idx, loc := range td.locs {
-			pkt := data[loc.offset : loc.offset+int64(loc.size)]
+			if pkt, err = readPacket(f, size, loc, pkt); err != nil {
+				tr.Unparsable++
+				continue
+			}
 			bodyEnd := findBodyEndBit(pkt, &params)
 			if bodyEnd < 0 {
+				tr.Unparsable++
 				continue
 			}
 			if bodyEnd == loc.size*8 {
@@ -728,22 +903,58 @@ func Run(path string, force bool, outPath ...string) error {
 					continue
 				}
 			}
-			if patchInPlace(data, loc.offset, loc.size, bodyEnd) {
-				patched++
-				report = append(report, bad{td.trackID, idx, loc.offset, loc.size, bodyEnd})
+			if patchPacket(pkt, bodyEnd) {
+				patches = append(patches, patch{loc, bodyEnd})
+				tr.Patched = append(tr.Patched, PatchedPacket{idx, loc.offset, loc.size, bodyEnd})
 			}
 		}
+		r.Patched += len(tr.Patched)
+		r.Tracks = append(r.Tracks, tr)
+	}
+	if opts.DryRun || (r.Patched == 0 && !opts.Force) {
+		return r, nil
 	}
 
-	if patched > 0 || force {
-		if err := os.WriteFile(dst, data, 0644); err != nil {
-			return err
+	dst := path
+	if opts.OutPath != "" {
+		dst = opts.OutPath
+	}
+	tmp := dst + ".alacfix-tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(out, io.NewSectionReader(f, 0, size))
+	for _, p := range patches {
+		if err != nil {
+			break
 		}
-		fmt.Printf("Patched %d packet(s).\n", patched)
-		for _, r := range report {
-			fmt.Printf("  track #%d packet #%d  file_offset=0x%x  size=%d  body_ends_at_bit=%d  tail_overwritten=[%d..%d)\n",
-				r.trackID, r.idx, r.off, r.size, r.bodyEndBit, r.bodyEndBit, r.size*8)
+		if pkt, err = readPacket(f, size, p.loc, pkt); err == nil {
+			patchPacket(pkt, p.bodyEnd)
+			_, err = out.WriteAt(pkt, p.loc.offset)
 		}
 	}
-	return nil
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	f.Close()
+	if err == nil && opts.Backup && dst == path {
+		r.Backup = path + ".bak"
+		err = os.Rename(path, r.Backup)
+	}
+	if err == nil {
+		err = os.Rename(tmp, dst)
+		if err != nil && r.Backup != "" {
+			os.Rename(r.Backup, path)
+		}
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	r.Output = dst
+	return r, nil
 }
@@ -0,0 +1,333 @@
+package alacfix
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// decode.go — Decode the ALAC packets of an .m4a/.mp4 file to PCM.
+//
+// This reuses the bitstream reader of the patcher and follows the same
+// libavcodec/alac.c code paths (rice_decompress, lpc_prediction,
+// decorrelate_stereo, append_extra_bits). Like the patcher it stops once
+// every channel has been decoded, so packets missing the TYPE_END tag
+// decode fine.
+
+var (
+	// ErrNoALAC is returned by Open for files without an ALAC track.
+	ErrNoALAC = errors.New("no ALAC track")
+	// ErrTruncated is returned by Decoder.Next for packets that the sample
+	// table places past the end of the file.
+	ErrTruncated = errors.New("packet outside of the file")
+)
+
+// Format describes the PCM produced by a Decoder.
+type Format struct {
+	SampleRate int
+	Channels   int
+	BitDepth   int
+}
+
+// Decoder decodes the first ALAC track of a file, one packet at a time.
+// Packets are read as they are decoded, so the file is never loaded whole.
+type Decoder struct {
+	f      *os.File
+	size   int64
+	params alacParams
+	locs   []packetLoc
+	next   int
+	pkt    []byte
+	out    [][]int32
+	extra  [][]int32
+}
+
+// Open opens an MP4 file and prepares to decode its first ALAC track.
+func Open(path string) (*Decoder, error) {
+	f, size, tracks, err := openTracks(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(tracks) == 0 {
+		f.Close()
+		return nil, ErrNoALAC
+	}
+	d, err := newDecoder(f, size, tracks[0])
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+func newDecoder(f *os.File, size int64, td trackData) (*Decoder, error) {
+	p := td.params
+	if p.channels == 0 || p.maxSamplesPerFrame == 0 || p.maxSamplesPerFrame > 1<<16 {
+		return nil, fmt.Errorf("track %d: bad ALAC config", td.trackID)
+	}
+	d := &Decoder{f: f, size: size, params: p, locs: td.locs}
+	for c := 0; c < int(p.channels); c++ {
+		d.out = append(d.out, make([]int32, p.maxSamplesPerFrame))
+		d.extra = append(d.extra, make([]int32, p.maxSamplesPerFrame))
+	}
+	return d, nil
+}
+
+// Close closes the file.
+func (d *Decoder) Close() error {
+	return d.f.Close()
+}
+
+// Format returns the sample rate, channel count and bit depth of the track.
+func (d *Decoder) Format() Format {
+	return Format{
+		SampleRate: int(d.params.sampleRate),
+		Channels:   int(d.params.channels),
+		BitDepth:   int(d.params.sampleSize),
+	}
+}
+
+// Next decodes the next packet and returns one slice of samples per
+// channel, in ALAC channel order. The slices are reused by the following
+// call. It returns io.EOF after the last packet.
+func (d *Decoder) Next() ([][]int32, error) {
+	if d.next >= len(d.locs) {
+		return nil, io.EOF
+	}
+	idx := d.next
+	loc := d.locs[idx]
+	d.next++
+	var err error
+	if d.pkt, err = readPacket(d.f, d.size, loc, d.pkt); err != nil {
+		return nil, fmt.Errorf("packet #%d: %w", idx, err)
+	}
+	br := newBitReader(d.pkt)
+	ch, n := 0, -1
+	for ch < int(d.params.channels) && br.left() >= 3 {
+		elem, err := br.read(3)
+		if err != nil {
+			return nil, fmt.Errorf("packet #%d: %w", idx, err)
+		}
+		if elem == 7 {
+			break
+		}
+		nCh, nSamples, err := d.decodeElement(br, elem, ch)
+		if err != nil {
+			return nil, fmt.Errorf("packet #%d: %w", idx, err)
+		}
+		if n >= 0 && nSamples != n {
+			return nil, fmt.Errorf("packet #%d: elements differ in length", idx)
+		}
+		ch += nCh
+		n = nSamples
+	}
+	if ch < int(d.params.channels) {
+		return nil, fmt.Errorf("packet #%d: %d of %d channels decoded", idx, ch, d.params.channels)
+	}
+	pcm := make([][]int32, len(d.out))
+	for c := range d.out {
+		pcm[c] = d.out[c][:n]
+	}
+	return pcm, nil
+}
+
+// decodeElement decodes one SCE, CPE or LFE element into the channels
+// starting at chOff. Returns (channels, samples, error).
+func (d *Decoder) decodeElement(br *bitReader, elem uint32, chOff int) (int, int, error) {
+	p := &d.params
+	if elem > 1 && elem != 3 {
+		return 0, 0, fmt.Errorf("unsupported element tag %d", elem)
+	}
+	channels := 1
+	if elem == 1 {
+		channels = 2
+	}
+	if chOff+channels > len(d.out) {
+		return 0, 0, errors.New("too many channels")
+	}
+	if err := br.skip(4 + 12); err != nil {
+		return 0, 0, err
+	}
+	hasSize, err := br.read(1)
+	if err != nil {
+		return 0, 0, err
+	}
+	extraBitsRaw, err := br.read(2)
+	if err != nil {
+		return 0, 0, err
+	}
+	extraBits := int(extraBitsRaw) << 3
+	bps := int(p.sampleSize) - extraBits + channels - 1
+	if bps > 32 || bps < 1 {
+		return 0, 0, fmt.Errorf("bad bps %d", bps)
+	}
+	notCompressed, err := br.read(1)
+	if err != nil {
+		return 0, 0, err
+	}
+	outputSamples := p.maxSamplesPerFrame
+	if hasSize != 0 {
+		if outputSamples, err = br.read(32); err != nil {
+			return 0, 0, err
+		}
+	}
+	if outputSamples == 0 || outputSamples > p.maxSamplesPerFrame {
+		return 0, 0, fmt.Errorf("bad output_samples %d", outputSamples)
+	}
+	n := int(outputSamples)
+	out := d.out[chOff : chOff+channels]
+
+	var decorrShift, decorrLeftWeight uint32
+	if notCompressed == 0 {
+		if decorrShift, err = br.read(8); err != nil {
+			return 0, 0, err
+		}
+		if decorrLeftWeight, err = br.read(8); err != nil {
+			return 0, 0, err
+		}
+		var (
+			predType [2]uint32
+			lpcQuant [2]uint32
+			rhms     [2]uint32
+			lpcOrder [2]int
+			coefs    [2][32]int16
+		)
+		for c := 0; c < channels; c++ {
+			if predType[c], err = br.read(4); err != nil {
+				return 0, 0, err
+			}
+			if lpcQuant[c], err = br.read(4); err != nil {
+				return 0, 0, err
+			}
+			if rhms[c], err = br.read(3); err != nil {
+				return 0, 0, err
+			}
+			order, err := br.read(5)
+			if err != nil {
+				return 0, 0, err
+			}
+			if order >= p.maxSamplesPerFrame || lpcQuant[c] == 0 {
+				return 0, 0, fmt.Errorf("bad lpc")
+			}
+			lpcOrder[c] = int(order)
+			// The coefficients are stored last to first.
+			for j := lpcOrder[c] - 1; j >= 0; j-- {
+				v, err := br.readSigned(16)
+				if err != nil {
+					return 0, 0, err
+				}
+				coefs[c][j] = int16(v)
+			}
+		}
+		if extraBits != 0 {
+			for i := 0; i < n; i++ {
+				for c := 0; c < channels; c++ {
+					v, err := br.read(extraBits)
+					if err != nil {
+						return 0, 0, err
+					}
+					d.extra[chOff+c][i] = int32(v)
+				}
+			}
+		}
+		for c := 0; c < channels; c++ {
+			buf := out[c][:n]
+			rhmEff := (rhms[c] * uint32(p.riceHistoryMult)) / 4
+			if err := riceDecompress(br, buf, n, bps, rhmEff, p); err != nil {
+				return 0, 0, err
+			}
+			if predType[c] == 15 {
+				// Two passes: first order prediction, then the coefficients.
+				lpcPrediction(buf, bps, nil, 31, 0)
+			}
+			lpcPrediction(buf, bps, coefs[c][:lpcOrder[c]], lpcOrder[c], lpcQuant[c])
+		}
+	} else {
+		for i := 0; i < n; i++ {
+			for c := 0; c < channels; c++ {
+				v, err := br.readSigned(int(p.sampleSize))
+				if err != nil {
+					return 0, 0, err
+				}
+				out[c][i] = v
+			}
+		}
+		extraBits = 0
+	}
+
+	if channels == 2 && decorrLeftWeight != 0 {
+		decorrelateStereo(out[0][:n], out[1][:n], decorrShift, int32(decorrLeftWeight))
+	}
+	if extraBits != 0 {
+		for c := 0; c < channels; c++ {
+			extra := d.extra[chOff+c]
+			for i := 0; i < n; i++ {
+				out[c][i] = out[c][i]<<uint(extraBits) | extra[i]
+			}
+		}
+	}
+	return channels, n, nil
+}
+
+// lpcPrediction turns the residuals in buf into samples in place, adapting
+// the coefficients as it goes. Order 31 is plain first order prediction.
+func lpcPrediction(buf []int32, bps int, coefs []int16, order int, quant uint32) {
+	n := len(buf)
+	if n <= 1 || order == 0 {
+		return
+	}
+	if order == 31 {
+		for i := 1; i < n; i++ {
+			buf[i] = signExtend(buf[i-1]+buf[i], bps)
+		}
+		return
+	}
+	i := 1
+	for ; i <= order && i < n; i++ {
+		buf[i] = signExtend(buf[i-1]+buf[i], bps)
+	}
+	for ; i < n; i++ {
+		d := buf[i-order-1]
+		pred := buf[i-order : i]
+		var val int32
+		for j := 0; j < order; j++ {
+			val += (pred[j] - d) * int32(coefs[j])
+		}
+		val = int32((int64(val) + 1<<(quant-1)) >> quant)
+		errVal := buf[i]
+		buf[i] = signExtend(val+d+errVal, bps)
+
+		sign := signOnly(errVal)
+		for j := 0; sign != 0 && j < order && errVal*sign > 0; j++ {
+			v := d - pred[j]
+			s := signOnly(v) * sign
+			coefs[j] -= int16(s)
+			errVal -= ((v * s) >> quant) * int32(j+1)
+		}
+	}
+}
+
+func decorrelateStereo(left, right []int32, shift uint32, weight int32) {
+	for i := range left {
+		a, b := left[i], right[i]
+		a -= (b * weight) >> shift
+		b += a
+		left[i], right[i] = b, a
+	}
+}
+
+func signExtend(v int32, bits int) int32 {
+	shift := uint(32 - bits)
+	return v << shift >> shift
+}
+
+func signOnly(v int32) int32 {
+	switch {
+	case v < 0:
+		return -1
+	case v > 0:
+		return 1
+	}
+	return 0
+}
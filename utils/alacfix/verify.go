@@ -0,0 +1,165 @@
+package alacfix
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/utopian-society/apple-music-downloader/utils/metadata"
+)
+
+// verify.go — Decode a whole ALAC track and report what is wrong with it.
+//
+// Every packet is decoded and its frame count is compared with the stts
+// duration the container gives it. The MD5 is taken over the decoded PCM
+// the way FLAC computes its STREAMINFO signature (interleaved, little
+// endian, bit depth rounded up to whole bytes), and only over the frames
+// the edit list (or iTunSMPB tag) plays, as conversions trim the encoder
+// priming and padding. A FLAC conversion of a good file therefore carries
+// the same checksum.
+
+// Packet problems found by Verify
+const (
+	IssueTruncated = "truncated" // packet lies past the end of the file
+	IssueCorrupt   = "corrupt"   // packet does not decode
+	IssueLength    = "length"    // decoded frames differ from stts
+)
+
+// PacketIssue is a packet that failed verification.
+type PacketIssue struct {
+	Packet int    `json:"packet"`
+	Offset int64  `json:"offset"`
+	Size   int    `json:"size"`
+	Kind   string `json:"kind"`
+	Detail string `json:"detail"`
+}
+
+// VerifyReport is the verification result of one file.
+type VerifyReport struct {
+	TrackID     uint32        `json:"track_id"`
+	SampleRate  int           `json:"sample_rate"`
+	Channels    int           `json:"channels"`
+	BitDepth    int           `json:"bit_depth"`
+	Packets     int           `json:"packets"`
+	Frames      int64         `json:"frames"`       // decoded PCM frames
+	TableFrames int64         `json:"table_frames"` // frames according to stts
+	DurationMs  int64         `json:"duration_ms"`  // of the decoded frames
+	MD5         string        `json:"md5"`          // of the frames the edit list plays
+	Issues      []PacketIssue `json:"issues,omitempty"`
+}
+
+// OK reports whether every packet decoded to the length the sample table
+// gives it.
+func (r *VerifyReport) OK() bool {
+	return len(r.Issues) == 0 && r.Frames == r.TableFrames
+}
+
+// Verify fully decodes the first ALAC track of a file.
+func Verify(path string) (*VerifyReport, error) {
+	f, size, tracks, err := openTracks(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if len(tracks) == 0 {
+		return nil, ErrNoALAC
+	}
+	td := tracks[0]
+	dec, err := newDecoder(f, size, td)
+	if err != nil {
+		return nil, err
+	}
+	format := dec.Format()
+	if format.SampleRate == 0 {
+		format.SampleRate = int(td.timescale)
+	}
+	r := &VerifyReport{
+		TrackID:    td.trackID,
+		SampleRate: format.SampleRate,
+		Channels:   format.Channels,
+		BitDepth:   format.BitDepth,
+		Packets:    len(td.locs),
+	}
+	if len(td.durations) != len(td.locs) {
+		r.Issues = append(r.Issues, PacketIssue{
+			Packet: -1,
+			Kind:   IssueLength,
+			Detail: fmt.Sprintf("stts has %d samples, stsz %d", len(td.durations), len(td.locs)),
+		})
+	}
+	// stts counts in the media timescale, which is the sample rate for
+	// ALAC written by Apple but not guaranteed to be.
+	tableFrames := func(d uint32) int64 {
+		if td.timescale == 0 || int(td.timescale) == format.SampleRate {
+			return int64(d)
+		}
+		return int64(d) * int64(format.SampleRate) / int64(td.timescale)
+	}
+	for _, d := range td.durations {
+		r.TableFrames += tableFrames(d)
+	}
+
+	// The hashed range, in decoded frames
+	start, end := int64(0), int64(math.MaxInt64)
+	if g, err := metadata.ReadGapless(path); err == nil && (g.Delay > 0 || g.Padding > 0) {
+		scale := func(n int64) int64 {
+			if g.Timescale == 0 || g.Timescale == int64(format.SampleRate) {
+				return n
+			}
+			return n * int64(format.SampleRate) / g.Timescale
+		}
+		start, end = scale(g.Delay), scale(g.Delay+g.Frames)
+	}
+
+	sum := md5.New()
+	width := (format.BitDepth + 7) / 8
+	var buf []byte
+	var pos int64
+	for idx := 0; ; idx++ {
+		pcm, err := dec.Next()
+		if err == io.EOF {
+			break
+		}
+		loc := td.locs[idx]
+		if err != nil {
+			kind := IssueCorrupt
+			if errors.Is(err, ErrTruncated) {
+				kind = IssueTruncated
+			}
+			r.Issues = append(r.Issues, PacketIssue{idx, loc.offset, loc.size, kind, err.Error()})
+			if idx < len(td.durations) {
+				pos += tableFrames(td.durations[idx])
+			}
+			continue
+		}
+		n := len(pcm[0])
+		r.Frames += int64(n)
+		if idx < len(td.durations) {
+			if want := tableFrames(td.durations[idx]); want != int64(n) {
+				r.Issues = append(r.Issues, PacketIssue{idx, loc.offset, loc.size, IssueLength,
+					fmt.Sprintf("decoded %d frames, stts says %d", n, want)})
+			}
+		}
+		first := int(min(max(start-pos, 0), int64(n)))
+		last := int(min(max(end-pos, 0), int64(n)))
+		pos += int64(n)
+		buf = buf[:0]
+		for i := first; i < last; i++ {
+			for c := range pcm {
+				v := pcm[c][i]
+				for b := 0; b < width; b++ {
+					buf = append(buf, byte(v>>(8*b)))
+				}
+			}
+		}
+		sum.Write(buf)
+	}
+	r.MD5 = hex.EncodeToString(sum.Sum(nil))
+	if format.SampleRate > 0 {
+		r.DurationMs = r.Frames * 1000 / int64(format.SampleRate)
+	}
+	return r, nil
+}
@@ -0,0 +1,368 @@
+// Package albumimage joins the tracks of a disc into one lossless file with
+// a CUE sheet, for archives that keep an image per disc rather than a file
+// per track. The tracks are decoded and written back to back, so nothing is
+// added or lost between them.
+package albumimage
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/utopian-society/apple-music-downloader/utils/alacfix"
+	"github.com/utopian-society/apple-music-downloader/utils/metadata"
+)
+
+// Track is one track of a disc image.
+type Track struct {
+	Path       string // ALAC, or any lossless file ffmpeg can decode
+	Title      string
+	Performer  string
+	Songwriter string
+	ISRC       string
+}
+
+// Disc describes the image of one disc.
+type Disc struct {
+	Title     string
+	Performer string
+	Genre     string
+	Date      string
+	Catalog   string // UPC, written as the CUE CATALOG
+	Number    int
+	Total     int
+	CoverPath string // embedded when set
+	Tracks    []Track
+}
+
+// Write decodes the tracks of disc into outPath and writes the CUE sheet
+// next to it. A .flac path gets a FLAC image with the CUE sheet embedded;
+// a .m4a path gets an ALAC image with a chapter per track.
+func Write(outPath string, disc Disc, ffmpegPath string) error {
+	if len(disc.Tracks) == 0 {
+		return errors.New("no tracks")
+	}
+	var muxer, codec string
+	switch strings.ToLower(filepath.Ext(outPath)) {
+	case ".flac":
+		muxer, codec = "flac", "flac"
+	case ".m4a":
+		muxer, codec = "mp4", "alac"
+	default:
+		return fmt.Errorf("unsupported image type %q", filepath.Ext(outPath))
+	}
+	if _, err := exec.LookPath(ffmpegPath); err != nil {
+		return fmt.Errorf("ffmpeg not found at '%s'", ffmpegPath)
+	}
+
+	format, err := probe(disc.Tracks[0].Path, ffmpegPath)
+	if err != nil {
+		return fmt.Errorf("%s: %w", filepath.Base(disc.Tracks[0].Path), err)
+	}
+	for _, t := range disc.Tracks[1:] {
+		f, err := probe(t.Path, ffmpegPath)
+		if err != nil {
+			return fmt.Errorf("%s: %w", filepath.Base(t.Path), err)
+		}
+		if f != format {
+			return fmt.Errorf("%s is %s, the disc starts as %s", filepath.Base(t.Path), formatString(f), formatString(format))
+		}
+	}
+
+	audioPath := outPath + ".audio." + muxer
+	metaPath := outPath + ".ffmeta"
+	defer os.Remove(audioPath)
+	defer os.Remove(metaPath)
+	starts, total, err := encode(audioPath, disc.Tracks, format, ffmpegPath, muxer, codec)
+	if err != nil {
+		return err
+	}
+
+	var cue strings.Builder
+	if err := writeCue(&cue, disc, filepath.Base(outPath), starts, format.SampleRate); err != nil {
+		return err
+	}
+	meta := ffmetadata(disc, starts, total, format.SampleRate, codec == "alac")
+	if codec == "flac" {
+		meta += "CUESHEET=" + ffmetaEscape(cue.String()) + "\n"
+	}
+	if err := os.WriteFile(metaPath, []byte(meta), 0644); err != nil {
+		return err
+	}
+	// Tags, chapters and cover go in with a second, copying pass, once the
+	// track lengths are known
+	args := []string{"-hide_banner", "-loglevel", "error", "-nostdin", "-y",
+		"-i", audioPath, "-f", "ffmetadata", "-i", metaPath}
+	if disc.CoverPath != "" {
+		args = append(args, "-i", disc.CoverPath)
+	}
+	args = append(args, "-map", "0:a", "-map_metadata", "1", "-map_chapters", "1")
+	if disc.CoverPath != "" {
+		args = append(args, "-map", "2:v", "-c:v", "copy", "-disposition:v", "attached_pic")
+	}
+	partPath := outPath + ".part"
+	args = append(args, "-c:a", "copy", "-f", muxer, partPath)
+	if out, err := exec.Command(ffmpegPath, args...).CombinedOutput(); err != nil {
+		os.Remove(partPath)
+		return fmt.Errorf("ffmpeg: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	if err := os.Rename(partPath, outPath); err != nil {
+		os.Remove(partPath)
+		return err
+	}
+	cuePath := strings.TrimSuffix(outPath, filepath.Ext(outPath)) + ".cue"
+	return os.WriteFile(cuePath, []byte(cue.String()), 0644)
+}
+
+// encode pipes the decoded tracks into one ffmpeg encoder and returns the
+// sample offset of each track and the total length.
+func encode(outPath string, tracks []Track, format alacfix.Format, ffmpegPath, muxer, codec string) ([]int64, int64, error) {
+	width := (format.BitDepth + 7) / 8
+	args := []string{"-hide_banner", "-loglevel", "error", "-y",
+		"-f", rawFormat(width), "-ar", strconv.Itoa(format.SampleRate), "-ac", strconv.Itoa(format.Channels)}
+	if layout := channelLayouts[format.Channels]; format.Channels > 2 && layout != "" {
+		args = append(args, "-ch_layout", layout)
+	}
+	args = append(args, "-i", "pipe:0", "-c:a", codec, "-f", muxer, outPath)
+	cmd := exec.Command(ffmpegPath, args...)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, 0, err
+	}
+	w := bufio.NewWriterSize(stdin, 1<<16)
+
+	starts := make([]int64, len(tracks))
+	var total int64
+	for i, t := range tracks {
+		starts[i] = total
+		n, err := decode(w, t.Path, format, ffmpegPath)
+		total += n
+		if err != nil {
+			stdin.Close()
+			cmd.Wait()
+			return nil, 0, fmt.Errorf("%s: %w", filepath.Base(t.Path), err)
+		}
+	}
+	err = w.Flush()
+	if cerr := stdin.Close(); err == nil {
+		err = cerr
+	}
+	if werr := cmd.Wait(); werr != nil {
+		return nil, 0, fmt.Errorf("ffmpeg: %v: %s", werr, strings.TrimSpace(stderr.String()))
+	}
+	return starts, total, err
+}
+
+// decode writes the PCM of one track to w as interleaved little endian
+// samples of the image format and returns the number of frames written.
+// The priming and padding the edit list of an ALAC file marks are left out.
+func decode(w io.Writer, path string, format alacfix.Format, ffmpegPath string) (int64, error) {
+	dec, err := alacfix.Open(path)
+	if errors.Is(err, alacfix.ErrNoALAC) {
+		return decodeFFmpeg(w, path, format, ffmpegPath)
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer dec.Close()
+	gapless, err := metadata.ReadGapless(path)
+	if err != nil {
+		return 0, err
+	}
+	skip, left := gapless.Delay, gapless.Frames
+
+	width := (format.BitDepth + 7) / 8
+	shift := uint(width*8 - format.BitDepth)
+	order := alacChannelOrder[format.Channels]
+	var frames int64
+	var buf []byte
+	for {
+		pcm, err := dec.Next()
+		if err == io.EOF {
+			return frames, nil
+		}
+		if err != nil {
+			return frames, err
+		}
+		first := int(min(skip, int64(len(pcm[0]))))
+		skip -= int64(first)
+		n := int(min(left, int64(len(pcm[0])-first)))
+		left -= int64(n)
+		buf = buf[:0]
+		for i := first; i < first+n; i++ {
+			for c := range pcm {
+				src := c
+				if order != nil {
+					src = order[c]
+				}
+				v := pcm[src][i] << shift
+				for b := 0; b < width; b++ {
+					buf = append(buf, byte(v>>(8*b)))
+				}
+			}
+		}
+		if _, err := w.Write(buf); err != nil {
+			return frames, err
+		}
+		frames += int64(n)
+	}
+}
+
+// decodeFFmpeg has ffmpeg decode a track that is not ALAC, a FLAC, WAV or
+// AIFF conversion in practice, to raw PCM of the image format.
+func decodeFFmpeg(w io.Writer, path string, format alacfix.Format, ffmpegPath string) (int64, error) {
+	width := (format.BitDepth + 7) / 8
+	cmd := exec.Command(ffmpegPath, "-v", "error", "-nostdin", "-i", path,
+		"-map", "0:a:0", "-f", rawFormat(width), "-")
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return 0, err
+	}
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(w, stdout)
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return 0, err
+	}
+	if err := cmd.Wait(); err != nil {
+		return 0, fmt.Errorf("ffmpeg: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return n / int64(width*format.Channels), nil
+}
+
+// probe returns the PCM format of a track, from the ALAC config or else
+// from ffprobe.
+func probe(path, ffmpegPath string) (alacfix.Format, error) {
+	dec, err := alacfix.Open(path)
+	if err == nil {
+		defer dec.Close()
+		format := dec.Format()
+		if format.SampleRate == 0 || format.BitDepth == 0 {
+			return format, errors.New("ALAC config without sample rate or bit depth")
+		}
+		return format, nil
+	}
+	if !errors.Is(err, alacfix.ErrNoALAC) {
+		return alacfix.Format{}, err
+	}
+	ffprobePath := strings.Replace(ffmpegPath, "ffmpeg", "ffprobe", 1)
+	out, err := exec.Command(ffprobePath, "-v", "error", "-select_streams", "a:0",
+		"-show_entries", "stream=codec_name,sample_rate,channels,bits_per_raw_sample,bits_per_sample",
+		"-of", "default=noprint_wrappers=1", path).Output()
+	if err != nil {
+		return alacfix.Format{}, fmt.Errorf("ffprobe: %w", err)
+	}
+	var format alacfix.Format
+	var codec string
+	for _, line := range strings.Split(string(out), "\n") {
+		key, value, _ := strings.Cut(strings.TrimSpace(line), "=")
+		n, _ := strconv.Atoi(value)
+		switch key {
+		case "codec_name":
+			codec = value
+		case "sample_rate":
+			format.SampleRate = n
+		case "channels":
+			format.Channels = n
+		case "bits_per_raw_sample", "bits_per_sample":
+			if format.BitDepth == 0 {
+				format.BitDepth = n
+			}
+		}
+	}
+	if !lossless[codec] {
+		return format, fmt.Errorf("%s is not lossless", codec)
+	}
+	if format.SampleRate == 0 || format.Channels == 0 || format.BitDepth == 0 {
+		return format, errors.New("could not read the audio format")
+	}
+	return format, nil
+}
+
+var lossless = map[string]bool{
+	"alac": true, "flac": true, "wavpack": true,
+	"pcm_s16le": true, "pcm_s24le": true, "pcm_s32le": true,
+	"pcm_s16be": true, "pcm_s24be": true, "pcm_s32be": true,
+}
+
+// alacChannelOrder maps the output channels, in WAV order, to the ALAC
+// channels, which put the centre first (as libavcodec's alac decoder does).
+var alacChannelOrder = map[int][]int{
+	3: {1, 2, 0},
+	4: {1, 2, 0, 3},
+	5: {1, 2, 0, 3, 4},
+	6: {1, 2, 0, 5, 3, 4},
+	7: {1, 2, 0, 6, 3, 4, 5},
+	8: {3, 4, 0, 7, 5, 6, 1, 2},
+}
+
+// channelLayouts names the layouts of the reordered ALAC channels.
+var channelLayouts = map[int]string{
+	3: "3.0",
+	4: "4.0",
+	5: "5.0",
+	6: "5.1",
+	7: "6.1(back)",
+	8: "7.1(wide)",
+}
+
+func rawFormat(width int) string {
+	return fmt.Sprintf("s%dle", width*8)
+}
+
+func formatString(f alacfix.Format) string {
+	return fmt.Sprintf("%d Hz/%d bit/%d ch", f.SampleRate, f.BitDepth, f.Channels)
+}
+
+// ffmetadata builds the ffmpeg metadata file with the album tags and, for
+// ALAC images, a chapter per track in sample units.
+func ffmetadata(disc Disc, starts []int64, total int64, sampleRate int, chapters bool) string {
+	var b strings.Builder
+	b.WriteString(";FFMETADATA1\n")
+	tag := func(key, value string) {
+		if value != "" {
+			fmt.Fprintf(&b, "%s=%s\n", key, ffmetaEscape(value))
+		}
+	}
+	tag("title", disc.Title)
+	tag("album", disc.Title)
+	tag("artist", disc.Performer)
+	tag("album_artist", disc.Performer)
+	tag("genre", disc.Genre)
+	tag("date", disc.Date)
+	if disc.Total > 1 {
+		tag("disc", fmt.Sprintf("%d/%d", disc.Number, disc.Total))
+	}
+	if !chapters {
+		return b.String()
+	}
+	for i, t := range disc.Tracks {
+		end := total
+		if i+1 < len(starts) {
+			end = starts[i+1]
+		}
+		fmt.Fprintf(&b, "[CHAPTER]\nTIMEBASE=1/%d\nSTART=%d\nEND=%d\n", sampleRate, starts[i], end)
+		tag("title", t.Title)
+	}
+	return b.String()
+}
+
+func ffmetaEscape(s string) string {
+	return strings.NewReplacer("\\", "\\\\", "=", "\\=", ";", "\\;", "#", "\\#", "\n", "\\\n").Replace(s)
+}
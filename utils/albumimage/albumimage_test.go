@@ -0,0 +1,232 @@
+package albumimage
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/utopian-society/apple-music-downloader/utils/alacfix"
+	"github.com/utopian-society/apple-music-downloader/utils/metadata"
+)
+
+const (
+	testRate     = 44100
+	testChannels = 2
+	testFrameLen = 4096 // frames per ALAC packet
+	testPriming  = 2112
+)
+
+// TestJoinIsSampleContinuous decodes two ALAC tracks with encoder priming
+// and padding, one marked by an edit list and one by an iTunSMPB tag, and
+// checks that the trimmed audio joins into exactly the source signal.
+func TestJoinIsSampleContinuous(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	noise := func(frames int) [][2]int16 {
+		pcm := make([][2]int16, frames)
+		for i := range pcm {
+			pcm[i] = [2]int16{int16(rng.Intn(1 << 16)), int16(rng.Intn(1 << 16))}
+		}
+		return pcm
+	}
+	source := noise(10000 + 7777)
+	parts := []struct {
+		audio   [][2]int16
+		padding int
+		smpb    bool
+	}{
+		{audio: source[:10000], padding: 1000},
+		{audio: source[10000:], padding: 321, smpb: true},
+	}
+
+	dir := t.TempDir()
+	var joined bytes.Buffer
+	for i, part := range parts {
+		// Priming and padding are noise too, so leaking any of it shows
+		track := append(noise(testPriming), part.audio...)
+		track = append(track, noise(part.padding)...)
+		g := metadata.Gapless{Delay: testPriming, Padding: int64(part.padding), Frames: int64(len(part.audio))}
+
+		path := filepath.Join(dir, fmt.Sprintf("%02d.m4a", i+1))
+		var smpb string
+		if part.smpb {
+			smpb = g.ITunSMPB()
+		}
+		if err := os.WriteFile(path, alacFile(track, smpb), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if !part.smpb {
+			if err := metadata.WriteGapless(path, g); err != nil {
+				t.Fatalf("track %d: WriteGapless: %v", i+1, err)
+			}
+		}
+
+		got, err := metadata.ReadGapless(path)
+		if err != nil {
+			t.Fatalf("track %d: ReadGapless: %v", i+1, err)
+		}
+		if got.Delay != g.Delay || got.Padding != g.Padding || got.Frames != g.Frames {
+			t.Fatalf("track %d: gapless %+v, want %+v", i+1, got, g)
+		}
+		if r, err := alacfix.Verify(path); err != nil {
+			t.Fatalf("track %d: Verify: %v", i+1, err)
+		} else if r.MD5 != pcmMD5(part.audio) {
+			t.Fatalf("track %d: Verify MD5 %s, want the MD5 of the played frames %s", i+1, r.MD5, pcmMD5(part.audio))
+		}
+		format := alacfix.Format{SampleRate: testRate, Channels: testChannels, BitDepth: 16}
+		n, err := decode(&joined, path, format, "ffmpeg")
+		if err != nil {
+			t.Fatalf("track %d: decode: %v", i+1, err)
+		}
+		if n != int64(len(part.audio)) {
+			t.Fatalf("track %d: decoded %d frames, want %d", i+1, n, len(part.audio))
+		}
+	}
+
+	want := pcmBytes(source)
+	got := joined.Bytes()
+	if len(got) != len(want) {
+		t.Fatalf("joined %d bytes, want %d", len(got), len(want))
+	}
+	for i := 0; i < len(want); i += 4 {
+		if !bytes.Equal(got[i:i+4], want[i:i+4]) {
+			t.Fatalf("joined audio differs from the source at frame %d", i/4)
+		}
+	}
+}
+
+func pcmBytes(pcm [][2]int16) []byte {
+	b := make([]byte, 0, len(pcm)*4)
+	for _, frame := range pcm {
+		b = binary.LittleEndian.AppendUint16(b, uint16(frame[0]))
+		b = binary.LittleEndian.AppendUint16(b, uint16(frame[1]))
+	}
+	return b
+}
+
+func pcmMD5(pcm [][2]int16) string {
+	return fmt.Sprintf("%x", md5.Sum(pcmBytes(pcm)))
+}
+
+// alacFile builds a 16 bit stereo ALAC .m4a of uncompressed packets, with
+// the moov box before the media data as downloads have it. A non-empty
+// smpb is stored as an iTunSMPB tag.
+func alacFile(pcm [][2]int16, smpb string) []byte {
+	var packets [][]byte
+	var sizes []uint32
+	for start := 0; start < len(pcm); start += testFrameLen {
+		p := alacPacket(pcm[start:min(start+testFrameLen, len(pcm))])
+		packets = append(packets, p)
+		sizes = append(sizes, uint32(len(p)))
+	}
+	last := len(pcm) - (len(packets)-1)*testFrameLen
+
+	ftyp := box("ftyp", []byte("M4A \x00\x00\x00\x00M4A mp42isom"))
+	moov := func(mdatOffset uint32) []byte {
+		stts := u32s(0, 1, uint32(len(packets)), testFrameLen)
+		if last != testFrameLen {
+			stts = u32s(0, 2, uint32(len(packets)-1), testFrameLen, 1, uint32(last))
+		}
+		stsz := u32s(0, 0, uint32(len(sizes)))
+		stsz = append(stsz, u32s(sizes...)...)
+		stbl := box("stbl", cat(
+			box("stsd", cat(u32s(0, 1), alacSampleEntry())),
+			box("stts", stts),
+			box("stsc", u32s(0, 1, 1, uint32(len(packets)), 1)),
+			box("stsz", stsz),
+			box("stco", u32s(0, 1, mdatOffset)),
+		))
+		mdia := box("mdia", cat(
+			box("mdhd", cat(u32s(0, 0, 0, testRate, uint32(len(pcm))), []byte{0x55, 0xC4, 0, 0})),
+			box("hdlr", cat(u32s(0, 0), []byte("soun"), make([]byte, 13))),
+			box("minf", cat(box("smhd", make([]byte, 8)), stbl)),
+		))
+		tkhd := cat(u32s(7, 0, 0, 1, 0, uint32(len(pcm)), 0, 0, 0, 0x01000000), identity(), u32s(0, 0))
+		body := cat(box("mvhd", mvhd(uint32(len(pcm)))), box("trak", cat(box("tkhd", tkhd), mdia)))
+		if smpb != "" {
+			freeform := box("----", cat(
+				box("mean", cat(u32s(0), []byte("com.apple.iTunes"))),
+				box("name", cat(u32s(0), []byte("iTunSMPB"))),
+				box("data", cat(u32s(1, 0), []byte(smpb))),
+			))
+			hdlr := box("hdlr", cat(u32s(0, 0), []byte("mdirappl"), make([]byte, 9)))
+			body = cat(body, box("udta", box("meta", cat(u32s(0), hdlr, box("ilst", freeform)))))
+		}
+		return box("moov", body)
+	}
+	header := len(ftyp) + len(moov(0)) + 8
+	return cat(ftyp, moov(uint32(header)), box("mdat", cat(packets...)))
+}
+
+// alacPacket encodes frames as one uncompressed stereo ALAC element.
+func alacPacket(pcm [][2]int16) []byte {
+	var w bitWriter
+	w.write(1, 3)  // CPE
+	w.write(0, 16) // element instance tag, unused header bits
+	w.write(1, 1)  // sample count present
+	w.write(0, 2)  // no extra bits
+	w.write(1, 1)  // not compressed
+	w.write(uint32(len(pcm)), 32)
+	for _, frame := range pcm {
+		w.write(uint32(uint16(frame[0])), 16)
+		w.write(uint32(uint16(frame[1])), 16)
+	}
+	w.write(7, 3) // end
+	return w.bytes()
+}
+
+func alacSampleEntry() []byte {
+	header := cat(make([]byte, 6), []byte{0, 1}, make([]byte, 8),
+		[]byte{0, testChannels, 0, 16}, make([]byte, 4), u32s(testRate<<16))
+	config := cat(u32s(0, testFrameLen), []byte{0, 16, 40, 10, 14, testChannels, 0, 255},
+		u32s(0, 0, testRate))
+	return box("alac", cat(header, box("alac", config)))
+}
+
+func mvhd(duration uint32) []byte {
+	return cat(u32s(0, 0, 0, testRate, duration, 0x00010000), []byte{1, 0}, make([]byte, 10),
+		identity(), make([]byte, 24), u32s(2))
+}
+
+func identity() []byte {
+	return u32s(0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000)
+}
+
+func box(typ string, body []byte) []byte {
+	return cat(u32s(uint32(8+len(body))), []byte(typ), body)
+}
+
+func u32s(values ...uint32) []byte {
+	var b []byte
+	for _, v := range values {
+		b = binary.BigEndian.AppendUint32(b, v)
+	}
+	return b
+}
+
+func cat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+type bitWriter struct {
+	buf   []byte
+	nbits int
+}
+
+func (w *bitWriter) write(v uint32, n int) {
+	for i := n - 1; i >= 0; i-- {
+		if w.nbits%8 == 0 {
+			w.buf = append(w.buf, 0)
+		}
+		if v>>uint(i)&1 != 0 {
+			w.buf[len(w.buf)-1] |= 0x80 >> uint(w.nbits%8)
+		}
+		w.nbits++
+	}
+}
+
+func (w *bitWriter) bytes() []byte { return w.buf }
@@ -0,0 +1,77 @@
+package albumimage
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// cueFramesPerSecond is the CD frame rate CUE times count in.
+const cueFramesPerSecond = 75
+
+// writeCue writes the CUE sheet of an image whose tracks start at the given
+// sample offsets. INDEX times are rounded down to CD frames, so tracks of
+// non CD rates start up to 1/75 s early.
+func writeCue(w io.Writer, disc Disc, file string, starts []int64, sampleRate int) error {
+	var b strings.Builder
+	if disc.Genre != "" {
+		fmt.Fprintf(&b, "REM GENRE %s\n", cueString(disc.Genre))
+	}
+	if len(disc.Date) >= 4 {
+		fmt.Fprintf(&b, "REM DATE %s\n", disc.Date[:4])
+	}
+	if disc.Total > 1 {
+		fmt.Fprintf(&b, "REM DISCNUMBER %d\nREM TOTALDISCS %d\n", disc.Number, disc.Total)
+	}
+	if catalog := cueCatalog(disc.Catalog); catalog != "" {
+		fmt.Fprintf(&b, "CATALOG %s\n", catalog)
+	}
+	fmt.Fprintf(&b, "PERFORMER %s\n", cueString(disc.Performer))
+	fmt.Fprintf(&b, "TITLE %s\n", cueString(disc.Title))
+	fmt.Fprintf(&b, "FILE %s WAVE\n", cueString(file))
+	for i, t := range disc.Tracks {
+		fmt.Fprintf(&b, "  TRACK %02d AUDIO\n", i+1)
+		fmt.Fprintf(&b, "    TITLE %s\n", cueString(t.Title))
+		fmt.Fprintf(&b, "    PERFORMER %s\n", cueString(t.Performer))
+		if t.Songwriter != "" {
+			fmt.Fprintf(&b, "    SONGWRITER %s\n", cueString(t.Songwriter))
+		}
+		if len(t.ISRC) == 12 {
+			fmt.Fprintf(&b, "    ISRC %s\n", strings.ToUpper(t.ISRC))
+		}
+		fmt.Fprintf(&b, "    INDEX 01 %s\n", cueTime(starts[i], sampleRate))
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// cueTime formats a sample offset as mm:ss:ff.
+func cueTime(sample int64, sampleRate int) string {
+	frames := sample * cueFramesPerSecond / int64(sampleRate)
+	return fmt.Sprintf("%02d:%02d:%02d",
+		frames/(60*cueFramesPerSecond), frames/cueFramesPerSecond%60, frames%cueFramesPerSecond)
+}
+
+// cueString quotes a value. CUE has no escapes, so double quotes become
+// single ones.
+func cueString(s string) string {
+	s = strings.NewReplacer("\"", "'", "\r", " ", "\n", " ").Replace(s)
+	return "\"" + s + "\""
+}
+
+// cueCatalog returns the 13 digit EAN of a UPC, or an empty string when the
+// code cannot be one. A 12 digit UPC-A is an EAN-13 with a leading zero.
+func cueCatalog(upc string) string {
+	for _, c := range upc {
+		if c < '0' || c > '9' {
+			return ""
+		}
+	}
+	switch len(upc) {
+	case 12:
+		return "0" + upc
+	case 13:
+		return upc
+	}
+	return ""
+}
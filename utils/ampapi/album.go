@@ -171,6 +171,54 @@ func GetAlbumRespByHref(href string, language string, token string) (*AlbumResp,
 	return obj, nil
 }
 
+// GetAlbumsResp returns several albums with their tracks, fetched 50 IDs
+// at a time. Only the first page of tracks of each album is included.
+func GetAlbumsResp(storefront string, ids []string, language string, token string) ([]AlbumRespData, error) {
+	var err error
+	if token == "" {
+		token, err = GetToken()
+		if err != nil {
+			return nil, err
+		}
+	}
+	var albums []AlbumRespData
+	for start := 0; start < len(ids); start += 50 {
+		query := url.Values{}
+		query.Set("ids", strings.Join(ids[start:min(start+50, len(ids))], ","))
+		query.Set("include", "tracks")
+		query.Set("l", language)
+		obj := new(AlbumResp)
+		if err := getAmp(fmt.Sprintf("/v1/catalog/%s/albums", storefront), query, token, "", obj); err != nil {
+			return nil, err
+		}
+		albums = append(albums, obj.Data...)
+	}
+	return albums, nil
+}
+
+// GetOtherVersions lists the other editions Apple Music links to an album,
+// such as its clean or explicit counterpart.
+func GetOtherVersions(storefront string, id string, language string, token string) ([]AlbumRespData, error) {
+	var err error
+	if token == "" {
+		token, err = GetToken()
+		if err != nil {
+			return nil, err
+		}
+	}
+	var albums []AlbumRespData
+	path := fmt.Sprintf("/v1/catalog/%s/albums/%s/view/other-versions", storefront, id)
+	for path != "" {
+		obj := new(AlbumResp)
+		if err := getAmp(path, url.Values{"l": {language}}, token, "", obj); err != nil {
+			return nil, err
+		}
+		albums = append(albums, obj.Data...)
+		path = obj.Next
+	}
+	return albums, nil
+}
+
 type AlbumResp struct {
 	Href string          `json:"href"`
 	Next string          `json:"next"`
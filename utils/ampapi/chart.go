@@ -0,0 +1,137 @@
+package ampapi
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Chart is one top list of a storefront.
+type Chart struct {
+	Name  string // e.g. "Top Albums"
+	Items []ChartItem
+}
+
+// ChartItem is a song, album, music video or playlist of a chart, in chart
+// order.
+type ChartItem struct {
+	ID          string
+	Type        string // "songs", "albums", "music-videos" or "playlists"
+	Name        string
+	ArtistName  string // artist, or curator for playlists
+	ReleaseDate string
+	URL         string
+}
+
+// Genre is a catalog genre charts can be narrowed to.
+type Genre struct {
+	ID       string
+	Name     string
+	ParentID string
+}
+
+type chartList struct {
+	Name string         `json:"name"`
+	Next string         `json:"next"`
+	Data []pageResource `json:"data"`
+}
+
+// GetChart returns the first limit entries of the chart of one type
+// ("songs", "albums", "music-videos" or "playlists") in a storefront,
+// optionally for a genre ID.
+func GetChart(storefront string, chartType string, genre string, limit int, language string, token string) (*Chart, error) {
+	var err error
+	if token == "" {
+		token, err = GetToken()
+		if err != nil {
+			return nil, err
+		}
+	}
+	query := url.Values{}
+	query.Set("types", chartType)
+	query.Set("limit", fmt.Sprint(min(limit, 50)))
+	if genre != "" {
+		query.Set("genre", genre)
+	}
+	query.Set("l", language)
+	path := fmt.Sprintf("/v1/catalog/%s/charts", storefront)
+	chart := &Chart{}
+	for len(chart.Items) < limit && path != "" {
+		obj := new(struct {
+			Results map[string][]chartList `json:"results"`
+		})
+		if err := getAmp(path, query, token, "", obj); err != nil {
+			return nil, err
+		}
+		lists := obj.Results[chartType]
+		if len(lists) == 0 {
+			break
+		}
+		chart.Name = lists[0].Name
+		for _, r := range lists[0].Data {
+			if len(chart.Items) == limit {
+				break
+			}
+			artist := r.Attributes.ArtistName
+			if artist == "" {
+				artist = r.Attributes.CuratorName
+			}
+			chart.Items = append(chart.Items, ChartItem{
+				ID:          r.ID,
+				Type:        r.Type,
+				Name:        r.Attributes.Name,
+				ArtistName:  artist,
+				ReleaseDate: r.Attributes.ReleaseDate,
+				URL:         r.Attributes.URL,
+			})
+		}
+		path = lists[0].Next
+	}
+	if len(chart.Items) == 0 {
+		return nil, errors.New("empty chart")
+	}
+	return chart, nil
+}
+
+// GetGenres lists the genres of a storefront.
+func GetGenres(storefront string, language string, token string) ([]Genre, error) {
+	var err error
+	if token == "" {
+		token, err = GetToken()
+		if err != nil {
+			return nil, err
+		}
+	}
+	query := url.Values{}
+	query.Set("limit", "200")
+	query.Set("l", language)
+	obj := new(struct {
+		Data []struct {
+			ID         string `json:"id"`
+			Attributes struct {
+				Name     string `json:"name"`
+				ParentID string `json:"parentId"`
+			} `json:"attributes"`
+		} `json:"data"`
+	})
+	if err := getAmp(fmt.Sprintf("/v1/catalog/%s/genres", storefront), query, token, "", obj); err != nil {
+		return nil, err
+	}
+	genres := make([]Genre, 0, len(obj.Data))
+	for _, g := range obj.Data {
+		genres = append(genres, Genre{ID: g.ID, Name: g.Attributes.Name, ParentID: g.Attributes.ParentID})
+	}
+	return genres, nil
+}
+
+// FindGenre returns the ID of a genre given by ID or by name, ignoring
+// case.
+func FindGenre(genres []Genre, genre string) (string, bool) {
+	for _, g := range genres {
+		if g.ID == genre || strings.EqualFold(g.Name, genre) {
+			return g.ID, true
+		}
+	}
+	return "", false
+}
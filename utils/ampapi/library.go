@@ -0,0 +1,201 @@
+package ampapi
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// FavoriteSongsName is the English name of the playlist Apple Music keeps
+// the songs marked as favorite in. The name is localized; see
+// FindFavoriteSongs.
+const FavoriteSongsName = "Favorite Songs"
+
+// LibraryItem is an album, playlist or song of the user's library, with
+// the catalog ID it corresponds to when there is one.
+type LibraryItem struct {
+	ID         string // library ID (l., p. or i.), or catalog ID for catalog items
+	Type       string // e.g. "library-albums", "library-playlists", "albums"
+	Name       string
+	ArtistName string
+	DateAdded  string
+	TrackCount int
+	ArtworkURL string
+	CatalogID  string // empty for uploads and personal playlists
+	System     bool   // a playlist the user can't delete, such as Favorite Songs
+}
+
+type libraryResource struct {
+	ID         string `json:"id"`
+	Type       string `json:"type"`
+	Attributes struct {
+		Name        string `json:"name"`
+		ArtistName  string `json:"artistName"`
+		CuratorName string `json:"curatorName"`
+		DateAdded   string `json:"dateAdded"`
+		TrackCount  int    `json:"trackCount"`
+		CanDelete   *bool  `json:"canDelete"`
+		Artwork     struct {
+			URL string `json:"url"`
+		} `json:"artwork"`
+		PlayParams struct {
+			ID        string `json:"id"`
+			Kind      string `json:"kind"`
+			IsLibrary bool   `json:"isLibrary"`
+			CatalogID string `json:"catalogId"`
+			GlobalID  string `json:"globalId"`
+		} `json:"playParams"`
+	} `json:"attributes"`
+	Relationships struct {
+		Catalog struct {
+			Data []struct {
+				ID string `json:"id"`
+			} `json:"data"`
+		} `json:"catalog"`
+	} `json:"relationships"`
+}
+
+type libraryResp struct {
+	Next string            `json:"next"`
+	Data []libraryResource `json:"data"`
+}
+
+func (r libraryResource) item() LibraryItem {
+	item := LibraryItem{
+		ID:         r.ID,
+		Type:       r.Type,
+		Name:       r.Attributes.Name,
+		ArtistName: r.Attributes.ArtistName,
+		DateAdded:  r.Attributes.DateAdded,
+		TrackCount: r.Attributes.TrackCount,
+		ArtworkURL: r.Attributes.Artwork.URL,
+		System:     r.Attributes.CanDelete != nil && !*r.Attributes.CanDelete,
+	}
+	if item.ArtistName == "" {
+		item.ArtistName = r.Attributes.CuratorName
+	}
+	switch {
+	case !strings.HasPrefix(r.Type, "library-"):
+		item.CatalogID = r.ID
+	case len(r.Relationships.Catalog.Data) > 0:
+		item.CatalogID = r.Relationships.Catalog.Data[0].ID
+	case r.Attributes.PlayParams.CatalogID != "":
+		item.CatalogID = r.Attributes.PlayParams.CatalogID
+	case r.Attributes.PlayParams.GlobalID != "":
+		// Shared personal playlists have a catalog twin
+		item.CatalogID = r.Attributes.PlayParams.GlobalID
+	}
+	return item
+}
+
+// GetLibraryAlbums lists the albums of the user's library.
+func GetLibraryAlbums(mediaUserToken string, language string, token string) ([]LibraryItem, error) {
+	return getLibraryList("/v1/me/library/albums", 100, mediaUserToken, language, token)
+}
+
+// GetLibraryPlaylists lists the playlists of the user's library, both
+// added catalog playlists and personal ones.
+func GetLibraryPlaylists(mediaUserToken string, language string, token string) ([]LibraryItem, error) {
+	return getLibraryList("/v1/me/library/playlists", 100, mediaUserToken, language, token)
+}
+
+// FindFavoriteSongs returns the Favorite Songs playlist among the
+// playlists of a library. It is the personal playlist the user can't
+// delete; its name is only used to choose when there are several such
+// playlists, or when the API doesn't tell.
+func FindFavoriteSongs(playlists []LibraryItem) (LibraryItem, bool) {
+	var system []LibraryItem
+	for _, p := range playlists {
+		if p.System && p.CatalogID == "" {
+			system = append(system, p)
+		}
+	}
+	if len(system) == 1 {
+		return system[0], true
+	}
+	candidates := system
+	if len(candidates) == 0 {
+		candidates = playlists
+	}
+	for _, p := range candidates {
+		if p.Name == FavoriteSongsName {
+			return p, true
+		}
+	}
+	if len(system) > 0 {
+		return system[0], true
+	}
+	return LibraryItem{}, false
+}
+
+// GetLibraryPlaylistTracks lists the songs of a library playlist.
+func GetLibraryPlaylistTracks(id string, mediaUserToken string, language string, token string) ([]LibraryItem, error) {
+	return getLibraryList(fmt.Sprintf("/v1/me/library/playlists/%s/tracks", id), 100, mediaUserToken, language, token)
+}
+
+// GetRecentlyAdded lists what was added to the library last, newest first.
+func GetRecentlyAdded(mediaUserToken string, language string, token string) ([]LibraryItem, error) {
+	return getLibraryList("/v1/me/library/recently-added", 25, mediaUserToken, language, token)
+}
+
+// GetLibraryAlbum returns one album of the user's library.
+func GetLibraryAlbum(id string, mediaUserToken string, language string, token string) (*LibraryItem, error) {
+	return getLibraryItem("/v1/me/library/albums/"+id, mediaUserToken, language, token)
+}
+
+// GetLibraryPlaylist returns one playlist of the user's library.
+func GetLibraryPlaylist(id string, mediaUserToken string, language string, token string) (*LibraryItem, error) {
+	return getLibraryItem("/v1/me/library/playlists/"+id, mediaUserToken, language, token)
+}
+
+func getLibraryItem(path string, mediaUserToken string, language string, token string) (*LibraryItem, error) {
+	items, err := getLibraryPage(path, url.Values{}, mediaUserToken, language, token)
+	if err != nil {
+		return nil, err
+	}
+	if len(items.Data) == 0 {
+		return nil, errors.New("not found in library")
+	}
+	item := items.Data[0].item()
+	return &item, nil
+}
+
+// getLibraryList fetches every page of a library listing.
+func getLibraryList(path string, limit int, mediaUserToken string, language string, token string) ([]LibraryItem, error) {
+	query := url.Values{}
+	query.Set("limit", fmt.Sprint(limit))
+	var items []LibraryItem
+	for path != "" {
+		page, err := getLibraryPage(path, query, mediaUserToken, language, token)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range page.Data {
+			items = append(items, r.item())
+		}
+		// next carries the offset; the limit is sent again
+		path = page.Next
+	}
+	return items, nil
+}
+
+func getLibraryPage(path string, query url.Values, mediaUserToken string, language string, token string) (*libraryResp, error) {
+	var err error
+	if token == "" {
+		token, err = GetToken()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if mediaUserToken == "" {
+		return nil, errors.New("the library needs a media-user-token")
+	}
+	query.Set("include", "catalog")
+	query.Set("l", language)
+	obj := new(libraryResp)
+	if err := getAmp(path, query, token, mediaUserToken, obj); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
@@ -0,0 +1,198 @@
+package ampapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+)
+
+// Page is a curator, record label or editorial room page, flattened to the
+// albums and playlists it lists.
+type Page struct {
+	Name  string
+	Items []PageItem
+}
+
+// PageItem is an album or playlist listed on a page.
+type PageItem struct {
+	ID          string
+	Type        string // "albums" or "playlists"
+	Name        string
+	ArtistName  string // album artist or playlist curator
+	ReleaseDate string
+	URL         string
+}
+
+var errPageNotFound = errors.New("404 Not Found")
+
+type pageResource struct {
+	ID         string `json:"id"`
+	Type       string `json:"type"`
+	Href       string `json:"href"`
+	Attributes struct {
+		Name        string `json:"name"`
+		ArtistName  string `json:"artistName"`
+		CuratorName string `json:"curatorName"`
+		ReleaseDate string `json:"releaseDate"`
+		URL         string `json:"url"`
+	} `json:"attributes"`
+	Relationships map[string]pageList `json:"relationships"`
+	Views         map[string]pageList `json:"views"`
+}
+
+type pageList struct {
+	Next string         `json:"next"`
+	Data []pageResource `json:"data"`
+}
+
+// GetCuratorPage lists the playlists of a curator. Apple's own curators
+// are a resource type of their own and are tried when there is no curator
+// with the ID.
+func GetCuratorPage(storefront string, id string, language string, token string) (*Page, error) {
+	query := url.Values{}
+	query.Set("include", "playlists")
+	page, err := getPage(fmt.Sprintf("/v1/catalog/%s/curators/%s", storefront, id), query, language, token)
+	if errors.Is(err, errPageNotFound) {
+		return getPage(fmt.Sprintf("/v1/catalog/%s/apple-curators/%s", storefront, id), query, language, token)
+	}
+	return page, err
+}
+
+// GetRecordLabelPage lists the latest and top releases of a record label.
+func GetRecordLabelPage(storefront string, id string, language string, token string) (*Page, error) {
+	query := url.Values{}
+	query.Set("views", "latest-releases,top-releases")
+	return getPage(fmt.Sprintf("/v1/catalog/%s/record-labels/%s", storefront, id), query, language, token)
+}
+
+// GetRoomPage lists the contents of an editorial room.
+func GetRoomPage(storefront string, id string, language string, token string) (*Page, error) {
+	return getPage(fmt.Sprintf("/v1/editorial/%s/rooms/%s", storefront, id), url.Values{}, language, token)
+}
+
+// GetMultiRoomPage lists the contents of every room of an editorial
+// multi-room.
+func GetMultiRoomPage(storefront string, id string, language string, token string) (*Page, error) {
+	return getPage(fmt.Sprintf("/v1/editorial/%s/multirooms/%s", storefront, id), url.Values{}, language, token)
+}
+
+// getPage fetches a page resource and collects the albums and playlists of
+// all its relationships and views, following their next links. Rooms
+// listed on the page are expanded in turn.
+func getPage(path string, query url.Values, language string, token string) (*Page, error) {
+	var err error
+	if token == "" {
+		token, err = GetToken()
+		if err != nil {
+			return nil, err
+		}
+	}
+	query.Set("l", language)
+	obj := new(struct {
+		Data []pageResource `json:"data"`
+	})
+	if err := getAmp(path, query, token, "", obj); err != nil {
+		return nil, err
+	}
+	if len(obj.Data) == 0 {
+		return nil, errors.New("empty page")
+	}
+	res := obj.Data[0]
+	page := &Page{Name: res.Attributes.Name}
+	seen := map[string]bool{}
+
+	var lists []pageList
+	for _, m := range []map[string]pageList{res.Views, res.Relationships} {
+		names := make([]string, 0, len(m))
+		for name := range m {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			lists = append(lists, m[name])
+		}
+	}
+	for _, list := range lists {
+		for {
+			for _, item := range list.Data {
+				if seen[item.Type+item.ID] {
+					continue
+				}
+				seen[item.Type+item.ID] = true
+				switch item.Type {
+				case "albums", "playlists":
+					artist := item.Attributes.ArtistName
+					if artist == "" {
+						artist = item.Attributes.CuratorName
+					}
+					page.Items = append(page.Items, PageItem{
+						ID:          item.ID,
+						Type:        item.Type,
+						Name:        item.Attributes.Name,
+						ArtistName:  artist,
+						ReleaseDate: item.Attributes.ReleaseDate,
+						URL:         item.Attributes.URL,
+					})
+				case "rooms":
+					if item.Href == "" {
+						continue
+					}
+					room, err := getPage(item.Href, url.Values{}, language, token)
+					if err != nil {
+						return nil, err
+					}
+					for _, roomItem := range room.Items {
+						if !seen[roomItem.Type+roomItem.ID] {
+							seen[roomItem.Type+roomItem.ID] = true
+							page.Items = append(page.Items, roomItem)
+						}
+					}
+				}
+			}
+			if list.Next == "" {
+				break
+			}
+			next := pageList{}
+			if err := getAmp(list.Next, url.Values{"l": {language}}, token, "", &next); err != nil {
+				return nil, err
+			}
+			list = next
+		}
+	}
+	return page, nil
+}
+
+// getAmp decodes the response to an amp-api path. Query values are added
+// to any the path already has. The media-user-token is only sent when set.
+func getAmp(path string, query url.Values, token string, mediaUserToken string, obj any) error {
+	req, err := http.NewRequest("GET", "https://amp-api.music.apple.com"+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0.4472.124 Safari/537.36")
+	req.Header.Set("Origin", "https://music.apple.com")
+	if mediaUserToken != "" {
+		req.Header.Set("Media-User-Token", mediaUserToken)
+	}
+	values := req.URL.Query()
+	for key, v := range query {
+		values[key] = v
+	}
+	req.URL.RawQuery = values.Encode()
+	do, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer do.Body.Close()
+	if do.StatusCode == http.StatusNotFound {
+		return errPageNotFound
+	}
+	if do.StatusCode != http.StatusOK {
+		return errors.New(do.Status)
+	}
+	return json.NewDecoder(do.Body).Decode(obj)
+}
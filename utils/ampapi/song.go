@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"strings"
 )
 
 func GetSongResp(storefront string, id string, language string, token string) (*SongResp, error) {
@@ -51,6 +52,40 @@ func GetSongResp(storefront string, id string, language string, token string) (*
 	return obj, nil
 }
 
+// GetSongsResp returns several songs as playlist tracks, fetched 100 IDs at
+// a time, in the order of ids. IDs the catalog doesn't have are left out.
+func GetSongsResp(storefront string, ids []string, language string, token string) ([]TrackRespData, error) {
+	var err error
+	if token == "" {
+		token, err = GetToken()
+		if err != nil {
+			return nil, err
+		}
+	}
+	byID := map[string]TrackRespData{}
+	for start := 0; start < len(ids); start += 100 {
+		query := url.Values{}
+		query.Set("ids", strings.Join(ids[start:min(start+100, len(ids))], ","))
+		query.Set("include", "albums,artists")
+		query.Set("extend", "extendedAssetUrls")
+		query.Set("l", language)
+		obj := new(TrackResp)
+		if err := getAmp(fmt.Sprintf("/v1/catalog/%s/songs", storefront), query, token, "", obj); err != nil {
+			return nil, err
+		}
+		for _, song := range obj.Data {
+			byID[song.ID] = song
+		}
+	}
+	var songs []TrackRespData
+	for _, id := range ids {
+		if song, ok := byID[id]; ok {
+			songs = append(songs, song)
+		}
+	}
+	return songs, nil
+}
+
 type SongResp struct {
 	Href string         `json:"href"`
 	Next string         `json:"next"`
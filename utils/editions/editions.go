@@ -0,0 +1,252 @@
+// Package editions finds the editions of the same record in a discography
+// (standard, deluxe, explicit, clean, remastered, ...) and keeps one of each.
+package editions
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Edition is an album of a discography.
+type Edition struct {
+	ID            string
+	Name          string
+	ReleaseDate   string
+	ContentRating string // "explicit", "clean" or empty
+	TrackCount    int
+	DigitalMaster bool // Apple Digital Master
+	HiRes         bool // available as Hi-Res Lossless
+	UPC           string
+	ISRCs         []string // of its tracks, when known
+}
+
+// Skipped is an edition that lost to another one of the same record.
+type Skipped struct {
+	Edition Edition
+	Kept    Edition
+	Reason  string
+}
+
+// Criteria a policy may list, in order of importance.
+const (
+	PreferExplicit      = "explicit"
+	PreferClean         = "clean"
+	PreferMostTracks    = "most-tracks"
+	PreferDigitalMaster = "apple-digital-master"
+	PreferHiRes         = "hi-res"
+)
+
+// DefaultPolicy is used when no policy is configured.
+var DefaultPolicy = []string{PreferExplicit, PreferHiRes, PreferDigitalMaster, PreferMostTracks}
+
+// CheckPolicy reports the first criterion of a policy that is unknown.
+func CheckPolicy(policy []string) error {
+	for _, c := range policy {
+		switch c {
+		case PreferExplicit, PreferClean, PreferMostTracks, PreferDigitalMaster, PreferHiRes:
+		default:
+			return fmt.Errorf("unknown edition preference %q", c)
+		}
+	}
+	return nil
+}
+
+// editionWords mark the parts of a title that only name the edition.
+var editionWords = regexp.MustCompile(`(?i)\b(deluxe|expanded|remaster(ed)?|anniversary|edition|bonus|special|collector'?s|explicit|clean|super)\b`)
+
+var (
+	bracketed  = regexp.MustCompile(`\s*[(\[]([^)\]]*)[)\]]`)
+	dashSuffix = regexp.MustCompile(`\s+-\s+([^-]*)$`)
+	spaces     = regexp.MustCompile(`\s+`)
+)
+
+// NormalizeTitle strips the edition from an album title: bracketed parts
+// and " - " suffixes that name an edition, and the " - Single" and " - EP"
+// suffixes. "1989 (Deluxe Edition)" and "1989 - 2014 Remaster" both become
+// "1989"; "1989 (Taylor's Version)" stays a record of its own.
+func NormalizeTitle(name string) string {
+	name = strings.TrimSuffix(strings.TrimSuffix(name, " - Single"), " - EP")
+	name = bracketed.ReplaceAllStringFunc(name, func(part string) string {
+		if editionWords.MatchString(part) {
+			return ""
+		}
+		return part
+	})
+	if m := dashSuffix.FindStringSubmatch(name); m != nil && editionWords.MatchString(m[1]) {
+		name = name[:len(name)-len(m[0])]
+	}
+	return spaces.ReplaceAllString(strings.ToLower(strings.TrimSpace(name)), " ")
+}
+
+// sameUPCFamily reports whether two UPCs differ only in the last two
+// digits (item number and check digit), as consecutive releases of a label
+// do.
+func sameUPCFamily(a, b string) bool {
+	a, b = strings.TrimLeft(a, "0"), strings.TrimLeft(b, "0")
+	return len(a) > 2 && len(a) == len(b) && a[:len(a)-2] == b[:len(b)-2]
+}
+
+// closeYears reports whether two release dates are at most a year apart.
+// Unknown dates are not close.
+func closeYears(a, b string) bool {
+	ya, errA := strconv.Atoi(a[:min(4, len(a))])
+	yb, errB := strconv.Atoi(b[:min(4, len(b))])
+	return errA == nil && errB == nil && ya-yb <= 1 && yb-ya <= 1
+}
+
+// Dedupe groups the editions of the same record and keeps the best one of
+// each group by policy; ties keep the earlier edition of the list. Editions
+// are the same record when at least half of the track ISRCs of each are
+// shared. Equal normalized titles alone only make two editions candidates,
+// as different records share titles too; they are the same record when
+// they also share a track, their UPCs are of one family, or they were
+// released at most a year apart. Editions whose normalized titles only
+// contain one another need both a UPC family and close release years. Kept
+// editions keep their order.
+func Dedupe(eds []Edition, policy []string) ([]Edition, []Skipped, error) {
+	if err := CheckPolicy(policy); err != nil {
+		return nil, nil, err
+	}
+	if len(policy) == 0 {
+		policy = DefaultPolicy
+	}
+
+	parent := make([]int, len(eds))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	union := func(i, j int) {
+		if ri, rj := find(i), find(j); ri != rj {
+			parent[max(ri, rj)] = min(ri, rj)
+		}
+	}
+
+	titles := make([]string, len(eds))
+	for i, e := range eds {
+		titles[i] = NormalizeTitle(e.Name)
+	}
+	// shared[i][j] counts the ISRCs editions i > j have in common
+	shared := make([]map[int]int, len(eds))
+	owners := map[string][]int{}
+	tracks := make([]int, len(eds))
+	for i, e := range eds {
+		shared[i] = map[int]int{}
+		for j := 0; j < i; j++ {
+			family := sameUPCFamily(e.UPC, eds[j].UPC)
+			if titles[i] == titles[j] {
+				if family || closeYears(e.ReleaseDate, eds[j].ReleaseDate) {
+					union(i, j)
+				}
+			} else if family && closeYears(e.ReleaseDate, eds[j].ReleaseDate) && titles[i] != "" && titles[j] != "" &&
+				(strings.Contains(titles[i], titles[j]) || strings.Contains(titles[j], titles[i])) {
+				union(i, j)
+			}
+		}
+		isrcs := uniq(e.ISRCs)
+		tracks[i] = len(isrcs)
+		for _, isrc := range isrcs {
+			for _, j := range owners[isrc] {
+				shared[i][j]++
+			}
+			owners[isrc] = append(owners[isrc], i)
+		}
+	}
+	// Sharing a track or two is what singles and best-ofs do; editions
+	// share at least half of the tracks of each, or a track and the title
+	for i := range eds {
+		for j, n := range shared[i] {
+			if (2*n >= tracks[i] && 2*n >= tracks[j]) || titles[i] == titles[j] {
+				union(i, j)
+			}
+		}
+	}
+
+	best := map[int]int{}
+	for i := range eds {
+		root := find(i)
+		if b, ok := best[root]; !ok || better(eds[i], eds[b], policy) != "" {
+			best[root] = i
+		}
+	}
+	var kept []Edition
+	var skipped []Skipped
+	for i, e := range eds {
+		b := best[find(i)]
+		if b == i {
+			kept = append(kept, e)
+			continue
+		}
+		reason := better(eds[b], e, policy)
+		if reason == "" {
+			reason = "same record, listed later"
+		}
+		skipped = append(skipped, Skipped{Edition: e, Kept: eds[b], Reason: reason})
+	}
+	return kept, skipped, nil
+}
+
+func uniq(values []string) []string {
+	seen := map[string]bool{}
+	var out []string
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// better returns why a beats b by the first criterion of the policy that
+// tells them apart, or an empty string when none does.
+func better(a, b Edition, policy []string) string {
+	for _, c := range policy {
+		switch c {
+		case PreferExplicit:
+			if a.ContentRating == "explicit" && b.ContentRating != "explicit" {
+				return "not explicit"
+			}
+			if b.ContentRating == "explicit" && a.ContentRating != "explicit" {
+				return ""
+			}
+		case PreferClean:
+			if a.ContentRating == "clean" && b.ContentRating != "clean" {
+				return "not clean"
+			}
+			if b.ContentRating == "clean" && a.ContentRating != "clean" {
+				return ""
+			}
+		case PreferMostTracks:
+			if a.TrackCount > b.TrackCount {
+				return fmt.Sprintf("fewer tracks (%d < %d)", b.TrackCount, a.TrackCount)
+			}
+			if b.TrackCount > a.TrackCount {
+				return ""
+			}
+		case PreferDigitalMaster:
+			if a.DigitalMaster && !b.DigitalMaster {
+				return "not an Apple Digital Master"
+			}
+			if b.DigitalMaster && !a.DigitalMaster {
+				return ""
+			}
+		case PreferHiRes:
+			if a.HiRes && !b.HiRes {
+				return "not Hi-Res"
+			}
+			if b.HiRes && !a.HiRes {
+				return ""
+			}
+		}
+	}
+	return ""
+}
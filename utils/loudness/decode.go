@@ -0,0 +1,218 @@
+package loudness
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os/exec"
+
+	"github.com/utopian-society/apple-music-downloader/utils/alacfix"
+)
+
+// ErrNoDecoder is returned by MeasureFile for files that are not ALAC when
+// no ffmpeg binary is available.
+var ErrNoDecoder = errors.New("ffmpeg is needed to decode this file")
+
+// MeasureFile decodes an audio file and measures it. ALAC is decoded
+// natively; anything else, AAC and E-AC-3 in practice, goes through ffmpeg
+// when ffmpegPath can be found.
+func MeasureFile(path, ffmpegPath string) (Result, error) {
+	dec, err := alacfix.Open(path)
+	if err == nil {
+		defer dec.Close()
+		return measureALAC(dec)
+	}
+	if !errors.Is(err, alacfix.ErrNoALAC) {
+		return Result{}, err
+	}
+	if ffmpegPath == "" {
+		return Result{}, ErrNoDecoder
+	}
+	if _, err := exec.LookPath(ffmpegPath); err != nil {
+		return Result{}, ErrNoDecoder
+	}
+	return measureFFmpeg(path, ffmpegPath)
+}
+
+func measureALAC(dec *alacfix.Decoder) (Result, error) {
+	format := dec.Format()
+	if format.SampleRate == 0 || format.BitDepth == 0 {
+		return Result{}, errors.New("ALAC config without sample rate or bit depth")
+	}
+	m := NewMeter(format.SampleRate, alacWeights(format.Channels))
+	scale := 1 / float64(int64(1)<<(format.BitDepth-1))
+	pcm := make([][]float64, format.Channels)
+	for {
+		packet, err := dec.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return Result{}, err
+		}
+		for c, samples := range packet {
+			pcm[c] = pcm[c][:0]
+			for _, s := range samples {
+				pcm[c] = append(pcm[c], float64(s)*scale)
+			}
+		}
+		m.Write(pcm)
+	}
+	return m.Result(), nil
+}
+
+// alacWeights returns the channel weights for the default ALAC channel
+// layouts, which put the centre first and the LFE last.
+func alacWeights(channels int) []float64 {
+	switch channels {
+	case 5: // C L R Ls Rs
+		return []float64{1, 1, 1, 1.41, 1.41}
+	case 6: // C L R Ls Rs LFE
+		return []float64{1, 1, 1, 1.41, 1.41, 0}
+	case 7: // C L R Ls Rs Cs LFE
+		return []float64{1, 1, 1, 1.41, 1.41, 1, 0}
+	case 8: // C Lc Rc L R Ls Rs LFE
+		return []float64{1, 1, 1, 1, 1, 1.41, 1.41, 0}
+	}
+	weights := make([]float64, channels)
+	for c := range weights {
+		weights[c] = 1
+	}
+	return weights
+}
+
+// measureFFmpeg has ffmpeg decode the first audio stream to 32 bit float
+// WAV on stdout and measures that.
+func measureFFmpeg(path, ffmpegPath string) (Result, error) {
+	cmd := exec.Command(ffmpegPath, "-v", "error", "-nostdin", "-i", path,
+		"-map", "0:a:0", "-c:a", "pcm_f32le", "-f", "wav", "-")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return Result{}, err
+	}
+	if err := cmd.Start(); err != nil {
+		return Result{}, err
+	}
+	res, err := measureWAV(bufio.NewReaderSize(stdout, 1<<16))
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return Result{}, err
+	}
+	if err := cmd.Wait(); err != nil {
+		return Result{}, fmt.Errorf("ffmpeg: %w", err)
+	}
+	return res, nil
+}
+
+// measureWAV reads a streamed 32 bit float WAV file. The data chunk size
+// is ignored, since ffmpeg cannot fill it in when writing to a pipe.
+func measureWAV(r io.Reader) (Result, error) {
+	var riff [12]byte
+	if _, err := io.ReadFull(r, riff[:]); err != nil {
+		return Result{}, err
+	}
+	if string(riff[0:4]) != "RIFF" || string(riff[8:12]) != "WAVE" {
+		return Result{}, errors.New("ffmpeg output is not WAV")
+	}
+	var (
+		channels, rate int
+		mask           uint32
+		hdr            [8]byte
+	)
+	for {
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return Result{}, errors.New("no data chunk in WAV")
+		}
+		size := int64(binary.LittleEndian.Uint32(hdr[4:]))
+		if string(hdr[0:4]) == "data" {
+			break
+		}
+		if string(hdr[0:4]) != "fmt " {
+			if _, err := io.CopyN(io.Discard, r, size+size&1); err != nil {
+				return Result{}, err
+			}
+			continue
+		}
+		fmtChunk := make([]byte, size+size&1)
+		if _, err := io.ReadFull(r, fmtChunk); err != nil || size < 16 {
+			return Result{}, errors.New("bad WAV fmt chunk")
+		}
+		channels = int(binary.LittleEndian.Uint16(fmtChunk[2:]))
+		rate = int(binary.LittleEndian.Uint32(fmtChunk[4:]))
+		if bits := binary.LittleEndian.Uint16(fmtChunk[14:]); bits != 32 {
+			return Result{}, fmt.Errorf("unexpected %d bit WAV samples", bits)
+		}
+		if size >= 24 {
+			mask = binary.LittleEndian.Uint32(fmtChunk[20:])
+		}
+	}
+	if channels == 0 || rate == 0 {
+		return Result{}, errors.New("WAV data before fmt chunk")
+	}
+
+	m := NewMeter(rate, maskWeights(channels, mask))
+	const frames = 4096
+	buf := make([]byte, frames*channels*4)
+	pcm := make([][]float64, channels)
+	for {
+		n, err := io.ReadFull(r, buf)
+		n -= n % (channels * 4)
+		for c := range pcm {
+			pcm[c] = pcm[c][:0]
+		}
+		for i := 0; i < n; i += 4 {
+			c := (i / 4) % channels
+			pcm[c] = append(pcm[c], float64(math.Float32frombits(binary.LittleEndian.Uint32(buf[i:]))))
+		}
+		m.Write(pcm)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return Result{}, err
+		}
+	}
+	return m.Result(), nil
+}
+
+// WAVE_FORMAT_EXTENSIBLE speaker positions with a BS.1770 weight other
+// than 1.
+const (
+	speakerLFE       = 0x8
+	speakerBackLeft  = 0x10
+	speakerBackRight = 0x20
+	speakerSideLeft  = 0x200
+	speakerSideRight = 0x400
+)
+
+// maskWeights maps a WAV channel mask to channel weights. Without a mask,
+// six channels are taken to be ffmpeg's 5.1 order: L R C LFE Ls Rs.
+func maskWeights(channels int, mask uint32) []float64 {
+	if mask == 0 && channels == 6 {
+		mask = 0x1 | 0x2 | 0x4 | speakerLFE | speakerSideLeft | speakerSideRight
+	}
+	weights := make([]float64, channels)
+	c := 0
+	for bit := uint32(1); bit != 0 && c < channels && mask != 0; bit <<= 1 {
+		if mask&bit == 0 {
+			continue
+		}
+		switch bit {
+		case speakerLFE:
+			weights[c] = 0
+		case speakerBackLeft, speakerBackRight, speakerSideLeft, speakerSideRight:
+			weights[c] = 1.41
+		default:
+			weights[c] = 1
+		}
+		c++
+	}
+	for ; c < channels; c++ {
+		weights[c] = 1
+	}
+	return weights
+}
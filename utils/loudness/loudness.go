@@ -0,0 +1,257 @@
+// Package loudness measures EBU R128 (ITU-R BS.1770-4) integrated loudness
+// and true peak, and turns the results into ReplayGain 2.0 and iTunes
+// Sound Check tags.
+package loudness
+
+import (
+	"math"
+)
+
+const (
+	// ReferenceLoudness is the ReplayGain 2.0 target level in LUFS.
+	ReferenceLoudness = -18.0
+
+	absoluteGate = -70.0 // LUFS
+	relativeGate = -10.0 // LU below the absolute-gated loudness
+)
+
+// Result is the loudness of a track or, from Album, of a set of tracks.
+type Result struct {
+	Loudness float64 // integrated loudness in LUFS, -Inf for silence
+	Peak     float64 // true peak, linear with 1.0 at full scale
+
+	blocks []float64 // mean square of every 400 ms gating block
+}
+
+// Gain is the ReplayGain 2.0 gain in dB.
+func (r Result) Gain() float64 {
+	return ReferenceLoudness - r.Loudness
+}
+
+// Album measures tracks as one programme: the gating runs over the blocks
+// of all tracks and the peak is the highest track peak.
+func Album(tracks []Result) Result {
+	var album Result
+	for _, t := range tracks {
+		album.blocks = append(album.blocks, t.blocks...)
+		album.Peak = math.Max(album.Peak, t.Peak)
+	}
+	album.Loudness = integrated(album.blocks)
+	return album
+}
+
+// Meter measures one track. Samples are written planar, one slice per
+// channel, scaled to [-1, 1].
+type Meter struct {
+	weights []float64
+	filters []kWeighting
+	peaks   []*truePeak
+
+	segLen  int        // samples per 100 ms step
+	segPos  int        // samples in the current step
+	segSum  float64    // weighted sum of squares of the current step
+	steps   [4]float64 // the last four steps, oldest first
+	nSteps  int
+	blocks  []float64
+	maxPeak float64
+}
+
+// NewMeter returns a meter for the given sample rate. weights holds one
+// BS.1770 channel weight per channel: 1 for front channels, 1.41 for
+// surrounds and 0 for LFE.
+func NewMeter(sampleRate int, weights []float64) *Meter {
+	m := &Meter{
+		weights: weights,
+		segLen:  int(math.Round(float64(sampleRate) / 10)),
+	}
+	for range weights {
+		m.filters = append(m.filters, newKWeighting(float64(sampleRate)))
+		m.peaks = append(m.peaks, newTruePeak(sampleRate))
+	}
+	return m
+}
+
+// Write adds samples to the measurement.
+func (m *Meter) Write(pcm [][]float64) {
+	if len(pcm) != len(m.weights) || len(pcm) == 0 {
+		return
+	}
+	n := len(pcm[0])
+	for i := 0; i < n; i++ {
+		var sum float64
+		for c, w := range m.weights {
+			x := pcm[c][i]
+			m.maxPeak = math.Max(m.maxPeak, m.peaks[c].push(x))
+			if w != 0 {
+				z := m.filters[c].process(x)
+				sum += w * z * z
+			}
+		}
+		m.segSum += sum
+		m.segPos++
+		if m.segPos == m.segLen {
+			m.endStep()
+		}
+	}
+}
+
+// endStep closes a 100 ms step; every step completes a 400 ms block that
+// overlaps the previous one by 75%.
+func (m *Meter) endStep() {
+	copy(m.steps[:], m.steps[1:])
+	m.steps[3] = m.segSum
+	m.segSum, m.segPos = 0, 0
+	if m.nSteps < 4 {
+		m.nSteps++
+	}
+	if m.nSteps == 4 {
+		sum := m.steps[0] + m.steps[1] + m.steps[2] + m.steps[3]
+		m.blocks = append(m.blocks, sum/float64(4*m.segLen))
+	}
+}
+
+// Result returns the loudness of everything written so far.
+func (m *Meter) Result() Result {
+	return Result{
+		Loudness: integrated(m.blocks),
+		Peak:     m.maxPeak,
+		blocks:   m.blocks,
+	}
+}
+
+// integrated applies the absolute and relative gates to the blocks.
+func integrated(blocks []float64) float64 {
+	gate := func(threshold float64) float64 {
+		var sum float64
+		var n int
+		for _, b := range blocks {
+			if b > threshold {
+				sum += b
+				n++
+			}
+		}
+		if n == 0 {
+			return 0
+		}
+		return sum / float64(n)
+	}
+	abs := energy(absoluteGate)
+	mean := gate(abs)
+	if mean == 0 {
+		return math.Inf(-1)
+	}
+	rel := mean * math.Pow(10, relativeGate/10)
+	return lufs(gate(math.Max(abs, rel)))
+}
+
+func energy(lufs float64) float64 {
+	return math.Pow(10, (lufs+0.691)/10)
+}
+
+func lufs(energy float64) float64 {
+	return -0.691 + 10*math.Log10(energy)
+}
+
+// kWeighting is the BS.1770 pre-filter: a high shelf followed by a high
+// pass, with coefficients derived for any sample rate.
+type kWeighting struct {
+	shelf, highPass biquad
+}
+
+func newKWeighting(rate float64) kWeighting {
+	var k kWeighting
+
+	f0, gain, q := 1681.974450955533, 3.999843853973347, 0.7071752369554196
+	kk := math.Tan(math.Pi * f0 / rate)
+	vh := math.Pow(10, gain/20)
+	vb := math.Pow(vh, 0.4996667741545416)
+	a0 := 1 + kk/q + kk*kk
+	k.shelf = biquad{
+		b0: (vh + vb*kk/q + kk*kk) / a0,
+		b1: 2 * (kk*kk - vh) / a0,
+		b2: (vh - vb*kk/q + kk*kk) / a0,
+		a1: 2 * (kk*kk - 1) / a0,
+		a2: (1 - kk/q + kk*kk) / a0,
+	}
+
+	f0, q = 38.13547087602444, 0.5003270373238773
+	kk = math.Tan(math.Pi * f0 / rate)
+	a0 = 1 + kk/q + kk*kk
+	k.highPass = biquad{
+		b0: 1, b1: -2, b2: 1,
+		a1: 2 * (kk*kk - 1) / a0,
+		a2: (1 - kk/q + kk*kk) / a0,
+	}
+	return k
+}
+
+func (k *kWeighting) process(x float64) float64 {
+	return k.highPass.process(k.shelf.process(x))
+}
+
+type biquad struct {
+	b0, b1, b2, a1, a2 float64
+	z1, z2             float64
+}
+
+// process runs one sample through the filter in transposed direct form II.
+func (f *biquad) process(x float64) float64 {
+	y := f.b0*x + f.z1
+	f.z1 = f.b1*x - f.a1*y + f.z2
+	f.z2 = f.b2*x - f.a2*y
+	return y
+}
+
+// truePeak estimates inter-sample peaks by oversampling with a windowed
+// sinc interpolator, 4x below 96 kHz and 2x below 192 kHz.
+type truePeak struct {
+	factor  int
+	phases  [][]float64 // phases[f][k] multiplies the input k samples back
+	history []float64   // newest first
+}
+
+const interpTaps = 49
+
+func newTruePeak(rate int) *truePeak {
+	factor := 1
+	switch {
+	case rate < 96000:
+		factor = 4
+	case rate < 192000:
+		factor = 2
+	}
+	t := &truePeak{
+		factor:  factor,
+		phases:  make([][]float64, factor),
+		history: make([]float64, (interpTaps+factor-1)/factor),
+	}
+	for j := 0; j < interpTaps; j++ {
+		m := float64(j) - float64(interpTaps-1)/2
+		c := 1.0
+		if math.Abs(m) > 1e-9 {
+			c = math.Sin(m*math.Pi/float64(factor)) / (m * math.Pi / float64(factor))
+		}
+		c *= 0.5 * (1 - math.Cos(2*math.Pi*float64(j)/float64(interpTaps-1))) // Hann window
+		t.phases[j%factor] = append(t.phases[j%factor], c)
+	}
+	return t
+}
+
+// push adds a sample and returns the highest absolute value among it and
+// the interpolated samples it produces.
+func (t *truePeak) push(x float64) float64 {
+	copy(t.history[1:], t.history)
+	t.history[0] = x
+	peak := math.Abs(x)
+	if t.factor == 1 {
+		return peak
+	}
+	for _, phase := range t.phases {
+		var y float64
+		for k, c := range phase {
+			y += c * t.history[k]
+		}
+		peak = math.Max(peak, math.Abs(y))
+	}
+	return peak
+}
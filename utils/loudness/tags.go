@@ -0,0 +1,43 @@
+package loudness
+
+import (
+	"fmt"
+	"math"
+)
+
+// Tags returns the ReplayGain 2.0 and iTunNORM freeform tags of a track,
+// keyed by tag name. Gains of silent tracks or albums are left out.
+func Tags(track, album Result) map[string]string {
+	tags := map[string]string{
+		"replaygain_reference_loudness": fmt.Sprintf("%.2f LUFS", ReferenceLoudness),
+	}
+	if !math.IsInf(track.Loudness, 0) {
+		tags["replaygain_track_gain"] = fmt.Sprintf("%.2f dB", track.Gain())
+		tags["replaygain_track_peak"] = fmt.Sprintf("%.6f", track.Peak)
+		tags["iTunNORM"] = SoundCheck(track.Gain(), track.Peak)
+	}
+	if !math.IsInf(album.Loudness, 0) {
+		tags["replaygain_album_gain"] = fmt.Sprintf("%.2f dB", album.Gain())
+		tags["replaygain_album_peak"] = fmt.Sprintf("%.6f", album.Peak)
+	}
+	return tags
+}
+
+// SoundCheck encodes a gain in dB and a linear peak as an iTunNORM value.
+// The format is ten hex words: the gain as a power ratio against 1000 and
+// 2500 units for each of two channels, two words nobody reads, the peak as
+// a 16 bit sample value for each channel and two more unused words.
+func SoundCheck(gain, peak float64) string {
+	ratio := math.Pow(10, -gain/10)
+	word := func(base float64) int {
+		v := int(math.Min(math.Round(ratio*base), 65534))
+		if v < 1 {
+			return 1
+		}
+		return v
+	}
+	g1, g2 := word(1000), word(2500)
+	p := int(math.Min(peak*32768, 0xFFFFFFFF))
+	return fmt.Sprintf(" %08X %08X %08X %08X %08X %08X %08X %08X %08X %08X",
+		g1, g1, g2, g2, 0, 0, p, p, 0, 0)
+}
@@ -0,0 +1,234 @@
+// Package manifest writes and checks per-album checksum manifests: the
+// SHA-256 of every file, in sha256sum format, and the MD5 of the decoded
+// audio of every lossless track, in the FLAC fingerprint (.ffp) format.
+// The audio MD5 survives retagging, so a file whose SHA-256 changed can be
+// told apart as a tag edit or as damaged audio.
+package manifest
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/utopian-society/apple-music-downloader/utils/alacfix"
+)
+
+// Manifest file names, written in the album folder
+const (
+	SHA256File = "manifest.sha256"
+	FFPFile    = "manifest.ffp"
+)
+
+// Entry is one file of a manifest. Path is relative to the album folder
+// and uses forward slashes.
+type Entry struct {
+	Path     string
+	SHA256   string
+	AudioMD5 string // empty for files without a decodable lossless stream
+}
+
+// Build hashes every file under dir, except the manifest files and the
+// folders that carry a manifest of their own.
+func Build(dir string) ([]Entry, error) {
+	files, err := listFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]Entry, 0, len(files))
+	for _, rel := range files {
+		path := filepath.Join(dir, filepath.FromSlash(rel))
+		sum, err := fileSHA256(path)
+		if err != nil {
+			return nil, err
+		}
+		md5, err := AudioMD5(path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", rel, err)
+		}
+		entries = append(entries, Entry{Path: rel, SHA256: sum, AudioMD5: md5})
+	}
+	return entries, nil
+}
+
+// Write builds the manifest of dir and writes both manifest files.
+func Write(dir string) error {
+	entries, err := Build(dir)
+	if err != nil {
+		return err
+	}
+	var sums, ffp strings.Builder
+	for _, e := range entries {
+		fmt.Fprintf(&sums, "%s  %s\n", e.SHA256, e.Path)
+		if e.AudioMD5 != "" {
+			fmt.Fprintf(&ffp, "%s:%s\n", e.Path, e.AudioMD5)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, SHA256File), []byte(sums.String()), 0644); err != nil {
+		return err
+	}
+	ffpPath := filepath.Join(dir, FFPFile)
+	if ffp.Len() == 0 {
+		if err := os.Remove(ffpPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	return os.WriteFile(ffpPath, []byte(ffp.String()), 0644)
+}
+
+// Read loads the manifest of dir.
+func Read(dir string) ([]Entry, error) {
+	var entries []Entry
+	index := map[string]int{}
+	err := readLines(filepath.Join(dir, SHA256File), func(line string) error {
+		sum, path, ok := strings.Cut(line, "  ")
+		if !ok {
+			// sha256sum marks binary mode with " *"
+			if sum, path, ok = strings.Cut(line, " *"); !ok {
+				return fmt.Errorf("bad line %q", line)
+			}
+		}
+		index[path] = len(entries)
+		entries = append(entries, Entry{Path: path, SHA256: strings.ToLower(sum)})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = readLines(filepath.Join(dir, FFPFile), func(line string) error {
+		i := strings.LastIndexByte(line, ':')
+		if i < 0 {
+			return fmt.Errorf("bad line %q", line)
+		}
+		if n, ok := index[line[:i]]; ok {
+			entries[n].AudioMD5 = strings.ToLower(line[i+1:])
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func readLines(path string, fn func(string) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimRight(sc.Text(), "\r")
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if err := fn(line); err != nil {
+			return fmt.Errorf("%s: %w", filepath.Base(path), err)
+		}
+	}
+	return sc.Err()
+}
+
+// listFiles returns the files belonging to the manifest of dir, sorted.
+func listFiles(dir string) ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path != dir && hasManifest(path) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel == SHA256File || rel == FFPFile {
+			return nil
+		}
+		files = append(files, rel)
+		return nil
+	})
+	sort.Strings(files)
+	return files, err
+}
+
+func hasManifest(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, SHA256File))
+	return err == nil
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// AudioMD5 returns the FLAC style MD5 of the decoded audio of a file: it is
+// computed by decoding ALAC, over the frames the edit list plays, and read
+// from the STREAMINFO block of FLAC files. The two agree for a FLAC
+// conversion of an ALAC track. Other files return an empty string.
+func AudioMD5(path string) (string, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".m4a", ".mp4":
+		report, err := alacfix.Verify(path)
+		if errors.Is(err, alacfix.ErrNoALAC) {
+			return "", nil
+		}
+		if err != nil {
+			return "", err
+		}
+		return report.MD5, nil
+	case ".flac":
+		return flacMD5(path)
+	}
+	return "", nil
+}
+
+// flacMD5 reads the MD5 signature of the STREAMINFO block, which is always
+// the first metadata block. An encoder that did not compute it leaves it
+// zero.
+func flacMD5(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	var hdr [42]byte
+	if _, err := io.ReadFull(f, hdr[:]); err != nil {
+		return "", nil
+	}
+	if string(hdr[0:4]) != "fLaC" || hdr[4]&0x7F != 0 {
+		return "", nil
+	}
+	sum := hdr[26:42]
+	for _, b := range sum {
+		if b != 0 {
+			return hex.EncodeToString(sum), nil
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,96 @@
+package manifest
+
+import (
+	"io/fs"
+	"path/filepath"
+)
+
+// File states reported by Verify
+const (
+	StatusOK           = "ok"
+	StatusMissing      = "missing"
+	StatusExtra        = "extra"         // not in the manifest
+	StatusTagsChanged  = "tags-changed"  // file changed, decoded audio did not
+	StatusAudioChanged = "audio-changed" // decoded audio changed
+	StatusChanged      = "changed"       // file changed, no audio MD5 to tell why
+)
+
+// Result is the state of one file.
+type Result struct {
+	Dir    string `json:"dir"`  // album folder holding the manifest
+	Path   string `json:"path"` // relative to Dir
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Verify re-hashes the files of the manifest in dir. The audio of a file is
+// only decoded again when its SHA-256 no longer matches.
+func Verify(dir string) ([]Result, error) {
+	entries, err := Read(dir)
+	if err != nil {
+		return nil, err
+	}
+	files, err := listFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	present := make(map[string]bool, len(files))
+	for _, f := range files {
+		present[f] = true
+	}
+
+	var results []Result
+	listed := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		listed[e.Path] = true
+		res := Result{Dir: dir, Path: e.Path, Status: StatusOK}
+		path := filepath.Join(dir, filepath.FromSlash(e.Path))
+		switch sum, err := fileSHA256(path); {
+		case !present[e.Path]:
+			res.Status = StatusMissing
+		case err != nil:
+			res.Status, res.Error = StatusChanged, err.Error()
+		case sum != e.SHA256:
+			res.Status = StatusChanged
+			if e.AudioMD5 == "" {
+				break
+			}
+			md5, err := AudioMD5(path)
+			switch {
+			case err != nil:
+				res.Status, res.Error = StatusAudioChanged, err.Error()
+			case md5 == e.AudioMD5:
+				res.Status = StatusTagsChanged
+			default:
+				res.Status = StatusAudioChanged
+			}
+		}
+		results = append(results, res)
+	}
+	for _, f := range files {
+		if !listed[f] {
+			results = append(results, Result{Dir: dir, Path: f, Status: StatusExtra})
+		}
+	}
+	return results, nil
+}
+
+// VerifyTree verifies every manifest found under root.
+func VerifyTree(root string) ([]Result, error) {
+	var results []Result
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() || !hasManifest(path) {
+			return nil
+		}
+		res, err := Verify(path)
+		if err != nil {
+			return err
+		}
+		results = append(results, res...)
+		return nil
+	})
+	return results, err
+}
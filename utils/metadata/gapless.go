@@ -0,0 +1,327 @@
+package metadata
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Gapless is the priming and padding of the audio track of an MP4, in
+// samples of its media timescale.
+type Gapless struct {
+	Delay     int64 // priming samples before the audio
+	Padding   int64 // padding samples after it
+	Frames    int64 // samples of audio in between
+	Timescale int64 // media timescale, set by ReadGapless
+}
+
+// ITunSMPB formats g the way iTunes writes it.
+func (g Gapless) ITunSMPB() string {
+	return fmt.Sprintf(" 00000000 %08X %08X %016X 00000000 00000000 00000000 00000000 00000000 00000000 00000000 00000000",
+		g.Delay, g.Padding, g.Frames)
+}
+
+// parseITunSMPB reads the delay, padding and length fields of an iTunSMPB
+// tag.
+func parseITunSMPB(s string) (Gapless, bool) {
+	fields := strings.Fields(s)
+	if len(fields) < 4 {
+		return Gapless{}, false
+	}
+	var v [3]int64
+	for i := range v {
+		n, err := strconv.ParseInt(fields[i+1], 16, 64)
+		if err != nil {
+			return Gapless{}, false
+		}
+		v[i] = n
+	}
+	return Gapless{Delay: v[0], Padding: v[1], Frames: v[2]}, true
+}
+
+// audioTrak holds the boxes of the first sound track of a moov box.
+type audioTrak struct {
+	trak, tkhd, mdhd, stts rawBox
+	edts, elst             rawBox // zero when absent
+	mvhd                   rawBox
+	traks                  int
+}
+
+func findAudioTrak(moov []byte) (audioTrak, error) {
+	var t audioTrak
+	boxes, err := rawBoxes(moov, 8, len(moov))
+	if err != nil {
+		return t, err
+	}
+	found := false
+	for _, box := range boxes {
+		switch box.typ {
+		case "mvhd":
+			t.mvhd = box
+		case "trak":
+			t.traks++
+			if found {
+				continue
+			}
+			mdia, ok := findRawBox(moov, box.body, box.end, "mdia")
+			if !ok {
+				continue
+			}
+			hdlr, ok := findRawBox(moov, mdia.body, mdia.end, "hdlr")
+			if !ok || hdlr.body+12 > hdlr.end || string(moov[hdlr.body+8:hdlr.body+12]) != "soun" {
+				continue
+			}
+			t.trak = box
+			t.tkhd, _ = findRawBox(moov, box.body, box.end, "tkhd")
+			t.mdhd, _ = findRawBox(moov, mdia.body, mdia.end, "mdhd")
+			if minf, ok := findRawBox(moov, mdia.body, mdia.end, "minf"); ok {
+				if stbl, ok := findRawBox(moov, minf.body, minf.end, "stbl"); ok {
+					t.stts, _ = findRawBox(moov, stbl.body, stbl.end, "stts")
+				}
+			}
+			if edts, ok := findRawBox(moov, box.body, box.end, "edts"); ok {
+				t.edts = edts
+				t.elst, _ = findRawBox(moov, edts.body, edts.end, "elst")
+			}
+			found = true
+		}
+	}
+	switch {
+	case !found:
+		return t, errors.New("no audio track")
+	case t.mvhd.typ == "" || t.tkhd.typ == "" || t.mdhd.typ == "" || t.stts.typ == "":
+		return t, errors.New("incomplete audio track")
+	}
+	return t, nil
+}
+
+// headerTimescale reads the timescale of an mvhd or mdhd box, and the
+// offset of its duration field.
+func headerTimescale(moov []byte, box rawBox) (timescale int64, durationAt int, err error) {
+	if box.body < box.end && moov[box.body] == 1 {
+		if box.body+32 > box.end {
+			return 0, 0, fmt.Errorf("truncated %s box", box.typ)
+		}
+		return int64(binary.BigEndian.Uint32(moov[box.body+20:])), box.body + 24, nil
+	}
+	if box.body+20 > box.end {
+		return 0, 0, fmt.Errorf("truncated %s box", box.typ)
+	}
+	return int64(binary.BigEndian.Uint32(moov[box.body+12:])), box.body + 16, nil
+}
+
+func sttsSamples(moov []byte, stts rawBox) (int64, error) {
+	if stts.body+8 > stts.end {
+		return 0, errors.New("truncated stts box")
+	}
+	count := int(binary.BigEndian.Uint32(moov[stts.body+4:]))
+	if stts.body+8+count*8 > stts.end {
+		return 0, errors.New("truncated stts box")
+	}
+	var total int64
+	for i := 0; i < count; i++ {
+		p := moov[stts.body+8+i*8:]
+		total += int64(binary.BigEndian.Uint32(p)) * int64(binary.BigEndian.Uint32(p[4:]))
+	}
+	return total, nil
+}
+
+// firstEdit returns the first edit of an elst box that is not empty.
+func firstEdit(moov []byte, elst rawBox) (duration, mediaTime int64, ok bool) {
+	if elst.body+8 > elst.end {
+		return 0, 0, false
+	}
+	v1 := moov[elst.body] == 1
+	count := int(binary.BigEndian.Uint32(moov[elst.body+4:]))
+	pos := elst.body + 8
+	for i := 0; i < count; i++ {
+		if v1 {
+			if pos+20 > elst.end {
+				return 0, 0, false
+			}
+			duration = int64(binary.BigEndian.Uint64(moov[pos:]))
+			mediaTime = int64(binary.BigEndian.Uint64(moov[pos+8:]))
+			pos += 20
+		} else {
+			if pos+12 > elst.end {
+				return 0, 0, false
+			}
+			duration = int64(binary.BigEndian.Uint32(moov[pos:]))
+			mediaTime = int64(int32(binary.BigEndian.Uint32(moov[pos+4:])))
+			pos += 12
+		}
+		if mediaTime >= 0 {
+			return duration, mediaTime, true
+		}
+	}
+	return 0, 0, false
+}
+
+// ReadGapless returns the gapless information of an MP4 file, from the
+// edit list of its audio track or else from an iTunSMPB tag. Files with
+// neither have no priming or padding.
+func ReadGapless(path string) (Gapless, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Gapless{}, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return Gapless{}, err
+	}
+	_, moov, err := readMoov(f, info.Size())
+	if err != nil {
+		return Gapless{}, err
+	}
+	t, err := findAudioTrak(moov)
+	if err != nil {
+		return Gapless{}, err
+	}
+	total, err := sttsSamples(moov, t.stts)
+	if err != nil {
+		return Gapless{}, err
+	}
+	mediaScale, _, err := headerTimescale(moov, t.mdhd)
+	if err != nil {
+		return Gapless{}, err
+	}
+	g := Gapless{Frames: total, Timescale: mediaScale}
+
+	if duration, mediaTime, ok := firstEdit(moov, t.elst); ok {
+		movieScale, _, err := headerTimescale(moov, t.mvhd)
+		if err != nil {
+			return Gapless{}, err
+		}
+		g.Delay = min(mediaTime, total)
+		g.Frames = total - g.Delay
+		// A zero duration, as in fragmented files, runs to the end
+		if duration > 0 && movieScale > 0 {
+			g.Frames = min(g.Frames, (duration*mediaScale+movieScale/2)/movieScale)
+		}
+		g.Padding = total - g.Delay - g.Frames
+		return g, nil
+	}
+	if chain, err := ilstChain(moov); err == nil {
+		ilst := chain[len(chain)-1]
+		items, _ := rawBoxes(moov, ilst.body, ilst.end)
+		for _, item := range items {
+			if ilstKey(moov, item) != "----:itunsmpb" {
+				continue
+			}
+			data, ok := findRawBox(moov, item.body, item.end, "data")
+			if !ok || data.body+8 > data.end {
+				continue
+			}
+			if smpb, ok := parseITunSMPB(string(moov[data.body+8 : data.end])); ok && smpb.Delay+smpb.Frames <= total {
+				smpb.Padding = total - smpb.Delay - smpb.Frames
+				smpb.Timescale = mediaScale
+				return smpb, nil
+			}
+		}
+	}
+	return g, nil
+}
+
+// WriteGapless writes an edit list for g into the audio track of an MP4
+// file, replacing any other; the padding is whatever the delay and frames
+// leave of the track. It also sets the track and movie durations to match
+// and, when the file has an ilst box, tags it with iTunSMPB for players
+// that read that instead.
+func WriteGapless(path string, g Gapless) error {
+	return writeMoov(path, func(moov []byte) ([]byte, error) {
+		t, err := findAudioTrak(moov)
+		if err != nil {
+			return nil, err
+		}
+		movieScale, movieDurAt, err := headerTimescale(moov, t.mvhd)
+		if err != nil {
+			return nil, err
+		}
+		mediaScale, _, err := headerTimescale(moov, t.mdhd)
+		if err != nil {
+			return nil, err
+		}
+		if mediaScale == 0 {
+			return nil, errors.New("audio track without timescale")
+		}
+		total, err := sttsSamples(moov, t.stts)
+		if err != nil {
+			return nil, err
+		}
+		if g.Delay+g.Frames > total {
+			return nil, fmt.Errorf("%d+%d samples do not fit in the %d of the track", g.Delay, g.Frames, total)
+		}
+		g.Padding = total - g.Delay - g.Frames
+		duration := (g.Frames*movieScale + mediaScale/2) / mediaScale
+
+		// Durations keep their size, so they are patched before splicing
+		moov = append([]byte(nil), moov...)
+		if t.traks == 1 {
+			putDuration(moov, t.mvhd, movieDurAt, duration)
+		}
+		if t.tkhd.body+32 > t.tkhd.end {
+			return nil, errors.New("truncated tkhd box")
+		}
+		if moov[t.tkhd.body] == 1 {
+			putDuration(moov, t.tkhd, t.tkhd.body+28, duration)
+		} else {
+			putDuration(moov, t.tkhd, t.tkhd.body+20, duration)
+		}
+
+		edts := editList(duration, g.Delay)
+		chain := []rawBox{{typ: "moov", start: 0, end: len(moov), body: 8}, t.trak}
+		if t.edts.typ != "" {
+			moov, err = spliceMoov(moov, chain, t.edts.start, t.edts.end, edts)
+		} else {
+			moov, err = spliceMoov(moov, chain, t.tkhd.end, t.tkhd.end, edts)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if _, err := ilstChain(moov); err != nil {
+			return moov, nil // untagged file, the edit list has to do
+		}
+		return setIlstItems(moov, []ilstItem{freeformItem("iTunSMPB", g.ITunSMPB())})
+	})
+}
+
+// putDuration writes the duration field of an mvhd or tkhd box, in 32 or
+// 64 bits as the box version says.
+func putDuration(moov []byte, box rawBox, at int, duration int64) {
+	if moov[box.body] == 1 {
+		binary.BigEndian.PutUint64(moov[at:], uint64(duration))
+	} else {
+		binary.BigEndian.PutUint32(moov[at:], uint32(duration))
+	}
+}
+
+// editList encodes an edts box with a single edit that plays duration
+// movie ticks from mediaTime on.
+func editList(duration, mediaTime int64) []byte {
+	v1 := duration > 0xFFFFFFFF || mediaTime > 0x7FFFFFFF
+	entry := 12
+	if v1 {
+		entry = 20
+	}
+	b := make([]byte, 0, 24+entry)
+	b = binary.BigEndian.AppendUint32(b, uint32(24+entry))
+	b = append(b, "edts"...)
+	b = binary.BigEndian.AppendUint32(b, uint32(16+entry))
+	b = append(b, "elst"...)
+	if v1 {
+		b = binary.BigEndian.AppendUint32(b, 1<<24)
+		b = binary.BigEndian.AppendUint32(b, 1)
+		b = binary.BigEndian.AppendUint64(b, uint64(duration))
+		b = binary.BigEndian.AppendUint64(b, uint64(mediaTime))
+	} else {
+		b = binary.BigEndian.AppendUint32(b, 0)
+		b = binary.BigEndian.AppendUint32(b, 1)
+		b = binary.BigEndian.AppendUint32(b, uint32(duration))
+		b = binary.BigEndian.AppendUint32(b, uint32(mediaTime))
+	}
+	return binary.BigEndian.AppendUint32(b, 1<<16) // media rate 1.0
+}
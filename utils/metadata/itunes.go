@@ -0,0 +1,521 @@
+package metadata
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/utopian-society/apple-music-downloader/utils/structs"
+	"github.com/utopian-society/go-mp4tag"
+)
+
+// MediaKind is the iTunes media type stored in the stik atom.
+type MediaKind byte
+
+const (
+	MediaKindMusic      MediaKind = 1
+	MediaKindMusicVideo MediaKind = 6
+)
+
+// ItunesAtoms are the iTunes items go-mp4tag has no field for.
+type ItunesAtoms struct {
+	MediaKind MediaKind
+	HDVideo   byte // hdvd: 0 SD, 1 720p, 2 1080p, 3 2160p; only written for videos
+}
+
+// HDVideo returns the hdvd value of a video height.
+func HDVideo(height int) byte {
+	switch {
+	case height >= 2160:
+		return 3
+	case height >= 1080:
+		return 2
+	case height >= 720:
+		return 1
+	}
+	return 0
+}
+
+// WriteTags is the tagging path shared by songs, music videos and station
+// recordings: the ilst box is created when the file has none, sort tags are
+// filled in when tag-sort-order is set, the tags and the cover at coverPath
+// (when not empty) are written with go-mp4tag and the iTunes atoms are
+// added.
+func WriteTags(path string, t *mp4tag.MP4Tags, atoms ItunesAtoms, coverPath string, config structs.ConfigSet) error {
+	if err := writeMoov(path, ensureIlst); err != nil {
+		return err
+	}
+	if config.TagSortOrder {
+		fillSortTags(t)
+	}
+	if coverPath != "" {
+		picture, err := coverPicture(coverPath)
+		if err != nil {
+			return err
+		}
+		t.Pictures = append(t.Pictures, picture)
+	}
+	mp4, err := mp4tag.Open(path)
+	if err != nil {
+		return err
+	}
+	err = mp4.Write(t, []string{})
+	mp4.Close()
+	if err != nil {
+		return err
+	}
+
+	items := []ilstItem{intItem("stik", byte(atoms.MediaKind))}
+	if atoms.MediaKind == MediaKindMusicVideo {
+		items = append(items, intItem("hdvd", atoms.HDVideo))
+	}
+	return writeIlstItems(path, items)
+}
+
+// WriteFreeformTags sets ----:com.apple.iTunes items, replacing items of the
+// same name regardless of case and leaving every other tag alone.
+func WriteFreeformTags(path string, tags map[string]string) error {
+	names := make([]string, 0, len(tags))
+	for name := range tags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	items := make([]ilstItem, 0, len(names))
+	for _, name := range names {
+		items = append(items, freeformItem(name, tags[name]))
+	}
+	return writeIlstItems(path, items)
+}
+
+// coverPicture reads a JPEG or PNG cover for embedding.
+func coverPicture(path string) (*mp4tag.MP4Picture, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	format := mp4tag.ImageTypeJPEG
+	if bytes.HasPrefix(data, []byte("\x89PNG")) {
+		format = mp4tag.ImageTypePNG
+	}
+	return &mp4tag.MP4Picture{Format: format, Data: data}, nil
+}
+
+// fillSortTags sets every empty sort tag to the tag it sorts.
+func fillSortTags(t *mp4tag.MP4Tags) {
+	fill := func(sort *string, value string) {
+		if *sort == "" {
+			*sort = value
+		}
+	}
+	fill(&t.TitleSort, t.Title)
+	fill(&t.ArtistSort, t.Artist)
+	fill(&t.AlbumSort, t.Album)
+	fill(&t.AlbumArtistSort, t.AlbumArtist)
+	fill(&t.ComposerSort, t.Composer)
+}
+
+// ilstItem is an encoded item of the iTunes ilst box. key is the box type,
+// or "----:" and the lower case name for freeform items.
+type ilstItem struct {
+	key  string
+	data []byte
+}
+
+func intItem(name string, value byte) ilstItem {
+	return ilstItem{name, ilstIntItem(name, value)}
+}
+
+func freeformItem(name, value string) ilstItem {
+	return ilstItem{"----:" + strings.ToLower(name), ilstFreeformItem(name, value)}
+}
+
+// ilstKey returns the key of an existing ilst item.
+func ilstKey(b []byte, item rawBox) string {
+	if item.typ != "----" {
+		return item.typ
+	}
+	if name, ok := findRawBox(b, item.body, item.end, "name"); ok && name.body+4 <= name.end {
+		return "----:" + strings.ToLower(string(b[name.body+4:name.end]))
+	}
+	return item.typ
+}
+
+// rawBox is the position of a box inside a byte slice.
+type rawBox struct {
+	typ        string
+	start, end int // box including header
+	body       int // start of the payload
+}
+
+func rawBoxes(b []byte, start, end int) ([]rawBox, error) {
+	var boxes []rawBox
+	for pos := start; pos < end; {
+		if pos+8 > end {
+			return nil, errors.New("truncated box header")
+		}
+		size := int(binary.BigEndian.Uint32(b[pos:]))
+		hdr := 8
+		if size == 1 {
+			if pos+16 > end {
+				return nil, errors.New("truncated box header")
+			}
+			size = int(binary.BigEndian.Uint64(b[pos+8:]))
+			hdr = 16
+		} else if size == 0 {
+			size = end - pos
+		}
+		if size < hdr || pos+size > end {
+			return nil, fmt.Errorf("bad %s box size", b[pos+4:pos+8])
+		}
+		boxes = append(boxes, rawBox{typ: string(b[pos+4 : pos+8]), start: pos, end: pos + size, body: pos + hdr})
+		pos += size
+	}
+	return boxes, nil
+}
+
+func findRawBox(b []byte, start, end int, typ string) (rawBox, bool) {
+	boxes, err := rawBoxes(b, start, end)
+	if err != nil {
+		return rawBox{}, false
+	}
+	for _, box := range boxes {
+		if box.typ == typ {
+			return box, true
+		}
+	}
+	return rawBox{}, false
+}
+
+// readMoov finds moov among the top level boxes, without reading the media
+// data, and returns its position and contents.
+func readMoov(f *os.File, size int64) (int64, []byte, error) {
+	var moovPos, moovSize int64
+	hdr := make([]byte, 16)
+	for pos := int64(0); pos < size; {
+		if _, err := f.ReadAt(hdr, pos); err != nil && err != io.EOF {
+			return 0, nil, err
+		}
+		boxSize := int64(binary.BigEndian.Uint32(hdr))
+		if boxSize == 1 {
+			boxSize = int64(binary.BigEndian.Uint64(hdr[8:]))
+		} else if boxSize == 0 {
+			boxSize = size - pos
+		}
+		if boxSize < 8 {
+			return 0, nil, errors.New("bad top level box size")
+		}
+		if string(hdr[4:8]) == "moov" {
+			moovPos, moovSize = pos, boxSize
+			break
+		}
+		pos += boxSize
+	}
+	if moovSize == 0 {
+		return 0, nil, errors.New("no moov box")
+	}
+	moov := make([]byte, moovSize)
+	if _, err := f.ReadAt(moov, moovPos); err != nil {
+		return 0, nil, err
+	}
+	return moovPos, moov, nil
+}
+
+// ilstChain returns the path from moov to the ilst box, outermost first.
+func ilstChain(moov []byte) ([]rawBox, error) {
+	chain := []rawBox{{typ: "moov", start: 0, end: len(moov), body: 8}}
+	for _, typ := range []string{"udta", "meta", "ilst"} {
+		parent := chain[len(chain)-1]
+		body := parent.body
+		if parent.typ == "meta" && body+8 <= parent.end && string(moov[body+4:body+8]) != "hdlr" {
+			body += 4 // version and flags, absent in QuickTime style meta
+		}
+		box, ok := findRawBox(moov, body, parent.end, typ)
+		if !ok {
+			return nil, fmt.Errorf("no %s box", typ)
+		}
+		chain = append(chain, box)
+	}
+	return chain, nil
+}
+
+// ensureIlst returns moov with the udta/meta/ilst chain added where it is
+// missing, as iTunes writes it, so go-mp4tag has a tag list to fill in.
+func ensureIlst(moov []byte) ([]byte, error) {
+	chain := []rawBox{{typ: "moov", start: 0, end: len(moov), body: 8}}
+	for i, typ := range []string{"udta", "meta", "ilst"} {
+		parent := chain[len(chain)-1]
+		body := parent.body
+		if parent.typ == "meta" && body+8 <= parent.end && string(moov[body+4:body+8]) != "hdlr" {
+			body += 4 // version and flags, absent in QuickTime style meta
+		}
+		if found, ok := findRawBox(moov, body, parent.end, typ); ok {
+			chain = append(chain, found)
+			continue
+		}
+		missing := makeBox("ilst")
+		if i <= 1 {
+			hdlr := makeBox("hdlr", make([]byte, 8), []byte("mdirappl"), make([]byte, 9))
+			missing = makeBox("meta", make([]byte, 4), hdlr, missing)
+		}
+		if i == 0 {
+			missing = makeBox("udta", missing)
+		}
+		return spliceMoov(moov, chain, parent.end, parent.end, missing)
+	}
+	return moov, nil
+}
+
+// makeBox encodes a box of the given type around the payload parts.
+func makeBox(typ string, parts ...[]byte) []byte {
+	size := 8
+	for _, p := range parts {
+		size += len(p)
+	}
+	b := binary.BigEndian.AppendUint32(make([]byte, 0, size), uint32(size))
+	b = append(b, typ...)
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	return b
+}
+
+// ReadFreeformTags returns the text of the ----:com.apple.iTunes items,
+// keyed by their name as stored.
+func ReadFreeformTags(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	_, moov, err := readMoov(f, info.Size())
+	if err != nil {
+		return nil, err
+	}
+	chain, err := ilstChain(moov)
+	if err != nil {
+		return nil, err
+	}
+	ilst := chain[len(chain)-1]
+	items, err := rawBoxes(moov, ilst.body, ilst.end)
+	if err != nil {
+		return nil, err
+	}
+	tags := map[string]string{}
+	for _, item := range items {
+		if item.typ != "----" {
+			continue
+		}
+		name, ok := findRawBox(moov, item.body, item.end, "name")
+		data, ok2 := findRawBox(moov, item.body, item.end, "data")
+		if !ok || !ok2 || name.body+4 > name.end || data.body+8 > data.end {
+			continue
+		}
+		tags[string(moov[name.body+4:name.end])] = string(moov[data.body+8 : data.end])
+	}
+	return tags, nil
+}
+
+// writeIlstItems replaces the given items in moov/udta/meta/ilst.
+func writeIlstItems(path string, items []ilstItem) error {
+	return writeMoov(path, func(moov []byte) ([]byte, error) {
+		return setIlstItems(moov, items)
+	})
+}
+
+// setIlstItems returns moov with the given items replaced in its ilst box.
+func setIlstItems(moov []byte, items []ilstItem) ([]byte, error) {
+	chain, err := ilstChain(moov)
+	if err != nil {
+		return nil, err
+	}
+	ilst := chain[len(chain)-1]
+
+	children, err := rawBoxes(moov, ilst.body, ilst.end)
+	if err != nil {
+		return nil, err
+	}
+	var newIlst []byte
+	for _, c := range children {
+		key := ilstKey(moov, c)
+		keep := true
+		for _, item := range items {
+			keep = keep && key != item.key
+		}
+		if keep {
+			newIlst = append(newIlst, moov[c.start:c.end]...)
+		}
+	}
+	for _, item := range items {
+		newIlst = append(newIlst, item.data...)
+	}
+	return spliceMoov(moov, chain, ilst.body, ilst.end, newIlst)
+}
+
+// spliceMoov replaces moov[start:end], which lies inside every box of
+// chain, and fixes the sizes of those boxes.
+func spliceMoov(moov []byte, chain []rawBox, start, end int, data []byte) ([]byte, error) {
+	delta := len(data) - (end - start)
+	newMoov := make([]byte, 0, len(moov)+delta)
+	newMoov = append(newMoov, moov[:start]...)
+	newMoov = append(newMoov, data...)
+	newMoov = append(newMoov, moov[end:]...)
+	for _, box := range chain {
+		if box.body-box.start != 8 {
+			return nil, fmt.Errorf("64-bit %s box size is not supported", box.typ)
+		}
+		size := binary.BigEndian.Uint32(newMoov[box.start:])
+		binary.BigEndian.PutUint32(newMoov[box.start:], uint32(int(size)+delta))
+	}
+	return newMoov, nil
+}
+
+// writeMoov replaces the moov box of a file with the result of edit. The
+// file is rewritten when the moov box changes size, moving the chunk
+// offsets of media data stored after it.
+func writeMoov(path string, edit func(moov []byte) ([]byte, error)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	moovPos, moov, err := readMoov(f, info.Size())
+	if err != nil {
+		return err
+	}
+	moovSize := int64(len(moov))
+	newMoov, err := edit(moov)
+	if err != nil {
+		return err
+	}
+	delta := int64(len(newMoov)) - moovSize
+
+	if delta == 0 {
+		f.Close()
+		out, err := os.OpenFile(path, os.O_WRONLY, 0)
+		if err != nil {
+			return err
+		}
+		if _, err := out.WriteAt(newMoov, moovPos); err != nil {
+			out.Close()
+			return err
+		}
+		return out.Close()
+	}
+	if err := shiftChunkOffsets(newMoov, moovPos, delta); err != nil {
+		return err
+	}
+
+	tmpPath := path + ".tmp"
+	out, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, io.NewSectionReader(f, 0, moovPos))
+	if err == nil {
+		_, err = out.Write(newMoov)
+	}
+	if err == nil {
+		_, err = io.Copy(out, io.NewSectionReader(f, moovPos+moovSize, info.Size()-moovPos-moovSize))
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	f.Close()
+	return os.Rename(tmpPath, path)
+}
+
+// ilstIntItem encodes an ilst item holding a one byte signed integer.
+func ilstIntItem(name string, value byte) []byte {
+	b := make([]byte, 0, 25)
+	b = binary.BigEndian.AppendUint32(b, 25)
+	b = append(b, name...)
+	b = binary.BigEndian.AppendUint32(b, 17)
+	b = append(b, "data"...)
+	b = binary.BigEndian.AppendUint32(b, 21) // well-known type: signed integer
+	b = binary.BigEndian.AppendUint32(b, 0)  // locale
+	return append(b, value)
+}
+
+// ilstFreeformItem encodes a ----:com.apple.iTunes item holding UTF-8 text.
+func ilstFreeformItem(name, value string) []byte {
+	const mean = "com.apple.iTunes"
+	size := 8 + (12 + len(mean)) + (12 + len(name)) + (16 + len(value))
+	b := make([]byte, 0, size)
+	b = binary.BigEndian.AppendUint32(b, uint32(size))
+	b = append(b, "----"...)
+	b = binary.BigEndian.AppendUint32(b, uint32(12+len(mean)))
+	b = append(b, "mean"...)
+	b = binary.BigEndian.AppendUint32(b, 0) // version and flags
+	b = append(b, mean...)
+	b = binary.BigEndian.AppendUint32(b, uint32(12+len(name)))
+	b = append(b, "name"...)
+	b = binary.BigEndian.AppendUint32(b, 0)
+	b = append(b, name...)
+	b = binary.BigEndian.AppendUint32(b, uint32(16+len(value)))
+	b = append(b, "data"...)
+	b = binary.BigEndian.AppendUint32(b, 1) // well-known type: UTF-8
+	b = binary.BigEndian.AppendUint32(b, 0) // locale
+	return append(b, value...)
+}
+
+// shiftChunkOffsets moves the stco/co64 entries pointing past the moov box
+// by delta.
+func shiftChunkOffsets(moov []byte, moovPos, delta int64) error {
+	moovEnd := moovPos + int64(len(moov)) - delta
+	var walk func(start, end int) error
+	walk = func(start, end int) error {
+		boxes, err := rawBoxes(moov, start, end)
+		if err != nil {
+			return err
+		}
+		for _, box := range boxes {
+			switch box.typ {
+			case "trak", "mdia", "minf", "stbl":
+				if err := walk(box.body, box.end); err != nil {
+					return err
+				}
+			case "stco", "co64":
+				if box.body+8 > box.end {
+					return fmt.Errorf("truncated %s box", box.typ)
+				}
+				count := int(binary.BigEndian.Uint32(moov[box.body+4:]))
+				width := 4
+				if box.typ == "co64" {
+					width = 8
+				}
+				if box.body+8+count*width > box.end {
+					return fmt.Errorf("truncated %s box", box.typ)
+				}
+				for i := 0; i < count; i++ {
+					p := moov[box.body+8+i*width:]
+					if width == 4 {
+						if off := int64(binary.BigEndian.Uint32(p)); off >= moovEnd {
+							binary.BigEndian.PutUint32(p, uint32(off+delta))
+						}
+					} else if off := int64(binary.BigEndian.Uint64(p)); off >= moovEnd {
+						binary.BigEndian.PutUint64(p, uint64(off+delta))
+					}
+				}
+			}
+		}
+		return nil
+	}
+	return walk(8, len(moov))
+}
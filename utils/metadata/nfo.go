@@ -0,0 +1,212 @@
+package metadata
+
+import (
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/utopian-society/apple-music-downloader/utils/ampapi"
+	"github.com/utopian-society/apple-music-downloader/utils/structs"
+)
+
+// NFO sidecars follow the Kodi schema, which Jellyfin and Emby also read.
+// Apple Music IDs are stored as <uniqueid type="apple"> so entries stay
+// matched without an online scraper.
+
+type nfoUniqueID struct {
+	Type    string `xml:"type,attr"`
+	Default bool   `xml:"default,attr,omitempty"`
+	Value   string `xml:",chardata"`
+}
+
+type nfoThumb struct {
+	Value string `xml:",chardata"`
+}
+
+type nfoAlbumArtist struct {
+	Artist string `xml:"artist"`
+}
+
+type nfoTrack struct {
+	Disc     int    `xml:"disc,omitempty"`
+	Position int    `xml:"position"`
+	Title    string `xml:"title"`
+	Duration string `xml:"duration,omitempty"`
+}
+
+type albumNFO struct {
+	XMLName      xml.Name         `xml:"album"`
+	Title        string           `xml:"title"`
+	ArtistDesc   string           `xml:"artistdesc"`
+	AlbumArtists []nfoAlbumArtist `xml:"albumArtistCredits"`
+	Genres       []string         `xml:"genre"`
+	Label        string           `xml:"label,omitempty"`
+	ReleaseDate  string           `xml:"releasedate,omitempty"`
+	Year         string           `xml:"year,omitempty"`
+	Review       string           `xml:"review,omitempty"`
+	Type         string           `xml:"releasetype,omitempty"`
+	Compilation  bool             `xml:"compilation"`
+	Barcode      string           `xml:"barcode,omitempty"`
+	Copyright    string           `xml:"copyright,omitempty"`
+	UniqueIDs    []nfoUniqueID    `xml:"uniqueid"`
+	Thumbs       []nfoThumb       `xml:"thumb"`
+	Tracks       []nfoTrack       `xml:"track"`
+}
+
+type artistNFO struct {
+	XMLName   xml.Name      `xml:"artist"`
+	Name      string        `xml:"name"`
+	UniqueIDs []nfoUniqueID `xml:"uniqueid"`
+	Thumbs    []nfoThumb    `xml:"thumb"`
+}
+
+type musicVideoNFO struct {
+	XMLName   xml.Name      `xml:"musicvideo"`
+	Title     string        `xml:"title"`
+	Artists   []string      `xml:"artist"`
+	Album     string        `xml:"album,omitempty"`
+	Track     int           `xml:"track,omitempty"`
+	Year      string        `xml:"year,omitempty"`
+	Premiered string        `xml:"premiered,omitempty"`
+	Genres    []string      `xml:"genre"`
+	Runtime   int           `xml:"runtime,omitempty"`
+	ISRC      string        `xml:"isrc,omitempty"`
+	UniqueIDs []nfoUniqueID `xml:"uniqueid"`
+	Thumbs    []nfoThumb    `xml:"thumb"`
+}
+
+// ArtworkURL resolves an Apple Music artwork template URL at the configured
+// cover size.
+func ArtworkURL(url string, config structs.ConfigSet) string {
+	return strings.Replace(url, "{w}x{h}", config.CoverSize, 1)
+}
+
+// nfoThumbs returns the local artwork file name, if any, followed by the remote URL.
+func nfoThumbs(local, remote string, config structs.ConfigSet) []nfoThumb {
+	var thumbs []nfoThumb
+	if local != "" {
+		thumbs = append(thumbs, nfoThumb{Value: filepath.Base(local)})
+	}
+	if remote != "" {
+		thumbs = append(thumbs, nfoThumb{Value: ArtworkURL(remote, config)})
+	}
+	return thumbs
+}
+
+func writeNFO(path string, v interface{}) error {
+	data, err := xml.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append([]byte(xml.Header), data...)
+	data = append(data, '\n')
+	return os.WriteFile(path, data, 0644)
+}
+
+func releaseYear(date string) string {
+	if len(date) >= 4 {
+		return date[:4]
+	}
+	return ""
+}
+
+// formatNFODuration formats a track length as m:ss.
+func formatNFODuration(ms int) string {
+	if ms <= 0 {
+		return ""
+	}
+	s := (ms + 500) / 1000
+	return fmt.Sprintf("%d:%02d", s/60, s%60)
+}
+
+// WriteAlbumNFO writes album.nfo into the album folder. cover is the path of
+// the saved cover file, or "" if none was saved.
+func WriteAlbumNFO(albumFolder string, album ampapi.AlbumRespData, cover string, config structs.ConfigSet) error {
+	attrs := album.Attributes
+	nfo := albumNFO{
+		Title:       attrs.Name,
+		ArtistDesc:  attrs.ArtistName,
+		Genres:      attrs.GenreNames,
+		Label:       attrs.RecordLabel,
+		ReleaseDate: attrs.ReleaseDate,
+		Year:        releaseYear(attrs.ReleaseDate),
+		Compilation: attrs.IsCompilation,
+		Barcode:     attrs.Upc,
+		Copyright:   attrs.Copyright,
+		UniqueIDs:   []nfoUniqueID{{Type: "apple", Default: true, Value: album.ID}},
+		Thumbs:      nfoThumbs(cover, attrs.Artwork.URL, config),
+	}
+	nfo.Review = attrs.EditorialNotes.Standard
+	if nfo.Review == "" {
+		nfo.Review = attrs.EditorialNotes.Short
+	}
+	if attrs.IsSingle {
+		nfo.Type = "single"
+	} else {
+		nfo.Type = "album"
+	}
+	for _, a := range album.Relationships.Artists.Data {
+		nfo.AlbumArtists = append(nfo.AlbumArtists, nfoAlbumArtist{Artist: a.Attributes.Name})
+	}
+	if len(nfo.AlbumArtists) == 0 {
+		nfo.AlbumArtists = []nfoAlbumArtist{{Artist: attrs.ArtistName}}
+	}
+	for _, t := range album.Relationships.Tracks.Data {
+		nfo.Tracks = append(nfo.Tracks, nfoTrack{
+			Disc:     t.Attributes.DiscNumber,
+			Position: t.Attributes.TrackNumber,
+			Title:    t.Attributes.Name,
+			Duration: formatNFODuration(t.Attributes.DurationInMillis),
+		})
+	}
+	return writeNFO(filepath.Join(albumFolder, "album.nfo"), nfo)
+}
+
+// WriteArtistNFO writes artist.nfo into the artist folder. artwork is the
+// artist artwork template URL and image the path of the saved artist image,
+// or "" if none was saved.
+func WriteArtistNFO(artistFolder, name, id, artwork, image string, config structs.ConfigSet) error {
+	nfo := artistNFO{
+		Name:   name,
+		Thumbs: nfoThumbs(image, artwork, config),
+	}
+	if id != "" {
+		nfo.UniqueIDs = []nfoUniqueID{{Type: "apple", Default: true, Value: id}}
+	}
+	return writeNFO(filepath.Join(artistFolder, "artist.nfo"), nfo)
+}
+
+// MusicVideoNFOPath returns the NFO path Kodi expects next to a video file.
+func MusicVideoNFOPath(videoPath string) string {
+	return strings.TrimSuffix(videoPath, filepath.Ext(videoPath)) + ".nfo"
+}
+
+// WriteMusicVideoNFO writes the <video>.nfo sidecar of a music video. album
+// overrides the album name from the music video metadata when not "".
+func WriteMusicVideoNFO(videoPath string, mv ampapi.MusicVideoRespData, album string, config structs.ConfigSet) error {
+	attrs := mv.Attributes
+	nfo := musicVideoNFO{
+		Title:     attrs.Name,
+		Album:     attrs.AlbumName,
+		Track:     attrs.TrackNumber,
+		Year:      releaseYear(attrs.ReleaseDate),
+		Premiered: attrs.ReleaseDate,
+		Genres:    attrs.GenreNames,
+		Runtime:   (attrs.DurationInMillis + 30000) / 60000,
+		ISRC:      attrs.Isrc,
+		UniqueIDs: []nfoUniqueID{{Type: "apple", Default: true, Value: mv.ID}},
+		Thumbs:    nfoThumbs("", attrs.Artwork.URL, config),
+	}
+	if album != "" {
+		nfo.Album = album
+	}
+	for _, a := range mv.Relationships.Artists.Data {
+		nfo.Artists = append(nfo.Artists, a.Attributes.Name)
+	}
+	if len(nfo.Artists) == 0 {
+		nfo.Artists = []string{attrs.ArtistName}
+	}
+	return writeNFO(MusicVideoNFOPath(videoPath), nfo)
+}
@@ -0,0 +1,294 @@
+// Package mirror keeps a transcoded copy of a music library up to date. It
+// remembers the size, modification time and SHA-256 of every source it
+// converted, so a run only converts new and changed files, and removes the
+// copies of sources that are gone.
+package mirror
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// StateFile is kept in the root of the mirror.
+const StateFile = ".mirror-state.json"
+
+// saveEvery is how many conversions may be lost to an interrupted run.
+const saveEvery = 25
+
+// Actions reported to Progress
+const (
+	ActionConverted = "converted"
+	ActionRemoved   = "removed"
+	ActionFailed    = "failed"
+	ActionSkipped   = "skipped" // another source already maps to the same copy
+)
+
+// entry is one mirrored source, keyed by the path of its copy.
+type entry struct {
+	Source  string   `json:"source"`
+	Size    int64    `json:"size"`
+	ModTime int64    `json:"mtime"`
+	SHA256  string   `json:"sha256"`
+	Profile string   `json:"profile"`
+	Extra   []string `json:"extra,omitempty"` // sidecars written with the copy
+}
+
+// Summary counts the files of a run.
+type Summary struct {
+	Converted int
+	Unchanged int
+	Removed   int
+	Failed    int
+	Skipped   int
+}
+
+// Mirror converts the files of one or more library folders into a
+// parallel tree.
+type Mirror struct {
+	Output  string   // root of the mirror
+	Ext     string   // extension of the copies, with the dot
+	Sources []string // extensions of the files to mirror, e.g. ".m4a"
+	Profile string   // conversion settings; a change converts everything again
+
+	// Convert writes the copy of src to dst and returns any sidecar files
+	// it wrote next to it.
+	Convert func(src, dst string) ([]string, error)
+	// Progress, when set, is told about every file that is converted,
+	// removed, skipped or failed. rel is the path of the copy.
+	Progress func(rel, action string, err error)
+}
+
+// Sync brings the mirror up to date with the given roots. Roots are walked
+// in order; when two sources map to the same copy the first one wins.
+// Copies are only removed when their source no longer exists, so syncing a
+// subset of the library leaves the rest alone.
+func (m *Mirror) Sync(roots []string) (Summary, error) {
+	var sum Summary
+	statePath := filepath.Join(m.Output, StateFile)
+	state, err := loadState(statePath)
+	if err != nil {
+		return sum, err
+	}
+	claimed := map[string]bool{}
+	dirty := 0
+
+	for _, root := range roots {
+		if _, err := os.Stat(root); errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() || !m.isSource(path) {
+				return nil
+			}
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			rel = filepath.ToSlash(strings.TrimSuffix(rel, filepath.Ext(rel)) + m.Ext)
+			if claimed[rel] {
+				sum.Skipped++
+				m.report(rel, ActionSkipped, nil)
+				return nil
+			}
+			claimed[rel] = true
+
+			// A file that can't be read fails alone, not the run
+			info, err := d.Info()
+			if err != nil {
+				sum.Failed++
+				m.report(rel, ActionFailed, err)
+				return nil
+			}
+			dst := filepath.Join(m.Output, filepath.FromSlash(rel))
+			e := state[rel]
+			current := e != nil && e.Source == path && e.Profile == m.Profile && exists(dst)
+			if current && e.Size == info.Size() && e.ModTime == info.ModTime().UnixNano() {
+				sum.Unchanged++
+				return nil
+			}
+			hash, err := fileSHA256(path)
+			if err != nil {
+				sum.Failed++
+				m.report(rel, ActionFailed, err)
+				return nil
+			}
+			if current && e.SHA256 == hash {
+				// Touched, not changed
+				e.Size, e.ModTime = info.Size(), info.ModTime().UnixNano()
+				sum.Unchanged++
+				return nil
+			}
+
+			if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+				return err
+			}
+			extra, err := m.Convert(path, dst)
+			if err != nil {
+				sum.Failed++
+				m.report(rel, ActionFailed, err)
+				return nil
+			}
+			var extraRel []string
+			written := map[string]bool{rel: true}
+			for _, x := range extra {
+				if r, err := filepath.Rel(m.Output, x); err == nil {
+					extraRel = append(extraRel, filepath.ToSlash(r))
+					written[filepath.ToSlash(r)] = true
+				}
+			}
+			// Sidecars of the previous conversion it no longer wrote, e.g.
+			// lyrics that went away with a profile change
+			if e != nil {
+				for _, f := range e.Extra {
+					if !written[f] {
+						os.Remove(filepath.Join(m.Output, filepath.FromSlash(f)))
+					}
+				}
+			}
+			state[rel] = &entry{
+				Source:  path,
+				Size:    info.Size(),
+				ModTime: info.ModTime().UnixNano(),
+				SHA256:  hash,
+				Profile: m.Profile,
+				Extra:   extraRel,
+			}
+			sum.Converted++
+			m.report(rel, ActionConverted, nil)
+			if dirty++; dirty%saveEvery == 0 {
+				return saveState(statePath, state)
+			}
+			return nil
+		})
+		if err != nil {
+			saveState(statePath, state)
+			return sum, err
+		}
+	}
+
+	for rel, e := range state {
+		if claimed[rel] {
+			continue
+		}
+		if _, err := os.Stat(e.Source); !errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		for _, f := range append([]string{rel}, e.Extra...) {
+			path := filepath.Join(m.Output, filepath.FromSlash(f))
+			if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				saveState(statePath, state)
+				return sum, err
+			}
+		}
+		delete(state, rel)
+		m.prune(filepath.Dir(filepath.Join(m.Output, filepath.FromSlash(rel))))
+		sum.Removed++
+		m.report(rel, ActionRemoved, nil)
+	}
+	return sum, saveState(statePath, state)
+}
+
+func (m *Mirror) isSource(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	for _, s := range m.Sources {
+		if ext == strings.ToLower(s) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Mirror) report(rel, action string, err error) {
+	if m.Progress != nil {
+		m.Progress(rel, action, err)
+	}
+}
+
+// prune removes folders of the mirror that hold nothing but a cover, from
+// dir up to the root.
+func (m *Mirror) prune(dir string) {
+	root := filepath.Clean(m.Output)
+	for dir = filepath.Clean(dir); dir != root && strings.HasPrefix(dir, root); dir = filepath.Dir(dir) {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return
+		}
+		for _, e := range entries {
+			if e.IsDir() || !isCover(e.Name()) {
+				return
+			}
+		}
+		for _, e := range entries {
+			os.Remove(filepath.Join(dir, e.Name()))
+		}
+		if os.Remove(dir) != nil {
+			return
+		}
+	}
+}
+
+func isCover(name string) bool {
+	switch strings.ToLower(name) {
+	case "cover.jpg", "cover.png", "folder.jpg":
+		return true
+	}
+	return false
+}
+
+func loadState(path string) (map[string]*entry, error) {
+	state := map[string]*entry{}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+func saveState(path string, state map[string]*entry) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
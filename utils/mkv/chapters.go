@@ -0,0 +1,58 @@
+package mkv
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ReadChapters parses a chapter list: one chapter per line, a start time
+// ([hh:]mm:ss[.fff]) followed by the title, as in video descriptions.
+// Empty lines and lines starting with # are skipped. Starts must increase.
+func ReadChapters(r io.Reader) ([]Chapter, error) {
+	var list []Chapter
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		stamp, title, _ := strings.Cut(line, " ")
+		start, err := parseChapterTime(stamp)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		if len(list) > 0 && start <= list[len(list)-1].Start {
+			return nil, fmt.Errorf("line %d: chapter starts at %s, not after the previous one", n, stamp)
+		}
+		title = strings.TrimSpace(strings.TrimLeft(strings.TrimSpace(title), "-–"))
+		if title == "" {
+			title = fmt.Sprintf("Chapter %d", len(list)+1)
+		}
+		list = append(list, Chapter{Title: title, Start: start})
+	}
+	return list, sc.Err()
+}
+
+func parseChapterTime(stamp string) (time.Duration, error) {
+	parts := strings.Split(stamp, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, fmt.Errorf("bad chapter time %q", stamp)
+	}
+	secs, err := strconv.ParseFloat(parts[len(parts)-1], 64)
+	if err != nil || secs < 0 || secs >= 60 {
+		return 0, fmt.Errorf("bad chapter time %q", stamp)
+	}
+	d := time.Duration(secs * float64(time.Second)).Round(time.Millisecond)
+	for i, unit := range []time.Duration{time.Minute, time.Hour}[:len(parts)-1] {
+		v, err := strconv.Atoi(parts[len(parts)-2-i])
+		if err != nil || v < 0 {
+			return 0, fmt.Errorf("bad chapter time %q", stamp)
+		}
+		d += time.Duration(v) * unit
+	}
+	return d, nil
+}
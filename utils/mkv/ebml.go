@@ -0,0 +1,217 @@
+package mkv
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// Matroska element IDs, with their length marker bits included.
+const (
+	idEBML               = 0x1A45DFA3
+	idEBMLVersion        = 0x4286
+	idEBMLReadVersion    = 0x42F7
+	idEBMLMaxIDLength    = 0x42F2
+	idEBMLMaxSizeLength  = 0x42F3
+	idDocType            = 0x4282
+	idDocTypeVersion     = 0x4287
+	idDocTypeReadVersion = 0x4285
+	idVoid               = 0xEC
+
+	idSegment      = 0x18538067
+	idSeekHead     = 0x114D9B74
+	idSeek         = 0x4DBB
+	idSeekID       = 0x53AB
+	idSeekPosition = 0x53AC
+
+	idInfo           = 0x1549A966
+	idTimestampScale = 0x2AD7B1
+	idDuration       = 0x4489
+	idTitle          = 0x7BA9
+	idMuxingApp      = 0x4D80
+	idWritingApp     = 0x5741
+
+	idTracks              = 0x1654AE6B
+	idTrackEntry          = 0xAE
+	idTrackNumber         = 0xD7
+	idTrackUID            = 0x73C5
+	idTrackType           = 0x83
+	idFlagDefault         = 0x88
+	idFlagForced          = 0x55AA
+	idFlagLacing          = 0x9C
+	idName                = 0x536E
+	idLanguage            = 0x22B59C
+	idLanguageBCP47       = 0x22B59D
+	idCodecID             = 0x86
+	idCodecPrivate        = 0x63A2
+	idDefaultDuration     = 0x23E383
+	idBlockAddMapping     = 0x41E4
+	idBlockAddIDType      = 0x41E7
+	idBlockAddIDExtraData = 0x41ED
+
+	idVideo                   = 0xE0
+	idPixelWidth              = 0xB0
+	idPixelHeight             = 0xBA
+	idColour                  = 0x55B0
+	idMatrixCoefficients      = 0x55B1
+	idRange                   = 0x55B9
+	idTransferCharacteristics = 0x55BA
+	idPrimaries               = 0x55BB
+	idMaxCLL                  = 0x55BC
+	idMaxFALL                 = 0x55BD
+	idMasteringMetadata       = 0x55D0
+	idPrimaryRChromaticityX   = 0x55D1
+	idPrimaryRChromaticityY   = 0x55D2
+	idPrimaryGChromaticityX   = 0x55D3
+	idPrimaryGChromaticityY   = 0x55D4
+	idPrimaryBChromaticityX   = 0x55D5
+	idPrimaryBChromaticityY   = 0x55D6
+	idWhitePointChromaX       = 0x55D7
+	idWhitePointChromaY       = 0x55D8
+	idLuminanceMax            = 0x55D9
+	idLuminanceMin            = 0x55DA
+
+	idAudio             = 0xE1
+	idSamplingFrequency = 0xB5
+	idChannels          = 0x9F
+
+	idCluster       = 0x1F43B675
+	idTimestamp     = 0xE7
+	idSimpleBlock   = 0xA3
+	idBlockGroup    = 0xA0
+	idBlock         = 0xA1
+	idBlockDuration = 0x9B
+
+	idCues               = 0x1C53BB6B
+	idCuePoint           = 0xBB
+	idCueTime            = 0xB3
+	idCueTrackPositions  = 0xB7
+	idCueTrack           = 0xF7
+	idCueClusterPosition = 0xF1
+
+	idChapters         = 0x1043A770
+	idEditionEntry     = 0x45B9
+	idEditionUID       = 0x45BC
+	idChapterAtom      = 0xB6
+	idChapterUID       = 0x73C4
+	idChapterTimeStart = 0x91
+	idChapterTimeEnd   = 0x92
+	idChapterDisplay   = 0x80
+	idChapString       = 0x85
+	idChapLanguage     = 0x437C
+
+	idAttachments     = 0x1941A469
+	idAttachedFile    = 0x61A7
+	idFileDescription = 0x467E
+	idFileName        = 0x466E
+	idFileMimeType    = 0x4660
+	idFileData        = 0x465C
+	idFileUID         = 0x46AE
+
+	idTags            = 0x1254C367
+	idTag             = 0x7373
+	idTargets         = 0x63C0
+	idTargetTypeValue = 0x68CA
+	idTargetType      = 0x63CA
+	idSimpleTag       = 0x67C8
+	idTagName         = 0x45A3
+	idTagLanguage     = 0x447A
+	idTagString       = 0x4487
+)
+
+// unknownSize is the 8 byte size of an element whose length is patched in
+// once it is known.
+var unknownSize = []byte{0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+
+// appendID appends an element ID, which already carries its length marker.
+func appendID(b []byte, id uint32) []byte {
+	switch {
+	case id >= 1<<24:
+		return append(b, byte(id>>24), byte(id>>16), byte(id>>8), byte(id))
+	case id >= 1<<16:
+		return append(b, byte(id>>16), byte(id>>8), byte(id))
+	case id >= 1<<8:
+		return append(b, byte(id>>8), byte(id))
+	}
+	return append(b, byte(id))
+}
+
+// appendSize appends n as a variable length integer of the minimal width.
+// The all-ones value of each width is reserved, so it moves up a width.
+func appendSize(b []byte, n uint64) []byte {
+	width := 1
+	for width < 8 && n >= 1<<(7*width)-1 {
+		width++
+	}
+	return appendSizeWidth(b, n, width)
+}
+
+func appendSizeWidth(b []byte, n uint64, width int) []byte {
+	n |= 1 << (7 * width)
+	for i := width - 1; i >= 0; i-- {
+		b = append(b, byte(n>>(8*i)))
+	}
+	return b
+}
+
+// element encodes a complete element.
+func element(id uint32, payload []byte) []byte {
+	b := appendID(make([]byte, 0, len(payload)+12), id)
+	b = appendSize(b, uint64(len(payload)))
+	return append(b, payload...)
+}
+
+// master encodes a master element from already encoded children.
+func master(id uint32, children ...[]byte) []byte {
+	var payload []byte
+	for _, c := range children {
+		payload = append(payload, c...)
+	}
+	return element(id, payload)
+}
+
+func uintElement(id uint32, v uint64) []byte {
+	width := 1
+	for width < 8 && v >= 1<<(8*width) {
+		width++
+	}
+	payload := make([]byte, width)
+	for i := range payload {
+		payload[i] = byte(v >> (8 * (width - 1 - i)))
+	}
+	return element(id, payload)
+}
+
+// fixedUintElement encodes v in 8 bytes so it can be rewritten in place.
+func fixedUintElement(id uint32, v uint64) []byte {
+	payload := make([]byte, 8)
+	binary.BigEndian.PutUint64(payload, v)
+	return element(id, payload)
+}
+
+func floatElement(id uint32, v float64) []byte {
+	payload := make([]byte, 8)
+	binary.BigEndian.PutUint64(payload, math.Float64bits(v))
+	return element(id, payload)
+}
+
+func stringElement(id uint32, s string) []byte {
+	return element(id, []byte(s))
+}
+
+func boolElement(id uint32, v bool) []byte {
+	if v {
+		return uintElement(id, 1)
+	}
+	return uintElement(id, 0)
+}
+
+// voidElement encodes a Void element of exactly n bytes, n >= 2.
+func voidElement(n int) []byte {
+	b := []byte{idVoid}
+	if n-2 < 127 {
+		b = appendSizeWidth(b, uint64(n-2), 1)
+	} else {
+		b = appendSizeWidth(b, uint64(n-9), 8)
+	}
+	return append(b, make([]byte, n-len(b))...)
+}
@@ -0,0 +1,501 @@
+// Package mkv writes Matroska files from the decrypted fragmented MP4
+// streams of a music video, with subtitle, chapter, attachment and tag
+// support, so no external muxer is needed.
+package mkv
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand/v2"
+	"os"
+	"time"
+
+	"github.com/utopian-society/apple-music-downloader/utils/subtitle"
+)
+
+// Input is a fragmented MP4 file holding one video or audio track.
+type Input struct {
+	Path     string
+	Language string // BCP-47 tag, "" for undetermined
+	Name     string
+	Default  bool
+	// StripCaptions drops the CEA-608 caption SEI messages from a video
+	// track, for when the captions are muxed as a subtitle track instead.
+	StripCaptions bool
+}
+
+// Subtitle is a subtitle track, written as S_TEXT/ASS so cue positions and
+// styling are kept.
+type Subtitle struct {
+	Language string
+	Name     string
+	Default  bool
+	Forced   bool
+	Doc      *subtitle.Document
+}
+
+// Chapter is a chapter starting at Start. A zero End lasts until the next
+// chapter or the end of the file.
+type Chapter struct {
+	Title string
+	Start time.Duration
+	End   time.Duration
+}
+
+// Attachment is a file embedded in the container, such as cover art.
+type Attachment struct {
+	Name        string
+	MIMEType    string
+	Description string
+	Data        []byte
+}
+
+// Tag is a simple tag applied to the whole file, e.g. ARTIST.
+type Tag struct {
+	Name  string
+	Value string
+}
+
+// File describes the contents of a Matroska file.
+type File struct {
+	Title       string
+	Tracks      []Input
+	Subtitles   []Subtitle
+	Chapters    []Chapter
+	Attachments []Attachment
+	Tags        []Tag
+}
+
+// Matroska track types
+const (
+	trackVideo    = 1
+	trackAudio    = 2
+	trackSubtitle = 0x11
+)
+
+// Clusters are cut at video keyframes, or after this long without one.
+const maxClusterDuration = 5 * time.Second
+
+// seekHeadSize is the space reserved after the segment header for the
+// SeekHead, which is written once all element positions are known.
+const seekHeadSize = 160
+
+// stream is a source of blocks for one output track.
+type stream interface {
+	next() (sample, error)
+}
+
+// subtitleStream turns the cues of a document into ASS blocks.
+type subtitleStream struct {
+	cues []subtitle.Cue
+	i    int
+}
+
+func (s *subtitleStream) next() (sample, error) {
+	if s.i >= len(s.cues) {
+		return sample{}, io.EOF
+	}
+	c := s.cues[s.i]
+	if c.End < c.Start {
+		c.End = c.Start
+	}
+	// Matroska ASS blocks drop the times from the Dialogue line and lead
+	// with the read order instead.
+	text := fmt.Sprintf("%d,0,Default,,0,0,0,,%s", s.i, subtitle.ASSText(c))
+	s.i++
+	return sample{dts: c.Start, pts: c.Start, dur: c.End - c.Start, key: true, data: []byte(text)}, nil
+}
+
+// writer tracks the file offset of everything written so that elements can
+// be patched in place afterwards.
+type writer struct {
+	f   *os.File
+	w   *bufio.Writer
+	off int64
+}
+
+func (w *writer) write(b []byte) error {
+	n, err := w.w.Write(b)
+	w.off += int64(n)
+	return err
+}
+
+// Write muxes the file to path. The file is removed again if muxing fails.
+func Write(path string, file File) (err error) {
+	var tracks []*mp4Track
+	defer func() {
+		for _, t := range tracks {
+			t.Close()
+		}
+	}()
+	for _, in := range file.Tracks {
+		t, err := openMP4(in.Path)
+		if err != nil {
+			return err
+		}
+		t.stripCC = in.StripCaptions
+		tracks = append(tracks, t)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(path)
+		}
+	}()
+	w := &writer{f: f, w: bufio.NewWriterSize(f, 1<<20)}
+
+	header := master(idEBML,
+		uintElement(idEBMLVersion, 1),
+		uintElement(idEBMLReadVersion, 1),
+		uintElement(idEBMLMaxIDLength, 4),
+		uintElement(idEBMLMaxSizeLength, 8),
+		stringElement(idDocType, "matroska"),
+		uintElement(idDocTypeVersion, 4),
+		uintElement(idDocTypeReadVersion, 2))
+	if err := w.write(header); err != nil {
+		return err
+	}
+	if err := w.write(append(appendID(nil, idSegment), unknownSize...)); err != nil {
+		return err
+	}
+	segmentStart := w.off
+	if err := w.write(voidElement(seekHeadSize)); err != nil {
+		return err
+	}
+
+	// Top level elements in the order they are written, with their offsets
+	// relative to the segment for the SeekHead.
+	var seeks [][2]uint64
+	writeTop := func(id uint32, b []byte) error {
+		seeks = append(seeks, [2]uint64{uint64(id), uint64(w.off - segmentStart)})
+		return w.write(b)
+	}
+
+	info := master(idInfo,
+		uintElement(idTimestampScale, uint64(time.Millisecond)),
+		stringElement(idMuxingApp, "apple-music-downloader"),
+		stringElement(idWritingApp, "apple-music-downloader"),
+		stringElement(idTitle, file.Title),
+		floatElement(idDuration, 0))
+	// Duration is the last child, so its payload ends the element.
+	durationOff := w.off + int64(len(info)) - 8
+	if err := writeTop(idInfo, info); err != nil {
+		return err
+	}
+
+	var entries [][]byte
+	var streams []stream
+	trackTypes := []uint64{}
+	for i, t := range tracks {
+		entries = append(entries, trackEntry(uint64(i+1), t, file.Tracks[i]))
+		streams = append(streams, t)
+		if t.kind == "video" {
+			trackTypes = append(trackTypes, trackVideo)
+		} else {
+			trackTypes = append(trackTypes, trackAudio)
+		}
+	}
+	for _, s := range file.Subtitles {
+		n := uint64(len(entries) + 1)
+		entries = append(entries, subtitleEntry(n, s))
+		s.Doc.Sort()
+		streams = append(streams, &subtitleStream{cues: s.Doc.Cues})
+		trackTypes = append(trackTypes, trackSubtitle)
+	}
+	if err := writeTop(idTracks, master(idTracks, entries...)); err != nil {
+		return err
+	}
+	if len(file.Chapters) > 0 {
+		if err := writeTop(idChapters, chapters(file.Chapters)); err != nil {
+			return err
+		}
+	}
+	if len(file.Attachments) > 0 {
+		if err := writeTop(idAttachments, attachments(file.Attachments)); err != nil {
+			return err
+		}
+	}
+	if len(file.Tags) > 0 {
+		if err := writeTop(idTags, tags(file.Tags)); err != nil {
+			return err
+		}
+	}
+
+	cues, duration, err := writeClusters(w, segmentStart, streams, trackTypes)
+	if err != nil {
+		return err
+	}
+	if len(cues) > 0 {
+		if err := writeTop(idCues, master(idCues, cues...)); err != nil {
+			return err
+		}
+	}
+	if err := w.w.Flush(); err != nil {
+		return err
+	}
+
+	// Patch the segment size, duration and SeekHead now that they are known.
+	size := make([]byte, 8)
+	binary.BigEndian.PutUint64(size, uint64(w.off-segmentStart)|1<<56)
+	if _, err := f.WriteAt(size, segmentStart-8); err != nil {
+		return err
+	}
+	dur := make([]byte, 8)
+	binary.BigEndian.PutUint64(dur, math.Float64bits(float64(duration)/float64(time.Millisecond)))
+	if _, err := f.WriteAt(dur, durationOff); err != nil {
+		return err
+	}
+	var seekEntries [][]byte
+	for _, s := range seeks {
+		seekEntries = append(seekEntries, master(idSeek,
+			element(idSeekID, appendID(nil, uint32(s[0]))),
+			fixedUintElement(idSeekPosition, s[1])))
+	}
+	seekHead := master(idSeekHead, seekEntries...)
+	if len(seekHead) > seekHeadSize-2 {
+		return errors.New("mkv: too many top level elements for the SeekHead")
+	}
+	seekHead = append(seekHead, voidElement(seekHeadSize-len(seekHead))...)
+	_, err = f.WriteAt(seekHead, segmentStart)
+	return err
+}
+
+// writeClusters interleaves the blocks of all streams in decode order. It
+// returns the CuePoints of the clusters starting at a keyframe and the
+// duration of the file.
+func writeClusters(w *writer, segmentStart int64, streams []stream, trackTypes []uint64) ([][]byte, time.Duration, error) {
+	heads := make([]*sample, len(streams))
+	advance := func(i int) error {
+		s, err := streams[i].next()
+		if err == io.EOF {
+			heads[i] = nil
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		heads[i] = &s
+		return nil
+	}
+	for i := range streams {
+		if err := advance(i); err != nil {
+			return nil, 0, err
+		}
+	}
+	cueTrack := -1
+	for i, t := range trackTypes {
+		if t == trackVideo {
+			cueTrack = i
+			break
+		}
+	}
+	if cueTrack < 0 && len(trackTypes) > 0 {
+		cueTrack = 0
+	}
+
+	var cues [][]byte
+	var cluster []byte
+	var clusterTime time.Duration
+	var duration time.Duration
+	flush := func() error {
+		if cluster == nil {
+			return nil
+		}
+		err := w.write(element(idCluster, cluster))
+		cluster = nil
+		return err
+	}
+	for {
+		i := -1
+		for j, h := range heads {
+			if h != nil && (i < 0 || h.dts < heads[i].dts) {
+				i = j
+			}
+		}
+		if i < 0 {
+			break
+		}
+		s := *heads[i]
+		if err := advance(i); err != nil {
+			return nil, 0, err
+		}
+
+		rel := (s.pts - clusterTime) / time.Millisecond
+		newCluster := cluster == nil || rel > math.MaxInt16 || rel < math.MinInt16
+		if i == cueTrack && s.key && cluster != nil {
+			newCluster = newCluster || trackTypes[i] == trackVideo || s.pts-clusterTime >= maxClusterDuration
+		}
+		if newCluster {
+			if err := flush(); err != nil {
+				return nil, 0, err
+			}
+			clusterTime = s.pts.Truncate(time.Millisecond)
+			if clusterTime < 0 {
+				clusterTime = 0
+			}
+			if i == cueTrack && s.key {
+				cues = append(cues, master(idCuePoint,
+					uintElement(idCueTime, uint64(clusterTime/time.Millisecond)),
+					master(idCueTrackPositions,
+						uintElement(idCueTrack, uint64(i+1)),
+						uintElement(idCueClusterPosition, uint64(w.off-segmentStart)))))
+			}
+			cluster = uintElement(idTimestamp, uint64(clusterTime/time.Millisecond))
+			rel = (s.pts - clusterTime) / time.Millisecond
+		}
+
+		block := appendSize(nil, uint64(i+1))
+		block = binary.BigEndian.AppendUint16(block, uint16(int16(rel)))
+		if trackTypes[i] == trackSubtitle {
+			block = append(block, 0)
+			block = append(block, s.data...)
+			cluster = append(cluster, master(idBlockGroup,
+				element(idBlock, block),
+				uintElement(idBlockDuration, uint64(s.dur/time.Millisecond)))...)
+		} else {
+			var flags byte
+			if s.key {
+				flags |= 0x80
+			}
+			block = append(block, flags)
+			block = append(block, s.data...)
+			cluster = append(cluster, element(idSimpleBlock, block)...)
+		}
+		if end := s.pts + s.dur; end > duration {
+			duration = end
+		}
+	}
+	return cues, duration, flush()
+}
+
+func trackEntry(n uint64, t *mp4Track, in Input) []byte {
+	children := [][]byte{
+		uintElement(idTrackNumber, n),
+		uintElement(idTrackUID, rand.Uint64()|1),
+		boolElement(idFlagDefault, in.Default),
+		boolElement(idFlagLacing, false),
+		stringElement(idCodecID, t.codecID),
+	}
+	children = append(children, languageElements(in.Language)...)
+	if in.Name != "" {
+		children = append(children, stringElement(idName, in.Name))
+	}
+	if len(t.codecPrivate) > 0 {
+		children = append(children, element(idCodecPrivate, t.codecPrivate))
+	}
+	if t.kind == "video" {
+		video := [][]byte{
+			uintElement(idPixelWidth, uint64(t.width)),
+			uintElement(idPixelHeight, uint64(t.height)),
+		}
+		if t.colour != nil {
+			video = append(video, t.colour)
+		}
+		children = append(children, uintElement(idTrackType, trackVideo), master(idVideo, video...))
+		if t.blockAdd != nil {
+			children = append(children, t.blockAdd)
+		}
+	} else {
+		audio := [][]byte{
+			floatElement(idSamplingFrequency, t.sampleRate),
+			uintElement(idChannels, uint64(t.channels)),
+		}
+		children = append(children, uintElement(idTrackType, trackAudio), master(idAudio, audio...))
+	}
+	return master(idTrackEntry, children...)
+}
+
+func subtitleEntry(n uint64, s Subtitle) []byte {
+	children := [][]byte{
+		uintElement(idTrackNumber, n),
+		uintElement(idTrackUID, rand.Uint64()|1),
+		uintElement(idTrackType, trackSubtitle),
+		boolElement(idFlagDefault, s.Default),
+		boolElement(idFlagForced, s.Forced),
+		boolElement(idFlagLacing, false),
+		stringElement(idCodecID, "S_TEXT/ASS"),
+		stringElement(idCodecPrivate, subtitle.ASSHeader()),
+	}
+	children = append(children, languageElements(s.Language)...)
+	if s.Name != "" {
+		children = append(children, stringElement(idName, s.Name))
+	}
+	return master(idTrackEntry, children...)
+}
+
+// languageElements returns the legacy ISO 639-2 Language element, which
+// every player reads, followed by the full BCP-47 tag.
+func languageElements(tag string) [][]byte {
+	if tag == "" {
+		return [][]byte{stringElement(idLanguage, "und")}
+	}
+	return [][]byte{
+		stringElement(idLanguage, subtitle.ISO639_2(tag)),
+		stringElement(idLanguageBCP47, subtitle.NormalizeLanguage(tag)),
+	}
+}
+
+func chapters(list []Chapter) []byte {
+	var atoms [][]byte
+	for _, c := range list {
+		children := [][]byte{
+			uintElement(idChapterUID, rand.Uint64()|1),
+			uintElement(idChapterTimeStart, uint64(c.Start)),
+		}
+		if c.End > c.Start {
+			children = append(children, uintElement(idChapterTimeEnd, uint64(c.End)))
+		}
+		children = append(children, master(idChapterDisplay,
+			stringElement(idChapString, c.Title),
+			stringElement(idChapLanguage, "und")))
+		atoms = append(atoms, master(idChapterAtom, children...))
+	}
+	edition := append([][]byte{uintElement(idEditionUID, rand.Uint64()|1)}, atoms...)
+	return master(idChapters, master(idEditionEntry, edition...))
+}
+
+func attachments(list []Attachment) []byte {
+	var files [][]byte
+	for _, a := range list {
+		children := [][]byte{}
+		if a.Description != "" {
+			children = append(children, stringElement(idFileDescription, a.Description))
+		}
+		children = append(children,
+			stringElement(idFileName, a.Name),
+			stringElement(idFileMimeType, a.MIMEType),
+			element(idFileData, a.Data),
+			uintElement(idFileUID, rand.Uint64()|1))
+		files = append(files, master(idAttachedFile, children...))
+	}
+	return master(idAttachments, files...)
+}
+
+// tags writes the tags at the album/movie level (TargetTypeValue 50), where
+// players look for the title, artist and release date of a video.
+func tags(list []Tag) []byte {
+	children := [][]byte{master(idTargets,
+		uintElement(idTargetTypeValue, 50),
+		stringElement(idTargetType, "MOVIE"))}
+	for _, t := range list {
+		if t.Value == "" {
+			continue
+		}
+		children = append(children, master(idSimpleTag,
+			stringElement(idTagName, t.Name),
+			stringElement(idTagLanguage, "und"),
+			stringElement(idTagString, t.Value)))
+	}
+	return master(idTags, master(idTag, children...))
+}
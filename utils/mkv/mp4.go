@@ -0,0 +1,365 @@
+package mkv
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/Eyevinn/mp4ff/mp4"
+)
+
+// sample is one frame of a track, with times relative to the start of the
+// presentation.
+type sample struct {
+	dts, pts time.Duration
+	dur      time.Duration
+	key      bool
+	data     []byte
+}
+
+// mp4Track reads the first video or audio track of a fragmented MP4 file,
+// one fragment at a time.
+type mp4Track struct {
+	f         *os.File
+	size      uint64
+	pos       uint64
+	trex      *mp4.TrexBox
+	timescale uint32
+	offset    int64 // edit list start in media time
+	moof      *mp4.MoofBox
+	pending   []sample
+
+	kind         string // "video" or "audio"
+	codecID      string
+	codecPrivate []byte
+	width        uint16
+	height       uint16
+	colour       []byte
+	blockAdd     []byte
+	sampleRate   float64
+	channels     uint16
+	nalLenSize   int
+	stripCC      bool
+}
+
+// openMP4 opens a fragmented MP4 file and reads its track description.
+func openMP4(path string) (*mp4Track, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	t := &mp4Track{f: f, size: uint64(info.Size())}
+	for t.pos < t.size {
+		hdr, boxSize, err := t.header()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if hdr.Name == "moov" {
+			box, err := mp4.DecodeBoxBody(t.pos, hdr, f)
+			if err == nil {
+				err = t.describe(box.(*mp4.MoovBox))
+			}
+			if err != nil {
+				f.Close()
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+			t.pos += boxSize
+			return t, nil
+		}
+		t.pos += boxSize
+	}
+	f.Close()
+	return nil, fmt.Errorf("%s: no moov box", path)
+}
+
+func (t *mp4Track) Close() error {
+	return t.f.Close()
+}
+
+// header decodes the box header at the current position.
+func (t *mp4Track) header() (mp4.BoxHeader, uint64, error) {
+	if _, err := t.f.Seek(int64(t.pos), io.SeekStart); err != nil {
+		return mp4.BoxHeader{}, 0, err
+	}
+	hdr, err := mp4.DecodeHeader(t.f)
+	if err != nil {
+		return hdr, 0, err
+	}
+	boxSize := hdr.Size
+	if boxSize == 0 {
+		boxSize = t.size - t.pos
+	}
+	return hdr, boxSize, nil
+}
+
+// describe fills in the codec parameters from the first supported track.
+func (t *mp4Track) describe(moov *mp4.MoovBox) error {
+	if moov.Mvex == nil {
+		return fmt.Errorf("not a fragmented MP4")
+	}
+	for _, trak := range moov.Traks {
+		if trak.Mdia == nil || trak.Mdia.Minf == nil || trak.Mdia.Minf.Stbl == nil {
+			continue
+		}
+		stsd := trak.Mdia.Minf.Stbl.Stsd
+		if stsd == nil || len(stsd.Children) == 0 {
+			continue
+		}
+		var err error
+		switch entry := stsd.Children[0].(type) {
+		case *mp4.VisualSampleEntryBox:
+			err = t.describeVideo(entry)
+		case *mp4.AudioSampleEntryBox:
+			err = t.describeAudio(entry)
+		default:
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		t.timescale = trak.Mdia.Mdhd.Timescale
+		for _, trex := range moov.Mvex.Trexs {
+			if trex.TrackID == trak.Tkhd.TrackID {
+				t.trex = trex
+			}
+		}
+		if t.trex == nil {
+			t.trex = &mp4.TrexBox{TrackID: trak.Tkhd.TrackID}
+		}
+		if trak.Edts != nil && len(trak.Edts.Elst) > 0 {
+			for _, e := range trak.Edts.Elst[0].Entries {
+				if e.MediaTime >= 0 {
+					t.offset = e.MediaTime
+					break
+				}
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("no video or audio track")
+}
+
+// boxPayload returns the encoded body of a box without its header.
+func boxPayload(b mp4.Box) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := b.Encode(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes()[8:], nil
+}
+
+func (t *mp4Track) describeVideo(e *mp4.VisualSampleEntryBox) error {
+	t.kind = "video"
+	t.width, t.height = e.Width, e.Height
+	var err error
+	switch {
+	case e.AvcC != nil:
+		t.codecID = "V_MPEG4/ISO/AVC"
+		if t.codecPrivate, err = boxPayload(e.AvcC); err == nil && len(t.codecPrivate) > 4 {
+			t.nalLenSize = int(t.codecPrivate[4]&3) + 1
+		}
+	case e.HvcC != nil:
+		t.codecID = "V_MPEGH/ISO/HEVC"
+		if t.codecPrivate, err = boxPayload(e.HvcC); err == nil && len(t.codecPrivate) > 21 {
+			t.nalLenSize = int(t.codecPrivate[21]&3) + 1
+		}
+	default:
+		return fmt.Errorf("unsupported video codec %s", e.Type())
+	}
+	if err != nil {
+		return err
+	}
+	if e.DoViConfig != nil {
+		payload, err := boxPayload(e.DoViConfig)
+		if err != nil {
+			return err
+		}
+		fourCC := []byte(e.DoViConfig.Type())
+		t.blockAdd = master(idBlockAddMapping,
+			uintElement(idBlockAddIDType, uint64(fourCC[0])<<24|uint64(fourCC[1])<<16|uint64(fourCC[2])<<8|uint64(fourCC[3])),
+			element(idBlockAddIDExtraData, payload))
+	}
+	t.colour = videoColour(e)
+	return nil
+}
+
+// videoColour maps the colr, mdcv and clli boxes to a Colour element, so
+// HDR signalling survives the remux.
+func videoColour(e *mp4.VisualSampleEntryBox) []byte {
+	var children [][]byte
+	for _, c := range e.Children {
+		colr, ok := c.(*mp4.ColrBox)
+		if !ok || (colr.ColorType != "nclx" && colr.ColorType != "nclc") {
+			continue
+		}
+		rng := uint64(1)
+		if colr.FullRangeFlag {
+			rng = 2
+		}
+		children = append(children,
+			uintElement(idMatrixCoefficients, uint64(colr.MatrixCoefficients)),
+			uintElement(idRange, rng),
+			uintElement(idTransferCharacteristics, uint64(colr.TransferCharacteristics)),
+			uintElement(idPrimaries, uint64(colr.ColorPrimaries)))
+		break
+	}
+	if e.Clli != nil {
+		children = append(children,
+			uintElement(idMaxCLL, uint64(e.Clli.MaxContentLightLevel)),
+			uintElement(idMaxFALL, uint64(e.Clli.MaxPicAverageLightLevel)))
+	}
+	if m := e.Mdcv; m != nil {
+		// mdcv stores primaries in units of 0.00002 in G, B, R order and
+		// luminance in units of 0.0001 cd/m2.
+		chroma := func(id uint32, v uint16) []byte { return floatElement(id, float64(v)*0.00002) }
+		children = append(children, master(idMasteringMetadata,
+			chroma(idPrimaryRChromaticityX, m.DisplayPrimariesX[2]),
+			chroma(idPrimaryRChromaticityY, m.DisplayPrimariesY[2]),
+			chroma(idPrimaryGChromaticityX, m.DisplayPrimariesX[0]),
+			chroma(idPrimaryGChromaticityY, m.DisplayPrimariesY[0]),
+			chroma(idPrimaryBChromaticityX, m.DisplayPrimariesX[1]),
+			chroma(idPrimaryBChromaticityY, m.DisplayPrimariesY[1]),
+			chroma(idWhitePointChromaX, m.WhitePointX),
+			chroma(idWhitePointChromaY, m.WhitePointY),
+			floatElement(idLuminanceMax, float64(m.MaxDisplayMasteringLuminance)*0.0001),
+			floatElement(idLuminanceMin, float64(m.MinDisplayMasteringLuminance)*0.0001)))
+	}
+	if len(children) == 0 {
+		return nil
+	}
+	return master(idColour, children...)
+}
+
+func (t *mp4Track) describeAudio(e *mp4.AudioSampleEntryBox) error {
+	t.kind = "audio"
+	t.sampleRate = float64(e.SampleRate)
+	t.channels = e.ChannelCount
+	switch e.Type() {
+	case "mp4a":
+		t.codecID = "A_AAC"
+		if e.Esds != nil && e.Esds.DecConfigDescriptor != nil && e.Esds.DecConfigDescriptor.DecSpecificInfo != nil {
+			t.codecPrivate = e.Esds.DecConfigDescriptor.DecSpecificInfo.DecConfig
+		}
+	case "ec-3":
+		t.codecID = "A_EAC3"
+		if e.Dec3 != nil {
+			// The channel count of the sample entry is fixed at 2 for
+			// E-AC-3; the real layout is in the dec3 substreams.
+			if n := dec3Channels(e.Dec3); n > 0 {
+				t.channels = n
+			}
+		}
+	case "ac-3":
+		t.codecID = "A_AC3"
+	default:
+		return fmt.Errorf("unsupported audio codec %s", e.Type())
+	}
+	return nil
+}
+
+// dec3Channels returns the channel count of the independent substream of an
+// E-AC-3 track, counting LFE.
+func dec3Channels(d *mp4.Dec3Box) uint16 {
+	if len(d.EC3Subs) == 0 {
+		return 0
+	}
+	nrChans, _ := d.ChannelInfo()
+	return uint16(nrChans)
+}
+
+// next returns the next sample in decode order, or io.EOF.
+func (t *mp4Track) next() (sample, error) {
+	for len(t.pending) == 0 {
+		if t.pos >= t.size {
+			return sample{}, io.EOF
+		}
+		hdr, boxSize, err := t.header()
+		if err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return sample{}, io.EOF
+			}
+			return sample{}, err
+		}
+		switch hdr.Name {
+		case "moof":
+			box, err := mp4.DecodeBoxBody(t.pos, hdr, t.f)
+			if err != nil {
+				return sample{}, err
+			}
+			t.moof = box.(*mp4.MoofBox)
+		case "mdat":
+			if t.moof == nil {
+				break
+			}
+			box, err := mp4.DecodeBoxBody(t.pos, hdr, t.f)
+			if err != nil {
+				return sample{}, err
+			}
+			frag := &mp4.Fragment{Moof: t.moof, Mdat: box.(*mp4.MdatBox)}
+			t.moof = nil
+			samples, err := frag.GetFullSamples(t.trex)
+			if err != nil {
+				return sample{}, err
+			}
+			for _, s := range samples {
+				data := s.Data
+				if t.stripCC {
+					data = stripCaptionSEI(data, t.nalLenSize, t.codecID == "V_MPEGH/ISO/HEVC")
+				}
+				t.pending = append(t.pending, sample{
+					dts:  t.duration(int64(s.DecodeTime) - t.offset),
+					pts:  t.duration(s.PresentationTime() - t.offset),
+					dur:  t.duration(int64(s.Dur)),
+					key:  t.kind == "audio" || s.IsSync(),
+					data: data,
+				})
+			}
+		}
+		t.pos += boxSize
+	}
+	s := t.pending[0]
+	t.pending = t.pending[1:]
+	return s, nil
+}
+
+func (t *mp4Track) duration(v int64) time.Duration {
+	return time.Duration(v) * time.Second / time.Duration(t.timescale)
+}
+
+// stripCaptionSEI removes the SEI NAL units carrying CEA-608/708 caption
+// data (ATSC "GA94" user data) from a length-prefixed video sample, so the
+// captions are not shown twice next to the subtitle tracks.
+func stripCaptionSEI(data []byte, lenSize int, hevc bool) []byte {
+	if lenSize == 0 {
+		return data
+	}
+	out := data[:0:0]
+	for pos := 0; pos+lenSize <= len(data); {
+		n := 0
+		for i := 0; i < lenSize; i++ {
+			n = n<<8 | int(data[pos+i])
+		}
+		end := pos + lenSize + n
+		if end > len(data) || n == 0 {
+			return data
+		}
+		nal := data[pos+lenSize : end]
+		isSEI := nal[0]&0x1F == 6
+		if hevc {
+			isSEI = (nal[0]>>1)&0x3F == 39
+		}
+		if !isSEI || !bytes.Contains(nal, []byte("GA94")) {
+			out = append(out, data[pos:end]...)
+		}
+		pos = end
+	}
+	return out
+}
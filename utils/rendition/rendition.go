@@ -0,0 +1,452 @@
+// Package rendition picks music video renditions from an HLS master playlist
+// by codec, dynamic range, resolution, bitrate and audio layout.
+package rendition
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/grafov/m3u8"
+)
+
+// Video codec families
+const (
+	CodecAVC  = "AVC"
+	CodecHEVC = "HEVC"
+)
+
+// Dynamic ranges
+const (
+	RangeSDR         = "SDR"
+	RangeHDR10       = "HDR10"
+	RangeHLG         = "HLG"
+	RangeDolbyVision = "Dolby Vision"
+)
+
+// Audio types, in the order mv-audio-type falls back through them
+const (
+	AudioAtmos = "atmos"
+	AudioAC3   = "ac3"
+	AudioAAC   = "aac"
+)
+
+// Video is one video rendition of a master playlist.
+type Video struct {
+	URL              string
+	Bandwidth        int // bits per second
+	AverageBandwidth int
+	Width, Height    int
+	FrameRate        float64
+	Codecs           string
+	Codec            string // CodecAVC or CodecHEVC
+	Range            string // RangeSDR, RangeHDR10, RangeHLG or RangeDolbyVision
+}
+
+// Resolution returns the height as "2160p".
+func (v Video) Resolution() string {
+	if v.Height == 0 {
+		return ""
+	}
+	return strconv.Itoa(v.Height) + "p"
+}
+
+// Audio is one audio rendition (EXT-X-MEDIA TYPE=AUDIO) of a master playlist.
+type Audio struct {
+	URL      string
+	GroupID  string
+	Name     string
+	Language string
+	Default  bool
+	Codecs   string
+	Type     string // AudioAtmos, AudioAC3 or AudioAAC
+	Channels int
+	Bitrate  int // kbps, from the _grN_ rank in the URI
+}
+
+// Label returns the display name of the audio type.
+func (a Audio) Label() string {
+	switch a.Type {
+	case AudioAtmos:
+		return "Atmos"
+	case AudioAC3:
+		return "AC3"
+	case AudioAAC:
+		return "AAC"
+	}
+	return a.Type
+}
+
+// Layout returns the channel layout as "2.0", "5.1" or "Atmos".
+func (a Audio) Layout() string {
+	switch {
+	case a.Type == AudioAtmos:
+		return "Atmos"
+	case a.Channels == 6:
+		return "5.1"
+	case a.Channels == 8:
+		return "7.1"
+	case a.Channels > 0:
+		return strconv.Itoa(a.Channels) + ".0"
+	}
+	return ""
+}
+
+// Videos returns the distinct video renditions of a master playlist. A video
+// URI listed once per audio group is returned once.
+func Videos(master *m3u8.MasterPlaylist, base *url.URL) []Video {
+	var videos []Video
+	seen := map[string]bool{}
+	for _, variant := range master.Variants {
+		if variant.Iframe || variant.Resolution == "" {
+			continue
+		}
+		u, err := base.Parse(variant.URI)
+		if err != nil || seen[u.String()] {
+			continue
+		}
+		seen[u.String()] = true
+		v := Video{
+			URL:              u.String(),
+			Bandwidth:        int(variant.Bandwidth),
+			AverageBandwidth: int(variant.AverageBandwidth),
+			FrameRate:        variant.FrameRate,
+			Codecs:           variant.Codecs,
+		}
+		if w, h, ok := strings.Cut(variant.Resolution, "x"); ok {
+			v.Width, _ = strconv.Atoi(w)
+			v.Height, _ = strconv.Atoi(h)
+		}
+		v.Codec, v.Range = videoFormat(variant.Codecs, variant.VideoRange)
+		videos = append(videos, v)
+	}
+	return videos
+}
+
+// videoFormat returns the codec family and dynamic range from the CODECS and
+// VIDEO-RANGE attributes.
+func videoFormat(codecs, videoRange string) (codec, dynamicRange string) {
+	codecs = strings.ToLower(codecs)
+	switch {
+	case strings.Contains(codecs, "dvh1"), strings.Contains(codecs, "dvhe"):
+		return CodecHEVC, RangeDolbyVision
+	case strings.Contains(codecs, "hvc1"), strings.Contains(codecs, "hev1"):
+		codec = CodecHEVC
+	case strings.Contains(codecs, "avc"):
+		codec = CodecAVC
+	}
+	switch strings.ToUpper(videoRange) {
+	case "PQ":
+		dynamicRange = RangeHDR10
+	case "HLG":
+		dynamicRange = RangeHLG
+	default:
+		dynamicRange = RangeSDR
+	}
+	return codec, dynamicRange
+}
+
+var (
+	mediaTagRe  = regexp.MustCompile(`^#EXT-X-MEDIA:(.*)$`)
+	mediaAttrRe = regexp.MustCompile(`([A-Z0-9-]+)=("[^"]*"|[^,]*)`)
+	groupRankRe = regexp.MustCompile(`_gr(\d+)_`)
+)
+
+// Audios returns the audio renditions of a master playlist. The raw playlist
+// text is needed because the CHANNELS attribute is not kept by the m3u8 parser.
+func Audios(playlist string, master *m3u8.MasterPlaylist, base *url.URL) []Audio {
+	// The codec of an audio group is only listed on the variants using it.
+	groupCodecs := map[string]string{}
+	for _, variant := range master.Variants {
+		if variant.Audio == "" {
+			continue
+		}
+		for _, c := range strings.Split(variant.Codecs, ",") {
+			c = strings.TrimSpace(c)
+			if strings.HasPrefix(c, "mp4a") || strings.HasPrefix(c, "ec-3") || strings.HasPrefix(c, "ac-3") {
+				groupCodecs[variant.Audio] = c
+			}
+		}
+	}
+
+	var audios []Audio
+	seen := map[string]bool{}
+	for _, line := range strings.Split(playlist, "\n") {
+		m := mediaTagRe.FindStringSubmatch(strings.TrimSpace(line))
+		if m == nil {
+			continue
+		}
+		attrs := map[string]string{}
+		for _, kv := range mediaAttrRe.FindAllStringSubmatch(m[1], -1) {
+			attrs[kv[1]] = strings.Trim(kv[2], `"`)
+		}
+		if attrs["TYPE"] != "AUDIO" || attrs["URI"] == "" {
+			continue
+		}
+		u, err := base.Parse(attrs["URI"])
+		if err != nil || seen[u.String()] {
+			continue
+		}
+		seen[u.String()] = true
+		a := Audio{
+			URL:      u.String(),
+			GroupID:  attrs["GROUP-ID"],
+			Name:     attrs["NAME"],
+			Language: attrs["LANGUAGE"],
+			Default:  attrs["DEFAULT"] == "YES",
+			Codecs:   groupCodecs[attrs["GROUP-ID"]],
+		}
+		channels := attrs["CHANNELS"]
+		a.Channels, _ = strconv.Atoi(strings.Split(channels, "/")[0])
+		if r := groupRankRe.FindStringSubmatch(attrs["URI"]); r != nil {
+			a.Bitrate, _ = strconv.Atoi(r[1])
+		}
+		a.Type = audioType(a.GroupID, a.Codecs, channels)
+		audios = append(audios, a)
+	}
+	return audios
+}
+
+// audioType classifies a rendition by codec and channel layout, falling back
+// to the group ID naming used by Apple Music.
+func audioType(groupID, codecs, channels string) string {
+	switch {
+	case strings.Contains(channels, "JOC"), strings.Contains(groupID, "atmos"):
+		return AudioAtmos
+	case strings.HasPrefix(codecs, "ec-3"), strings.HasPrefix(codecs, "ac-3"), strings.Contains(groupID, "ac3"):
+		return AudioAC3
+	case strings.HasPrefix(codecs, "mp4a"), strings.Contains(groupID, "stereo"), strings.Contains(groupID, "aac"):
+		return AudioAAC
+	}
+	return ""
+}
+
+// VideoPrefs are the ordered preferences used to pick a video rendition.
+// Empty lists and zero limits place no constraint.
+type VideoPrefs struct {
+	Codecs       []string // codec families, most preferred first
+	Ranges       []string // dynamic ranges, most preferred first
+	MaxHeight    int
+	MaxBitrate   int // kbps, compared against the average bandwidth
+	MaxFrameRate float64
+}
+
+// Acceptable reports whether v satisfies the limits and listed preferences.
+func (p VideoPrefs) Acceptable(v Video) bool {
+	switch {
+	case p.MaxHeight > 0 && v.Height > p.MaxHeight:
+		return false
+	case p.MaxBitrate > 0 && videoBitrate(v) > p.MaxBitrate*1000:
+		return false
+	case p.MaxFrameRate > 0 && v.FrameRate > p.MaxFrameRate+0.01:
+		return false
+	}
+	return rank(p.Codecs, v.Codec) >= 0 && rank(p.Ranges, v.Range) >= 0
+}
+
+func videoBitrate(v Video) int {
+	if v.AverageBandwidth > 0 {
+		return v.AverageBandwidth
+	}
+	return v.Bandwidth
+}
+
+// SelectVideo returns the best acceptable video: the most preferred range,
+// then codec, then the highest resolution, frame rate and bitrate.
+func SelectVideo(videos []Video, prefs VideoPrefs) (Video, bool) {
+	var candidates []Video
+	for _, v := range videos {
+		if prefs.Acceptable(v) {
+			candidates = append(candidates, v)
+		}
+	}
+	if len(candidates) == 0 {
+		return Video{}, false
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if ra, rb := rank(prefs.Ranges, a.Range), rank(prefs.Ranges, b.Range); ra != rb {
+			return ra < rb
+		}
+		if ca, cb := rank(prefs.Codecs, a.Codec), rank(prefs.Codecs, b.Codec); ca != cb {
+			return ca < cb
+		}
+		// Without preferences this keeps the old highest-bandwidth choice.
+		if len(prefs.Ranges) > 0 || len(prefs.Codecs) > 0 {
+			if a.Height != b.Height {
+				return a.Height > b.Height
+			}
+			if a.FrameRate != b.FrameRate {
+				return a.FrameRate > b.FrameRate
+			}
+		}
+		return videoBitrate(a) > videoBitrate(b)
+	})
+	return candidates[0], true
+}
+
+// AudioPrefs are the ordered preferences used to pick an audio rendition.
+type AudioPrefs struct {
+	Types       []string // audio types, most preferred first
+	MaxChannels int
+	Language    string // preferred language; "" prefers the playlist's default rendition
+}
+
+// Acceptable reports whether a satisfies the listed types and channel limit.
+func (p AudioPrefs) Acceptable(a Audio) bool {
+	if p.MaxChannels > 0 && a.Channels > p.MaxChannels {
+		return false
+	}
+	return rank(p.Types, a.Type) >= 0
+}
+
+// SelectAudio returns the best acceptable audio: the most preferred type,
+// then the preferred language, the most channels and the highest bitrate.
+func SelectAudio(audios []Audio, prefs AudioPrefs) (Audio, bool) {
+	var candidates []Audio
+	for _, a := range audios {
+		if prefs.Acceptable(a) {
+			candidates = append(candidates, a)
+		}
+	}
+	if len(candidates) == 0 {
+		return Audio{}, false
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if ta, tb := rank(prefs.Types, a.Type), rank(prefs.Types, b.Type); ta != tb {
+			return ta < tb
+		}
+		if la, lb := matchesLanguage(a, prefs.Language), matchesLanguage(b, prefs.Language); la != lb {
+			return la
+		}
+		if a.Channels != b.Channels {
+			return a.Channels > b.Channels
+		}
+		return a.Bitrate > b.Bitrate
+	})
+	return candidates[0], true
+}
+
+// SelectAudios returns the best rendition of each listed type, skipping
+// types the playlist does not offer. Stereo renditions are moved to the front
+// so players that cannot decode multichannel audio start on a usable track.
+func SelectAudios(audios []Audio, types []string, prefs AudioPrefs) []Audio {
+	var picked []Audio
+	for _, t := range types {
+		p := prefs
+		p.Types = []string{t}
+		if a, ok := SelectAudio(audios, p); ok {
+			picked = append(picked, a)
+		}
+	}
+	sort.SliceStable(picked, func(i, j int) bool { return picked[i].IsStereo() && !picked[j].IsStereo() })
+	return picked
+}
+
+// IsStereo reports whether the rendition is known to have one or two
+// channels.
+func (a Audio) IsStereo() bool {
+	return a.Type != AudioAtmos && (a.Channels == 1 || a.Channels == 2)
+}
+
+// Title returns a track title such as "AAC Stereo" or "Dolby Atmos".
+func (a Audio) Title() string {
+	switch {
+	case a.Type == AudioAtmos:
+		return "Dolby Atmos"
+	case a.IsStereo():
+		return a.Label() + " Stereo"
+	case a.Layout() == "":
+		return a.Label()
+	}
+	return a.Label() + " " + a.Layout()
+}
+
+func matchesLanguage(a Audio, lang string) bool {
+	if lang == "" {
+		return a.Default
+	}
+	al, _, _ := strings.Cut(strings.ToLower(a.Language), "-")
+	pl, _, _ := strings.Cut(strings.ToLower(lang), "-")
+	return al == pl
+}
+
+// rank returns the index of value in prefs, 0 for every value when prefs is
+// empty, or -1 when value is not listed.
+func rank(prefs []string, value string) int {
+	if len(prefs) == 0 {
+		return 0
+	}
+	for i, p := range prefs {
+		if p == value {
+			return i
+		}
+	}
+	return -1
+}
+
+// ParseCodecs normalises a comma separated codec list such as "hevc,avc"
+// (h264 and h265 are accepted as aliases).
+func ParseCodecs(list string) ([]string, error) {
+	return parseList(list, "video codec", map[string]string{
+		"avc": CodecAVC, "h264": CodecAVC, "h.264": CodecAVC,
+		"hevc": CodecHEVC, "h265": CodecHEVC, "h.265": CodecHEVC,
+	})
+}
+
+// ParseRanges normalises a comma separated dynamic range list such as
+// "sdr,hdr10,dolby-vision".
+func ParseRanges(list string) ([]string, error) {
+	return parseList(list, "dynamic range", map[string]string{
+		"sdr":          RangeSDR,
+		"hdr":          RangeHDR10,
+		"hdr10":        RangeHDR10,
+		"pq":           RangeHDR10,
+		"hlg":          RangeHLG,
+		"dv":           RangeDolbyVision,
+		"dolby-vision": RangeDolbyVision,
+		"dolbyvision":  RangeDolbyVision,
+	})
+}
+
+// ParseAudioTypes normalises a comma separated audio type list such as
+// "aac,atmos" (stereo is accepted as an alias for aac).
+func ParseAudioTypes(list string) ([]string, error) {
+	return parseList(list, "audio type", map[string]string{
+		"atmos": AudioAtmos, "ac3": AudioAC3, "aac": AudioAAC, "stereo": AudioAAC,
+	})
+}
+
+// AudioTypes returns the fallback order for an mv-audio-type setting.
+func AudioTypes(preferred string) []string {
+	switch strings.ToLower(preferred) {
+	case AudioAC3:
+		return []string{AudioAC3, AudioAAC}
+	case AudioAAC:
+		return []string{AudioAAC}
+	}
+	return []string{AudioAtmos, AudioAC3, AudioAAC}
+}
+
+// parseList maps the items of a comma separated list to their canonical
+// names. An item that is not one of names is an error, so a typo does not
+// quietly lift the constraint.
+func parseList(list string, what string, names map[string]string) ([]string, error) {
+	var out []string
+	for _, item := range strings.Split(list, ",") {
+		item = strings.ToLower(strings.TrimSpace(item))
+		if item == "" {
+			continue
+		}
+		name, ok := names[item]
+		if !ok {
+			return nil, fmt.Errorf("unknown %s %q", what, item)
+		}
+		out = append(out, name)
+	}
+	return out, nil
+}
@@ -678,19 +678,21 @@ func DecryptFragment(frag *mp4.Fragment, tracks map[uint32]mp4.DecryptTrackInfo,
 	return nil
 }
 
+// EncoderDelay returns the priming samples the stream of a codec starts
+// with, which the edit list written by InjectElst skips.
+func EncoderDelay(codecName string) int64 {
+	switch codecName {
+	case "alac", "ec3", "aac", "aac-he", "aac-binaural", "aac-downmix":
+		return 2112
+	}
+	// "aac-lc" is intentionally absent
+	return 0
+}
+
 // InjectElst adds an Edit List box to the init segment to skip encoder delay samples
 func InjectElst(init *mp4.InitSegment, codecName string) {
-	const encoderDelay = int64(2112)
-	needsElst := map[string]bool{
-		"alac":         true,
-		"ec3":          true,
-		"aac":          true,
-		"aac-he":       true,
-		"aac-binaural": true,
-		"aac-downmix":  true,
-		// "aac-lc" is intentionally absent
-	}
-	if !needsElst[codecName] {
+	encoderDelay := EncoderDelay(codecName)
+	if encoderDelay == 0 {
 		return
 	}
 	for _, trak := range init.Moov.Traks {
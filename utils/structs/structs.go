@@ -14,6 +14,7 @@ type ConfigSet struct {
 	EmbedLrc                   bool   `yaml:"embed-lrc"`
 	EmbedCover                 bool   `yaml:"embed-cover"`
 	SaveArtistCover            bool   `yaml:"save-artist-cover"`
+	SaveNFO                    bool   `yaml:"save-nfo"`
 	CoverSize                  string `yaml:"cover-size"`
 	CoverFormat                string `yaml:"cover-format"`
 	TagSortOrder               bool   `yaml:"tag-sort-order"`
@@ -26,6 +27,8 @@ type ConfigSet struct {
 	PlaylistFolderFormat       string `yaml:"playlist-folder-format"`
 	ArtistFolderFormat         string `yaml:"artist-folder-format"`
 	SongFileFormat             string `yaml:"song-file-format"`
+	MVFolderFormat             string `yaml:"mv-folder-format"`
+	MVFileFormat               string `yaml:"mv-file-format"`
 	SeparateDiscFolders        bool   `yaml:"separate-disc-folders"`
 	ExplicitChoice             string `yaml:"explicit-choice"`
 	CleanChoice                string `yaml:"clean-choice"`
@@ -46,6 +49,9 @@ type ConfigSet struct {
 	PreferPlaylistEditorial    bool   `yaml:"prefer-playlist-editorial"`
 	MVAudioType                string `yaml:"mv-audio-type"`
 	MVMax                      int    `yaml:"mv-max"`
+	MVSubtitleMode             string `yaml:"mv-subtitle-mode"`
+	MVSubtitleLanguages        string `yaml:"mv-subtitle-languages"`
+	MVSubtitleDefaultLanguage  string `yaml:"mv-subtitle-default-language"`
 	DownloadMusicVideo         bool   `yaml:"download-music-video"`
 	ALACFix                    bool   `yaml:"alac-fix"`
 	ConvertAfterDownload       bool   `yaml:"convert-after-download"`
@@ -59,6 +65,62 @@ type ConfigSet struct {
 	ConvertSkipLossyToLossless bool   `yaml:"convert-skip-lossy-to-lossless"`
 	ConvertCheckBadALAC        bool   `yaml:"convert-check-bad-alac"`
 	ConvertDeleteBadALAC       bool   `yaml:"convert-delete-bad-alac"`
+
+	// Music video rendition preferences
+	MVVideoCodecs      string  `yaml:"mv-video-codecs"`
+	MVVideoRanges      string  `yaml:"mv-video-ranges"`
+	MVMaxBitrate       int     `yaml:"mv-max-bitrate"`
+	MVMaxFrameRate     float64 `yaml:"mv-max-framerate"`
+	MVAudioMaxChannels int     `yaml:"mv-audio-max-channels"`
+	MVAudioLanguage    string  `yaml:"mv-audio-language"`
+	MVAudioTracks      string  `yaml:"mv-audio-tracks"`
+	MVContainer        string  `yaml:"mv-container"`
+
+	// Loudness tagging
+	ReplayGain bool `yaml:"replaygain"`
+
+	// Archival
+	SaveManifest bool   `yaml:"save-manifest"`
+	AlbumImage   string `yaml:"album-image"`
+
+	// Named conversion profiles, each writing its own output tree
+	ConvertProfiles map[string]ConvertProfile `yaml:"convert-profiles"`
+
+	// Sample-rate and bit-depth limits for downloads and every conversion
+	AudioPolicy AudioPolicy `yaml:"audio-policy"`
+
+	// Edition de-duplication of artist album lists
+	DedupeEditions    bool     `yaml:"dedupe-editions"`
+	EditionPreference []string `yaml:"edition-preference"` // explicit, clean, most-tracks, apple-digital-master, hi-res
+
+	// Rating of the album and song editions to download: explicit, clean,
+	// or empty for the edition linked
+	ContentVersionPreference string `yaml:"content-version-preference"`
+}
+
+// AudioPolicy limits the sample rate and bit depth of ALAC downloads and of
+// all converted files. Profiles may set lower limits of their own.
+type AudioPolicy struct {
+	PreferredRates   []int  `yaml:"preferred-rates"`   // ALAC sample rates to pick first, in order, e.g. [48000, 44100]
+	MaxRate          int    `yaml:"max-rate"`          // highest sample rate to download or convert to; 0 = no limit
+	MaxBitDepth      int    `yaml:"max-bit-depth"`     // highest bit depth to download or convert to; 0 = no limit
+	DownsampleMethod string `yaml:"downsample-method"` // ffmpeg resampler: swr (default) or soxr
+	Dither           string `yaml:"dither"`            // ffmpeg dither method when reducing to 16 bit, e.g. "triangular"
+}
+
+// ConvertProfile describes one derived copy of every downloaded track.
+type ConvertProfile struct {
+	Format     string `yaml:"format"`      // flac | mp3 | opus | wav | aiff
+	Bitrate    string `yaml:"bitrate"`     // mp3/opus, e.g. "320k"; empty = encoder default (mp3 VBR q2, opus 192k)
+	Quality    string `yaml:"quality"`     // mp3 VBR quality (0-9) when no bitrate is set
+	CBR        bool   `yaml:"cbr"`         // constant bitrate for mp3 (ABR otherwise) and opus
+	SampleRate int    `yaml:"sample-rate"` // max sample rate; higher sources are resampled
+	BitDepth   int    `yaml:"bit-depth"`   // max bit depth; 16 also feeds mp3/opus encoders 16 bit samples
+	Dither     string `yaml:"dither"`      // ffmpeg dither method when reducing to 16 bit, e.g. "triangular"
+	Channels   int    `yaml:"channels"`    // output channels, e.g. 2 to downmix Atmos; 0 = keep
+	CoverSize  int    `yaml:"cover-size"`  // max cover width/height in pixels for the copies; 0 = original
+	Output     string `yaml:"output"`      // root of the profile's tree, mirroring the download folders
+	ExtraArgs  string `yaml:"extra-args"`  // additional raw ffmpeg args
 }
 
 type Counter struct {
@@ -108,9 +170,12 @@ type AutoGeneratedArtist struct {
 				ID   string `json:"id"`
 				Kind string `json:"kind"`
 			} `json:"playParams"`
-			TrackNumber  int    `json:"trackNumber"`
-			AudioLocale  string `json:"audioLocale"`
-			ComposerName string `json:"composerName"`
+			TrackNumber   int    `json:"trackNumber"`
+			AudioLocale   string `json:"audioLocale"`
+			ComposerName  string `json:"composerName"`
+			IsSingle      bool   `json:"isSingle"`
+			IsCompilation bool   `json:"isCompilation"`
+			TrackCount    int    `json:"trackCount"`
 		} `json:"attributes"`
 	} `json:"data"`
 }
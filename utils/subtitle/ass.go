@@ -0,0 +1,95 @@
+package subtitle
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ASS script resolution; positions are scaled from frame percentages to it.
+const (
+	assPlayResX = 1920
+	assPlayResY = 1080
+)
+
+const assHeader = `[Script Info]
+ScriptType: v4.00+
+WrapStyle: 0
+ScaledBorderAndShadow: yes
+PlayResX: %d
+PlayResY: %d
+
+[V4+ Styles]
+Format: Name, Fontname, Fontsize, PrimaryColour, SecondaryColour, OutlineColour, BackColour, Bold, Italic, Underline, StrikeOut, ScaleX, ScaleY, Spacing, Angle, BorderStyle, Outline, Shadow, Alignment, MarginL, MarginR, MarginV, Encoding
+Style: Default,Arial,60,&H00FFFFFF,&H000000FF,&H00000000,&H80000000,0,0,0,0,100,100,0,0,1,3,0,2,60,60,50,1
+
+[Events]
+Format: Layer, Start, End, Style, Name, MarginL, MarginR, MarginV, Effect, Text
+`
+
+// formatASSTime formats a duration as H:MM:SS.cc.
+func formatASSTime(d time.Duration) string {
+	cs := d.Milliseconds() / 10
+	return fmt.Sprintf("%d:%02d:%02d.%02d", cs/360000, cs/6000%60, cs/100%60, cs%100)
+}
+
+// assText renders cue lines with ASS override tags and \N line breaks.
+func assText(lines []Line) string {
+	out := make([]string, 0, len(lines))
+	// Override tags stay in effect across \N, so the state spans lines.
+	var italic, bold, underline bool
+	for _, line := range lines {
+		var sb strings.Builder
+		for _, s := range line {
+			if s.Italic != italic {
+				sb.WriteString(map[bool]string{true: `{\i1}`, false: `{\i0}`}[s.Italic])
+				italic = s.Italic
+			}
+			if s.Bold != bold {
+				sb.WriteString(map[bool]string{true: `{\b1}`, false: `{\b0}`}[s.Bold])
+				bold = s.Bold
+			}
+			if s.Underline != underline {
+				sb.WriteString(map[bool]string{true: `{\u1}`, false: `{\u0}`}[s.Underline])
+				underline = s.Underline
+			}
+			// Braces start override blocks in ASS
+			text := strings.NewReplacer("{", "(", "}", ")", "\n", " ").Replace(s.Text)
+			sb.WriteString(text)
+		}
+		out = append(out, sb.String())
+	}
+	return strings.Join(out, `\N`)
+}
+
+// ASSHeader returns the script header written before the dialogue lines.
+// Matroska stores it as the CodecPrivate of S_TEXT/ASS tracks.
+func ASSHeader() string {
+	return fmt.Sprintf(assHeader, assPlayResX, assPlayResY)
+}
+
+// ASSText returns the Text field of the dialogue line of a cue, including
+// the position override.
+func ASSText(c Cue) string {
+	var override string
+	if !c.Position.IsDefault() {
+		override = fmt.Sprintf(`{\an%d}`, c.Position.numpad())
+		if c.Position.Region {
+			x, y := c.Position.anchorPoint()
+			override = fmt.Sprintf(`{\an%d\pos(%d,%d)}`, c.Position.numpad(),
+				int(x*assPlayResX/100+0.5), int(y*assPlayResY/100+0.5))
+		}
+	}
+	return override + assText(c.Lines)
+}
+
+// writeASS renders the document as an Advanced SubStation Alpha script.
+func writeASS(d *Document) string {
+	var sb strings.Builder
+	sb.WriteString(ASSHeader())
+	for _, c := range d.Cues {
+		fmt.Fprintf(&sb, "Dialogue: 0,%s,%s,Default,,0,0,0,,%s\n",
+			formatASSTime(c.Start), formatASSTime(c.End), ASSText(c))
+	}
+	return sb.String()
+}
@@ -0,0 +1,766 @@
+package subtitle
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Eyevinn/mp4ff/mp4"
+	"github.com/Eyevinn/mp4ff/sei"
+)
+
+// ccPair is one CEA-608 byte pair from field 1 with its presentation time.
+type ccPair struct {
+	t      time.Duration
+	b1, b2 byte
+}
+
+// ccTrack describes the MP4 track the caption data is read from: either a
+// video track carrying captions in H.264/HEVC SEI messages or a c608 track.
+type ccTrack struct {
+	trak      *mp4.TrakBox
+	trex      *mp4.TrexBox
+	timescale uint32
+	kind      string // "avc", "hevc" or "c608"
+}
+
+// errStopScan is returned by a pair callback to end the scan early.
+var errStopScan = errors.New("stop scan")
+
+// ReadClosedCaptions decodes the CEA-608 closed captions (CC1) embedded in an
+// MP4 file, either as H.264/HEVC SEI user data or as a c608 track. It returns
+// a document without cues and no error if the file carries no captions.
+func ReadClosedCaptions(videoPath string) (*Document, error) {
+	var pairs []ccPair
+	err := scanCCPairs(videoPath, func(p ccPair) error {
+		pairs = append(pairs, p)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// SEI data is stored in decode order; captions must be fed in presentation order.
+	sort.SliceStable(pairs, func(i, j int) bool { return pairs[i].t < pairs[j].t })
+
+	d := newCEA608Decoder()
+	for _, p := range pairs {
+		d.decode(p.t, p.b1, p.b2)
+	}
+	if len(pairs) > 0 {
+		d.flush(pairs[len(pairs)-1].t + 2*time.Second)
+	}
+	return &Document{Cues: d.cues}, nil
+}
+
+// scanCCPairs walks the top-level boxes of an MP4 file and calls fn for every
+// field 1 caption byte pair. Fragments are decoded one at a time so large
+// videos are never read into memory at once.
+func scanCCPairs(videoPath string, fn func(ccPair) error) error {
+	f, err := os.Open(videoPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := uint64(info.Size())
+
+	var track *ccTrack
+	var moof *mp4.MoofBox
+	fragmented := false
+	pos := uint64(0)
+	for pos < size {
+		if _, err := f.Seek(int64(pos), io.SeekStart); err != nil {
+			return err
+		}
+		hdr, err := mp4.DecodeHeader(f)
+		if err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return err
+		}
+		boxSize := hdr.Size
+		if boxSize == 0 {
+			boxSize = size - pos
+		}
+		switch hdr.Name {
+		case "moov":
+			box, err := mp4.DecodeBoxBody(pos, hdr, f)
+			if err != nil {
+				return err
+			}
+			track = findCCTrack(box.(*mp4.MoovBox))
+			if track == nil {
+				return nil
+			}
+		case "moof":
+			box, err := mp4.DecodeBoxBody(pos, hdr, f)
+			if err != nil {
+				return err
+			}
+			moof = box.(*mp4.MoofBox)
+			fragmented = true
+		case "mdat":
+			if moof == nil || track == nil {
+				break
+			}
+			box, err := mp4.DecodeBoxBody(pos, hdr, f)
+			if err != nil {
+				return err
+			}
+			frag := &mp4.Fragment{Moof: moof, Mdat: box.(*mp4.MdatBox)}
+			moof = nil
+			samples, err := frag.GetFullSamples(track.trex)
+			if err != nil {
+				return err
+			}
+			for _, s := range samples {
+				t := time.Duration(s.PresentationTime()) * time.Second / time.Duration(track.timescale)
+				if err := track.samplePairs(t, time.Duration(s.Dur)*time.Second/time.Duration(track.timescale), s.Data, fn); err != nil {
+					return stopOK(err)
+				}
+			}
+		}
+		pos += boxSize
+	}
+	if track != nil && !fragmented {
+		return stopOK(track.scanProgressive(f, fn))
+	}
+	return nil
+}
+
+func stopOK(err error) error {
+	if errors.Is(err, errStopScan) {
+		return nil
+	}
+	return err
+}
+
+// findCCTrack picks the track carrying captions, preferring a dedicated c608
+// track over SEI data in the video track.
+func findCCTrack(moov *mp4.MoovBox) *ccTrack {
+	var video *ccTrack
+	for _, trak := range moov.Traks {
+		if trak.Mdia == nil || trak.Mdia.Minf == nil || trak.Mdia.Minf.Stbl == nil {
+			continue
+		}
+		stsd := trak.Mdia.Minf.Stbl.Stsd
+		if stsd == nil || len(stsd.Children) == 0 {
+			continue
+		}
+		t := &ccTrack{trak: trak, timescale: trak.Mdia.Mdhd.Timescale}
+		if moov.Mvex != nil {
+			for _, trex := range moov.Mvex.Trexs {
+				if trex.TrackID == trak.Tkhd.TrackID {
+					t.trex = trex
+				}
+			}
+		}
+		if t.trex == nil {
+			t.trex = &mp4.TrexBox{TrackID: trak.Tkhd.TrackID}
+		}
+		switch stsd.Children[0].Type() {
+		case "c608":
+			t.kind = "c608"
+			return t
+		case "avc1", "avc3":
+			t.kind = "avc"
+		case "hvc1", "hev1", "dvh1", "dvhe":
+			t.kind = "hevc"
+		default:
+			continue
+		}
+		if video == nil {
+			video = t
+		}
+	}
+	return video
+}
+
+// scanProgressive reads the samples of a non-fragmented file using the
+// sample table of the track.
+func (t *ccTrack) scanProgressive(f *os.File, fn func(ccPair) error) error {
+	stbl := t.trak.Mdia.Minf.Stbl
+	if stbl.Stsz == nil || stbl.Stsc == nil || stbl.Stts == nil {
+		return nil
+	}
+	nrSamples := stbl.Stsz.GetNrSamples()
+	var chunkNr int
+	var offset uint64
+	for nr := uint32(1); nr <= nrSamples; nr++ {
+		cNr, firstInChunk, err := stbl.Stsc.ChunkNrFromSampleNr(int(nr))
+		if err != nil {
+			return err
+		}
+		if cNr != chunkNr {
+			chunkNr = cNr
+			if stbl.Co64 != nil {
+				offset, err = stbl.Co64.GetOffset(cNr)
+			} else if stbl.Stco != nil {
+				offset, err = stbl.Stco.GetOffset(cNr)
+			} else {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			for i := firstInChunk; i < int(nr); i++ {
+				offset += uint64(stbl.Stsz.GetSampleSize(i))
+			}
+		}
+		size := stbl.Stsz.GetSampleSize(int(nr))
+		data := make([]byte, size)
+		if _, err := f.ReadAt(data, int64(offset)); err != nil {
+			return err
+		}
+		offset += uint64(size)
+
+		decTime, dur := stbl.Stts.GetDecodeTime(nr)
+		pts := int64(decTime)
+		if stbl.Ctts != nil {
+			pts += int64(stbl.Ctts.GetCompositionTimeOffset(nr))
+		}
+		ts := time.Duration(t.timescale)
+		if err := t.samplePairs(time.Duration(pts)*time.Second/ts, time.Duration(dur)*time.Second/ts, data, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// samplePairs extracts the field 1 caption pairs from one sample.
+func (t *ccTrack) samplePairs(pts, dur time.Duration, data []byte, fn func(ccPair) error) error {
+	var field1 []byte
+	switch t.kind {
+	case "c608":
+		field1 = c608Field1(data)
+	default:
+		field1 = seiField1(data, t.kind == "hevc")
+	}
+	nrPairs := len(field1) / 2
+	for i := 0; i < nrPairs; i++ {
+		// Spread multiple pairs in one sample evenly over its duration.
+		pt := pts + dur*time.Duration(i)/time.Duration(nrPairs)
+		if err := fn(ccPair{t: pt, b1: field1[2*i], b2: field1[2*i+1]}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// c608Field1 returns the byte pairs of the cdat boxes in a c608 sample.
+func c608Field1(data []byte) []byte {
+	var out []byte
+	for len(data) >= 8 {
+		size := binary.BigEndian.Uint32(data[0:4])
+		if size < 8 || int(size) > len(data) {
+			break
+		}
+		if string(data[4:8]) == "cdat" {
+			out = append(out, data[8:size]...)
+		}
+		data = data[size:]
+	}
+	return out
+}
+
+// seiField1 returns the CTA-608 field 1 byte pairs found in the SEI NAL units
+// of a length-prefixed H.264 or HEVC sample.
+func seiField1(data []byte, hevc bool) []byte {
+	var out []byte
+	for len(data) >= 4 {
+		naluLen := int(binary.BigEndian.Uint32(data[0:4]))
+		data = data[4:]
+		if naluLen <= 0 || naluLen > len(data) {
+			break
+		}
+		nalu := data[:naluLen]
+		data = data[naluLen:]
+
+		var payload []byte
+		if hevc {
+			// Prefix SEI, two-byte NAL unit header
+			if len(nalu) < 3 || (nalu[0]>>1)&0x3f != 39 {
+				continue
+			}
+			payload = nalu[2:]
+		} else {
+			if len(nalu) < 2 || nalu[0]&0x1f != 6 {
+				continue
+			}
+			payload = nalu[1:]
+		}
+		seiDatas, err := sei.ExtractSEIData(bytes.NewReader(payload))
+		if err != nil && !errors.Is(err, sei.ErrRbspTrailingBitsMissing) {
+			continue
+		}
+		for i := range seiDatas {
+			if seiDatas[i].Type() != sei.SEIUserDataRegisteredITUtT35Type {
+				continue
+			}
+			msg, err := sei.DecodeUserDataRegisteredSEI(&seiDatas[i])
+			if err != nil {
+				continue
+			}
+			if cc, ok := msg.(*sei.CTA608sei); ok {
+				out = append(out, cc.Field1...)
+			}
+		}
+	}
+	return out
+}
+
+// ExtractClosedCaptionsFromMP4 decodes the EIA-608/CEA-608 closed captions of
+// an MP4 file and writes them to outputPath as SRT.
+func ExtractClosedCaptionsFromMP4(videoPath, outputPath string) error {
+	doc, err := ReadClosedCaptions(videoPath)
+	if err != nil {
+		return err
+	}
+	if len(doc.Cues) == 0 {
+		return fmt.Errorf("no closed captions found in video")
+	}
+	return SaveToFile(writeSRT(doc), outputPath)
+}
+
+// parseSCC decodes the CC1 captions of an SCC (Scenarist Closed Caption) file.
+func parseSCC(data string) (*Document, error) {
+	d := newCEA608Decoder()
+	var last time.Duration
+	found := false
+	for _, line := range strings.Split(data, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		start, err := parseSCCTime(fields[0])
+		if err != nil {
+			continue
+		}
+		// One byte pair is transmitted per frame starting at the timecode.
+		for i, word := range fields[1:] {
+			v, err := strconv.ParseUint(word, 16, 16)
+			if err != nil || len(word) != 4 {
+				continue
+			}
+			last = start + time.Duration(i)*sccFrameDuration
+			d.decode(last, byte(v>>8), byte(v))
+			found = true
+		}
+	}
+	if !found {
+		return nil, errors.New("no caption data found in SCC content")
+	}
+	d.flush(last + 2*time.Second)
+	return &Document{Cues: d.cues}, nil
+}
+
+// HasClosedCaptions checks if a video file contains CEA-608 closed captions.
+// It stops reading at the first caption byte pair.
+func HasClosedCaptions(videoPath string) (bool, error) {
+	found := false
+	err := scanCCPairs(videoPath, func(p ccPair) error {
+		if p.b1&0x7f != 0 || p.b2&0x7f != 0 {
+			found = true
+			return errStopScan
+		}
+		return nil
+	})
+	return found, err
+}
+
+const (
+	ccRows = 15
+	ccCols = 32
+)
+
+type ccMode int
+
+const (
+	ccModeNone ccMode = iota
+	ccModePopOn
+	ccModeRollUp
+	ccModePaintOn
+	ccModeText
+)
+
+type ccCell struct {
+	ch     rune
+	italic bool
+}
+
+type ccScreen [ccRows][ccCols]ccCell
+
+func (s *ccScreen) clear() {
+	*s = ccScreen{}
+}
+
+// cue returns the non-empty rows of the screen as cue lines, keeping italics.
+// Captions starting in the upper half of the screen are anchored to the top.
+func (s *ccScreen) cue() ([]Line, Position) {
+	var lines []Line
+	first := -1
+	for r := 0; r < ccRows; r++ {
+		var line Line
+		for c := 0; c < ccCols; c++ {
+			cell := s[r][c]
+			ch := cell.ch
+			if ch == 0 {
+				ch = ' '
+			}
+			// Spaces take the style of the text around them
+			italic := cell.italic
+			if ch == ' ' && len(line) > 0 {
+				italic = line[len(line)-1].Italic
+			}
+			line = appendSpan(line, Span{Text: string(ch), Italic: italic})
+		}
+		line = trimLine(line)
+		if len(line) == 0 {
+			continue
+		}
+		if first < 0 {
+			first = r
+		}
+		lines = append(lines, line)
+	}
+	var pos Position
+	if first >= 0 && first < ccRows/2 {
+		pos.Anchor = AnchorTop
+	}
+	return lines, pos
+}
+
+// cea608Decoder implements the CEA-608 caption channel 1 state machine
+// (pop-on, roll-up and paint-on) and turns screen changes into cues.
+type cea608Decoder struct {
+	displayed    ccScreen
+	nonDisplayed ccScreen
+	mode         ccMode
+	rollRows     int
+	row, col     int
+	italic       bool
+	channel      int // 1 or 2, selected by the last control code
+	lastCtrl     [2]byte
+
+	// Current cue and the time the displayed memory was first modified
+	// since the last emitted change.
+	cur      Cue
+	curKey   string
+	pending  bool
+	pendingT time.Duration
+	cues     []Cue
+}
+
+func newCEA608Decoder() *cea608Decoder {
+	return &cea608Decoder{row: ccRows - 1, rollRows: 2, channel: 1}
+}
+
+// memory returns the memory that characters are currently written to.
+func (d *cea608Decoder) memory() *ccScreen {
+	if d.mode == ccModePopOn {
+		return &d.nonDisplayed
+	}
+	return &d.displayed
+}
+
+func (d *cea608Decoder) touch(t time.Duration) {
+	if !d.pending {
+		d.pending = true
+		d.pendingT = t
+	}
+}
+
+// update closes the current cue and opens a new one if the displayed text
+// differs from the last emitted one.
+func (d *cea608Decoder) update() {
+	if !d.pending {
+		return
+	}
+	d.pending = false
+	lines, pos := d.displayed.cue()
+	key := fmt.Sprintf("%d|%s", pos.numpad(), htmlStyledText(lines, noEscape))
+	if key == d.curKey {
+		return
+	}
+	start := d.pendingT
+	if len(d.cur.Lines) > 0 && start > d.cur.Start {
+		d.cur.End = start
+		d.cues = append(d.cues, d.cur)
+	}
+	d.cur = Cue{Start: start, Lines: lines, Position: pos}
+	d.curKey = key
+}
+
+// flush emits the cue still on screen, ending it at t.
+func (d *cea608Decoder) flush(t time.Duration) {
+	d.update()
+	if len(d.cur.Lines) > 0 && t > d.cur.Start {
+		d.cur.End = t
+		d.cues = append(d.cues, d.cur)
+	}
+	d.cur = Cue{}
+	d.curKey = ""
+}
+
+func (d *cea608Decoder) decode(t time.Duration, b1, b2 byte) {
+	b1 &= 0x7f
+	b2 &= 0x7f
+	if b1 == 0 && b2 == 0 {
+		return
+	}
+
+	if b1 >= 0x10 && b1 <= 0x1f {
+		// Control codes are sent twice; ignore the redundant copy.
+		if d.lastCtrl == [2]byte{b1, b2} {
+			d.lastCtrl = [2]byte{}
+			return
+		}
+		d.lastCtrl = [2]byte{b1, b2}
+		if b1&0x08 != 0 {
+			d.channel = 2
+		} else {
+			d.channel = 1
+		}
+		if d.channel != 1 {
+			return
+		}
+		d.update()
+		d.control(t, b1&^0x08, b2)
+		d.update()
+		return
+	}
+	d.lastCtrl = [2]byte{}
+
+	if b1 < 0x10 {
+		// XDS data or padding
+		return
+	}
+	if d.channel != 1 || d.mode == ccModeNone || d.mode == ccModeText {
+		return
+	}
+	d.putChar(t, basicChar(b1))
+	if b2 >= 0x20 {
+		d.putChar(t, basicChar(b2))
+	}
+}
+
+// control handles a channel 1 control code with the channel bit cleared.
+func (d *cea608Decoder) control(t time.Duration, b1, b2 byte) {
+	switch {
+	case b1 == 0x14 && b2 >= 0x20 && b2 <= 0x2f:
+		d.miscControl(t, b2)
+	case b1 == 0x17 && b2 >= 0x21 && b2 <= 0x23:
+		// Tab offset
+		d.col += int(b2 - 0x20)
+		if d.col >= ccCols {
+			d.col = ccCols - 1
+		}
+	case b1 == 0x11 && b2 >= 0x20 && b2 <= 0x2f:
+		// Mid-row style change, displayed as a space
+		d.italic = b2 == 0x2e || b2 == 0x2f
+		d.putChar(t, ' ')
+	case b1 == 0x11 && b2 >= 0x30 && b2 <= 0x3f:
+		d.putChar(t, specialChars[b2-0x30])
+	case (b1 == 0x12 || b1 == 0x13) && b2 >= 0x20 && b2 <= 0x3f:
+		// Extended characters replace the standard fallback sent before them.
+		if d.col > 0 {
+			d.col--
+		}
+		if b1 == 0x12 {
+			d.putChar(t, extendedChars12[b2-0x20])
+		} else {
+			d.putChar(t, extendedChars13[b2-0x20])
+		}
+	case b2 >= 0x40 && b2 <= 0x7f:
+		d.preambleAddress(t, b1, b2)
+	}
+}
+
+func (d *cea608Decoder) miscControl(t time.Duration, b2 byte) {
+	switch b2 {
+	case 0x20: // RCL resume caption loading
+		d.mode = ccModePopOn
+	case 0x21: // BS backspace
+		if d.col > 0 {
+			d.col--
+			d.memory()[d.row][d.col] = ccCell{}
+			if d.mode != ccModePopOn {
+				d.touch(t)
+			}
+		}
+	case 0x24: // DER delete to end of row
+		for c := d.col; c < ccCols; c++ {
+			d.memory()[d.row][c] = ccCell{}
+		}
+		if d.mode != ccModePopOn {
+			d.touch(t)
+		}
+	case 0x25, 0x26, 0x27: // RU2, RU3, RU4
+		if d.mode != ccModeRollUp {
+			d.displayed.clear()
+			d.nonDisplayed.clear()
+			d.touch(t)
+			d.row = ccRows - 1
+		}
+		d.mode = ccModeRollUp
+		d.rollRows = int(b2-0x25) + 2
+		d.col = 0
+	case 0x29: // RDC resume direct captioning
+		d.mode = ccModePaintOn
+	case 0x2a, 0x2b: // TR, RTD text mode
+		d.mode = ccModeText
+	case 0x2c: // EDM erase displayed memory
+		d.displayed.clear()
+		d.touch(t)
+	case 0x2d: // CR carriage return
+		if d.mode == ccModeRollUp {
+			d.rollUp(t)
+		} else if d.row < ccRows-1 {
+			d.row++
+		}
+		d.col = 0
+	case 0x2e: // ENM erase non-displayed memory
+		d.nonDisplayed.clear()
+	case 0x2f: // EOC end of caption
+		d.displayed, d.nonDisplayed = d.nonDisplayed, d.displayed
+		d.mode = ccModePopOn
+		d.touch(t)
+	}
+}
+
+// rollUp scrolls the roll-up window one row, dropping the top row.
+func (d *cea608Decoder) rollUp(t time.Duration) {
+	top := d.row - d.rollRows + 1
+	if top < 0 {
+		top = 0
+	}
+	for r := 0; r < ccRows; r++ {
+		if r < top || r > d.row {
+			d.displayed[r] = [ccCols]ccCell{}
+		}
+	}
+	for r := top; r < d.row; r++ {
+		d.displayed[r] = d.displayed[r+1]
+	}
+	d.displayed[d.row] = [ccCols]ccCell{}
+	d.touch(t)
+}
+
+// pacRows maps the preamble address code first byte (channel bit cleared) to
+// the two rows it can address.
+var pacRows = map[byte][2]int{
+	0x11: {1, 2},
+	0x12: {3, 4},
+	0x15: {5, 6},
+	0x16: {7, 8},
+	0x17: {9, 10},
+	0x10: {11, 11},
+	0x13: {12, 13},
+	0x14: {14, 15},
+}
+
+func (d *cea608Decoder) preambleAddress(t time.Duration, b1, b2 byte) {
+	rows, ok := pacRows[b1]
+	if !ok {
+		return
+	}
+	row := rows[0]
+	if b2&0x20 != 0 {
+		row = rows[1]
+	}
+	row-- // zero based
+
+	if d.mode == ccModeRollUp && row != d.row {
+		// Move the roll-up window so that its base row is the addressed row.
+		var moved ccScreen
+		for i := 0; i < d.rollRows; i++ {
+			from, to := d.row-i, row-i
+			if from >= 0 && to >= 0 {
+				moved[to] = d.displayed[from]
+			}
+		}
+		d.displayed = moved
+		d.touch(t)
+	}
+	d.row = row
+	d.col = 0
+	d.italic = false
+	if b2&0x10 != 0 {
+		// Indent
+		d.col = int((b2&0x0e)>>1) * 4
+	} else if b2&0x0e == 0x0e {
+		d.italic = true
+	}
+}
+
+func (d *cea608Decoder) putChar(t time.Duration, ch rune) {
+	if d.mode == ccModeNone || d.mode == ccModeText {
+		return
+	}
+	mem := d.memory()
+	mem[d.row][d.col] = ccCell{ch: ch, italic: d.italic}
+	if d.col < ccCols-1 {
+		d.col++
+	}
+	if d.mode != ccModePopOn {
+		d.touch(t)
+	}
+}
+
+// basicChar maps a CEA-608 standard character code to its rune; the code
+// points that differ from ASCII are listed explicitly.
+func basicChar(b byte) rune {
+	switch b {
+	case 0x2a:
+		return 'á'
+	case 0x5c:
+		return 'é'
+	case 0x5e:
+		return 'í'
+	case 0x5f:
+		return 'ó'
+	case 0x60:
+		return 'ú'
+	case 0x7b:
+		return 'ç'
+	case 0x7c:
+		return '÷'
+	case 0x7d:
+		return 'Ñ'
+	case 0x7e:
+		return 'ñ'
+	case 0x7f:
+		return '█'
+	}
+	return rune(b)
+}
+
+var specialChars = [16]rune{
+	'®', '°', '½', '¿', '™', '¢', '£', '♪',
+	'à', ' ', 'è', 'â', 'ê', 'î', 'ô', 'û',
+}
+
+var extendedChars12 = [32]rune{
+	'Á', 'É', 'Ó', 'Ú', 'Ü', 'ü', '‘', '¡',
+	'*', '\'', '—', '©', '℠', '•', '“', '”',
+	'À', 'Â', 'Ç', 'È', 'Ê', 'Ë', 'ë', 'Î',
+	'Ï', 'ï', 'Ô', 'Ù', 'ù', 'Û', '«', '»',
+}
+
+var extendedChars13 = [32]rune{
+	'Ã', 'ã', 'Í', 'Ì', 'ì', 'Ò', 'ò', 'Õ',
+	'õ', '{', '}', '\\', '^', '_', '|', '~',
+	'Ä', 'ä', 'Ö', 'ö', 'ß', '¥', '¤', '¦',
+	'Å', 'å', 'Ø', 'ø', '┌', '┐', '└', '┘',
+}
@@ -0,0 +1,422 @@
+package subtitle
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Format identifies a subtitle file format.
+type Format string
+
+const (
+	FormatSRT    Format = "srt"
+	FormatWebVTT Format = "vtt"
+	FormatASS    Format = "ass"
+	FormatTTML   Format = "ttml"
+	FormatSCC    Format = "scc"
+)
+
+// VAlign is the edge of the cue region the text block is anchored to.
+type VAlign int
+
+const (
+	AnchorBottom VAlign = iota
+	AnchorMiddle
+	AnchorTop
+)
+
+// HAlign is the horizontal alignment of text lines.
+type HAlign int
+
+const (
+	AlignCenter HAlign = iota
+	AlignLeft
+	AlignRight
+)
+
+// Position places a cue on screen. The zero value is the usual bottom-centre
+// placement. When Region is set, X, Y, Width and Height give the cue box as
+// percentages of the video frame; a zero Height means the box is a single
+// anchored edge (as in WebVTT "line:" settings).
+type Position struct {
+	Anchor VAlign
+	Align  HAlign
+	Region bool
+	X      float64
+	Y      float64
+	Width  float64
+	Height float64
+}
+
+// IsDefault reports whether the position is the default bottom-centre placement.
+func (p Position) IsDefault() bool {
+	return p == Position{}
+}
+
+// anchorPoint returns the point of the cue box the text is anchored to, in
+// percent of the frame.
+func (p Position) anchorPoint() (x, y float64) {
+	switch p.Align {
+	case AlignLeft:
+		x = p.X
+	case AlignRight:
+		x = p.X + p.Width
+	default:
+		x = p.X + p.Width/2
+	}
+	switch p.Anchor {
+	case AnchorTop:
+		y = p.Y
+	case AnchorMiddle:
+		y = p.Y + p.Height/2
+	default:
+		y = p.Y + p.Height
+	}
+	return x, y
+}
+
+// numpad returns the ASS \an alignment (numeric keypad layout) of the position.
+func (p Position) numpad() int {
+	n := 2
+	switch p.Align {
+	case AlignLeft:
+		n = 1
+	case AlignRight:
+		n = 3
+	}
+	switch p.Anchor {
+	case AnchorMiddle:
+		n += 3
+	case AnchorTop:
+		n += 6
+	}
+	return n
+}
+
+// positionFromNumpad is the inverse of numpad.
+func positionFromNumpad(n int) Position {
+	var p Position
+	switch (n - 1) % 3 {
+	case 0:
+		p.Align = AlignLeft
+	case 2:
+		p.Align = AlignRight
+	}
+	switch (n - 1) / 3 {
+	case 1:
+		p.Anchor = AnchorMiddle
+	case 2:
+		p.Anchor = AnchorTop
+	}
+	return p
+}
+
+// Span is a run of text sharing the same style.
+type Span struct {
+	Text      string
+	Italic    bool
+	Bold      bool
+	Underline bool
+}
+
+// Line is one displayed line of a cue.
+type Line []Span
+
+// Cue is a single timed caption in the format-neutral model.
+type Cue struct {
+	Start    time.Duration
+	End      time.Duration
+	Lines    []Line
+	Position Position
+}
+
+// PlainText returns the cue text without styling, lines joined by "\n".
+func (c Cue) PlainText() string {
+	lines := make([]string, 0, len(c.Lines))
+	for _, line := range c.Lines {
+		var sb strings.Builder
+		for _, span := range line {
+			sb.WriteString(span.Text)
+		}
+		lines = append(lines, sb.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Document is a subtitle track in the format-neutral cue model.
+type Document struct {
+	Language string
+	Cues     []Cue
+}
+
+// Sort orders the cues by start time.
+func (d *Document) Sort() {
+	sort.SliceStable(d.Cues, func(i, j int) bool { return d.Cues[i].Start < d.Cues[j].Start })
+}
+
+// Parse reads a subtitle document in the given format.
+func Parse(data string, format Format) (*Document, error) {
+	var doc *Document
+	var err error
+	switch format {
+	case FormatSRT:
+		doc, err = parseSRT(data)
+	case FormatWebVTT:
+		doc, err = parseWebVTT(data)
+	case FormatTTML:
+		doc, err = parseTTML(data)
+	case FormatSCC:
+		doc, err = parseSCC(data)
+	default:
+		return nil, fmt.Errorf("unsupported input format: %s", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	doc.Sort()
+	return doc, nil
+}
+
+// Encode writes the document in the given format.
+func (d *Document) Encode(format Format) (string, error) {
+	switch format {
+	case FormatSRT:
+		return writeSRT(d), nil
+	case FormatWebVTT:
+		return writeWebVTT(d), nil
+	case FormatASS:
+		return writeASS(d), nil
+	case FormatTTML:
+		return writeTTML(d)
+	default:
+		return "", fmt.Errorf("unsupported output format: %s", format)
+	}
+}
+
+// Convert converts subtitle data from one format to another.
+func Convert(data string, from, to Format) (string, error) {
+	doc, err := Parse(data, from)
+	if err != nil {
+		return "", err
+	}
+	return doc.Encode(to)
+}
+
+// FormatFromPath returns the subtitle format implied by a file extension.
+func FormatFromPath(path string) (Format, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".srt":
+		return FormatSRT, nil
+	case ".vtt", ".webvtt":
+		return FormatWebVTT, nil
+	case ".ass", ".ssa":
+		return FormatASS, nil
+	case ".ttml", ".dfxp", ".xml":
+		return FormatTTML, nil
+	case ".scc":
+		return FormatSCC, nil
+	}
+	return "", fmt.Errorf("unknown subtitle format for %s", path)
+}
+
+// DetectFormat guesses the format of subtitle data from its content.
+func DetectFormat(data string) (Format, error) {
+	head := strings.TrimSpace(strings.TrimPrefix(data, "\ufeff"))
+	switch {
+	case strings.HasPrefix(head, "WEBVTT"):
+		return FormatWebVTT, nil
+	case strings.HasPrefix(head, "Scenarist_SCC"):
+		return FormatSCC, nil
+	case strings.HasPrefix(head, "<?xml") || strings.HasPrefix(head, "<tt"):
+		return FormatTTML, nil
+	case strings.HasPrefix(head, "[Script Info]"):
+		return FormatASS, nil
+	case strings.Contains(head, "-->"):
+		return FormatSRT, nil
+	}
+	return "", fmt.Errorf("unable to detect subtitle format")
+}
+
+// ParseFile reads a subtitle file, detecting its format from the content or,
+// failing that, the extension. MP4 files are read for CEA-608 closed captions.
+func ParseFile(path string) (*Document, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".mp4", ".m4v", ".mov":
+		doc, err := ReadClosedCaptions(path)
+		if err != nil {
+			return nil, err
+		}
+		if len(doc.Cues) == 0 {
+			return nil, fmt.Errorf("no closed captions found in video")
+		}
+		return doc, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	format, err := DetectFormat(string(data))
+	if err != nil {
+		if format, err = FormatFromPath(path); err != nil {
+			return nil, err
+		}
+	}
+	return Parse(string(data), format)
+}
+
+// cueFromText builds a cue from text with "\n" line breaks and no styling.
+func cueFromText(start, end time.Duration, text string) Cue {
+	c := Cue{Start: start, End: end}
+	for _, l := range strings.Split(text, "\n") {
+		c.Lines = append(c.Lines, Line{{Text: l}})
+	}
+	return c
+}
+
+// appendSpan adds text to a line, merging it into the last span when the
+// style is unchanged.
+func appendSpan(line Line, s Span) Line {
+	if s.Text == "" {
+		return line
+	}
+	if n := len(line); n > 0 {
+		last := &line[n-1]
+		if last.Italic == s.Italic && last.Bold == s.Bold && last.Underline == s.Underline {
+			last.Text += s.Text
+			return line
+		}
+	}
+	return append(line, s)
+}
+
+// trimLine removes leading and trailing whitespace from a line.
+func trimLine(line Line) Line {
+	for len(line) > 0 {
+		line[0].Text = strings.TrimLeft(line[0].Text, " \t")
+		if line[0].Text != "" {
+			break
+		}
+		line = line[1:]
+	}
+	for len(line) > 0 {
+		n := len(line) - 1
+		line[n].Text = strings.TrimRight(line[n].Text, " \t")
+		if line[n].Text != "" {
+			break
+		}
+		line = line[:n]
+	}
+	return line
+}
+
+// htmlStyledText renders the cue lines using <i>, <b> and <u> tags, as used
+// by SRT and WebVTT. escape is applied to the text of each span.
+func htmlStyledText(lines []Line, escape func(string) string) string {
+	out := make([]string, 0, len(lines))
+	for _, line := range lines {
+		var sb strings.Builder
+		for _, s := range line {
+			open, close := "", ""
+			if s.Bold {
+				open += "<b>"
+				close = "</b>" + close
+			}
+			if s.Italic {
+				open += "<i>"
+				close = "</i>" + close
+			}
+			if s.Underline {
+				open += "<u>"
+				close = "</u>" + close
+			}
+			sb.WriteString(open)
+			sb.WriteString(escape(s.Text))
+			sb.WriteString(close)
+		}
+		out = append(out, sb.String())
+	}
+	return strings.Join(out, "\n")
+}
+
+// parseHTMLStyledText parses text using <i>, <b> and <u> tags and {\anN}
+// overrides, as found in SRT and WebVTT cues. Other tags are dropped.
+// unescape is applied to the text between tags.
+func parseHTMLStyledText(text string, unescape func(string) string) ([]Line, int) {
+	var lines []Line
+	an := 0
+	var italic, bold, underline int
+	for _, raw := range strings.Split(text, "\n") {
+		var line Line
+		for raw != "" {
+			switch {
+			case raw[0] == '<':
+				end := strings.IndexByte(raw, '>')
+				if end < 0 {
+					line = appendSpan(line, Span{Text: unescape(raw), Italic: italic > 0, Bold: bold > 0, Underline: underline > 0})
+					raw = ""
+					continue
+				}
+				tag := strings.ToLower(strings.TrimSpace(raw[1:end]))
+				raw = raw[end+1:]
+				closing := strings.HasPrefix(tag, "/")
+				tag = strings.TrimPrefix(tag, "/")
+				if i := strings.IndexAny(tag, " .\t"); i >= 0 {
+					tag = tag[:i]
+				}
+				delta := 1
+				if closing {
+					delta = -1
+				}
+				switch tag {
+				case "i":
+					italic = max(italic+delta, 0)
+				case "b":
+					bold = max(bold+delta, 0)
+				case "u":
+					underline = max(underline+delta, 0)
+				}
+			case raw[0] == '{' && strings.HasPrefix(raw, "{\\"):
+				end := strings.IndexByte(raw, '}')
+				if end < 0 {
+					raw = raw[1:]
+					continue
+				}
+				override := raw[:end+1]
+				raw = raw[end+1:]
+				var n int
+				if _, err := fmt.Sscanf(override, "{\\an%d}", &n); err == nil && n >= 1 && n <= 9 {
+					an = n
+				}
+			default:
+				next := strings.IndexAny(raw, "<{")
+				if next == 0 {
+					// A literal '{' that does not start an override
+					next = 1 + strings.IndexAny(raw[1:], "<{")
+					if next == 0 {
+						next = len(raw)
+					}
+				}
+				if next < 0 {
+					next = len(raw)
+				}
+				line = appendSpan(line, Span{Text: unescape(raw[:next]), Italic: italic > 0, Bold: bold > 0, Underline: underline > 0})
+				raw = raw[next:]
+			}
+		}
+		lines = append(lines, trimLine(line))
+	}
+	// Drop leading and trailing empty lines
+	for len(lines) > 0 && len(lines[0]) == 0 {
+		lines = lines[1:]
+	}
+	for len(lines) > 0 && len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	return lines, an
+}
+
+func noEscape(s string) string { return s }
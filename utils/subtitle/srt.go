@@ -0,0 +1,83 @@
+package subtitle
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var srtTimingRe = regexp.MustCompile(`(\d+:\d{2}:\d{2}[,.]\d{1,3})\s*-->\s*(\d+:\d{2}:\d{2}[,.]\d{1,3})`)
+
+// parseSRT reads an SRT document. Italic, bold and underline tags and {\anN}
+// position overrides are kept.
+func parseSRT(data string) (*Document, error) {
+	data = strings.ReplaceAll(strings.TrimPrefix(data, "\ufeff"), "\r\n", "\n")
+	doc := &Document{}
+	var cur *Cue
+	var text []string
+	flush := func() {
+		if cur == nil {
+			return
+		}
+		lines, an := parseHTMLStyledText(strings.Join(text, "\n"), noEscape)
+		if len(lines) > 0 {
+			cur.Lines = lines
+			if an != 0 {
+				cur.Position = positionFromNumpad(an)
+			}
+			doc.Cues = append(doc.Cues, *cur)
+		}
+		cur = nil
+		text = nil
+	}
+	for _, line := range strings.Split(data, "\n") {
+		if m := srtTimingRe.FindStringSubmatch(line); m != nil {
+			flush()
+			start, err := parseSRTTime(m[1])
+			if err != nil {
+				continue
+			}
+			end, err := parseSRTTime(m[2])
+			if err != nil {
+				continue
+			}
+			cur = &Cue{Start: start, End: end}
+			continue
+		}
+		if cur == nil {
+			// Index line or junk between cues
+			continue
+		}
+		if strings.TrimSpace(line) == "" {
+			flush()
+			continue
+		}
+		text = append(text, line)
+	}
+	flush()
+	if len(doc.Cues) == 0 {
+		return nil, errors.New("no subtitle entries found in SRT")
+	}
+	return doc, nil
+}
+
+func parseSRTTime(ts string) (time.Duration, error) {
+	return parseWebVTTTime(strings.Replace(ts, ",", ".", 1))
+}
+
+// writeSRT renders the document as SRT. Non-default positions are written as
+// {\anN} overrides, which most players honour.
+func writeSRT(d *Document) string {
+	var sb strings.Builder
+	for i, c := range d.Cues {
+		fmt.Fprintf(&sb, "%d\n%s --> %s\n", i+1, formatSRTTime(c.Start), formatSRTTime(c.End))
+		if !c.Position.IsDefault() && c.Position.numpad() != 2 {
+			fmt.Fprintf(&sb, "{\\an%d}", c.Position.numpad())
+		}
+		sb.WriteString(htmlStyledText(c.Lines, noEscape))
+		sb.WriteString("\n\n")
+	}
+	return strings.TrimSpace(sb.String())
+}
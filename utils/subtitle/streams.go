@@ -0,0 +1,344 @@
+package subtitle
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"golang.org/x/text/language"
+	"golang.org/x/text/language/display"
+)
+
+// Subtitle sources, in the order they are preferred when two sources provide
+// the same language.
+const (
+	SourceHLS    = "hls"
+	SourceAPI    = "api"
+	SourceCEA608 = "cea608"
+)
+
+var sourcePriority = map[string]int{
+	SourceHLS:    0,
+	SourceAPI:    1,
+	SourceCEA608: 2,
+}
+
+// Stream is a single subtitle rendition collected for a music video,
+// already converted to SRT.
+type Stream struct {
+	Language string // BCP-47 tag, e.g. "en-US"
+	Name     string // human readable track title
+	Source   string // SourceHLS, SourceAPI or SourceCEA608
+	Forced   bool
+	Default  bool
+	SRT      string
+}
+
+// Title returns the track title of the stream: its name, or the language
+// name when it has none, marked when the stream is forced.
+func (s Stream) Title() string {
+	title := s.Name
+	if title == "" {
+		title = LanguageName(s.Language)
+	}
+	if s.Forced {
+		title += " (Forced)"
+	}
+	return title
+}
+
+// NormalizeLanguage canonicalizes a language tag to BCP-47 form ("en_us" -> "en-US").
+// Unknown or empty tags are returned as "und".
+func NormalizeLanguage(tag string) string {
+	tag = strings.TrimSpace(strings.ReplaceAll(tag, "_", "-"))
+	if tag == "" {
+		return "und"
+	}
+	t, err := language.Parse(tag)
+	if err != nil {
+		return "und"
+	}
+	return t.String()
+}
+
+// ISO639_2 returns the three-letter language code used by MP4/Matroska track
+// headers for a BCP-47 tag.
+func ISO639_2(tag string) string {
+	t, err := language.Parse(tag)
+	if err != nil {
+		return "und"
+	}
+	base, conf := t.Base()
+	if conf == language.No {
+		return "und"
+	}
+	return base.ISO3()
+}
+
+// LanguageName returns the English display name of a BCP-47 tag.
+func LanguageName(tag string) string {
+	t, err := language.Parse(tag)
+	if err != nil || t == language.Und {
+		return "Unknown"
+	}
+	if name := display.English.Tags().Name(t); name != "" {
+		return name
+	}
+	return tag
+}
+
+// SameLanguage reports whether two tags refer to the same language, ignoring region.
+func SameLanguage(a, b string) bool {
+	return ISO639_2(a) == ISO639_2(b)
+}
+
+// ExtractClosedCaptionLanguage returns the LANGUAGE of the first
+// TYPE=CLOSED-CAPTIONS rendition in a master playlist, or "" if none is declared.
+func ExtractClosedCaptionLanguage(m3u8URL string) (string, error) {
+	content, err := DownloadSubtitle(m3u8URL)
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "#EXT-X-MEDIA:") && strings.Contains(line, "TYPE=CLOSED-CAPTIONS") {
+			if m := regexp.MustCompile(`LANGUAGE="([^"]+)"`).FindStringSubmatch(line); len(m) > 1 {
+				return m[1], nil
+			}
+			return "", nil
+		}
+	}
+	return "", nil
+}
+
+// DownloadHLSSubtitle downloads a subtitle rendition from an HLS playlist and
+// converts it to SRT. The rendition URL may point either to a media playlist of
+// WebVTT segments or directly to a subtitle file.
+func DownloadHLSSubtitle(track SubtitleTrack) (string, error) {
+	content, err := DownloadSubtitle(track.URL)
+	if err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(strings.TrimSpace(content), "#EXTM3U") {
+		content, err = downloadWebVTTSegments(track.URL, content)
+		if err != nil {
+			return "", err
+		}
+		return WebVTTToSRT(content)
+	}
+	switch track.Format {
+	case "ttml":
+		return TTMLToSRT(content)
+	case "srt":
+		return content, nil
+	default:
+		return WebVTTToSRT(content)
+	}
+}
+
+// downloadWebVTTSegments fetches every segment of a WebVTT media playlist and
+// joins the cues into a single WebVTT document.
+func downloadWebVTTSegments(playlistURL, playlist string) (string, error) {
+	base, err := url.Parse(playlistURL)
+	if err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	sb.WriteString("WEBVTT\n\n")
+	for _, line := range strings.Split(playlist, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		segURL, err := base.Parse(line)
+		if err != nil {
+			return "", err
+		}
+		resp, err := http.Get(segURL.String())
+		if err != nil {
+			return "", err
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return "", err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("failed to download subtitle segment: %s", resp.Status)
+		}
+		for _, segLine := range strings.Split(string(body), "\n") {
+			trimmed := strings.TrimSpace(segLine)
+			// Segment headers are repeated in every file; keep only the cues.
+			if strings.HasPrefix(trimmed, "WEBVTT") || strings.HasPrefix(trimmed, "X-TIMESTAMP-MAP") {
+				continue
+			}
+			sb.WriteString(strings.TrimRight(segLine, "\r"))
+			sb.WriteString("\n")
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String(), nil
+}
+
+// DedupeStreams drops streams that duplicate another stream's language tag
+// (and forced flag) or text, keeping the one from the most preferred source.
+// Tags are compared whole, so script and region variants such as zh-Hans
+// and zh-Hant are kept apart.
+func DedupeStreams(streams []Stream) []Stream {
+	var out []Stream
+	byKey := make(map[string]int)
+	byText := make(map[string]int)
+	for _, s := range streams {
+		if strings.TrimSpace(s.SRT) == "" {
+			continue
+		}
+		s.Language = NormalizeLanguage(s.Language)
+		key := fmt.Sprintf("%s|%t", s.Language, s.Forced)
+		textKey := textFingerprint(s.SRT)
+		idx, ok := byKey[key]
+		if !ok {
+			idx, ok = byText[textKey]
+		}
+		if ok {
+			if sourcePriority[s.Source] < sourcePriority[out[idx].Source] {
+				out[idx] = s
+				// The winner may differ in tag or text from the stream it
+				// replaced; later duplicates of either must find it
+				byKey[key] = idx
+				byText[textKey] = idx
+			}
+			continue
+		}
+		byKey[key] = len(out)
+		byText[textKey] = len(out)
+		out = append(out, s)
+	}
+	return out
+}
+
+// textFingerprint hashes the dialogue of an SRT document, ignoring indices,
+// timings and whitespace, so the same captions from two sources compare equal.
+func textFingerprint(srt string) string {
+	var sb strings.Builder
+	for _, line := range strings.Split(srt, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.Contains(line, "-->") || regexp.MustCompile(`^\d+$`).MatchString(line) {
+			continue
+		}
+		sb.WriteString(strings.ToLower(line))
+	}
+	sum := sha1.Sum([]byte(sb.String()))
+	return hex.EncodeToString(sum[:])
+}
+
+// SelectDefault marks the stream matching preferred (or, failing that, the
+// first non-forced stream) as the default track. Only one stream is marked.
+func SelectDefault(streams []Stream, preferred string) {
+	for i := range streams {
+		streams[i].Default = false
+	}
+	if preferred != "" {
+		for i := range streams {
+			if !streams[i].Forced && SameLanguage(streams[i].Language, preferred) {
+				streams[i].Default = true
+				return
+			}
+		}
+	}
+	for i := range streams {
+		if !streams[i].Forced {
+			streams[i].Default = true
+			return
+		}
+	}
+}
+
+// SidecarPath returns the "name.<lang>.srt" (or "name.<lang>.forced.srt")
+// path for a stream next to the video at videoPath.
+func SidecarPath(videoPath string, s Stream) string {
+	base := strings.TrimSuffix(videoPath, filepath.Ext(videoPath))
+	if s.Forced {
+		return fmt.Sprintf("%s.%s.forced.srt", base, s.Language)
+	}
+	return fmt.Sprintf("%s.%s.srt", base, s.Language)
+}
+
+// WriteSidecars saves each stream as an SRT file next to videoPath and returns
+// the written paths.
+func WriteSidecars(videoPath string, streams []Stream) ([]string, error) {
+	var paths []string
+	for _, s := range streams {
+		p := SidecarPath(videoPath, s)
+		if err := SaveToFile(s.SRT, p); err != nil {
+			return paths, err
+		}
+		paths = append(paths, p)
+	}
+	return paths, nil
+}
+
+// WriteTempFiles saves each stream to a temporary SRT file in dir for muxing.
+// The caller is responsible for removing the returned files.
+func WriteTempFiles(dir, prefix string, streams []Stream) ([]string, error) {
+	var paths []string
+	for i, s := range streams {
+		p := filepath.Join(dir, fmt.Sprintf("%s_sub%d_%s.srt", prefix, i, s.Language))
+		if err := SaveToFile(s.SRT, p); err != nil {
+			for _, written := range paths {
+				os.Remove(written)
+			}
+			return nil, err
+		}
+		paths = append(paths, p)
+	}
+	return paths, nil
+}
+
+// FFmpegMuxArgs builds the ffmpeg arguments that add the subtitle files in
+// subPaths (one per stream, in order) to inPath and write outPath. codec is
+// the subtitle codec of the output container ("mov_text" for MP4, "srt" or
+// "ass" for Matroska).
+func FFmpegMuxArgs(inPath string, subPaths []string, streams []Stream, codec, outPath string) []string {
+	args := []string{"-i", inPath}
+	for _, p := range subPaths {
+		args = append(args, "-i", p)
+	}
+	args = append(args, "-map", "0:v", "-map", "0:a")
+	for i := range subPaths {
+		args = append(args, "-map", fmt.Sprintf("%d:0", i+1))
+	}
+	args = append(args, "-map_metadata", "0", "-c:v", "copy", "-c:a", "copy", "-c:s", codec)
+	for i, s := range streams {
+		disposition := "0"
+		switch {
+		case s.Default && s.Forced:
+			disposition = "default+forced"
+		case s.Default:
+			disposition = "default"
+		case s.Forced:
+			disposition = "forced"
+		}
+		args = append(args,
+			fmt.Sprintf("-metadata:s:s:%d", i), "language="+ISO639_2(s.Language),
+			fmt.Sprintf("-metadata:s:s:%d", i), "title="+s.Title(),
+			fmt.Sprintf("-disposition:s:%d", i), disposition,
+		)
+	}
+	args = append(args, "-y", outPath)
+	return args
+}
+
+// TTMLLanguage returns the xml:lang declared on a TTML document, or "".
+func TTMLLanguage(ttml string) string {
+	if m := regexp.MustCompile(`xml:lang="([^"]+)"`).FindStringSubmatch(ttml); len(m) > 1 {
+		return m[1]
+	}
+	return ""
+}
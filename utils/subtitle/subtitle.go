@@ -1,7 +1,6 @@
 package subtitle
 
 import (
-	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -11,12 +10,9 @@ import (
 	"os"
 	"os/exec"
 	"regexp"
-	"sort"
 	"strconv"
 	"strings"
 	"time"
-
-	"github.com/beevik/etree"
 )
 
 // SubtitleTrack represents a subtitle track with language information
@@ -25,6 +21,8 @@ type SubtitleTrack struct {
 	LanguageCode string
 	URL          string
 	Format       string
+	Forced       bool
+	Default      bool
 }
 
 // MusicVideoSubtitles represents the subtitle data from Apple Music API
@@ -164,6 +162,9 @@ func ExtractSubtitlesFromM3U8(m3u8URL string) ([]SubtitleTrack, error) {
 				track.LanguageCode = langMatch[1]
 			}
 
+			track.Forced = strings.Contains(line, "FORCED=YES")
+			track.Default = strings.Contains(line, "DEFAULT=YES")
+
 			// Extract URI
 			if uriMatch := regexp.MustCompile(`URI="([^"]+)"`).FindStringSubmatch(line); len(uriMatch) > 1 {
 				subtitleURL := uriMatch[1]
@@ -226,216 +227,15 @@ func DownloadSubtitle(subtitleURL string) (string, error) {
 	return string(body), nil
 }
 
-// extractTextFromTTMLElement recursively extracts text content from TTML element
-// This properly handles nested elements like <span>, <br/>, etc.
-func extractTextFromTTMLElement(elem *etree.Element) string {
-	var textParts []string
-
-	// Process all child nodes (text and elements)
-	for _, child := range elem.Child {
-		switch node := child.(type) {
-		case *etree.CharData:
-			// Direct text content
-			text := node.Data
-			// Remove escape sequences and special characters
-			text = strings.ReplaceAll(text, "\\h", "")
-			text = strings.ReplaceAll(text, "\\n", "\n")
-			text = strings.ReplaceAll(text, "\\t", " ")
-			text = strings.TrimSpace(text)
-			if text != "" {
-				textParts = append(textParts, text)
-			}
-		case *etree.Element:
-			// Handle break elements
-			if node.Tag == "br" {
-				textParts = append(textParts, "\n")
-			} else {
-				// Recursively get text from nested elements
-				text := extractTextFromTTMLElement(node)
-				if text != "" {
-					textParts = append(textParts, text)
-				}
-			}
-		}
-	}
-
-	result := strings.Join(textParts, " ")
-
-	// Remove any remaining escape sequences or special patterns
-	result = regexp.MustCompile(`\\[a-z]`).ReplaceAllString(result, "")
-
-	// Clean up multiple spaces and trim
-	result = regexp.MustCompile(`\s+`).ReplaceAllString(result, " ")
-	result = strings.ReplaceAll(result, " \n ", "\n")
-	result = strings.ReplaceAll(result, " \n", "\n")
-	result = strings.ReplaceAll(result, "\n ", "\n")
-
-	return strings.TrimSpace(result)
-}
-
-// TTMLToSRT converts TTML format to SRT format
+// TTMLToSRT converts TTML format to SRT format, keeping italics, line breaks
+// and region placement
 func TTMLToSRT(ttml string) (string, error) {
-	parsedTTML := etree.NewDocument()
-	err := parsedTTML.ReadFromString(ttml)
-	if err != nil {
-		return "", err
-	}
-
-	var subtitles []SRTSubtitle
-	index := 1
-
-	// Find all p (paragraph) elements with timing information
-	for _, p := range parsedTTML.FindElements("//p") {
-		beginAttr := p.SelectAttr("begin")
-		endAttr := p.SelectAttr("end")
-
-		if beginAttr == nil || endAttr == nil {
-			continue
-		}
-
-		startTime, err := parseTimeCode(beginAttr.Value)
-		if err != nil {
-			continue
-		}
-
-		endTime, err := parseTimeCode(endAttr.Value)
-		if err != nil {
-			continue
-		}
-
-		text := extractTextFromTTMLElement(p)
-		if text == "" {
-			continue
-		}
-
-		subtitles = append(subtitles, SRTSubtitle{
-			Index:     index,
-			StartTime: startTime,
-			EndTime:   endTime,
-			Text:      text,
-		})
-		index++
-	}
-
-	if len(subtitles) == 0 {
-		return "", errors.New("no subtitle entries found in TTML")
-	}
-
-	// Sort by start time
-	sort.Slice(subtitles, func(i, j int) bool {
-		return subtitles[i].StartTime < subtitles[j].StartTime
-	})
-
-	// Convert to SRT format
-	srt := convertToSRT(subtitles)
-
-	// Apply final cleaning to remove any remaining formatting tags
-	srt = string(removeFormattingTags([]byte(srt)))
-
-	return srt, nil
+	return Convert(ttml, FormatTTML, FormatSRT)
 }
 
 // WebVTTToSRT converts WebVTT format to SRT format
 func WebVTTToSRT(webvtt string) (string, error) {
-	lines := strings.Split(webvtt, "\n")
-	var subtitles []SRTSubtitle
-	index := 1
-
-	inCue := false
-	var currentStart, currentEnd time.Duration
-	var currentText []string
-
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-
-		// Skip WEBVTT header and NOTE blocks
-		if strings.HasPrefix(line, "WEBVTT") || strings.HasPrefix(line, "NOTE") {
-			continue
-		}
-
-		// Check if this is a timestamp line (contains -->)
-		if strings.Contains(line, "-->") {
-			parts := strings.Split(line, "-->")
-			if len(parts) == 2 {
-				start, err := parseWebVTTTime(strings.TrimSpace(parts[0]))
-				if err != nil {
-					continue
-				}
-				end, err := parseWebVTTTime(strings.TrimSpace(parts[1]))
-				if err != nil {
-					continue
-				}
-
-				// Save previous subtitle if exists
-				if inCue && len(currentText) > 0 {
-					subtitles = append(subtitles, SRTSubtitle{
-						Index:     index,
-						StartTime: currentStart,
-						EndTime:   currentEnd,
-						Text:      strings.Join(currentText, "\n"),
-					})
-					index++
-				}
-
-				currentStart = start
-				currentEnd = end
-				currentText = []string{}
-				inCue = true
-			}
-		} else if line == "" {
-			// Empty line marks end of subtitle
-			if inCue && len(currentText) > 0 {
-				subtitles = append(subtitles, SRTSubtitle{
-					Index:     index,
-					StartTime: currentStart,
-					EndTime:   currentEnd,
-					Text:      strings.Join(currentText, "\n"),
-				})
-				index++
-				currentText = []string{}
-			}
-			inCue = false
-		} else if inCue && line != "" {
-			// Remove WebVTT tags like <v Name> or <c>
-			cleanLine := regexp.MustCompile(`<[^>]+>`).ReplaceAllString(line, "")
-			if cleanLine != "" {
-				currentText = append(currentText, cleanLine)
-			}
-		}
-	}
-
-	// Add last subtitle if exists
-	if inCue && len(currentText) > 0 {
-		subtitles = append(subtitles, SRTSubtitle{
-			Index:     index,
-			StartTime: currentStart,
-			EndTime:   currentEnd,
-			Text:      strings.Join(currentText, "\n"),
-		})
-	}
-
-	if len(subtitles) == 0 {
-		return "", errors.New("no subtitle entries found in WebVTT")
-	}
-
-	return convertToSRT(subtitles), nil
-}
-
-// convertToSRT converts subtitle entries to SRT format string
-func convertToSRT(subtitles []SRTSubtitle) string {
-	var srtBuilder strings.Builder
-
-	for i, sub := range subtitles {
-		// Re-index in case of gaps
-		srtBuilder.WriteString(fmt.Sprintf("%d\n", i+1))
-		srtBuilder.WriteString(fmt.Sprintf("%s --> %s\n",
-			formatSRTTime(sub.StartTime),
-			formatSRTTime(sub.EndTime)))
-		srtBuilder.WriteString(sub.Text)
-		srtBuilder.WriteString("\n\n")
-	}
-
-	return strings.TrimSpace(srtBuilder.String())
+	return Convert(webvtt, FormatWebVTT, FormatSRT)
 }
 
 // parseTimeCode parses TTML timecode formats
@@ -577,342 +377,6 @@ func SaveToFile(content, filePath string) error {
 	return os.WriteFile(filePath, []byte(content), 0644)
 }
 
-// ExtractClosedCaptionsFromMP4 extracts EIA-608/CEA-608 closed captions from MP4 file using FFmpeg
-func ExtractClosedCaptionsFromMP4(videoPath, outputPath, ffmpegPath string) error {
-	if ffmpegPath == "" {
-		ffmpegPath = "ffmpeg"
-	}
-
-	// Check if video file exists
-	if _, err := os.Stat(videoPath); os.IsNotExist(err) {
-		return fmt.Errorf("video file not found: %s", videoPath)
-	}
-
-	// Step 1: Use ffprobe to detect ALL streams (including text/subtitle streams)
-	cmd := exec.Command("ffprobe",
-		"-v", "quiet",
-		"-print_format", "json",
-		"-show_streams",
-		videoPath)
-
-	output, err := cmd.Output()
-	if err != nil {
-		return fmt.Errorf("ffprobe failed: %v", err)
-	}
-
-	// Parse to find subtitle/text streams (including c608 EIA-608)
-	var result struct {
-		Streams []struct {
-			Index          int    `json:"index"`
-			CodecName      string `json:"codec_name"`
-			CodecType      string `json:"codec_type"`
-			CodecTagString string `json:"codec_tag_string"`
-		} `json:"streams"`
-	}
-
-	if err := json.Unmarshal(output, &result); err != nil {
-		return fmt.Errorf("failed to parse ffprobe output: %v", err)
-	}
-
-	// Find subtitle/text streams (look for codec_type="subtitle" or codec_name containing "608" or "c608")
-	var subtitleStreams []struct {
-		Index     int
-		CodecName string
-	}
-
-	for _, stream := range result.Streams {
-		if stream.CodecType == "subtitle" ||
-			strings.Contains(stream.CodecName, "608") ||
-			stream.CodecName == "eia_608" ||
-			stream.CodecName == "c608" ||
-			stream.CodecTagString == "c608" {
-			subtitleStreams = append(subtitleStreams, struct {
-				Index     int
-				CodecName string
-			}{stream.Index, stream.CodecName})
-		}
-	}
-
-	if len(subtitleStreams) == 0 {
-		return fmt.Errorf("no closed captions found in video or failed to extract")
-	}
-
-	// Step 2: For EIA-608 streams, try CCExtractor first (FFmpeg can't extract the data properly)
-	for _, stream := range subtitleStreams {
-		// If this is an EIA-608 stream, try CCExtractor first
-		if stream.CodecName == "eia_608" || stream.CodecName == "c608" || strings.Contains(stream.CodecName, "608") {
-			// Try CCExtractor first for EIA-608
-			if err := extractWithCCExtractor(videoPath, outputPath); err == nil {
-				if info, statErr := os.Stat(outputPath); statErr == nil && info.Size() > 100 {
-					return nil
-				}
-			}
-		}
-
-		// Method A: Direct extraction to SRT
-		cmd := exec.Command(ffmpegPath,
-			"-i", videoPath,
-			"-map", fmt.Sprintf("0:%d", stream.Index),
-			"-c:s", "srt",
-			"-y",
-			outputPath)
-
-		if cmd.Run() == nil {
-			if info, err := os.Stat(outputPath); err == nil && info.Size() > 100 {
-				return nil
-			}
-		}
-
-		// Method B: Extract without codec conversion
-		cmd = exec.Command(ffmpegPath,
-			"-i", videoPath,
-			"-map", fmt.Sprintf("0:%d", stream.Index),
-			"-y",
-			outputPath)
-
-		if cmd.Run() == nil {
-			if info, err := os.Stat(outputPath); err == nil && info.Size() > 100 {
-				return nil
-			}
-		}
-
-		// Method C: Extract to WebVTT then convert
-		tempVttPath := strings.TrimSuffix(outputPath, ".srt") + "_temp.vtt"
-		cmd = exec.Command(ffmpegPath,
-			"-i", videoPath,
-			"-map", fmt.Sprintf("0:%d", stream.Index),
-			"-c:s", "webvtt",
-			"-y",
-			tempVttPath)
-
-		if cmd.Run() == nil {
-			if info, err := os.Stat(tempVttPath); err == nil && info.Size() > 100 {
-				// Convert WebVTT to SRT
-				if vttContent, err := os.ReadFile(tempVttPath); err == nil {
-					if srtContent, err := WebVTTToSRT(string(vttContent)); err == nil {
-						if err := os.WriteFile(outputPath, []byte(srtContent), 0644); err == nil {
-							_ = os.Remove(tempVttPath)
-							if info, err := os.Stat(outputPath); err == nil && info.Size() > 100 {
-								return nil
-							}
-						}
-					}
-				}
-			}
-		}
-		// Always clean up temp VTT file regardless of cmd.Run() result
-		_ = os.Remove(tempVttPath)
-	}
-
-	// Try alternative methods if direct extraction failed
-	err = extractClosedCaptionsAlternative(videoPath, outputPath, ffmpegPath)
-
-	// Final check: if file was created with meaningful content (>100 bytes), consider it success
-	// Use same threshold as other checks to avoid false positives from empty/header-only files
-	if info, statErr := os.Stat(outputPath); statErr == nil && info.Size() > 100 {
-		return nil
-	}
-
-	// Clean up any small/empty output file that may have been created
-	if info, statErr := os.Stat(outputPath); statErr == nil && info.Size() <= 100 {
-		_ = os.Remove(outputPath)
-	}
-
-	return err
-}
-
-// extractClosedCaptionsAlternative uses alternative FFmpeg method to extract CC
-func extractClosedCaptionsAlternative(videoPath, outputPath, ffmpegPath string) error {
-	// Method 1: Try direct copy without codec conversion
-	cmd := exec.Command(ffmpegPath,
-		"-i", videoPath,
-		"-map", "0:s:0",
-		"-c:s", "copy",
-		"-y",
-		outputPath)
-
-	if cmd.Run() == nil {
-		if info, err := os.Stat(outputPath); err == nil && info.Size() > 100 {
-			return nil
-		}
-	}
-
-	// Method 2: Try extracting without format specification
-	cmd = exec.Command(ffmpegPath,
-		"-i", videoPath,
-		"-map", "0:s:0",
-		"-y",
-		outputPath)
-
-	if cmd.Run() == nil {
-		if info, err := os.Stat(outputPath); err == nil && info.Size() > 100 {
-			return nil
-		}
-	}
-
-	// Method 3: Try with explicit codec name
-	cmd = exec.Command(ffmpegPath,
-		"-i", videoPath,
-		"-map", "0:s:0",
-		"-c:s", "srt",
-		"-y",
-		outputPath)
-
-	if cmd.Run() == nil {
-		if info, err := os.Stat(outputPath); err == nil && info.Size() > 100 {
-			return nil
-		}
-	}
-
-	// Method 4: Try extracting to WebVTT first, then convert
-	tempVttPath := strings.TrimSuffix(outputPath, ".srt") + ".vtt"
-	cmd = exec.Command(ffmpegPath,
-		"-i", videoPath,
-		"-map", "0:s:0",
-		"-c:s", "webvtt",
-		"-y",
-		tempVttPath)
-
-	if cmd.Run() == nil {
-		if info, err := os.Stat(tempVttPath); err == nil && info.Size() > 100 {
-			// Convert WebVTT to SRT
-			vttContent, err := os.ReadFile(tempVttPath)
-			if err == nil {
-				srtContent, err := WebVTTToSRT(string(vttContent))
-				if err == nil {
-					os.WriteFile(outputPath, []byte(srtContent), 0644)
-					os.Remove(tempVttPath)
-					if info, err := os.Stat(outputPath); err == nil && info.Size() > 100 {
-						return nil
-					}
-				}
-			}
-		}
-	}
-	// Always clean up temp VTT file regardless of cmd.Run() result
-	os.Remove(tempVttPath)
-
-	// Try ccextractor if all FFmpeg methods fail
-	return extractWithCCExtractor(videoPath, outputPath)
-}
-
-// extractWithCCExtractor uses CCExtractor tool if available
-func extractWithCCExtractor(videoPath, outputPath string) error {
-	// Try to find ccextractor binary in multiple locations
-	ccextractorPaths := []string{
-		"ccextractor", // System PATH
-		"/usr/bin/ccextractor",
-		"/usr/local/bin/ccextractor",
-	}
-
-	// Also check common build locations relative to home directory
-	if homeDir, err := os.UserHomeDir(); err == nil {
-		ccextractorPaths = append(ccextractorPaths,
-			homeDir+"/ccextractor/linux/ccextractor",
-			homeDir+"/ccextractor/ccextractor",
-			homeDir+"/bin/ccextractor",
-		)
-	}
-
-	var ccextractorPath string
-	for _, path := range ccextractorPaths {
-		cmd := exec.Command(path, "-h")
-		if err := cmd.Run(); err == nil {
-			ccextractorPath = path
-			break
-		}
-	}
-
-	if ccextractorPath == "" {
-		return fmt.Errorf("all closed caption extraction methods failed (ccextractor not found)")
-	}
-
-	// CCExtractor syntax: ccextractor [options] inputfile [-o outputfilename]
-	// For EIA-608: ccextractor input.mp4 -o output.srt
-	cmd := exec.Command(ccextractorPath,
-		videoPath,        // Input file
-		"-o", outputPath) // Output file
-
-	var stdout bytes.Buffer
-	var stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-
-	err := cmd.Run()
-
-	// CCExtractor might return non-zero exit code even on success
-	// Check if output file was created with content first
-	if info, statErr := os.Stat(outputPath); statErr == nil && info.Size() > 100 {
-		return nil // Success - file created with reasonable content
-	}
-
-	// Check again after successful run
-	if err != nil {
-		errMsg := stderr.String()
-		if strings.Contains(errMsg, "No captions") || strings.Contains(errMsg, "can't be read") {
-			return fmt.Errorf("no closed captions found in video")
-		}
-		return fmt.Errorf("CCExtractor failed: %v - %s", err, errMsg)
-	}
-
-	// Check if output file was created and has content
-	info, err := os.Stat(outputPath)
-	if err != nil || info.Size() < 100 {
-		return fmt.Errorf("no closed captions found in video or failed to extract")
-	}
-
-	return nil
-}
-
-// HasClosedCaptions checks if a video file contains closed captions
-func HasClosedCaptions(videoPath, ffmpegPath string) (bool, error) {
-	if ffmpegPath == "" {
-		ffmpegPath = "ffmpeg"
-	}
-
-	// Use ffprobe to check for subtitle/closed caption streams (check ALL streams)
-	cmd := exec.Command("ffprobe",
-		"-v", "quiet",
-		"-print_format", "json",
-		"-show_streams",
-		videoPath)
-
-	output, err := cmd.Output()
-	if err != nil {
-		return false, err
-	}
-
-	// Parse JSON output
-	var result struct {
-		Streams []struct {
-			CodecName      string `json:"codec_name"`
-			CodecType      string `json:"codec_type"`
-			CodecTagString string `json:"codec_tag_string"`
-			Tags           struct {
-				Language string `json:"language"`
-			} `json:"tags"`
-		} `json:"streams"`
-	}
-
-	err = json.Unmarshal(output, &result)
-	if err != nil {
-		return false, err
-	}
-
-	// Check for subtitle streams or c608/EIA-608 streams
-	for _, stream := range result.Streams {
-		if stream.CodecType == "subtitle" ||
-			strings.Contains(stream.CodecName, "608") ||
-			stream.CodecName == "eia_608" ||
-			stream.CodecName == "c608" ||
-			stream.CodecTagString == "c608" {
-			return true, nil
-		}
-	}
-
-	return false, nil
-}
-
 // ExtractAllSubtitlesFromMP4 extracts all subtitle/CC tracks from MP4 file
 func ExtractAllSubtitlesFromMP4(videoPath, outputDir, ffmpegPath string) ([]string, error) {
 	if ffmpegPath == "" {
@@ -1083,44 +547,29 @@ func CleanSRTFile(filePath string) error {
 	return os.WriteFile(filePath, []byte(strings.Join(cleaned, "\n")), 0644)
 }
 
-// removeFormattingTags removes WebVTT and ASS formatting tags from subtitle content
-// NOTE: Positioning and alignment tags are preserved to prevent subtitles from defaulting to top-left
-func removeFormattingTags(content []byte) []byte {
-	text := string(content)
-
-	// DO NOT remove positioning tags like {\an1} to {\an9} - they control subtitle position
-	// Removing them causes subtitles to default to top-left corner
-
-	// Remove other common ASS tags (but keep positioning-related ones like \an, \pos, \move)
-	// Only remove color, style, and decoration tags
-	text = regexp.MustCompile(`\{\\(?:c|1c|3c|4c|fs|fsp|bord|shad|be|blur|fe|r|fscx|fscy|fax|fay|org)[^}]*\}`).ReplaceAllString(text, "")
-
-	// Remove HTML-like tags: <b>, <i>, <u>, <font>, etc. (but keep positioning-related tags)
-	text = regexp.MustCompile(`<(?:b|i|u|s|font|span)[^>]*>`).ReplaceAllString(text, "")
-	text = regexp.MustCompile(`</(?:b|i|u|s|font|span)>`).ReplaceAllString(text, "")
-
-	// Remove WebVTT voice tags: <v Name>
-	text = regexp.MustCompile(`<v\s+[^>]+>`).ReplaceAllString(text, "")
-
-	// Remove WebVTT class tags: <c.className> (but keep cue settings like position, align, line, size)
-	text = regexp.MustCompile(`<c\.[\w-]+>`).ReplaceAllString(text, "")
-	text = regexp.MustCompile(`</c>`).ReplaceAllString(text, "")
-
-	// DO NOT remove positioning cues like 'position:', 'align:', 'line:', 'size:' - they are essential
-
-	// Remove escape sequences like \h, \n, \t (literal backslash followed by letter)
-	text = strings.ReplaceAll(text, "\\h", "")
-	text = regexp.MustCompile(`\\[a-z]`).ReplaceAllString(text, "")
-
-	// Remove patterns like /h/h/h that might appear
-	text = regexp.MustCompile(`(/[a-z])+`).ReplaceAllString(text, "")
-
-	return []byte(text)
-}
-
 // ConvertSCCToSRT converts SCC (Scenarist Closed Caption) format to SRT
 func ConvertSCCToSRT(sccContent string) (string, error) {
-	// SCC is a hex-based format, FFmpeg handles this better
-	// This is a placeholder for direct conversion if needed
-	return "", errors.New("SCC to SRT conversion requires FFmpeg or CCExtractor")
+	return Convert(sccContent, FormatSCC, FormatSRT)
+}
+
+// sccFrameDuration is the duration of one frame at 29.97 fps.
+const sccFrameDuration = time.Second * 1001 / 30000
+
+// parseSCCTime parses an SCC timecode, HH:MM:SS:FF (non-drop frame) or
+// HH:MM:SS;FF (drop frame).
+func parseSCCTime(tc string) (time.Duration, error) {
+	m := regexp.MustCompile(`^(\d{2}):(\d{2}):(\d{2})([:;.,])(\d{2})$`).FindStringSubmatch(tc)
+	if m == nil {
+		return 0, fmt.Errorf("invalid SCC timecode: %s", tc)
+	}
+	h, _ := strconv.Atoi(m[1])
+	mi, _ := strconv.Atoi(m[2])
+	sec, _ := strconv.Atoi(m[3])
+	ff, _ := strconv.Atoi(m[5])
+	seconds := h*3600 + mi*60 + sec
+	if m[4] == ";" || m[4] == "," {
+		// Drop-frame timecode tracks wall-clock time.
+		return time.Duration(seconds)*time.Second + time.Duration(ff)*sccFrameDuration, nil
+	}
+	return time.Duration(seconds*30+ff) * sccFrameDuration, nil
 }
@@ -0,0 +1,377 @@
+package subtitle
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/beevik/etree"
+)
+
+// ttmlStyle is the subset of TTML styling the cue model keeps.
+type ttmlStyle struct {
+	italic, bold, underline *bool
+	textAlign               string
+	displayAlign            string
+	origin, extent          string
+}
+
+// merge overlays the attributes set in o on top of s.
+func (s ttmlStyle) merge(o ttmlStyle) ttmlStyle {
+	if o.italic != nil {
+		s.italic = o.italic
+	}
+	if o.bold != nil {
+		s.bold = o.bold
+	}
+	if o.underline != nil {
+		s.underline = o.underline
+	}
+	if o.textAlign != "" {
+		s.textAlign = o.textAlign
+	}
+	if o.displayAlign != "" {
+		s.displayAlign = o.displayAlign
+	}
+	if o.origin != "" {
+		s.origin = o.origin
+	}
+	if o.extent != "" {
+		s.extent = o.extent
+	}
+	return s
+}
+
+func boolPtr(b bool) *bool { return &b }
+
+// ttmlReader resolves the styles and regions declared in a TTML head.
+type ttmlReader struct {
+	styles  map[string]ttmlStyle
+	regions map[string]ttmlStyle
+}
+
+// attr returns an attribute value by local name, ignoring the namespace prefix.
+func ttmlAttr(e *etree.Element, name string) string {
+	for _, a := range e.Attr {
+		if a.Key == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// inlineStyle reads the tts:* styling attributes set directly on an element.
+func inlineStyle(e *etree.Element) ttmlStyle {
+	var s ttmlStyle
+	switch ttmlAttr(e, "fontStyle") {
+	case "italic", "oblique":
+		s.italic = boolPtr(true)
+	case "normal":
+		s.italic = boolPtr(false)
+	}
+	switch ttmlAttr(e, "fontWeight") {
+	case "bold":
+		s.bold = boolPtr(true)
+	case "normal":
+		s.bold = boolPtr(false)
+	}
+	switch deco := ttmlAttr(e, "textDecoration"); {
+	case strings.Contains(deco, "noUnderline"):
+		s.underline = boolPtr(false)
+	case strings.Contains(deco, "underline"):
+		s.underline = boolPtr(true)
+	}
+	s.textAlign = ttmlAttr(e, "textAlign")
+	s.displayAlign = ttmlAttr(e, "displayAlign")
+	s.origin = ttmlAttr(e, "origin")
+	s.extent = ttmlAttr(e, "extent")
+	return s
+}
+
+// elementStyle resolves referenced styles followed by inline attributes.
+func (r *ttmlReader) elementStyle(e *etree.Element) ttmlStyle {
+	var s ttmlStyle
+	for _, id := range strings.Fields(ttmlAttr(e, "style")) {
+		s = s.merge(r.styles[id])
+	}
+	return s.merge(inlineStyle(e))
+}
+
+func (r *ttmlReader) readHead(doc *etree.Document) {
+	// Styles may reference other styles; resolve them in document order.
+	for _, e := range doc.FindElements("//styling/style") {
+		r.styles[ttmlAttr(e, "id")] = r.elementStyle(e)
+	}
+	for _, e := range doc.FindElements("//layout/region") {
+		s := r.elementStyle(e)
+		for _, child := range e.SelectElements("style") {
+			s = s.merge(r.elementStyle(child))
+		}
+		r.regions[ttmlAttr(e, "id")] = s
+	}
+}
+
+var ttmlPercentPairRe = regexp.MustCompile(`^\s*(-?[\d.]+)%\s+(-?[\d.]+)%\s*$`)
+
+func parsePercentPair(v string) (float64, float64, bool) {
+	m := ttmlPercentPairRe.FindStringSubmatch(v)
+	if m == nil {
+		return 0, 0, false
+	}
+	a, _ := strconv.ParseFloat(m[1], 64)
+	b, _ := strconv.ParseFloat(m[2], 64)
+	return a, b, true
+}
+
+// position converts resolved region styling to a Position.
+func (s ttmlStyle) position() Position {
+	var p Position
+	switch s.textAlign {
+	case "left", "start":
+		p.Align = AlignLeft
+	case "right", "end":
+		p.Align = AlignRight
+	}
+	switch s.displayAlign {
+	case "before":
+		p.Anchor = AnchorTop
+	case "center":
+		p.Anchor = AnchorMiddle
+	}
+	if x, y, ok := parsePercentPair(s.origin); ok {
+		w, h, ok := parsePercentPair(s.extent)
+		if !ok {
+			w, h = 100-x, 100-y
+		}
+		p.Region = true
+		p.X, p.Y, p.Width, p.Height = x, y, w, h
+		// A region covering the lower part of the frame with text at its
+		// bottom is the default placement.
+		if p.Anchor == AnchorBottom && p.Align == AlignCenter && y+h >= 85 && x+w/2 > 45 && x+w/2 < 55 {
+			p = Position{}
+		}
+	}
+	return p
+}
+
+var ttmlEscapeRe = regexp.MustCompile(`\\[a-z]`)
+
+// collectTTMLText appends the text of e to lines, breaking lines at <br/>.
+func (r *ttmlReader) collectTTMLText(e *etree.Element, style ttmlStyle, lines []Line) []Line {
+	for _, child := range e.Child {
+		switch node := child.(type) {
+		case *etree.CharData:
+			text := node.Data
+			// Remove escape sequences and special characters
+			text = strings.ReplaceAll(text, "\\h", " ")
+			// A literal \n is a line break; real newlines are just whitespace.
+			text = strings.ReplaceAll(text, "\\n", "\x00")
+			text = ttmlEscapeRe.ReplaceAllString(text, "")
+			for i, part := range strings.Split(text, "\x00") {
+				if i > 0 {
+					lines = append(lines, nil)
+				}
+				// Collapse whitespace but keep a separating space at the edges
+				raw := part
+				part = strings.Join(strings.Fields(raw), " ")
+				if part == "" {
+					if raw == "" {
+						continue
+					}
+					part = " "
+				} else {
+					if strings.TrimLeft(raw, " \t\r\n") != raw {
+						part = " " + part
+					}
+					if strings.TrimRight(raw, " \t\r\n") != raw {
+						part += " "
+					}
+				}
+				lines[len(lines)-1] = appendSpan(lines[len(lines)-1], Span{
+					Text:      part,
+					Italic:    style.italic != nil && *style.italic,
+					Bold:      style.bold != nil && *style.bold,
+					Underline: style.underline != nil && *style.underline,
+				})
+			}
+		case *etree.Element:
+			if node.Tag == "br" {
+				lines = append(lines, nil)
+				continue
+			}
+			lines = r.collectTTMLText(node, style.merge(r.elementStyle(node)), lines)
+		}
+	}
+	return lines
+}
+
+// parseTTML reads a TTML document, keeping region placement, italics, bold,
+// underline and <br/> line breaks.
+func parseTTML(data string) (*Document, error) {
+	parsed := etree.NewDocument()
+	if err := parsed.ReadFromString(data); err != nil {
+		return nil, err
+	}
+	r := &ttmlReader{styles: map[string]ttmlStyle{}, regions: map[string]ttmlStyle{}}
+	r.readHead(parsed)
+
+	doc := &Document{}
+	if root := parsed.Root(); root != nil {
+		doc.Language = ttmlAttr(root, "lang")
+	}
+
+	// Find all p (paragraph) elements with timing information
+	for _, p := range parsed.FindElements("//p") {
+		begin, end := ttmlAttr(p, "begin"), ttmlAttr(p, "end")
+		if begin == "" || end == "" {
+			continue
+		}
+		startTime, err := parseTimeCode(begin)
+		if err != nil {
+			continue
+		}
+		endTime, err := parseTimeCode(end)
+		if err != nil {
+			continue
+		}
+
+		// Region and style are inherited from the enclosing body and div.
+		var style ttmlStyle
+		regionID := ""
+		var chain []*etree.Element
+		for e := p; e != nil && e.Tag != "tt"; e = e.Parent() {
+			chain = append([]*etree.Element{e}, chain...)
+		}
+		for _, e := range chain {
+			if id := ttmlAttr(e, "region"); id != "" {
+				regionID = id
+			}
+		}
+		style = r.regions[regionID]
+		for _, e := range chain {
+			style = style.merge(r.elementStyle(e))
+		}
+
+		lines := r.collectTTMLText(p, style, []Line{nil})
+		var cueLines []Line
+		for _, l := range lines {
+			cueLines = append(cueLines, trimLine(l))
+		}
+		for len(cueLines) > 0 && len(cueLines[0]) == 0 {
+			cueLines = cueLines[1:]
+		}
+		for len(cueLines) > 0 && len(cueLines[len(cueLines)-1]) == 0 {
+			cueLines = cueLines[:len(cueLines)-1]
+		}
+		if len(cueLines) == 0 {
+			continue
+		}
+		doc.Cues = append(doc.Cues, Cue{
+			Start:    startTime,
+			End:      endTime,
+			Lines:    cueLines,
+			Position: style.position(),
+		})
+	}
+
+	if len(doc.Cues) == 0 {
+		return nil, errors.New("no subtitle entries found in TTML")
+	}
+	return doc, nil
+}
+
+// ttmlRegion returns the region attributes used to write a Position.
+func ttmlRegion(p Position) (origin, extent, displayAlign, textAlign string) {
+	x, y, w, h := 10.0, 10.0, 80.0, 80.0
+	if p.Region {
+		x, y, w, h = p.X, p.Y, p.Width, p.Height
+	}
+	origin = fmt.Sprintf("%s%% %s%%", formatPct(x), formatPct(y))
+	extent = fmt.Sprintf("%s%% %s%%", formatPct(w), formatPct(h))
+	displayAlign = "after"
+	switch p.Anchor {
+	case AnchorTop:
+		displayAlign = "before"
+	case AnchorMiddle:
+		displayAlign = "center"
+	}
+	textAlign = "center"
+	switch p.Align {
+	case AlignLeft:
+		textAlign = "left"
+	case AlignRight:
+		textAlign = "right"
+	}
+	return origin, extent, displayAlign, textAlign
+}
+
+// writeTTML renders the document as TTML, with one region per distinct position.
+func writeTTML(d *Document) (string, error) {
+	doc := etree.NewDocument()
+	doc.CreateProcInst("xml", `version="1.0" encoding="UTF-8"`)
+	tt := doc.CreateElement("tt")
+	tt.CreateAttr("xmlns", "http://www.w3.org/ns/ttml")
+	tt.CreateAttr("xmlns:tts", "http://www.w3.org/ns/ttml#styling")
+	lang := d.Language
+	if lang == "" {
+		lang = "und"
+	}
+	tt.CreateAttr("xml:lang", lang)
+
+	layout := tt.CreateElement("head").CreateElement("layout")
+	div := tt.CreateElement("body").CreateElement("div")
+
+	regionIDs := map[Position]string{}
+	var paragraphs []*etree.Element
+	for _, c := range d.Cues {
+		id, ok := regionIDs[c.Position]
+		if !ok {
+			id = fmt.Sprintf("r%d", len(regionIDs))
+			regionIDs[c.Position] = id
+			origin, extent, displayAlign, textAlign := ttmlRegion(c.Position)
+			region := layout.CreateElement("region")
+			region.CreateAttr("xml:id", id)
+			region.CreateAttr("tts:origin", origin)
+			region.CreateAttr("tts:extent", extent)
+			region.CreateAttr("tts:displayAlign", displayAlign)
+			region.CreateAttr("tts:textAlign", textAlign)
+		}
+
+		p := div.CreateElement("p")
+		p.CreateAttr("begin", formatWebVTTTime(c.Start))
+		p.CreateAttr("end", formatWebVTTTime(c.End))
+		p.CreateAttr("region", id)
+		paragraphs = append(paragraphs, p)
+	}
+
+	// Indent before filling the paragraphs so no whitespace is added to the text.
+	doc.Indent(2)
+	for i, c := range d.Cues {
+		p := paragraphs[i]
+		for j, line := range c.Lines {
+			if j > 0 {
+				p.CreateElement("br")
+			}
+			for _, s := range line {
+				if !s.Italic && !s.Bold && !s.Underline {
+					p.CreateText(s.Text)
+					continue
+				}
+				span := p.CreateElement("span")
+				if s.Italic {
+					span.CreateAttr("tts:fontStyle", "italic")
+				}
+				if s.Bold {
+					span.CreateAttr("tts:fontWeight", "bold")
+				}
+				if s.Underline {
+					span.CreateAttr("tts:textDecoration", "underline")
+				}
+				span.SetText(s.Text)
+			}
+		}
+	}
+	return doc.WriteToString()
+}
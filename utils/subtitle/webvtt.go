@@ -0,0 +1,230 @@
+package subtitle
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var vttUnescaper = strings.NewReplacer(
+	"&amp;", "&",
+	"&lt;", "<",
+	"&gt;", ">",
+	"&nbsp;", " ",
+	"&lrm;", "\u200e",
+	"&rlm;", "\u200f",
+)
+
+var vttEscaper = strings.NewReplacer(
+	"&", "&amp;",
+	"<", "&lt;",
+	">", "&gt;",
+)
+
+// parseWebVTT reads a WebVTT document, keeping italic, bold and underline
+// tags and translating cue settings (line, position, size, align) into a
+// Position.
+func parseWebVTT(data string) (*Document, error) {
+	data = strings.ReplaceAll(strings.TrimPrefix(data, "\ufeff"), "\r\n", "\n")
+	doc := &Document{}
+	blocks := strings.Split(data, "\n\n")
+	for _, block := range blocks {
+		lines := strings.Split(strings.Trim(block, "\n"), "\n")
+		timing := -1
+		for i, l := range lines {
+			if strings.Contains(l, "-->") {
+				timing = i
+				break
+			}
+		}
+		// Skips the header, NOTE, STYLE and REGION blocks
+		if timing < 0 {
+			continue
+		}
+		parts := strings.SplitN(lines[timing], "-->", 2)
+		start, err := parseWebVTTTime(strings.TrimSpace(parts[0]))
+		if err != nil {
+			continue
+		}
+		endFields := strings.Fields(parts[1])
+		if len(endFields) == 0 {
+			continue
+		}
+		end, err := parseWebVTTTime(endFields[0])
+		if err != nil {
+			continue
+		}
+		cueLines, an := parseHTMLStyledText(strings.Join(lines[timing+1:], "\n"), vttUnescaper.Replace)
+		if len(cueLines) == 0 {
+			continue
+		}
+		c := Cue{Start: start, End: end, Lines: cueLines}
+		c.Position = parseVTTSettings(endFields[1:])
+		if an != 0 && c.Position.IsDefault() {
+			c.Position = positionFromNumpad(an)
+		}
+		doc.Cues = append(doc.Cues, c)
+	}
+	if len(doc.Cues) == 0 {
+		return nil, errors.New("no subtitle entries found in WebVTT")
+	}
+	return doc, nil
+}
+
+// parseVTTSettings converts WebVTT cue settings to a Position.
+func parseVTTSettings(settings []string) Position {
+	var p Position
+	line, linePct := -1.0, false
+	lineAlign, posAlign := "", ""
+	position, size := -1.0, 100.0
+	for _, s := range settings {
+		key, value, ok := strings.Cut(s, ":")
+		if !ok {
+			continue
+		}
+		value, extra, _ := strings.Cut(value, ",")
+		switch key {
+		case "line":
+			linePct = strings.HasSuffix(value, "%")
+			if v, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64); err == nil {
+				line = v
+			}
+			lineAlign = extra
+		case "position":
+			if v, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64); err == nil {
+				position = v
+			}
+			posAlign = extra
+		case "size":
+			if v, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64); err == nil {
+				size = v
+			}
+		case "align":
+			switch value {
+			case "start", "left":
+				p.Align = AlignLeft
+			case "end", "right":
+				p.Align = AlignRight
+			}
+		}
+	}
+
+	switch {
+	case line >= 0 && linePct:
+		p.Region = true
+		p.Y = line
+		switch lineAlign {
+		case "center":
+			p.Anchor = AnchorMiddle
+		case "end":
+			p.Anchor = AnchorBottom
+		default:
+			p.Anchor = AnchorTop
+		}
+	case line >= 0:
+		// Line numbers count from the top of the frame
+		if line < 8 {
+			p.Anchor = AnchorTop
+		}
+	}
+
+	if position >= 0 || size < 100 {
+		p.Region = true
+		if !linePct {
+			// Keep the default vertical placement at the bottom edge.
+			p.Y = 90
+			if p.Anchor == AnchorTop {
+				p.Y = 10
+			}
+		}
+		p.Width = size
+		if position < 0 {
+			position = 50
+		}
+		switch posAlign {
+		case "line-left":
+			p.X = position
+		case "line-right":
+			p.X = position - size
+		default:
+			switch p.Align {
+			case AlignLeft:
+				p.X = position
+			case AlignRight:
+				p.X = position - size
+			default:
+				p.X = position - size/2
+			}
+		}
+	} else if p.Region {
+		p.Width = 100
+	}
+	return p
+}
+
+// vttSettings renders a Position as WebVTT cue settings.
+func vttSettings(p Position) string {
+	if p.IsDefault() {
+		return ""
+	}
+	var settings []string
+	if p.Region {
+		x, y := p.anchorPoint()
+		lineAlign := "end"
+		switch p.Anchor {
+		case AnchorTop:
+			lineAlign = "start"
+		case AnchorMiddle:
+			lineAlign = "center"
+		}
+		settings = append(settings, fmt.Sprintf("line:%s%%,%s", formatPct(y), lineAlign))
+		settings = append(settings, fmt.Sprintf("position:%s%%", formatPct(x)))
+		if p.Width > 0 {
+			settings = append(settings, fmt.Sprintf("size:%s%%", formatPct(p.Width)))
+		}
+	} else {
+		switch p.Anchor {
+		case AnchorTop:
+			settings = append(settings, "line:0")
+		case AnchorMiddle:
+			settings = append(settings, "line:50%,center")
+		}
+	}
+	switch p.Align {
+	case AlignLeft:
+		settings = append(settings, "align:left")
+	case AlignRight:
+		settings = append(settings, "align:right")
+	default:
+		if p.Region {
+			settings = append(settings, "align:center")
+		}
+	}
+	return " " + strings.Join(settings, " ")
+}
+
+func formatPct(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// formatWebVTTTime formats a duration as HH:MM:SS.mmm.
+func formatWebVTTTime(d time.Duration) string {
+	return strings.Replace(formatSRTTime(d), ",", ".", 1)
+}
+
+// writeWebVTT renders the document as WebVTT.
+func writeWebVTT(d *Document) string {
+	var sb strings.Builder
+	sb.WriteString("WEBVTT\n")
+	if d.Language != "" {
+		fmt.Fprintf(&sb, "Language: %s\n", d.Language)
+	}
+	for _, c := range d.Cues {
+		fmt.Fprintf(&sb, "\n%s --> %s%s\n", formatWebVTTTime(c.Start), formatWebVTTTime(c.End), vttSettings(c.Position))
+		sb.WriteString(htmlStyledText(c.Lines, vttEscaper.Replace))
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
@@ -48,7 +48,21 @@ func (a *Playlist) GetResp(token, l string) error {
 		return errors.New("error getting album response")
 	}
 	a.Resp = *resp
+	a.setTracks()
+	return nil
+}
 
+// NewLibraryPlaylist returns a playlist of the user's library that has no
+// catalog version, made of the catalog songs it holds.
+func NewLibraryPlaylist(st string, id string, l string, data ampapi.PlaylistRespData) *Playlist {
+	a := NewPlaylist(st, id)
+	a.Language = l
+	a.Resp.Data = []ampapi.PlaylistRespData{data}
+	a.setTracks()
+	return a
+}
+
+func (a *Playlist) setTracks() {
 	a.Resp.Data[0].Attributes.ArtistName = "Apple Music"
 	//简化高频调用名称
 	a.Name = a.Resp.Data[0].Attributes.Name
@@ -78,7 +92,6 @@ func (a *Playlist) GetResp(token, l string) error {
 			PlaylistData: a.Resp.Data[0],
 		})
 	}
-	return nil
 }
 
 func (a *Playlist) GetArtwork() string {
@@ -0,0 +1,225 @@
+// Package urlref parses Apple Music and iTunes links into typed references.
+//
+// Accepted hosts are music.apple.com and its beta, classical, geo and embed
+// variants, and the legacy itunes.apple.com. Paths look like
+//
+//	/{storefront}/{kind}/{optional-name}/{id}
+//	/library/{albums|playlist}/{id}
+//
+// where the storefront may be missing (geo links), numeric IDs may carry the
+// legacy "id" prefix, and a trailing slash is ignored. Album and song links
+// may add ?content-version=explicit|clean|as-linked to override the
+// content-version-preference setting for that link.
+package urlref
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Kind is the type of page a link points to.
+type Kind string
+
+const (
+	Album       Kind = "album"
+	Song        Kind = "song"
+	Playlist    Kind = "playlist"
+	MusicVideo  Kind = "music-video"
+	Station     Kind = "station"
+	Artist      Kind = "artist"
+	Curator     Kind = "curator"
+	RecordLabel Kind = "record-label"
+	Room        Kind = "room"
+	MultiRoom   Kind = "multi-room"
+)
+
+// Ref is a parsed link.
+type Ref struct {
+	Kind       Kind
+	Storefront string // two letter code, empty when the link has none
+	ID         string // catalog ID, or library ID when Library is set
+	SongID     string // track picked with ?i= on an album link
+	Library    bool   // an item of the user's library rather than the catalog
+
+	// ContentVersion is the content-version query parameter: "explicit",
+	// "clean" or "as-linked", empty when the link has none.
+	ContentVersion string
+}
+
+// Error explains why a link could not be parsed.
+type Error struct {
+	URL    string
+	Reason string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("invalid Apple Music URL %q: %s", e.URL, e.Reason)
+}
+
+var hosts = map[string]bool{
+	"music.apple.com":           true,
+	"beta.music.apple.com":      true,
+	"classical.music.apple.com": true,
+	"geo.music.apple.com":       true,
+	"embed.music.apple.com":     true,
+	"itunes.apple.com":          true,
+}
+
+// kinds maps the first path segment after the storefront to its kind.
+var kinds = map[string]Kind{
+	"album":        Album,
+	"song":         Song,
+	"playlist":     Playlist,
+	"music-video":  MusicVideo,
+	"station":      Station,
+	"artist":       Artist,
+	"curator":      Curator,
+	"record-label": RecordLabel,
+	"room":         Room,
+	"multi-room":   MultiRoom,
+}
+
+var (
+	storefrontPattern = regexp.MustCompile(`^[a-zA-Z]{2}$`)
+	numericID         = regexp.MustCompile(`^(?:id)?(\d+)$`)
+	playlistID        = regexp.MustCompile(`^pl\.[\w-]+$`)
+	stationID         = regexp.MustCompile(`^ra\.[\w-]+$`)
+	libraryAlbumID    = regexp.MustCompile(`^l\.[\w-]+$`)
+	libraryPlaylistID = regexp.MustCompile(`^p\.[\w-]+$`)
+)
+
+// Parse parses an Apple Music or iTunes link.
+func Parse(raw string) (Ref, error) {
+	raw = strings.TrimSpace(raw)
+	fail := func(format string, args ...any) (Ref, error) {
+		return Ref{}, &Error{URL: raw, Reason: fmt.Sprintf(format, args...)}
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fail("%v", err)
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return fail("not a web link")
+	}
+	if !hosts[strings.ToLower(u.Hostname())] {
+		return fail("%s is not an Apple Music host", u.Hostname())
+	}
+
+	var segments []string
+	for _, s := range strings.Split(u.Path, "/") {
+		if s != "" {
+			segments = append(segments, s)
+		}
+	}
+	var ref Ref
+	if len(segments) > 0 && storefrontPattern.MatchString(segments[0]) {
+		ref.Storefront = strings.ToLower(segments[0])
+		segments = segments[1:]
+	}
+	if len(segments) == 0 {
+		return fail("no item in the link")
+	}
+
+	if segments[0] == "library" {
+		return parseLibrary(ref, segments[1:], fail)
+	}
+	kind, ok := kinds[segments[0]]
+	if !ok {
+		return fail("unsupported link type %q", segments[0])
+	}
+	ref.Kind = kind
+	if len(segments) < 2 {
+		return fail("%s link without an ID", kind)
+	}
+	id := segments[len(segments)-1]
+	switch kind {
+	case Playlist:
+		if !playlistID.MatchString(id) {
+			return fail("malformed playlist ID %q", id)
+		}
+		ref.ID = id
+	case Station:
+		if !stationID.MatchString(id) {
+			return fail("malformed station ID %q", id)
+		}
+		ref.ID = id
+	default:
+		m := numericID.FindStringSubmatch(id)
+		if m == nil {
+			return fail("malformed %s ID %q", kind, id)
+		}
+		ref.ID = m[1]
+	}
+
+	if i := u.Query().Get("i"); i != "" && kind == Album {
+		m := numericID.FindStringSubmatch(i)
+		if m == nil {
+			return fail("malformed song ID %q", i)
+		}
+		ref.SongID = m[1]
+	}
+	if v := u.Query().Get("content-version"); v != "" {
+		if kind != Album && kind != Song {
+			return fail("content-version only applies to album and song links")
+		}
+		if v != "explicit" && v != "clean" && v != "as-linked" {
+			return fail("unknown content-version %q", v)
+		}
+		ref.ContentVersion = v
+	}
+	return ref, nil
+}
+
+func parseLibrary(ref Ref, segments []string, fail func(string, ...any) (Ref, error)) (Ref, error) {
+	if len(segments) < 2 {
+		return fail("library link without an ID")
+	}
+	ref.Library = true
+	id := segments[len(segments)-1]
+	switch segments[0] {
+	case "albums", "album":
+		if !libraryAlbumID.MatchString(id) {
+			return fail("malformed library album ID %q", id)
+		}
+		ref.Kind = Album
+	case "playlist", "playlists":
+		if !libraryPlaylistID.MatchString(id) && !playlistID.MatchString(id) {
+			return fail("malformed library playlist ID %q", id)
+		}
+		ref.Kind = Playlist
+	default:
+		return fail("unsupported library link type %q", segments[0])
+	}
+	ref.ID = id
+	return ref, nil
+}
+
+// String returns the canonical music.apple.com link of r. References
+// without a storefront use "us".
+func (r Ref) String() string {
+	storefront := r.Storefront
+	if storefront == "" {
+		storefront = "us"
+	}
+	if r.Library {
+		section := "albums"
+		if r.Kind == Playlist {
+			section = "playlist"
+		}
+		return fmt.Sprintf("https://music.apple.com/library/%s/%s", section, r.ID)
+	}
+	link := fmt.Sprintf("https://music.apple.com/%s/%s/%s", storefront, r.Kind, r.ID)
+	query := url.Values{}
+	if r.SongID != "" {
+		query.Set("i", r.SongID)
+	}
+	if r.ContentVersion != "" {
+		query.Set("content-version", r.ContentVersion)
+	}
+	if len(query) > 0 {
+		link += "?" + query.Encode()
+	}
+	return link
+}
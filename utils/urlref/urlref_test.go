@@ -0,0 +1,104 @@
+package urlref
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	for _, tc := range []struct {
+		url  string
+		want Ref
+	}{
+		// Hosts
+		{"https://music.apple.com/us/album/1989/1440935467", Ref{Kind: Album, Storefront: "us", ID: "1440935467"}},
+		{"https://beta.music.apple.com/jp/album/1440935467", Ref{Kind: Album, Storefront: "jp", ID: "1440935467"}},
+		{"https://classical.music.apple.com/gb/album/goldberg-variations/1452830036", Ref{Kind: Album, Storefront: "gb", ID: "1452830036"}},
+		{"https://geo.music.apple.com/album/1440935467", Ref{Kind: Album, ID: "1440935467"}},
+		{"https://embed.music.apple.com/de/playlist/pl.f4d106fed2bd41149aaacabb233eb5eb", Ref{Kind: Playlist, Storefront: "de", ID: "pl.f4d106fed2bd41149aaacabb233eb5eb"}},
+		{"https://itunes.apple.com/us/album/1989/id1440935467", Ref{Kind: Album, Storefront: "us", ID: "1440935467"}},
+		{"http://MUSIC.apple.com/US/album/1440935467", Ref{Kind: Album, Storefront: "us", ID: "1440935467"}},
+
+		// Kinds
+		{"https://music.apple.com/us/song/style/1440935808", Ref{Kind: Song, Storefront: "us", ID: "1440935808"}},
+		{"https://music.apple.com/us/music-video/shake-it-off/1445845393", Ref{Kind: MusicVideo, Storefront: "us", ID: "1445845393"}},
+		{"https://music.apple.com/us/station/taylor-swift-station/ra.1445854201", Ref{Kind: Station, Storefront: "us", ID: "ra.1445854201"}},
+		{"https://music.apple.com/us/artist/taylor-swift/159260351", Ref{Kind: Artist, Storefront: "us", ID: "159260351"}},
+
+		// Library IDs
+		{"https://music.apple.com/library/albums/l.abc123", Ref{Kind: Album, ID: "l.abc123", Library: true}},
+		{"https://music.apple.com/us/library/playlist/p.XyZ-9", Ref{Kind: Playlist, Storefront: "us", ID: "p.XyZ-9", Library: true}},
+		{"https://music.apple.com/library/playlist/pl.u-abc", Ref{Kind: Playlist, ID: "pl.u-abc", Library: true}},
+
+		// Song picked on an album
+		{"https://music.apple.com/us/album/1989/1440935467?i=1440935808", Ref{Kind: Album, Storefront: "us", ID: "1440935467", SongID: "1440935808"}},
+		{"https://music.apple.com/us/artist/159260351?i=1440935808", Ref{Kind: Artist, Storefront: "us", ID: "159260351"}},
+
+		// Trailing slashes and whitespace
+		{"https://music.apple.com/us/album/1989/1440935467/", Ref{Kind: Album, Storefront: "us", ID: "1440935467"}},
+		{"  https://music.apple.com/us/album/1440935467//  ", Ref{Kind: Album, Storefront: "us", ID: "1440935467"}},
+
+		// Content version
+		{"https://music.apple.com/us/album/1440935467?content-version=clean", Ref{Kind: Album, Storefront: "us", ID: "1440935467", ContentVersion: "clean"}},
+		{"https://music.apple.com/us/song/1440935808?content-version=as-linked", Ref{Kind: Song, Storefront: "us", ID: "1440935808", ContentVersion: "as-linked"}},
+		{"https://music.apple.com/us/album/1440935467?i=1440935808&content-version=explicit", Ref{Kind: Album, Storefront: "us", ID: "1440935467", SongID: "1440935808", ContentVersion: "explicit"}},
+	} {
+		got, err := Parse(tc.url)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tc.url, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("Parse(%q) = %+v, want %+v", tc.url, got, tc.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, raw := range []string{
+		"",
+		"music.apple.com/us/album/1440935467",
+		"ftp://music.apple.com/us/album/1440935467",
+		"https://open.spotify.com/album/1440935467",
+		"https://music.apple.com/us",
+		"https://music.apple.com/us/browse",
+		"https://music.apple.com/us/album",
+		"https://music.apple.com/us/album/red",
+		"https://music.apple.com/us/playlist/todays-hits/1440935467",
+		"https://music.apple.com/us/station/ra-1445854201",
+		"https://music.apple.com/us/album/1440935467?i=abc",
+		"https://music.apple.com/us/album/1440935467?content-version=dirty",
+		"https://music.apple.com/us/playlist/pl.abc?content-version=clean",
+		"https://music.apple.com/library/albums",
+		"https://music.apple.com/library/albums/1440935467",
+		"https://music.apple.com/library/playlist/l.abc123",
+		"https://music.apple.com/library/songs/i.abc123",
+		"https://music.apple.com/%zz",
+	} {
+		ref, err := Parse(raw)
+		var e *Error
+		if !errors.As(err, &e) {
+			t.Errorf("Parse(%q) = %+v, %v, want an *Error", raw, ref, err)
+			continue
+		}
+		if e.Reason == "" {
+			t.Errorf("Parse(%q): error without a reason", raw)
+		}
+	}
+}
+
+func TestStringRoundTrip(t *testing.T) {
+	for _, raw := range []string{
+		"https://music.apple.com/us/album/1440935467?content-version=clean&i=1440935808",
+		"https://music.apple.com/jp/station/ra.1445854201",
+		"https://music.apple.com/library/playlist/p.XyZ-9",
+	} {
+		ref, err := Parse(raw)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", raw, err)
+		}
+		if got := ref.String(); got != raw {
+			t.Errorf("Parse(%q).String() = %q", raw, got)
+		}
+	}
+}